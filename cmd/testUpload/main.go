@@ -1,114 +1,1061 @@
 package main
 
 import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
 	"io"
+	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"runtime"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/fsnotify/fsnotify"
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// 默认配置（未提供配置文件时使用），源目录和目标目录为 Windows 上的路径
+const (
+	defaultSourceDir  = `C:\Users\83795\Downloads\compressed`
+	defaultDestDir    = `D:\project\cx_project\china_mobile\gitProject\richinfo_tyjf_xhmqqthy\src\main\webapp\res\wap\images\xdrNormal\202505`
+	defaultMaxRetries = 3
+	defaultRetryDelay = 500 * time.Millisecond
+	defaultJobs       = 4
+	jpegQuality       = 95          // 重新编码JPEG时使用的质量
+	watchStableDelay  = time.Second // -watch 时文件大小保持不变多久后视为下载完成
 )
 
+// 其他平台上的默认源目录和目标目录（相对当前目录）
 const (
-	sourceDir   = `C:\Users\83795\Downloads\compressed`
-	defaultDest  = `D:\project\cx_project\china_mobile\gitProject\richinfo_tyjf_xhmqqthy\src\main\webapp\res\wap\images\xdrNormal\202505`
-	maxRetries   = 3
-	retryDelay   = 500 * time.Millisecond
+	portableSourceDir = "downloads"
+	portableDestDir   = "images"
 )
 
-// 前缀到目标目录的映射
-var prefixDestMap = map[string]string{
-	"invite": `D:\project\cx_project\china_mobile\gitProject\richinfo_tyjf_xhmqqthy\src\main\webapp\res\wap\components\xdrInvite\static\202510`,
+// 覆盖源目录和目标目录的环境变量，优先于配置文件和内置默认值（便于在CI中不写配置文件直接运行）
+const (
+	envSourceDir = "UPLOAD_SOURCE_DIR"
+	envDestDir   = "UPLOAD_DEST_DIR"
+)
+
+// 默认的前缀到目标目录的映射
+var defaultPrefixDestMap = routeList{
+	{Pattern: "invite", Dest: `D:\project\cx_project\china_mobile\gitProject\richinfo_tyjf_xhmqqthy\src\main\webapp\res\wap\components\xdrInvite\static\202510`},
 	// 可以在这里添加更多前缀映射
-	// "other": `D:\path\to\other\directory`,
+	// {Pattern: "other", Dest: `D:\path\to\other\directory`},
+	// {Pattern: `re:^banner_\d{4}_q[1-4]`, Dest: `D:\path\to\banner\directory`},
 }
 
-// 支持的图片扩展名
-var imageExtensions = []string{".jpg", ".jpeg", ".png", ".gif", ".bmp", ".webp"}
+// 文件名到目标目录的路由规则（均不区分大小写）
+// Pattern 以 re: 开头或写成 /正则/ 时按正则匹配，其余按普通前缀匹配（logo.v2 中的点只匹配点本身）
+type route struct {
+	Pattern string
+	Dest    string
+	re      *regexp.Regexp
+}
+
+// 按声明顺序排列的路由规则，第一个匹配的生效
+type routeList []route
+
+// 从 JSON 对象解析路由规则，保留键的声明顺序
+func (r *routeList) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		*r = nil
+		return nil
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '{' {
+		return fmt.Errorf("prefixDestMap 必须是对象")
+	}
+
+	routes := routeList{}
+	for decoder.More() {
+		keyToken, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		var dest string
+		if err := decoder.Decode(&dest); err != nil {
+			return err
+		}
+
+		rt := route{Pattern: keyToken.(string), Dest: dest}
+		if err := rt.compile(); err != nil {
+			return err
+		}
+		routes = append(routes, rt)
+	}
+	*r = routes
+	return nil
+}
+
+// 带 re: 前缀或写成 /正则/ 的规则编译为正则表达式
+func (rt *route) compile() error {
+	expr, ok := strings.CutPrefix(rt.Pattern, "re:")
+	if !ok {
+		if len(rt.Pattern) < 2 || !strings.HasPrefix(rt.Pattern, "/") || !strings.HasSuffix(rt.Pattern, "/") {
+			return nil
+		}
+		expr = rt.Pattern[1 : len(rt.Pattern)-1]
+	}
+	re, err := regexp.Compile("(?i)" + expr)
+	if err != nil {
+		return fmt.Errorf("无效的路由正则 %q: %v", rt.Pattern, err)
+	}
+	rt.re = re
+	return nil
+}
+
+// 判断文件名是否匹配该路由
+func (rt route) matches(fileName string) bool {
+	if rt.re != nil {
+		return rt.re.MatchString(fileName)
+	}
+	return strings.HasPrefix(strings.ToLower(fileName), strings.ToLower(rt.Pattern))
+}
+
+// 默认支持的图片扩展名（HEIC/HEIF、AVIF、TIFF 等无法重新编码的格式按原样复制）
+var defaultImageExtensions = []string{".jpg", ".jpeg", ".png", ".gif", ".bmp", ".webp", ".heic", ".heif", ".avif", ".tif", ".tiff"}
+
+// 移动结果
+type moveResult string
+
+const (
+	resultMoved        moveResult = "moved"        // 已移动
+	resultCopied       moveResult = "copied"       // 已复制（-copy 模式，保留源文件）
+	resultDeduplicated moveResult = "deduplicated" // 目标已存在相同内容，仅删除源文件
+	resultConflict     moveResult = "conflict"     // 目标已存在不同内容，未移动
+	resultOverwritten  moveResult = "overwritten"  // 目标已存在不同内容，已覆盖
+	resultRenamed      moveResult = "renamed"      // 目标已存在不同内容，已重命名后移动
+	resultSkipped      moveResult = "skipped"      // 非图片文件，未处理
+	resultFailed       moveResult = "failed"       // 移动失败
+	resultInLedger     moveResult = "uploaded"     // 相同内容已在上传记录中，未移动
+	resultRetained     moveResult = "retained"     // 已复制且目标已校验，但源文件无法删除（被占用）
+)
+
+// 清单中的一条记录（-manifest）
+type manifestEntry struct {
+	Source      string     `json:"source"`
+	Destination string     `json:"destination"`
+	Bytes       int64      `json:"bytes"`
+	Hash        string     `json:"hash"` // 移动后内容的MD5（未移动时为源文件的MD5）
+	Status      moveResult `json:"status"`
+}
+
+// 本次运行处理过的文件清单
+var manifest = []manifestEntry{}
+
+// 交给工作协程处理的一个图片文件
+type fileJob struct {
+	sourcePath string
+	info       os.FileInfo
+}
+
+// 一个文件的处理结果，由主协程统一输出和计数
+type fileOutcome struct {
+	sourcePath string
+	fileName   string
+	destDir    string
+	finalPath  string
+	result     moveResult
+	err        error
+	log        string // 处理过程中的附加输出（重试、警告等）
+	entry      manifestEntry
+	duration   time.Duration // 处理耗时
+}
+
+// 上传记录文件名（位于配置文件所在目录），记录已移动文件的内容MD5，重复下载的文件据此跳过
+const ledgerFileName = ".upload-ledger.json"
+
+// 上传记录中的一条记录
+type ledgerEntry struct {
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	MovedAt     time.Time `json:"movedAt"`
+}
+
+// 上传记录：源文件内容MD5 -> 记录
+var ledger = struct {
+	sync.Mutex
+	path    string
+	entries map[string]ledgerEntry
+	dirty   bool
+}{entries: map[string]ledgerEntry{}}
+
+// 加载上传记录，文件不存在时从空记录开始
+func loadLedger(path string) error {
+	ledger.Lock()
+	defer ledger.Unlock()
+	ledger.path = path
+	ledger.entries = map[string]ledgerEntry{}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &ledger.entries)
+}
+
+// 查找内容相同的已上传文件
+func ledgerLookup(hash string) (ledgerEntry, bool) {
+	ledger.Lock()
+	defer ledger.Unlock()
+	entry, ok := ledger.entries[hash]
+	return entry, ok
+}
+
+// 记录一个已移动的文件
+func ledgerRecord(hash, sourcePath, destPath string) {
+	ledger.Lock()
+	defer ledger.Unlock()
+	ledger.entries[hash] = ledgerEntry{Source: sourcePath, Destination: destPath, MovedAt: time.Now()}
+	ledger.dirty = true
+}
+
+// 保存有变化的上传记录（先写临时文件再替换）
+func saveLedger() error {
+	ledger.Lock()
+	defer ledger.Unlock()
+	if !ledger.dirty || ledger.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(ledger.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := ledger.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, ledger.path); err != nil {
+		return err
+	}
+	ledger.dirty = false
+	return nil
+}
+
+// 按目标路径加锁，避免多个工作协程同时写入同名文件
+var destLocks = struct {
+	sync.Mutex
+	m map[string]*sync.Mutex
+}{m: map[string]*sync.Mutex{}}
+
+// 锁定目标路径（不区分大小写），返回解锁函数
+func lockDest(destPath string) func() {
+	key := strings.ToLower(filepath.Clean(destPath))
+	destLocks.Lock()
+	mu, ok := destLocks.m[key]
+	if !ok {
+		mu = &sync.Mutex{}
+		destLocks.m[key] = mu
+	}
+	destLocks.Unlock()
+
+	mu.Lock()
+	return mu.Unlock
+}
+
+// 预演时本次运行已计划写入的目标路径（不区分大小写）-> 源文件，同名的源文件据此判断冲突
+var plannedDests = struct {
+	sync.Mutex
+	m map[string]string
+}{m: map[string]string{}}
+
+// 查找计划写入该目标路径的源文件
+func plannedSource(destPath string) (string, bool) {
+	plannedDests.Lock()
+	defer plannedDests.Unlock()
+	sourcePath, ok := plannedDests.m[strings.ToLower(filepath.Clean(destPath))]
+	return sourcePath, ok
+}
+
+// 记录计划写入的目标路径
+func planDest(destPath, sourcePath string) {
+	plannedDests.Lock()
+	defer plannedDests.Unlock()
+	plannedDests.m[strings.ToLower(filepath.Clean(destPath))] = sourcePath
+}
+
+// 目标文件冲突时的处理方式
+const (
+	conflictOverwrite = "overwrite" // 覆盖目标文件
+	conflictSkip      = "skip"      // 跳过，保留源文件
+	conflictRename    = "rename"    // 重命名为 name (1).ext 后移动
+)
+
+// Config 配置结构
+type Config struct {
+	SourceDir       string    `json:"sourceDir"`
+	DefaultDest     string    `json:"defaultDest"`
+	PrefixDestMap   routeList `json:"prefixDestMap"`
+	ImageExtensions []string  `json:"imageExtensions"`
+	MaxRetries      int       `json:"maxRetries"`
+	RetryDelayMs    int       `json:"retryDelayMs"`
+	OnConflict      string    `json:"onConflict"` // overwrite / skip / rename
+	// 按 EXIF 方向旋转/翻转JPEG像素，写入时去掉方向标记
+	NormalizeOrientation bool `json:"normalizeOrientation"`
+	// 超出最大宽高的图片按比例缩小后重新编码，0 表示不限制；webp 无法重新编码，超出时记为失败
+	MaxWidth  int `json:"maxWidth"`
+	MaxHeight int `json:"maxHeight"`
+	// 重新编码JPEG时的质量（1-100），0 表示使用默认值 95
+	Quality int `json:"quality"`
+	// 在目标目录下按日期创建子目录，值为 Go 时间格式（如 200601），为空时不创建
+	DateSubfolder string `json:"dateSubfolder"`
+	// 子目录日期使用今天而不是文件的修改时间
+	DateFromToday bool `json:"dateFromToday"`
+	// 只复制不删除源文件
+	CopyOnly bool `json:"copyOnly"`
+	// 同时处理的文件数
+	Jobs int `json:"jobs"`
+	// 保留源目录中的子目录结构（sub/a.png 写入 <目标目录>/sub/a.png），默认全部平铺到目标目录
+	PreserveStructure bool `json:"preserveStructure"`
+	// 只输出计划的操作，不复制、不删除任何文件（仅命令行 -dry-run）
+	DryRun bool `json:"-"`
+	// 输出每个文件的MD5、大小和匹配的路由规则（仅命令行 -v）
+	Verbose bool `json:"-"`
+}
+
+// 当前使用的配置
+var config = defaultConfig()
+
+// 带时间戳的运行日志，输出到标准输出（-log 时同时追加写入日志文件）
+var logger = log.New(os.Stdout, "", log.LstdFlags)
+
+// 复制完成后删除源文件（测试中替换以模拟源文件被占用）
+var removeSource = os.Remove
+
+// 返回当前平台的默认源目录、目标目录和路由（内置的路由只适用于 Windows 上的默认路径）
+func platformDefaults() (string, string, routeList) {
+	if runtime.GOOS == "windows" {
+		return defaultSourceDir, defaultDestDir, defaultPrefixDestMap
+	}
+	return portableSourceDir, portableDestDir, routeList{}
+}
+
+// defaultConfig 返回内置的默认配置
+func defaultConfig() Config {
+	sourceDir, destDir, routes := platformDefaults()
+	return Config{
+		SourceDir:       sourceDir,
+		DefaultDest:     destDir,
+		PrefixDestMap:   routes,
+		ImageExtensions: defaultImageExtensions,
+		MaxRetries:      defaultMaxRetries,
+		RetryDelayMs:    int(defaultRetryDelay / time.Millisecond),
+		OnConflict:      conflictSkip,
+		Jobs:            defaultJobs,
+	}
+}
+
+// RetryDelay 返回重试间隔
+func (c Config) RetryDelay() time.Duration {
+	return time.Duration(c.RetryDelayMs) * time.Millisecond
+}
+
+// loadConfig 加载配置文件，未设置的字段使用默认值；配置文件不存在时返回默认配置
+// 设置了 UPLOAD_SOURCE_DIR / UPLOAD_DEST_DIR 时覆盖源目录和目标目录
+func loadConfig(configPath string) (Config, error) {
+	cfg, err := readConfigFile(configPath)
+	if err != nil {
+		return cfg, err
+	}
+	if dir := os.Getenv(envSourceDir); dir != "" {
+		cfg.SourceDir = dir
+	}
+	if dir := os.Getenv(envDestDir); dir != "" {
+		cfg.DefaultDest = dir
+	}
+	return cfg, nil
+}
+
+// 读取配置文件，未设置的字段使用默认值；配置文件不存在时返回默认配置
+func readConfigFile(configPath string) (Config, error) {
+	cfg := defaultConfig()
+	sourceDir, destDir, routes := platformDefaults()
+
+	data, err := os.ReadFile(configPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+
+	// 配置文件中的映射整体替换默认映射，而不是合并
+	cfg.PrefixDestMap = nil
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, err
+	}
+
+	if cfg.SourceDir == "" {
+		cfg.SourceDir = sourceDir
+	}
+	if cfg.DefaultDest == "" {
+		cfg.DefaultDest = destDir
+	}
+	if cfg.PrefixDestMap == nil {
+		cfg.PrefixDestMap = routes
+	}
+	if len(cfg.ImageExtensions) == 0 {
+		cfg.ImageExtensions = defaultImageExtensions
+	}
+	cfg.ImageExtensions = normalizeExtensions(cfg.ImageExtensions)
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = defaultMaxRetries
+	}
+	if cfg.RetryDelayMs < 0 {
+		cfg.RetryDelayMs = int(defaultRetryDelay / time.Millisecond)
+	}
+	if cfg.OnConflict == "" {
+		cfg.OnConflict = conflictSkip
+	}
+	if cfg.Jobs <= 0 {
+		cfg.Jobs = defaultJobs
+	}
+
+	return cfg, nil
+}
 
 func main() {
-	fmt.Println("开始移动图片...")
-	fmt.Printf("源目录: %s\n", sourceDir)
+	configPath := flag.String("config", "upload.config.json", "配置文件路径")
+	onConflict := flag.String("on-conflict", "", "目标文件已存在且内容不同时的处理方式: overwrite, skip(默认), rename")
+	normalizeOrientation := flag.Bool("normalize-orientation", false, "按 EXIF 方向矫正JPEG图片并去掉方向标记")
+	maxWidth := flag.Int("max-width", 0, "图片最大宽度，超出时按比例缩小（0 表示不限制）")
+	maxHeight := flag.Int("max-height", 0, "图片最大高度，超出时按比例缩小（0 表示不限制）")
+	quality := flag.Int("quality", 0, "缩小后重新编码JPEG的质量 1-100（默认 95）")
+	dateSubfolder := flag.String("date-subfolder", "", "按日期在目标目录下创建子目录，值为 Go 时间格式（如 200601）")
+	dateFromToday := flag.Bool("date-today", false, "日期子目录使用今天的日期（默认使用文件修改时间）")
+	copyOnly := flag.Bool("copy", false, "只复制到目标目录，保留源文件")
+	jobs := flag.Int("jobs", 0, "同时处理的文件数（默认 4）")
+	manifestPath := flag.String("manifest", "", "将每个文件的处理结果以JSON数组写入指定路径")
+	resetLedger := flag.Bool("reset-ledger", false, "清空上传记录（"+ledgerFileName+"）后再处理，之前上传过的文件也会重新处理")
+	preserveStructure := flag.Bool("preserve-structure", false, "保留源目录中的子目录结构（默认平铺到目标目录）")
+	dryRun := flag.Bool("dry-run", false, "只输出每个文件计划的操作（目标路径、冲突），不复制、不删除任何文件")
+	verbose := flag.Bool("v", false, "输出每个文件的MD5、大小和匹配的路由规则")
+	watchMode := flag.Bool("watch", false, "处理完已有文件后继续监听源目录，新图片下载完成后自动处理（Ctrl-C 结束）")
+	logPath := flag.String("log", "", "同时将带时间戳的运行日志追加写入指定文件")
+	flag.Parse()
+
+	if *logPath != "" {
+		logFile, err := openLogFile(*logPath)
+		if err != nil {
+			fmt.Printf("错误: 无法打开日志文件 %s: %v\n", *logPath, err)
+			return
+		}
+		defer logFile.Close()
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		logger.Printf("错误: 无法加载配置文件 %s: %v\n", *configPath, err)
+		fmt.Println("按任意键退出...")
+		fmt.Scanln()
+		return
+	}
+	if *onConflict != "" {
+		cfg.OnConflict = *onConflict
+	}
+	if *normalizeOrientation {
+		cfg.NormalizeOrientation = true
+	}
+	if *maxWidth > 0 {
+		cfg.MaxWidth = *maxWidth
+	}
+	if *maxHeight > 0 {
+		cfg.MaxHeight = *maxHeight
+	}
+	if *quality > 0 {
+		cfg.Quality = *quality
+	}
+	if *dateSubfolder != "" {
+		cfg.DateSubfolder = *dateSubfolder
+	}
+	if *dateFromToday {
+		cfg.DateFromToday = true
+	}
+	if *copyOnly {
+		cfg.CopyOnly = true
+	}
+	if *jobs > 0 {
+		cfg.Jobs = *jobs
+	}
+	if *preserveStructure {
+		cfg.PreserveStructure = true
+	}
+	cfg.DryRun = *dryRun
+	cfg.Verbose = *verbose
+	if cfg.Quality < 0 || cfg.Quality > 100 {
+		logger.Printf("错误: 图片质量必须在 1-100 之间: %d\n", cfg.Quality)
+		return
+	}
+	switch cfg.OnConflict {
+	case conflictOverwrite, conflictSkip, conflictRename:
+	default:
+		logger.Printf("错误: 不支持的冲突处理方式: %s（可选 overwrite, skip, rename）\n", cfg.OnConflict)
+		return
+	}
+	config = cfg
+	sourceDir := config.SourceDir
+
+	verb := actionVerb()
+	if config.DryRun {
+		logger.Printf("开始预演%s图片（不会修改任何文件）...\n", verb)
+	} else {
+		logger.Printf("开始%s图片...\n", verb)
+	}
+	logger.Printf("源目录: %s\n", sourceDir)
 
 	// 检查源目录是否存在
 	if _, err := os.Stat(sourceDir); os.IsNotExist(err) {
-		fmt.Printf("错误: 源目录不存在: %s\n", sourceDir)
+		logger.Printf("错误: 源目录不存在: %s\n", sourceDir)
 		fmt.Println("按任意键退出...")
 		fmt.Scanln()
 		return
 	}
 
-	// 读取源目录中的所有文件
-	files, err := os.ReadDir(sourceDir)
-	if err != nil {
-		fmt.Printf("错误: 无法读取源目录: %v\n", err)
+	ledgerPath := filepath.Join(filepath.Dir(*configPath), ledgerFileName)
+	switch {
+	case *resetLedger && config.DryRun:
+		// 预演不删除上传记录，只按清空后的情况输出计划
+		logger.Printf("预演: 按清空上传记录处理，%s 未删除\n", ledgerPath)
+	case *resetLedger:
+		if err := os.Remove(ledgerPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Printf("警告: 无法清空上传记录 %s: %v\n", ledgerPath, err)
+		} else {
+			logger.Printf("已清空上传记录: %s\n", ledgerPath)
+		}
+	}
+	if !(*resetLedger && config.DryRun) {
+		if err := loadLedger(ledgerPath); err != nil {
+			logger.Printf("警告: 上传记录 %s 格式错误，将重新记录: %v\n", ledgerPath, err)
+		}
+	}
+
+	// 监听模式下先开始监听再扫描已有文件，扫描期间新下载的图片也会收到事件
+	var watcher *fsnotify.Watcher
+	if *watchMode {
+		watcher, err = newSourceWatcher(sourceDir)
+		if err != nil {
+			logger.Printf("错误: 无法监听源目录: %v\n", err)
+			fmt.Println("按任意键退出...")
+			fmt.Scanln()
+			return
+		}
+		defer watcher.Close()
+	}
+
+	summary := &runSummary{}
+	walkErr := moveAll(sourceDir, summary)
+	if err := saveLedger(); err != nil {
+		logger.Printf("警告: 无法保存上传记录 %s: %v\n", ledgerPath, err)
+	}
+	if walkErr != nil {
+		logger.Printf("错误: 无法读取源目录: %v\n", walkErr)
 		fmt.Println("按任意键退出...")
 		fmt.Scanln()
 		return
 	}
 
-	movedCount := 0
-	skippedCount := 0
-	failedFiles := []string{}
+	if *watchMode {
+		watchSourceDir(watcher, sourceDir, summary, ledgerPath)
+	}
 
-	for _, file := range files {
-		if file.IsDir() {
-			continue
+	if *manifestPath != "" {
+		if err := writeManifest(*manifestPath); err != nil {
+			logger.Printf("警告: 无法写入清单 %s: %v\n", *manifestPath, err)
+		} else {
+			logger.Printf("清单已保存: %s\n", *manifestPath)
 		}
+	}
 
-		fileName := file.Name()
-		ext := strings.ToLower(filepath.Ext(fileName))
+	summary.print()
 
-		// 检查是否为图片文件
-		if !isImageFile(ext) {
-			fmt.Printf("跳过非图片文件: %s\n", fileName)
-			skippedCount++
-			continue
+	if !*watchMode {
+		fmt.Println("\n按任意键退出...")
+		fmt.Scanln()
+	}
+}
+
+// 以追加方式打开日志文件，之后的运行日志同时输出到标准输出和该文件
+func openLogFile(path string) (*os.File, error) {
+	logFile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	logger.SetOutput(io.MultiWriter(os.Stdout, logFile))
+	return logFile, nil
+}
+
+// 运行结果统计，由主协程按处理结果逐个输出和累计
+type runSummary struct {
+	moved, deduped, skipped, overwritten, renamed, uploaded int
+	failedFiles, conflictFiles, retainedFiles               []string
+}
+
+// 输出一个文件的处理结果并计数
+func (s *runSummary) record(outcome fileOutcome) {
+	verb, done := actionVerb(), doneWord()
+	if outcome.log != "" {
+		for _, line := range strings.Split(strings.TrimRight(outcome.log, "\n"), "\n") {
+			logger.Println(line)
+		}
+	}
+	if outcome.result == "" {
+		return
+	}
+	took := ""
+	if outcome.duration > 0 {
+		took = fmt.Sprintf(" [%s]", outcome.duration.Round(time.Microsecond))
+	}
+	manifest = append(manifest, outcome.entry)
+
+	fileName, destDir := outcome.fileName, outcome.destDir
+	switch outcome.result {
+	case resultSkipped:
+		logger.Printf("跳过非图片文件: %s%s\n", fileName, took)
+		s.skipped++
+	case resultFailed:
+		if outcome.finalPath == "" {
+			logger.Printf("错误: 无法创建目标目录 %s: %v%s\n", destDir, outcome.err, took)
+		} else {
+			logger.Printf("✗ 失败: %s (原因: %v)%s\n", fileName, outcome.err, took)
+		}
+		s.failedFiles = append(s.failedFiles, fileName)
+	case resultDeduplicated:
+		logger.Printf("= 内容相同，%s去重: %s -> %s%s\n", done, fileName, destDir, took)
+		s.deduped++
+	case resultRetained:
+		logger.Printf("! 已复制但无法删除源文件: %s -> %s（目标已校验，源文件保留）%s\n", fileName, destDir, took)
+		s.retainedFiles = append(s.retainedFiles, outcome.sourcePath)
+	case resultInLedger:
+		logger.Printf("= 已上传过，跳过: %s（之前已%s到 %s）%s\n", fileName, verb, outcome.finalPath, took)
+		s.uploaded++
+	case resultConflict:
+		logger.Printf("! 冲突: %s 在 %s 中已存在且内容不同，未%s%s\n", fileName, destDir, verb, took)
+		s.conflictFiles = append(s.conflictFiles, outcome.sourcePath)
+	case resultOverwritten:
+		logger.Printf("! 冲突: %s %s覆盖 %s 中的同名文件%s\n", fileName, done, destDir, took)
+		s.overwritten++
+	case resultRenamed:
+		logger.Printf("! 冲突: %s %s重命名为 %s%s\n", fileName, done, outcome.finalPath, took)
+		s.renamed++
+	default:
+		if config.DryRun {
+			logger.Printf("→ 将%s: %s -> %s%s\n", verb, outcome.sourcePath, outcome.finalPath, took)
+		} else {
+			logger.Printf("✓ 已%s: %s -> %s%s\n", verb, fileName, destDir, took)
 		}
+		s.moved++
+	}
+}
 
-		// 根据文件名前缀确定目标目录
-		destDir := getDestDirectory(fileName)
+// 输出本次运行的汇总结果
+func (s *runSummary) print() {
+	verb := actionVerb()
+	logger.Println("==================")
+	title := verb + "完成!"
+	if config.DryRun {
+		title = fmt.Sprintf("预演完成（未实际%s任何文件）!", verb)
+	}
+	logger.Printf("%s 成功: %d, 已复制但保留源文件: %d, 去重: %d, 跳过: %d, 已上传过: %d, 失败: %d\n",
+		title, s.moved, len(s.retainedFiles), s.deduped, s.skipped, s.uploaded, len(s.failedFiles))
+	logger.Printf("冲突: %d (覆盖: %d, 重命名: %d, 未%s: %d)\n",
+		s.overwritten+s.renamed+len(s.conflictFiles), s.overwritten, s.renamed, verb, len(s.conflictFiles))
 
-		// 确保目标目录存在
-		if err := os.MkdirAll(destDir, 0755); err != nil {
-			fmt.Printf("错误: 无法创建目标目录 %s: %v\n", destDir, err)
-			failedFiles = append(failedFiles, fileName)
-			continue
+	if len(s.conflictFiles) > 0 {
+		logger.Printf("未%s的冲突文件列表（目标已存在不同内容，源文件已保留）:\n", verb)
+		for _, f := range s.conflictFiles {
+			logger.Printf("  - %s\n", f)
+		}
+	}
+
+	if len(s.retainedFiles) > 0 {
+		logger.Println("已复制到目标目录但无法删除的源文件（可在关闭占用程序后手动删除）:")
+		for _, f := range s.retainedFiles {
+			logger.Printf("  - %s\n", f)
+		}
+	}
+
+	if len(s.failedFiles) > 0 {
+		logger.Println("失败的文件列表:")
+		for _, f := range s.failedFiles {
+			logger.Printf("  - %s\n", f)
+		}
+		logger.Println("提示: 请关闭可能占用这些文件的程序（如图片查看器、编辑器等），然后重新运行。")
+	}
+}
+
+// 递归处理源目录中的所有文件，每个文件的结果按完成顺序计入 summary；源目录本身无法读取时返回错误
+func moveAll(sourceDir string, summary *runSummary) error {
+	jobQueue := make(chan fileJob)
+	outcomes := make(chan fileOutcome)
+
+	// 工作协程：并发处理图片文件
+	var wg sync.WaitGroup
+	for i := 0; i < config.Jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobQueue {
+				outcomes <- processFile(job)
+			}
+		}()
+	}
+
+	// 递归遍历源目录（包括子目录中的文件），图片交给工作协程，其余直接记为跳过
+	walkErr := make(chan error, 1)
+	go func() {
+		walkErr <- filepath.Walk(sourceDir, func(sourcePath string, info os.FileInfo, err error) error {
+			if err != nil {
+				// 源目录本身无法读取时中止，其中的子目录或文件无法访问时输出警告后继续
+				if sourcePath == sourceDir {
+					return err
+				}
+				outcomes <- fileOutcome{log: fmt.Sprintf("警告: 无法访问 %s: %v\n", sourcePath, err)}
+				return nil
+			}
+
+			if info.IsDir() {
+				return nil
+			}
+
+			// 检查是否为图片文件
+			if !isImageFile(info.Name()) {
+				outcomes <- fileOutcome{
+					sourcePath: sourcePath,
+					fileName:   info.Name(),
+					result:     resultSkipped,
+					entry:      newManifestEntry(sourcePath, "", resultSkipped),
+				}
+				return nil
+			}
+
+			jobQueue <- fileJob{sourcePath: sourcePath, info: info}
+			return nil
+		})
+		close(jobQueue)
+		wg.Wait()
+		close(outcomes)
+	}()
+
+	// 主协程统一输出和计数，保证每个文件的输出不会交错
+	for outcome := range outcomes {
+		summary.record(outcome)
+	}
+	return <-walkErr
+}
+
+// 监听源目录（包括之后新建的子目录），新图片的大小在 watchStableDelay 内不再变化后按同样的规则处理，收到 Ctrl-C 后等处理中的文件完成再返回
+func watchSourceDir(watcher *fsnotify.Watcher, sourceDir string, summary *runSummary, ledgerPath string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	defer signal.Stop(signals)
+
+	outcomes := make(chan fileOutcome)
+	slots := make(chan struct{}, config.Jobs)
+	var mu sync.Mutex
+	pending := map[string]bool{}
+	var inflight sync.WaitGroup
+
+	// 同一文件在等待期间的多次写入事件只处理一次
+	schedule := func(sourcePath string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if pending[sourcePath] {
+			return
+		}
+		pending[sourcePath] = true
+		inflight.Add(1)
+		go func() {
+			defer inflight.Done()
+			defer func() {
+				mu.Lock()
+				delete(pending, sourcePath)
+				mu.Unlock()
+			}()
+			info, ok := waitStable(sourcePath, watchStableDelay)
+			if !ok {
+				return
+			}
+			slots <- struct{}{}
+			outcome := processFile(fileJob{sourcePath: sourcePath, info: info})
+			<-slots
+			outcomes <- outcome
+		}()
+	}
+
+	// 结束监听前等待处理中的文件完成，结果计入汇总和清单后再保存上传记录
+	stop := func() {
+		go func() {
+			inflight.Wait()
+			close(outcomes)
+		}()
+		for outcome := range outcomes {
+			summary.record(outcome)
+		}
+		if err := saveLedger(); err != nil {
+			logger.Printf("警告: 无法保存上传记录 %s: %v\n", ledgerPath, err)
+		}
+	}
+
+	logger.Printf("正在监听 %s，新图片下载完成后自动%s（按 Ctrl-C 结束）...\n", sourceDir, actionVerb())
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				stop()
+				return
+			}
+			if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) {
+				continue
+			}
+			info, err := os.Stat(event.Name)
+			if err != nil {
+				continue
+			}
+			if info.IsDir() {
+				if err := addWatchDirs(watcher, event.Name, schedule); err != nil {
+					logger.Printf("警告: 无法监听 %s: %v\n", event.Name, err)
+				}
+				continue
+			}
+			// 下载中的临时文件（如 .crdownload）在重命名为图片后再处理
+			if isImageFile(info.Name()) {
+				schedule(event.Name)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				stop()
+				return
+			}
+			logger.Printf("警告: 监听出错: %v\n", err)
+		case outcome := <-outcomes:
+			summary.record(outcome)
+			if err := saveLedger(); err != nil {
+				logger.Printf("警告: 无法保存上传记录 %s: %v\n", ledgerPath, err)
+			}
+		case <-signals:
+			logger.Println("正在等待处理中的文件完成...")
+			stop()
+			logger.Println("已停止监听")
+			return
 		}
+	}
+}
 
-		// 移动文件（带重试）
-		sourcePath := filepath.Join(sourceDir, fileName)
-		destPath := filepath.Join(destDir, fileName)
+// 创建监听器并监听源目录及其子目录，在扫描已有文件之前调用
+func newSourceWatcher(sourceDir string) (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := addWatchDirs(watcher, sourceDir, nil); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	return watcher, nil
+}
+
+// 监听目录及其子目录；onImage 不为 nil 时同时处理其中已有的图片（监听开始后新建的目录）
+func addWatchDirs(watcher *fsnotify.Watcher, root string, onImage func(string)) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			return watcher.Add(path)
+		}
+		if onImage != nil && isImageFile(info.Name()) {
+			onImage(path)
+		}
+		return nil
+	})
+}
 
-		if err := moveFileWithRetry(sourcePath, destPath); err != nil {
-			fmt.Printf("✗ 失败: %s (原因: %v)\n", fileName, err)
-			failedFiles = append(failedFiles, fileName)
+// 等待文件写入完成：大小和修改时间在 stableFor 内不再变化时返回文件信息，文件消失时返回 false
+func waitStable(path string, stableFor time.Duration) (os.FileInfo, bool) {
+	last, err := os.Stat(path)
+	if err != nil {
+		return nil, false
+	}
+	stableSince := time.Now()
+	for {
+		time.Sleep(stableFor / 4)
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, false
+		}
+		if info.Size() != last.Size() || !info.ModTime().Equal(last.ModTime()) {
+			last, stableSince = info, time.Now()
 			continue
 		}
+		if time.Since(stableSince) >= stableFor {
+			return info, true
+		}
+	}
+}
+
+// 处理一个图片文件：确定目标目录并移动（带重试），附加输出写入结果的 log 中
+func processFile(job fileJob) (outcome fileOutcome) {
+	defer func(start time.Time) { outcome.duration = time.Since(start) }(time.Now())
 
-		fmt.Printf("✓ 已移动: %s -> %s\n", fileName, destDir)
-		movedCount++
+	fileName := job.info.Name()
+	outcome = fileOutcome{sourcePath: job.sourcePath, fileName: fileName}
+
+	// 根据文件名前缀确定目标目录，再按日期追加子目录，保留目录结构时再追加相对源目录的子路径
+	destDir, pattern := matchRoute(fileName)
+	if config.DateSubfolder != "" {
+		destDir = filepath.Join(destDir, dateSubfolderName(job.info.ModTime()))
+	}
+	if config.PreserveStructure {
+		if rel, err := filepath.Rel(config.SourceDir, filepath.Dir(job.sourcePath)); err == nil && filepath.IsLocal(rel) {
+			destDir = filepath.Join(destDir, rel)
+		}
 	}
+	outcome.destDir = destDir
 
-	// 显示结果
-	fmt.Println("\n==================")
-	fmt.Printf("移动完成! 成功: %d, 跳过: %d, 失败: %d\n", movedCount, skippedCount, len(failedFiles))
+	var log strings.Builder
 
-	if len(failedFiles) > 0 {
-		fmt.Println("\n失败的文件列表:")
-		for _, f := range failedFiles {
-			fmt.Printf("  - %s\n", f)
+	// 相同内容已在上传记录中时跳过，保留源文件
+	sourceHash, hashErr := fileMD5(job.sourcePath)
+	if config.Verbose {
+		if pattern == "" {
+			pattern = "（默认目录）"
 		}
-		fmt.Println("\n提示: 请关闭可能占用这些文件的程序（如图片查看器、编辑器等），然后重新运行。")
+		fmt.Fprintf(&log, "  %s: MD5 %s, 大小 %d 字节, 匹配规则 %s\n", job.sourcePath, sourceHash, job.info.Size(), pattern)
+	}
+	if hashErr == nil {
+		if prev, ok := ledgerLookup(sourceHash); ok {
+			outcome.log = log.String()
+			outcome.result, outcome.finalPath = resultInLedger, prev.Destination
+			outcome.entry = newManifestEntry(job.sourcePath, prev.Destination, resultInLedger)
+			return outcome
+		}
+	}
+
+	// 需要缩小的 webp 无法重新编码，写入前直接记为失败，保留源文件
+	if err := checkWebpSize(job.sourcePath); err != nil {
+		outcome.log = log.String()
+		outcome.result, outcome.err = resultFailed, err
+		outcome.finalPath = filepath.Join(destDir, fileName)
+		outcome.entry = newManifestEntry(job.sourcePath, outcome.finalPath, resultFailed)
+		return outcome
 	}
 
-	fmt.Println("\n按任意键退出...")
-	fmt.Scanln()
+	// 确保目标目录存在（预演时不创建）
+	if !config.DryRun {
+		if err := os.MkdirAll(destDir, 0755); err != nil {
+			outcome.log = log.String()
+			outcome.result, outcome.err = resultFailed, err
+			outcome.entry = newManifestEntry(job.sourcePath, destDir, resultFailed)
+			return outcome
+		}
+	}
+
+	// 移动文件（带重试）
+	destPath := filepath.Join(destDir, fileName)
+	unlock := lockDest(destPath)
+	defer unlock()
+
+	result, finalPath, err := moveFileWithRetry(job.sourcePath, destPath, &log)
+	outcome.log, outcome.finalPath = log.String(), finalPath
+	if err != nil {
+		result = resultFailed
+		outcome.err = err
+	}
+	outcome.result = result
+	outcome.entry = newManifestEntry(job.sourcePath, finalPath, result)
+	if hashErr == nil && !config.DryRun {
+		switch result {
+		case resultMoved, resultCopied, resultDeduplicated, resultOverwritten, resultRenamed, resultRetained:
+			ledgerRecord(sourceHash, job.sourcePath, finalPath)
+		}
+	}
+	return outcome
+}
+
+// 生成一个文件的清单记录；已写入目标的记录目标文件的大小和MD5，否则记录源文件的
+func newManifestEntry(sourcePath, destPath string, status moveResult) manifestEntry {
+	contentPath := sourcePath
+	switch status {
+	case resultMoved, resultCopied, resultDeduplicated, resultOverwritten, resultRenamed, resultRetained:
+		contentPath = destPath
+	}
+
+	entry := manifestEntry{Source: sourcePath, Destination: destPath, Status: status}
+	if info, err := os.Stat(contentPath); err == nil {
+		entry.Bytes = info.Size()
+		entry.Hash, _ = fileMD5(contentPath)
+	}
+	return entry
 }
 
-// 判断是否为图片文件
-func isImageFile(ext string) bool {
-	for _, imgExt := range imageExtensions {
+// 将清单以JSON数组写入文件
+func writeManifest(path string) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// 返回当前模式下的操作名称（移动/复制）
+func actionVerb() string {
+	if config.CopyOnly {
+		return "复制"
+	}
+	return "移动"
+}
+
+// 返回结果描述中的时态：实际执行为"已"，预演为"将"
+func doneWord() string {
+	if config.DryRun {
+		return "将"
+	}
+	return "已"
+}
+
+// 将扩展名统一为小写并带前导点（配置中可写 PNG、png 或 .png），去掉空项
+func normalizeExtensions(extensions []string) []string {
+	normalized := make([]string, 0, len(extensions))
+	for _, ext := range extensions {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		normalized = append(normalized, ext)
+	}
+	return normalized
+}
+
+// 按扩展名判断是否为图片文件（不区分大小写）
+func isImageFile(fileName string) bool {
+	ext := strings.ToLower(filepath.Ext(fileName))
+	for _, imgExt := range config.ImageExtensions {
 		if ext == imgExt {
 			return true
 		}
@@ -116,40 +1063,472 @@ func isImageFile(ext string) bool {
 	return false
 }
 
-// 根据文件名前缀获取目标目录
+// 根据文件名按声明顺序匹配路由获取目标目录，都不匹配时使用默认目录
 func getDestDirectory(fileName string) string {
-	for prefix, destDir := range prefixDestMap {
-		if strings.HasPrefix(strings.ToLower(fileName), strings.ToLower(prefix)) {
-			return destDir
+	dest, _ := matchRoute(fileName)
+	return dest
+}
+
+// 返回文件名匹配的目标目录和路由规则，都不匹配时返回默认目录和空规则
+func matchRoute(fileName string) (string, string) {
+	for _, rt := range config.PrefixDestMap {
+		if rt.matches(fileName) {
+			return rt.Dest, rt.Pattern
 		}
 	}
-	return defaultDest
+	return config.DefaultDest, ""
+}
+
+// 按 DateSubfolder 格式生成日期子目录名（默认使用文件修改时间）
+func dateSubfolderName(modTime time.Time) string {
+	if config.DateFromToday {
+		return time.Now().Format(config.DateSubfolder)
+	}
+	return modTime.Format(config.DateSubfolder)
 }
 
-// 带重试的移动文件
-func moveFileWithRetry(sourcePath, destPath string) error {
+// 带重试的移动文件，返回移动结果和实际写入的目标路径
+// 目标文件已存在时先比较MD5：内容相同则跳过复制并删除源文件，内容不同则按 OnConflict 处理
+func moveFileWithRetry(sourcePath, destPath string, log io.Writer) (moveResult, string, error) {
+	result := resultMoved
+
+	// 预演时目标文件不会真正写入，之前计划写入同一路径的源文件也视为已存在的目标
+	existingPath, exists := destPath, false
+	if config.DryRun {
+		existingPath, exists = plannedSource(destPath)
+		if !exists {
+			existingPath = destPath
+		}
+	}
+	if !exists {
+		_, err := os.Stat(destPath)
+		exists = err == nil
+	}
+
+	if exists {
+		same, err := sameContent(sourcePath, existingPath)
+		if err != nil {
+			return "", destPath, err
+		}
+
+		if same {
+			if config.CopyOnly || config.DryRun {
+				return resultDeduplicated, destPath, nil
+			}
+			if err := removeSource(sourcePath); err != nil {
+				fmt.Fprintf(log, "  警告: 目标已存在相同文件但无法删除源文件: %v\n", err)
+			}
+			return resultDeduplicated, destPath, nil
+		}
+
+		switch config.OnConflict {
+		case conflictOverwrite:
+			result = resultOverwritten
+		case conflictRename:
+			var unlock func()
+			destPath, unlock = reserveRenamedPath(destPath)
+			defer unlock()
+			result = resultRenamed
+		default:
+			return resultConflict, destPath, nil
+		}
+	}
+
+	// 预演：目标路径和冲突处理已确定，不写入也不删除
+	if config.DryRun {
+		if config.CopyOnly && result == resultMoved {
+			result = resultCopied
+		}
+		planDest(destPath, sourcePath)
+		return result, destPath, nil
+	}
+
 	var lastErr error
 
-	for i := 0; i < maxRetries; i++ {
+	for i := 0; i < config.MaxRetries; i++ {
 		if i > 0 {
-			fmt.Printf("  重试 %d/%d...\n", i, maxRetries-1)
-			time.Sleep(retryDelay)
+			fmt.Fprintf(log, "  重试 %d/%d...\n", i, config.MaxRetries-1)
+			time.Sleep(config.RetryDelay())
 		}
 
-		err := copyFile(sourcePath, destPath)
+		transformed, err := writeDest(sourcePath, destPath, log)
 		if err == nil {
+			// 复制模式保留源文件
+			if config.CopyOnly {
+				if result == resultMoved {
+					result = resultCopied
+				}
+				return result, destPath, nil
+			}
 			// 复制成功，尝试删除源文件
-			if err := os.Remove(sourcePath); err != nil {
-				// 删除失败，但复制成功，记录警告
-				fmt.Printf("  警告: 文件已复制但无法删除源文件: %v\n", err)
-				return nil
+			if err := removeSource(sourcePath); err != nil {
+				// 删除失败（跨盘移动时源文件被占用）：确认目标完整后保留源文件，单独计数，避免重新运行时重复计为已移动
+				if verifyErr := verifyCopy(sourcePath, destPath, transformed); verifyErr != nil {
+					os.Remove(destPath)
+					return "", destPath, verifyErr
+				}
+				fmt.Fprintf(log, "  警告: 文件已复制但无法删除源文件: %v\n", err)
+				return resultRetained, destPath, nil
 			}
-			return nil
+			return result, destPath, nil
 		}
 		lastErr = err
 	}
 
-	return lastErr
+	return "", destPath, lastErr
+}
+
+// 选定重命名后的目标路径并锁定，返回解锁函数：锁定后再确认该路径仍未被占用，
+// 避免与同时处理的、本身就叫 name (N).ext 的源文件写入同一路径
+func reserveRenamedPath(destPath string) (string, func()) {
+	for {
+		candidate := nextAvailablePath(destPath)
+		unlock := lockDest(candidate)
+		if nextAvailablePath(destPath) == candidate {
+			return candidate, unlock
+		}
+		unlock()
+	}
+}
+
+// 返回第一个不存在（预演时也未计划写入）的 name (N).ext 路径
+func nextAvailablePath(destPath string) string {
+	ext := filepath.Ext(destPath)
+	base := strings.TrimSuffix(destPath, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, i, ext)
+		if config.DryRun {
+			if _, planned := plannedSource(candidate); planned {
+				continue
+			}
+		}
+		if _, err := os.Stat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+// 比较两个文件的内容是否相同（MD5）
+func sameContent(pathA, pathB string) (bool, error) {
+	hashA, err := fileMD5(pathA)
+	if err != nil {
+		return false, err
+	}
+	hashB, err := fileMD5(pathB)
+	if err != nil {
+		return false, err
+	}
+	return hashA == hashB, nil
+}
+
+// 计算文件的MD5
+func fileMD5(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := md5.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// 写入目标文件：需要矫正方向或缩小尺寸的图片重新编码，其余文件原样复制
+func writeDest(sourcePath, destPath string, log io.Writer) (bool, error) {
+	transformed, err := transformImage(sourcePath, destPath, log)
+	if err != nil || transformed {
+		return transformed, err
+	}
+	return false, copyFile(sourcePath, destPath)
+}
+
+// 校验写入的目标文件：原样复制的与源文件内容相同，重新编码的不为空
+func verifyCopy(sourcePath, destPath string, transformed bool) error {
+	if transformed {
+		info, err := os.Stat(destPath)
+		if err != nil {
+			return err
+		}
+		if info.Size() == 0 {
+			return fmt.Errorf("目标文件为空: %s", destPath)
+		}
+		return nil
+	}
+	same, err := sameContent(sourcePath, destPath)
+	if err != nil {
+		return err
+	}
+	if !same {
+		return fmt.Errorf("目标文件与源文件内容不一致: %s", destPath)
+	}
+	return nil
+}
+
+// 根据扩展名返回可重新编码处理的图片格式（jpeg、png、webp），其他返回空
+func imageFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg":
+		return "jpeg"
+	case ".png":
+		return "png"
+	case ".webp":
+		return "webp"
+	}
+	return ""
+}
+
+// 设置了最大宽高时检查 webp 是否超出：超出则返回错误，避免按原尺寸复制
+func checkWebpSize(sourcePath string) error {
+	if (config.MaxWidth <= 0 && config.MaxHeight <= 0) || imageFormat(sourcePath) != "webp" {
+		return nil
+	}
+	f, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	imgConfig, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return err
+	}
+	newWidth, newHeight := fitWithin(imgConfig.Width, imgConfig.Height, config.MaxWidth, config.MaxHeight)
+	if newWidth != imgConfig.Width || newHeight != imgConfig.Height {
+		return fmt.Errorf("webp 尺寸 %dx%d 超出最大尺寸，不支持重新编码缩小", imgConfig.Width, imgConfig.Height)
+	}
+	return nil
+}
+
+// 按配置矫正JPEG方向、缩小超出最大宽高的图片，重新编码后写入目标文件，返回是否做了处理
+// 不需要处理的图片返回 false，由调用方原样复制
+func transformImage(sourcePath, destPath string, log io.Writer) (bool, error) {
+	if !config.NormalizeOrientation && config.MaxWidth <= 0 && config.MaxHeight <= 0 {
+		return false, nil
+	}
+
+	format := imageFormat(sourcePath)
+	if format == "" {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(sourcePath)
+	if err != nil {
+		return false, err
+	}
+
+	orientation := 0
+	if config.NormalizeOrientation && format == "jpeg" {
+		if o := jpegOrientation(data); o >= 2 && o <= 8 {
+			orientation = o
+		}
+	}
+
+	imgConfig, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	width, height := imgConfig.Width, imgConfig.Height
+	if orientation >= 5 {
+		width, height = height, width
+	}
+	newWidth, newHeight := fitWithin(width, height, config.MaxWidth, config.MaxHeight)
+	resize := newWidth != width || newHeight != height
+
+	if orientation == 0 && !resize {
+		return false, nil
+	}
+	if format == "webp" {
+		return false, fmt.Errorf("不支持重新编码 webp: %s", filepath.Base(sourcePath))
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	if orientation != 0 {
+		img = applyOrientation(img, orientation)
+	}
+	if resize {
+		img = resizeImage(img, newWidth, newHeight)
+	}
+
+	var buf bytes.Buffer
+	if format == "png" {
+		encoder := png.Encoder{CompressionLevel: png.BestCompression}
+		err = encoder.Encode(&buf, img)
+	} else {
+		q := config.Quality
+		if q == 0 {
+			q = jpegQuality
+		}
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: q})
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := writeFileLike(sourcePath, destPath, buf.Bytes()); err != nil {
+		return false, err
+	}
+	if orientation != 0 {
+		fmt.Fprintf(log, "  已矫正方向: %s (orientation %d)\n", filepath.Base(sourcePath), orientation)
+	}
+	if resize {
+		fmt.Fprintf(log, "  已缩小: %s (%dx%d -> %dx%d)\n", filepath.Base(sourcePath), width, height, newWidth, newHeight)
+	}
+	return true, nil
+}
+
+// 计算按比例缩小到最大宽高以内的尺寸，maxWidth/maxHeight 为 0 表示该方向不限制
+func fitWithin(width, height, maxWidth, maxHeight int) (int, int) {
+	scale := 1.0
+	if maxWidth > 0 && width > maxWidth {
+		scale = float64(maxWidth) / float64(width)
+	}
+	if maxHeight > 0 && float64(height)*scale > float64(maxHeight) {
+		scale = float64(maxHeight) / float64(height)
+	}
+	if scale >= 1 {
+		return width, height
+	}
+
+	newWidth := int(float64(width)*scale + 0.5)
+	newHeight := int(float64(height)*scale + 0.5)
+	if newWidth < 1 {
+		newWidth = 1
+	}
+	if newHeight < 1 {
+		newHeight = 1
+	}
+	return newWidth, newHeight
+}
+
+// 使用 Catmull-Rom 插值缩放图片
+func resizeImage(img image.Image, width, height int) image.Image {
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), xdraw.Over, nil)
+	return dst
+}
+
+// 读取JPEG中 EXIF 的方向标记（0x0112），没有时返回 0
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 0
+	}
+
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xFF {
+			return 0
+		}
+		marker := data[pos+1]
+		// SOS 之后是图像数据，不再有 EXIF
+		if marker == 0xDA || marker == 0xD9 {
+			return 0
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return 0
+		}
+		segment := data[pos+4 : pos+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		pos += 2 + length
+	}
+	return 0
+}
+
+// 从 TIFF 格式的 EXIF 数据中读取 IFD0 的方向标记
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	ifdOffset := int(order.Uint32(tiff[4:]))
+	if ifdOffset+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[ifdOffset:]))
+	for i := 0; i < count; i++ {
+		entry := ifdOffset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+	return 0
+}
+
+// 按 EXIF 方向（2-8）翻转/旋转图像，使其以方向 1 正常显示
+func applyOrientation(img image.Image, orientation int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	// 方向 5-8 需要交换宽高
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		dstW, dstH = h, w
+	}
+
+	src := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	dst := image.NewNRGBA(image.Rect(0, 0, dstW, dstH))
+
+	for y := 0; y < dstH; y++ {
+		for x := 0; x < dstW; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // 水平翻转
+				sx, sy = w-1-x, y
+			case 3: // 旋转 180°
+				sx, sy = w-1-x, h-1-y
+			case 4: // 垂直翻转
+				sx, sy = x, h-1-y
+			case 5: // 沿主对角线翻转
+				sx, sy = y, x
+			case 6: // 顺时针旋转 90°
+				sx, sy = y, h-1-x
+			case 7: // 沿副对角线翻转
+				sx, sy = w-1-y, h-1-x
+			case 8: // 逆时针旋转 90°
+				sx, sy = w-1-y, x
+			default:
+				sx, sy = x, y
+			}
+			dst.SetNRGBA(x, y, src.NRGBAAt(sx, sy))
+		}
+	}
+	return dst
+}
+
+// 将数据写入目标文件，并保留源文件的权限位和修改时间
+func writeFileLike(sourcePath, destPath string, data []byte) error {
+	sourceInfo, err := os.Stat(sourcePath)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(destPath, data, sourceInfo.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := os.Chmod(destPath, sourceInfo.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(destPath, sourceInfo.ModTime(), sourceInfo.ModTime())
 }
 
 // 复制文件
@@ -161,6 +1540,12 @@ func copyFile(sourcePath, destPath string) error {
 	}
 	defer sourceFile.Close()
 
+	// 获取源文件的权限和修改时间
+	sourceInfo, err := sourceFile.Stat()
+	if err != nil {
+		return err
+	}
+
 	// 创建目标文件（如果存在则覆盖）
 	destFile, err := os.Create(destPath)
 	if err != nil {
@@ -178,5 +1563,15 @@ func copyFile(sourcePath, destPath string) error {
 		return err
 	}
 
-	return nil
+	// 保留源文件的权限位
+	if err := destFile.Chmod(sourceInfo.Mode().Perm()); err != nil {
+		return err
+	}
+
+	if err := destFile.Close(); err != nil {
+		return err
+	}
+
+	// 保留源文件的修改时间
+	return os.Chtimes(destPath, sourceInfo.ModTime(), sourceInfo.ModTime())
 }
@@ -0,0 +1,787 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeFiles 在 dir 下按 相对路径 -> 内容 创建文件
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for rel, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCopyFilePreservesModeAndModTime(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "photo.png")
+	writeFiles(t, dir, map[string]string{"photo.png": "PNG"})
+	if err := os.Chmod(src, 0640); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2024, 5, 1, 8, 30, 0, 0, time.Local)
+	if err := os.Chtimes(src, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(dir, "copy.png")
+	if err := copyFile(src, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("权限位为 %v，应为 0640", info.Mode().Perm())
+	}
+	if !info.ModTime().Equal(modTime) {
+		t.Errorf("修改时间为 %v，应为 %v", info.ModTime(), modTime)
+	}
+}
+
+// newTestConfig 返回源目录和目标目录都是临时目录、没有路由规则的默认配置
+func newTestConfig(t *testing.T) Config {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.SourceDir = t.TempDir()
+	cfg.DefaultDest = t.TempDir()
+	cfg.PrefixDestMap = routeList{}
+	cfg.RetryDelayMs = 1
+	return cfg
+}
+
+// useConfig 在测试期间使用 cfg 作为当前配置，清空上传记录、清单和预演计划，返回捕获的日志
+func useConfig(t *testing.T, cfg Config) *bytes.Buffer {
+	t.Helper()
+	saved := config
+	config = cfg
+	ledger.path, ledger.entries, ledger.dirty = "", map[string]ledgerEntry{}, false
+	manifest = []manifestEntry{}
+	plannedDests.m = map[string]string{}
+	var logs bytes.Buffer
+	logger.SetOutput(&logs)
+	t.Cleanup(func() {
+		config = saved
+		logger.SetOutput(os.Stdout)
+	})
+	return &logs
+}
+
+// assertContent 检查文件存在且内容为 want
+func assertContent(t *testing.T, path, want string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Errorf("%s 不存在: %v", path, err)
+		return
+	}
+	if string(data) != want {
+		t.Errorf("%s 的内容为 %q，应为 %q", path, data, want)
+	}
+}
+
+// assertMissing 检查文件不存在
+func assertMissing(t *testing.T, path string) {
+	t.Helper()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("%s 应不存在 (stat: %v)", path, err)
+	}
+}
+
+func TestMoveAllRecursesIntoSubdirectories(t *testing.T) {
+	cfg := newTestConfig(t)
+	useConfig(t, cfg)
+	writeFiles(t, cfg.SourceDir, map[string]string{
+		"top.png":       "TOP",
+		"a/mid.png":     "MID",
+		"a/b/deep.jpg":  "DEEP",
+		"a/b/notes.txt": "TXT",
+	})
+
+	summary := &runSummary{}
+	if err := moveAll(cfg.SourceDir, summary); err != nil {
+		t.Fatal(err)
+	}
+
+	assertContent(t, filepath.Join(cfg.DefaultDest, "top.png"), "TOP")
+	assertContent(t, filepath.Join(cfg.DefaultDest, "mid.png"), "MID")
+	assertContent(t, filepath.Join(cfg.DefaultDest, "deep.jpg"), "DEEP")
+	assertMissing(t, filepath.Join(cfg.SourceDir, "a/b/deep.jpg"))
+	assertContent(t, filepath.Join(cfg.SourceDir, "a/b/notes.txt"), "TXT")
+	if summary.moved != 3 || summary.skipped != 1 {
+		t.Errorf("移动 %d 个、跳过 %d 个，应为 3 和 1", summary.moved, summary.skipped)
+	}
+}
+
+func TestLoadConfigRoutesPrefixedFile(t *testing.T) {
+	t.Setenv(envSourceDir, "")
+	t.Setenv(envDestDir, "")
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"upload.config.json": `{
+  "sourceDir": "/data/downloads",
+  "defaultDest": "/data/images",
+  "prefixDestMap": {"banner_": "/data/banners", "icon_": "/data/icons"},
+  "maxRetries": 5
+}`})
+
+	cfg, err := loadConfig(filepath.Join(dir, "upload.config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	useConfig(t, cfg)
+
+	if config.SourceDir != "/data/downloads" || config.MaxRetries != 5 {
+		t.Errorf("sourceDir=%s maxRetries=%d", config.SourceDir, config.MaxRetries)
+	}
+	if config.OnConflict != conflictSkip || config.Jobs != defaultJobs {
+		t.Errorf("未设置的字段应使用默认值: onConflict=%s jobs=%d", config.OnConflict, config.Jobs)
+	}
+	for fileName, want := range map[string]string{
+		"banner_spring.png": "/data/banners",
+		"ICON_home.png":     "/data/icons",
+		"photo.png":         "/data/images",
+	} {
+		if got := getDestDirectory(fileName); got != want {
+			t.Errorf("%s 的目标目录为 %s，应为 %s", fileName, got, want)
+		}
+	}
+}
+
+func TestMoveClassifiesIdenticalAndDifferentDestination(t *testing.T) {
+	cfg := newTestConfig(t)
+	useConfig(t, cfg)
+	writeFiles(t, cfg.SourceDir, map[string]string{"same.png": "SAME", "diff.png": "NEW"})
+	writeFiles(t, cfg.DefaultDest, map[string]string{"same.png": "SAME", "diff.png": "OLD"})
+
+	var log strings.Builder
+	result, _, err := moveFileWithRetry(filepath.Join(cfg.SourceDir, "same.png"), filepath.Join(cfg.DefaultDest, "same.png"), &log)
+	if err != nil || result != resultDeduplicated {
+		t.Errorf("内容相同: 结果为 %s (%v)，应为 %s", result, err, resultDeduplicated)
+	}
+	assertMissing(t, filepath.Join(cfg.SourceDir, "same.png"))
+
+	result, _, err = moveFileWithRetry(filepath.Join(cfg.SourceDir, "diff.png"), filepath.Join(cfg.DefaultDest, "diff.png"), &log)
+	if err != nil || result != resultConflict {
+		t.Errorf("内容不同: 结果为 %s (%v)，应为 %s", result, err, resultConflict)
+	}
+	assertContent(t, filepath.Join(cfg.SourceDir, "diff.png"), "NEW")
+	assertContent(t, filepath.Join(cfg.DefaultDest, "diff.png"), "OLD")
+}
+
+func TestConflictModes(t *testing.T) {
+	tests := []struct {
+		mode       string
+		result     moveResult
+		finalName  string
+		destAfter  string
+		sourceLeft bool
+	}{
+		{conflictSkip, resultConflict, "a.png", "OLD", true},
+		{conflictOverwrite, resultOverwritten, "a.png", "NEW", false},
+		{conflictRename, resultRenamed, "a (1).png", "OLD", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			cfg.OnConflict = tt.mode
+			useConfig(t, cfg)
+			writeFiles(t, cfg.SourceDir, map[string]string{"a.png": "NEW"})
+			writeFiles(t, cfg.DefaultDest, map[string]string{"a.png": "OLD"})
+
+			var log strings.Builder
+			result, finalPath, err := moveFileWithRetry(filepath.Join(cfg.SourceDir, "a.png"), filepath.Join(cfg.DefaultDest, "a.png"), &log)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != tt.result || filepath.Base(finalPath) != tt.finalName {
+				t.Errorf("结果为 %s -> %s，应为 %s -> %s", result, finalPath, tt.result, tt.finalName)
+			}
+			assertContent(t, filepath.Join(cfg.DefaultDest, "a.png"), tt.destAfter)
+			if tt.mode == conflictRename {
+				assertContent(t, filepath.Join(cfg.DefaultDest, "a (1).png"), "NEW")
+			}
+			if tt.sourceLeft {
+				assertContent(t, filepath.Join(cfg.SourceDir, "a.png"), "NEW")
+			} else {
+				assertMissing(t, filepath.Join(cfg.SourceDir, "a.png"))
+			}
+		})
+	}
+}
+
+// withOrientation 在JPEG的 SOI 之后插入只含方向标记的 EXIF 段
+func withOrientation(jpegData []byte, orientation uint16) []byte {
+	tiff := []byte("II*\x00\x08\x00\x00\x00")
+	ifd := make([]byte, 2+12+4)
+	binary.LittleEndian.PutUint16(ifd[0:], 1)
+	binary.LittleEndian.PutUint16(ifd[2:], 0x0112)
+	binary.LittleEndian.PutUint16(ifd[4:], 3)
+	binary.LittleEndian.PutUint32(ifd[6:], 1)
+	binary.LittleEndian.PutUint16(ifd[10:], orientation)
+	payload := append([]byte("Exif\x00\x00"), append(tiff, ifd...)...)
+
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	segment = append(segment, payload...)
+
+	out := append([]byte{}, jpegData[:2]...)
+	out = append(out, segment...)
+	return append(out, jpegData[2:]...)
+}
+
+func TestNormalizeOrientationRotatesJPEG(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.NormalizeOrientation = true
+	useConfig(t, cfg)
+
+	// 32x16：左半红、右半蓝，方向 6 表示显示时需顺时针旋转 90°
+	img := image.NewRGBA(image.Rect(0, 0, 32, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 32; x++ {
+			c := color.RGBA{R: 255, A: 255}
+			if x >= 16 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(cfg.SourceDir, "photo.jpg")
+	if err := os.WriteFile(src, withOrientation(buf.Bytes(), 6), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var log strings.Builder
+	_, finalPath, err := moveFileWithRetry(src, filepath.Join(cfg.DefaultDest, "photo.jpg"), &log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(finalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o := jpegOrientation(data); o != 0 {
+		t.Errorf("输出仍带方向标记 %d", o)
+	}
+	out, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := out.Bounds(); b.Dx() != 16 || b.Dy() != 32 {
+		t.Fatalf("尺寸为 %dx%d，应为 16x32", b.Dx(), b.Dy())
+	}
+	// 旋转后原来的左半（红）在上，右半（蓝）在下
+	if r, _, b, _ := out.At(8, 4).RGBA(); r>>8 < 200 || b>>8 > 60 {
+		t.Errorf("上半部分应为红色，实际 r=%d b=%d", r>>8, b>>8)
+	}
+	if r, _, b, _ := out.At(8, 28).RGBA(); b>>8 < 200 || r>>8 > 60 {
+		t.Errorf("下半部分应为蓝色，实际 r=%d b=%d", r>>8, b>>8)
+	}
+}
+
+// vp8xHeader 返回只有 VP8X 头（声明画布尺寸）的 webp 数据，足以读取尺寸
+func vp8xHeader(width, height int) []byte {
+	chunk := make([]byte, 10)
+	chunk[4], chunk[5], chunk[6] = byte(width-1), byte((width-1)>>8), byte((width-1)>>16)
+	chunk[7], chunk[8], chunk[9] = byte(height-1), byte((height-1)>>8), byte((height-1)>>16)
+
+	data := []byte("RIFF\x00\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00")
+	data = append(data, chunk...)
+	binary.LittleEndian.PutUint32(data[4:], uint32(len(data)-8))
+	return data
+}
+
+func TestMaxSizeResizesOversizedImages(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.MaxWidth, cfg.MaxHeight = 100, 80
+	useConfig(t, cfg)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 400, 200))); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, cfg.SourceDir, map[string]string{
+		"big.png":  buf.String(),
+		"big.webp": string(vp8xHeader(400, 200)),
+	})
+	var small bytes.Buffer
+	if err := png.Encode(&small, image.NewRGBA(image.Rect(0, 0, 50, 40))); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, cfg.SourceDir, map[string]string{"small.png": small.String()})
+
+	summary := &runSummary{}
+	if err := moveAll(cfg.SourceDir, summary); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(filepath.Join(cfg.DefaultDest, "big.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	imgConfig, err := png.DecodeConfig(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imgConfig.Width != 100 || imgConfig.Height != 50 {
+		t.Errorf("缩小后尺寸为 %dx%d，应为 100x50", imgConfig.Width, imgConfig.Height)
+	}
+
+	// 未超出的图片原样复制
+	assertContent(t, filepath.Join(cfg.DefaultDest, "small.png"), small.String())
+
+	// 超出的 webp 无法重新编码，记为失败并保留源文件
+	assertMissing(t, filepath.Join(cfg.DefaultDest, "big.webp"))
+	assertContent(t, filepath.Join(cfg.SourceDir, "big.webp"), string(vp8xHeader(400, 200)))
+	if summary.moved != 2 || len(summary.failedFiles) != 1 {
+		t.Errorf("移动 %d 个、失败 %v，应为 2 个和 big.webp", summary.moved, summary.failedFiles)
+	}
+}
+
+func TestRegexAndLiteralRoutes(t *testing.T) {
+	cfg := newTestConfig(t)
+	quarterly, banners := t.TempDir(), t.TempDir()
+	data := fmt.Sprintf(`{%q: %q, %q: %q}`, `re:^banner_\d{4}_q[1-4]`, quarterly, "banner_", banners)
+	if err := json.Unmarshal([]byte(data), &cfg.PrefixDestMap); err != nil {
+		t.Fatal(err)
+	}
+	useConfig(t, cfg)
+	writeFiles(t, cfg.SourceDir, map[string]string{
+		"banner_2024_q3.jpg": "Q3",
+		"BANNER_sale.jpg":    "SALE",
+		"banner_2024_q5.jpg": "Q5",
+		"photo.jpg":          "PHOTO",
+	})
+
+	if err := moveAll(cfg.SourceDir, &runSummary{}); err != nil {
+		t.Fatal(err)
+	}
+
+	assertContent(t, filepath.Join(quarterly, "banner_2024_q3.jpg"), "Q3")
+	assertContent(t, filepath.Join(banners, "BANNER_sale.jpg"), "SALE")
+	// 正则不匹配时按顺序落到普通前缀规则
+	assertContent(t, filepath.Join(banners, "banner_2024_q5.jpg"), "Q5")
+	assertContent(t, filepath.Join(cfg.DefaultDest, "photo.jpg"), "PHOTO")
+}
+
+func TestDateSubfolderFromModTime(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.DateSubfolder = "200601"
+	icons := t.TempDir()
+	cfg.PrefixDestMap = routeList{{Pattern: "icon_", Dest: icons}}
+	useConfig(t, cfg)
+	writeFiles(t, cfg.SourceDir, map[string]string{"photo.png": "PHOTO", "icon_home.png": "ICON"})
+	modTime := time.Date(2024, 3, 15, 12, 0, 0, 0, time.Local)
+	for _, name := range []string{"photo.png", "icon_home.png"} {
+		if err := os.Chtimes(filepath.Join(cfg.SourceDir, name), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := moveAll(cfg.SourceDir, &runSummary{}); err != nil {
+		t.Fatal(err)
+	}
+
+	assertContent(t, filepath.Join(cfg.DefaultDest, "202403", "photo.png"), "PHOTO")
+	assertContent(t, filepath.Join(icons, "202403", "icon_home.png"), "ICON")
+}
+
+func TestManifestRecordsEachFile(t *testing.T) {
+	cfg := newTestConfig(t)
+	useConfig(t, cfg)
+	writeFiles(t, cfg.SourceDir, map[string]string{
+		"new.png":      "NEW",
+		"same.png":     "SAME",
+		"conflict.png": "MINE",
+		"notes.txt":    "TXT",
+	})
+	writeFiles(t, cfg.DefaultDest, map[string]string{"same.png": "SAME", "conflict.png": "THEIRS"})
+
+	if err := moveAll(cfg.SourceDir, &runSummary{}); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "manifest.json")
+	if err := writeManifest(path); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []manifestEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]moveResult{
+		"new.png":      resultMoved,
+		"same.png":     resultDeduplicated,
+		"conflict.png": resultConflict,
+		"notes.txt":    resultSkipped,
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("清单有 %d 条记录，应为 %d 条:\n%s", len(entries), len(want), data)
+	}
+	for _, entry := range entries {
+		name := filepath.Base(entry.Source)
+		if entry.Status != want[name] {
+			t.Errorf("%s 的状态为 %s，应为 %s", name, entry.Status, want[name])
+		}
+		if name == "new.png" {
+			if entry.Destination != filepath.Join(cfg.DefaultDest, "new.png") || entry.Bytes != 3 || entry.Hash != fmt.Sprintf("%x", md5.Sum([]byte("NEW"))) {
+				t.Errorf("new.png 的记录不正确: %+v", entry)
+			}
+		}
+	}
+}
+
+func TestCopyModeKeepsSource(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.CopyOnly = true
+	logs := useConfig(t, cfg)
+	writeFiles(t, cfg.SourceDir, map[string]string{"a.png": "PNG"})
+
+	summary := &runSummary{}
+	if err := moveAll(cfg.SourceDir, summary); err != nil {
+		t.Fatal(err)
+	}
+
+	assertContent(t, filepath.Join(cfg.DefaultDest, "a.png"), "PNG")
+	assertContent(t, filepath.Join(cfg.SourceDir, "a.png"), "PNG")
+	if summary.moved != 1 {
+		t.Errorf("复制 %d 个，应为 1 个", summary.moved)
+	}
+	if !strings.Contains(logs.String(), "已复制") || strings.Contains(logs.String(), "已移动") {
+		t.Errorf("复制模式的输出应使用\"已复制\":\n%s", logs.String())
+	}
+}
+
+func TestMoveAllWithWorkerPool(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.Jobs = 8
+	useConfig(t, cfg)
+	files := map[string]string{}
+	for i := 0; i < 100; i++ {
+		files[fmt.Sprintf("img%03d.png", i)] = fmt.Sprintf("PNG-%d", i)
+	}
+	writeFiles(t, cfg.SourceDir, files)
+	// 其中 10 个目标已有相同内容
+	existing := map[string]string{}
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("img%03d.png", i)
+		existing[name] = files[name]
+	}
+	writeFiles(t, cfg.DefaultDest, existing)
+
+	summary := &runSummary{}
+	if err := moveAll(cfg.SourceDir, summary); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range files {
+		assertContent(t, filepath.Join(cfg.DefaultDest, name), content)
+		assertMissing(t, filepath.Join(cfg.SourceDir, name))
+	}
+	if summary.moved != 90 || summary.deduped != 10 || len(summary.failedFiles) != 0 {
+		t.Errorf("移动 %d 个、去重 %d 个、失败 %v，应为 90、10、0", summary.moved, summary.deduped, summary.failedFiles)
+	}
+	if len(manifest) != 100 {
+		t.Errorf("清单有 %d 条记录，应为 100 条", len(manifest))
+	}
+}
+
+func TestWatchMovesNewImages(t *testing.T) {
+	cfg := newTestConfig(t)
+	useConfig(t, cfg)
+	watcher, err := newSourceWatcher(cfg.SourceDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary := &runSummary{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		watchSourceDir(watcher, cfg.SourceDir, summary, "")
+	}()
+
+	writeFiles(t, cfg.SourceDir, map[string]string{"new.png": "NEW", "later/nested.jpg": "NESTED", "notes.txt": "TXT"})
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		_, errA := os.Stat(filepath.Join(cfg.DefaultDest, "new.png"))
+		_, errB := os.Stat(filepath.Join(cfg.DefaultDest, "nested.jpg"))
+		if errA == nil && errB == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("超时：监听期间新建的图片没有被移动")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// 关闭监听器后等处理中的文件完成再返回
+	watcher.Close()
+	<-done
+	assertContent(t, filepath.Join(cfg.DefaultDest, "new.png"), "NEW")
+	assertContent(t, filepath.Join(cfg.DefaultDest, "nested.jpg"), "NESTED")
+	assertMissing(t, filepath.Join(cfg.SourceDir, "new.png"))
+	assertContent(t, filepath.Join(cfg.SourceDir, "notes.txt"), "TXT")
+	if summary.moved != 2 {
+		t.Errorf("移动 %d 个，应为 2 个", summary.moved)
+	}
+}
+
+func TestLedgerSkipsRedownloadedFile(t *testing.T) {
+	cfg := newTestConfig(t)
+	useConfig(t, cfg)
+	ledgerPath := filepath.Join(t.TempDir(), ledgerFileName)
+	run := func() *runSummary {
+		if err := loadLedger(ledgerPath); err != nil {
+			t.Fatal(err)
+		}
+		summary := &runSummary{}
+		if err := moveAll(cfg.SourceDir, summary); err != nil {
+			t.Fatal(err)
+		}
+		if err := saveLedger(); err != nil {
+			t.Fatal(err)
+		}
+		return summary
+	}
+
+	writeFiles(t, cfg.SourceDir, map[string]string{"a.png": "PNG"})
+	if summary := run(); summary.moved != 1 {
+		t.Fatalf("第一次运行移动 %d 个，应为 1 个", summary.moved)
+	}
+	// 目标已被上传后清理，同一图片又被下载了一次
+	if err := os.Remove(filepath.Join(cfg.DefaultDest, "a.png")); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, cfg.SourceDir, map[string]string{"a.png": "PNG"})
+
+	summary := run()
+	if summary.moved != 0 || summary.uploaded != 1 {
+		t.Errorf("第二次运行移动 %d 个、按记录跳过 %d 个，应为 0 和 1", summary.moved, summary.uploaded)
+	}
+	assertMissing(t, filepath.Join(cfg.DefaultDest, "a.png"))
+	assertContent(t, filepath.Join(cfg.SourceDir, "a.png"), "PNG")
+}
+
+// snapshotDir 返回目录下所有文件的 相对路径 -> 内容
+func snapshotDir(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		files[filepath.ToSlash(rel)] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestDryRunLeavesSourceUnchanged(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.DryRun = true
+	cfg.DateSubfolder = "2006"
+	logs := useConfig(t, cfg)
+	writeFiles(t, cfg.SourceDir, map[string]string{"a.png": "A", "sub/b.jpg": "B"})
+	before := snapshotDir(t, cfg.SourceDir)
+
+	summary := &runSummary{}
+	if err := moveAll(cfg.SourceDir, summary); err != nil {
+		t.Fatal(err)
+	}
+
+	if after := snapshotDir(t, cfg.SourceDir); !reflect.DeepEqual(after, before) {
+		t.Errorf("预演后源目录变为 %v，应保持 %v", after, before)
+	}
+	if dest := snapshotDir(t, cfg.DefaultDest); len(dest) != 0 {
+		t.Errorf("预演不应写入目标目录: %v", dest)
+	}
+	year := time.Now().Format("2006")
+	for _, move := range [][2]string{
+		{filepath.Join(cfg.SourceDir, "a.png"), filepath.Join(cfg.DefaultDest, year, "a.png")},
+		{filepath.Join(cfg.SourceDir, "sub", "b.jpg"), filepath.Join(cfg.DefaultDest, year, "b.jpg")},
+	} {
+		if want := fmt.Sprintf("→ 将移动: %s -> %s", move[0], move[1]); !strings.Contains(logs.String(), want) {
+			t.Errorf("输出应包含 %q:\n%s", want, logs.String())
+		}
+	}
+	if summary.moved != 2 {
+		t.Errorf("计划移动 %d 个，应为 2 个", summary.moved)
+	}
+}
+
+func TestMovesAvifAndHeic(t *testing.T) {
+	cfg := newTestConfig(t)
+	useConfig(t, cfg)
+	writeFiles(t, cfg.SourceDir, map[string]string{"photo.avif": "AVIF", "IMG_0001.HEIC": "HEIC"})
+
+	summary := &runSummary{}
+	if err := moveAll(cfg.SourceDir, summary); err != nil {
+		t.Fatal(err)
+	}
+
+	assertContent(t, filepath.Join(cfg.DefaultDest, "photo.avif"), "AVIF")
+	assertContent(t, filepath.Join(cfg.DefaultDest, "IMG_0001.HEIC"), "HEIC")
+	if summary.moved != 2 || summary.skipped != 0 {
+		t.Errorf("移动 %d 个、跳过 %d 个，应为 2 和 0", summary.moved, summary.skipped)
+	}
+}
+
+func TestDeleteFailureRetainsVerifiedCopy(t *testing.T) {
+	cfg := newTestConfig(t)
+	useConfig(t, cfg)
+	saved := removeSource
+	removeSource = func(string) error { return errors.New("文件被占用") }
+	t.Cleanup(func() { removeSource = saved })
+	writeFiles(t, cfg.SourceDir, map[string]string{"a.png": "PNG"})
+
+	summary := &runSummary{}
+	if err := moveAll(cfg.SourceDir, summary); err != nil {
+		t.Fatal(err)
+	}
+
+	assertContent(t, filepath.Join(cfg.DefaultDest, "a.png"), "PNG")
+	assertContent(t, filepath.Join(cfg.SourceDir, "a.png"), "PNG")
+	if summary.moved != 0 || len(summary.retainedFiles) != 1 {
+		t.Errorf("移动 %d 个、保留源文件 %v，应为 0 个和 a.png", summary.moved, summary.retainedFiles)
+	}
+	if len(manifest) != 1 || manifest[0].Status != resultRetained {
+		t.Errorf("清单记录为 %+v，状态应为 %s", manifest, resultRetained)
+	}
+}
+
+func TestPreserveStructure(t *testing.T) {
+	for _, preserve := range []bool{false, true} {
+		t.Run(fmt.Sprintf("preserve=%v", preserve), func(t *testing.T) {
+			cfg := newTestConfig(t)
+			cfg.PreserveStructure = preserve
+			useConfig(t, cfg)
+			writeFiles(t, cfg.SourceDir, map[string]string{"top.png": "TOP", "2024/trip/beach.jpg": "BEACH"})
+
+			if err := moveAll(cfg.SourceDir, &runSummary{}); err != nil {
+				t.Fatal(err)
+			}
+
+			assertContent(t, filepath.Join(cfg.DefaultDest, "top.png"), "TOP")
+			nested, flat := filepath.Join(cfg.DefaultDest, "2024", "trip", "beach.jpg"), filepath.Join(cfg.DefaultDest, "beach.jpg")
+			if preserve {
+				assertContent(t, nested, "BEACH")
+				assertMissing(t, flat)
+			} else {
+				assertContent(t, flat, "BEACH")
+				assertMissing(t, nested)
+			}
+		})
+	}
+}
+
+func TestEnvOverridesSourceAndDest(t *testing.T) {
+	sourceDir, destDir := t.TempDir(), t.TempDir()
+	t.Setenv(envSourceDir, sourceDir)
+	t.Setenv(envDestDir, destDir)
+	writeFiles(t, sourceDir, map[string]string{"photo.png": "PHOTO"})
+
+	cfg, err := loadConfig(filepath.Join(t.TempDir(), "upload.config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.PrefixDestMap = routeList{}
+	useConfig(t, cfg)
+
+	if config.SourceDir != sourceDir {
+		t.Errorf("源目录为 %s，应为 %s", config.SourceDir, sourceDir)
+	}
+	if got := getDestDirectory("photo.png"); got != destDir {
+		t.Errorf("目标目录为 %s，应为 %s", got, destDir)
+	}
+
+	if err := moveAll(config.SourceDir, &runSummary{}); err != nil {
+		t.Fatal(err)
+	}
+	assertContent(t, filepath.Join(destDir, "photo.png"), "PHOTO")
+	assertMissing(t, filepath.Join(sourceDir, "photo.png"))
+}
+
+func TestLogFileHasTimestampedLinePerMove(t *testing.T) {
+	cfg := newTestConfig(t)
+	useConfig(t, cfg)
+	writeFiles(t, cfg.SourceDir, map[string]string{
+		"a.png": "A",
+		"b.jpg": "B",
+		"c.gif": "C",
+	})
+
+	logPath := filepath.Join(t.TempDir(), "upload.log")
+	logFile, err := openLogFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary := &runSummary{}
+	err = moveAll(cfg.SourceDir, summary)
+	logFile.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.moved != 3 {
+		t.Fatalf("移动了 %d 个文件，应为 3", summary.moved)
+	}
+
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stamp := regexp.MustCompile(`^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} `)
+	for _, name := range []string{"a.png", "b.jpg", "c.gif"} {
+		count := 0
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.Contains(line, name) && strings.Contains(line, "->") {
+				count++
+				if !stamp.MatchString(line) {
+					t.Errorf("日志行没有时间戳: %q", line)
+				}
+			}
+		}
+		if count != 1 {
+			t.Errorf("%s 的移动记录有 %d 行，应为 1 行:\n%s", name, count, data)
+		}
+	}
+}
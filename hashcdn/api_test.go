@@ -0,0 +1,67 @@
+package hashcdn_test
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"image-upload-service/hashcdn"
+)
+
+// 只通过导出的API使用本包，与外部调用方相同
+func TestProcessHTMLFromImportingPackage(t *testing.T) {
+    root := t.TempDir()
+    files := map[string]string{
+        "index.html":             `<link rel="stylesheet" href="components/nav/nav.css"><script src="components/nav/nav.js"></script>`,
+        "components/nav/nav.css": `.nav{}`,
+        "components/nav/nav.js":  "nav()",
+    }
+    for rel, content := range files {
+        path := filepath.Join(root, filepath.FromSlash(rel))
+        if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+            t.Fatal(err)
+        }
+        if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+            t.Fatal(err)
+        }
+    }
+    
+    logger, err := hashcdn.NewLogger(io.Discard, "text", false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    vm := hashcdn.NewVersionManager(hashcdn.Config{RootDir: root}, false)
+    vm.SetLogger(logger)
+    report, err := vm.ProcessHTML(filepath.Join(root, "index.html"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    
+    hash := func(content string) string {
+        sum := md5.Sum([]byte(content))
+        return hex.EncodeToString(sum[:])[:8]
+    }
+    css := "components/nav/nav." + hash(`.nav{}`) + ".css"
+    js := "components/nav/nav." + hash("nav()") + ".js"
+    data, err := os.ReadFile(filepath.Join(root, "index.html"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, want := range []string{`href="` + css + `"`, `src="` + js + `"`} {
+        if !strings.Contains(string(data), want) {
+            t.Errorf("处理结果应包含 %s:\n%s", want, data)
+        }
+    }
+    for _, rel := range []string{css, js} {
+        if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(rel))); err != nil {
+            t.Errorf("%s 未生成: %v", rel, err)
+        }
+    }
+    if len(report.Changed) != 1 || report.ErrorCount != 0 {
+        t.Errorf("报告: changed=%v errors=%v", report.Changed, report.Errors)
+    }
+}
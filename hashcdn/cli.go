@@ -0,0 +1,258 @@
+package hashcdn
+
+import (
+	"os"
+	"time"
+)
+
+// Options 命令行参数对应的运行选项（由 cmd/hashCdn 解析参数后传入 Run）
+type Options struct {
+    ConfigPath     string  // 配置文件路径
+    HTMLFile       string  // 单个HTML文件路径（优先级高于配置文件）
+    ScanAll        bool    // 扫描所有HTML文件
+    CDNDomain      string  // CDN域名（覆盖配置文件）
+    Debug          bool    // 调试模式
+    Watch          bool    // 处理完成后监听文件变化
+    ReportPath     string  // 将运行结果以JSON格式写入指定路径
+    Clean          bool    // 删除所有hash文件并还原引用
+    VersionMapFile string  // 版本映射文件路径（覆盖配置文件）
+    NoMerge        bool    // 直接覆盖版本映射文件
+    Incremental    bool    // 增量模式
+    Timing         bool    // 输出各处理阶段的耗时
+    Force          bool    // 强制重新生成hash文件
+    Progress       bool    // 显示单行刷新的进度
+    CSSFile        string  // 单独处理一个CSS文件
+    Stdin          bool    // 从标准输入读取HTML，改写后输出到标准输出
+    BaseDir        string  // Stdin 模式下相对引用的基准目录
+    Prune          bool    // 处理完成后删除不再使用的hash文件
+    Diff           bool    // 输出引用改动的 unified diff
+    ZipArchive     string  // 处理zip归档中的站点
+    Verify         bool    // 只校验HTML中的引用
+    Since          string  // 只处理在此时间之后修改的HTML文件
+    Logger         *Logger // 日志输出，为 nil 时输出到标准输出
+}
+
+// Run 按运行选项执行对应的处理，返回进程退出码（0 成功，1 处理失败，2 参数错误）
+func Run(opts Options) int {
+    logger := opts.Logger
+    if logger == nil {
+        logger = defaultLogger()
+    }
+    
+    var sinceTime time.Time
+    if opts.Since != "" {
+        parsed, err := parseSince(opts.Since, logger)
+        if err != nil {
+            logger.Printf("❌ -since 参数无效: %v\n", err)
+            return 2
+        }
+        sinceTime = parsed
+    }
+    
+    // 加载配置（命令行已指定处理目标时，配置中可以不写HTML文件列表）
+    hasTarget := opts.HTMLFile != "" || opts.ScanAll || opts.CSSFile != "" || opts.Clean || opts.Stdin || opts.Verify || opts.ZipArchive != ""
+    config, err := loadConfig(opts.ConfigPath, !hasTarget, logger)
+    if err != nil {
+        logger.Printf("❌ 配置错误: %v\n", err)
+        return 1
+    }
+    
+    if opts.CDNDomain != "" {
+        config.CDNDomain = opts.CDNDomain
+        config.CDNDomains = nil
+    }
+    if opts.VersionMapFile != "" {
+        config.VersionMapFile = opts.VersionMapFile
+    }
+    if opts.Force {
+        config.ForceRegen = true
+    }
+    
+    // 处理zip归档时以解压目录作为 RootDir
+    if opts.ZipArchive != "" {
+        dir, err := extractZip(opts.ZipArchive)
+        if err != nil {
+            logger.Printf("❌ 解压失败: %s (%v)\n", opts.ZipArchive, err)
+            return 1
+        }
+        defer os.RemoveAll(dir)
+        logger.Printf("📦 已解压: %s\n", opts.ZipArchive)
+        config.RootDir = dir
+    }
+    
+    vm := NewVersionManager(*config, opts.Debug)
+    vm.SetLogger(logger)
+    vm.showProgress = opts.Progress
+    vm.showTiming = opts.Timing
+    vm.showDiff = opts.Diff
+    vm.noMerge = opts.NoMerge
+    // -prune 也需要处理前的版本映射，用于识别之前生成、原始文件已删除的hash文件
+    if opts.Incremental || opts.Prune {
+        vm.incremental = opts.Incremental
+        vm.loadPreviousVersionMap()
+    }
+    
+    // 显示处理的组件配置
+    if len(config.IncludeComponents) > 0 {
+        vm.logf("📋 指定处理组件: %v\n", config.IncludeComponents)
+    } else {
+        vm.logf("📋 处理所有组件\n")
+    }
+    
+    if opts.Clean {
+        vm.cleanHashedFiles()
+        return 0
+    }
+    
+    // 校验HTML引用：-file 或配置中的单个文件 > -all 或配置中没有HTML列表时扫描所有 > 配置中的HTML列表
+    if opts.Verify {
+        var verifyFiles []string
+        if opts.HTMLFile != "" {
+            verifyFiles = []string{opts.HTMLFile}
+        } else if config.SingleHTMLFile != "" {
+            verifyFiles = []string{config.SingleHTMLFile}
+        } else if opts.ScanAll || len(config.HTMLFiles) == 0 {
+            verifyFiles = joinRootDir(config.RootDir, vm.findAllHTMLFiles())
+        } else {
+            verifyFiles = joinRootDir(config.RootDir, vm.expandHTMLFiles(config.HTMLFiles))
+        }
+        if vm.verifyReferences(verifyFiles) > 0 {
+            return 1
+        }
+        return 0
+    }
+    
+    saveReport := func() {
+        if opts.ReportPath != "" {
+            vm.saveReport(opts.ReportPath)
+        }
+    }
+    pruneHashed := func() {
+        if opts.Prune {
+            vm.pruneHashedFiles()
+        }
+    }
+    
+    // 单独处理CSS文件
+    if opts.CSSFile != "" {
+        if err := vm.processCSSFile(opts.CSSFile); err != nil {
+            vm.logf("❌ 处理失败: %v\n", err)
+            vm.recordError("%s: %v", opts.CSSFile, err)
+            saveReport()
+            return 1
+        }
+        vm.saveVersionMap()
+        vm.printByteSummary()
+        pruneHashed()
+        saveReport()
+        return 0
+    }
+    
+    // 处理zip归档中的所有HTML，成功后重新打包
+    if opts.ZipArchive != "" {
+        exitCode := RunHTMLFiles(vm, vm.findAllHTMLFiles())
+        if exitCode == 0 {
+            pruneHashed()
+            if err := writeZip(config.RootDir, opts.ZipArchive); err != nil {
+                vm.logf("❌ 写入zip失败: %s (%v)\n", opts.ZipArchive, err)
+                exitCode = 1
+            } else {
+                vm.logf("📦 已更新: %s\n", opts.ZipArchive)
+            }
+        }
+        saveReport()
+        return exitCode
+    }
+    
+    // 从标准输入读取HTML
+    if opts.Stdin {
+        dir := opts.BaseDir
+        if dir == "" {
+            dir = config.RootDir
+        }
+        if err := vm.processHTMLStream(os.Stdin, os.Stdout, dir); err != nil {
+            vm.logf("❌ 处理失败: %v\n", err)
+            vm.recordError("stdin: %v", err)
+            saveReport()
+            return 1
+        }
+        vm.saveVersionMap()
+        vm.printByteSummary()
+        saveReport()
+        return 0
+    }
+    
+    // 确定要处理的单个HTML文件（优先级：命令行 > 配置文件）
+    targetHTMLFile := opts.HTMLFile
+    if targetHTMLFile == "" && config.SingleHTMLFile != "" {
+        targetHTMLFile = config.SingleHTMLFile
+        vm.logf("📋 使用配置文件中的HTML文件\n")
+    }
+    
+    // 处理单个文件
+    if targetHTMLFile != "" {
+        if err := vm.processHTMLFile(targetHTMLFile); err != nil {
+            vm.logf("❌ 处理失败: %v\n", err)
+            vm.recordError("%s: %v", targetHTMLFile, err)
+            saveReport()
+            return 1
+        }
+        vm.saveVersionMap()
+        vm.printByteSummary()
+        pruneHashed()
+        saveReport()
+        if opts.Watch {
+            return runWatch(vm, []string{targetHTMLFile})
+        }
+        return 0
+    }
+    
+    if opts.Since != "" && !opts.ScanAll {
+        vm.logf("⚠️  -since 只在 -all 模式下生效，已忽略\n")
+    }
+    
+    // 扫描所有文件
+    if opts.ScanAll {
+        htmlFiles := vm.findAllHTMLFiles()
+        vm.logf("📋 找到 %d 个HTML文件\n\n", len(htmlFiles))
+        targetFiles := htmlFiles
+        if opts.Since != "" && !sinceTime.IsZero() {
+            targetFiles = vm.filterModifiedSince(htmlFiles, sinceTime)
+            vm.logf("📋 其中 %d 个在 %s 之后修改\n\n", len(targetFiles), sinceTime.Format(time.RFC3339))
+            if len(htmlFiles) > 0 && len(targetFiles) == 0 {
+                vm.logln("✨ 没有需要处理的HTML文件")
+                if opts.Watch {
+                    return runWatch(vm, joinRootDir(config.RootDir, htmlFiles))
+                }
+                return 0
+            }
+        }
+        if len(htmlFiles) > 0 {
+            exitCode := RunHTMLFiles(vm, targetFiles)
+            if exitCode == 0 {
+                pruneHashed()
+            }
+            saveReport()
+            if opts.Watch {
+                return runWatch(vm, joinRootDir(config.RootDir, htmlFiles))
+            }
+            return exitCode
+        }
+        vm.logln("❌ 未找到HTML文件")
+        return 0
+    }
+    
+    // 使用配置文件中的HTML列表
+    if len(config.HTMLFiles) > 0 {
+        exitCode := RunHTMLFiles(vm, config.HTMLFiles)
+        if exitCode == 0 {
+            pruneHashed()
+        }
+        saveReport()
+        if opts.Watch {
+            return runWatch(vm, joinRootDir(config.RootDir, vm.expandHTMLFiles(config.HTMLFiles)))
+        }
+        return exitCode
+    }
+    return 0
+}
@@ -0,0 +1,6230 @@
+// Package hashcdn 为HTML引用的 CSS/JS/图片等静态资源生成带内容hash的文件名并改写引用，
+// 可作为库调用（NewVersionManager、ProcessHTML、ProcessAll），命令行入口 cmd/hashCdn 解析参数后调用 Run
+package hashcdn
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/andybalholm/brotli"
+	"github.com/fsnotify/fsnotify"
+)
+
+// Config 配置结构
+type Config struct {
+    RootDir         string   `json:"rootDir"`
+    CDNDomain       string   `json:"cdnDomain"`
+    CDNDomains      []string `json:"cdnDomains"` // 多个CDN域名，按文件名hash分配，设置后优先于 CDNDomain
+    HashLength      int      `json:"hashLength"`
+    // 按扩展名指定hash长度（如 {"js": 16, "css": 16}），未列出的扩展名使用 HashLength
+    HashLengthByExt map[string]int `json:"hashLengthByExt"`
+    SingleHTMLFile  string   `json:"singleHTMLFile"`  // 单个HTML文件路径
+    HTMLFiles       []string `json:"htmlFiles"`
+    ExcludeDirs     []string `json:"excludeDirs"`
+    // 环境相关配置
+    HomeHTMLFile    string   `json:"homeHTMLFile"`    // 家里电脑的HTML文件路径
+    CompanyHTMLFile string   `json:"companyHTMLFile"` // 公司电脑的HTML文件路径
+    // 新增：指定要处理的组件
+    IncludeComponents []string `json:"includeComponents"` // 只处理指定的组件
+    // 为改写后的 <script>/<link> 标签添加 integrity 和 crossorigin 属性
+    EmitSRI bool `json:"emitSRI"`
+    // 保留最近的 N 个旧hash文件（按修改时间），0 表示删除全部旧文件
+    KeepOldVersions int `json:"keepOldVersions"`
+    // 参与hash处理的文件扩展名（不区分大小写，可带或不带前导点），为空时使用默认列表
+    HashExtensions []string `json:"hashExtensions"`
+    // 不做hash处理的文件（相对 RootDir 的路径glob，支持 * 和 **），其引用保持不变
+    ExcludeFiles []string `json:"excludeFiles"`
+    // 为生成的hash文件写入预压缩副本，可选 "gzip"（.gz）、"brotli"（.br）
+    Precompress []string `json:"precompress"`
+    // 版本映射文件路径（相对 RootDir），默认 .version-map.json
+    VersionMapFile string `json:"versionMapFile"`
+    // 版本化方式："rename"（默认，生成 name.hash.ext 副本）或 "query"（不改文件名，引用追加 ?v=hash）
+    Mode string `json:"mode"`
+    // 即使同名hash文件已存在且内容一致，也重新从源文件复制（用于修复被损坏的CDN资源）
+    ForceRegen bool `json:"forceRegen"`
+    // 哪些路径下的 CSS/JS 算作组件资源：普通字符串按路径子串匹配，含通配符的按相对 RootDir 的路径glob匹配；默认 ["components"]
+    ComponentPathPatterns []string `json:"componentPathPatterns"`
+    // 资源对外访问的URL路径前缀（如 /static），设置后改写的引用为 前缀 + 相对 RootDir 的路径（再加CDN域名），磁盘上的文件位置不变
+    URLBasePath string `json:"urlBasePath"`
+    // CSS/JS 按折叠空白后的内容计算hash，只改动空白时hash文件名不变（写出的文件内容不受影响）
+    HashNormalized bool `json:"hashNormalized"`
+    // hash文件名模板，{name} 为不含扩展名的文件名，{hash} 为hash，{ext} 为带点的扩展名；默认 "{name}.{hash}{ext}"
+    FilenameTemplate string `json:"filenameTemplate"`
+    // 文件系统是否不区分大小写（macOS/Windows 默认如此），为 true 时查找hash文件、清理旧文件按不区分大小写匹配；未设置时自动检测
+    CaseInsensitiveFS *bool `json:"caseInsensitiveFS"`
+    // 生成hash副本前压缩SVG（去掉注释、标签间空白和默认属性），hash按压缩后的内容计算；原始SVG不变
+    MinifySVG bool `json:"minifySVG"`
+    // 懒加载等场景中引用本地资源的 data-* 属性（如 data-src、data-bg），按 src 一样hash并改写；以 srcset 结尾的按 srcset 解析
+    DataAttributes []string `json:"dataAttributes"`
+    // 回收目录（相对 RootDir 或绝对路径），设置后删除的文件移动到这里（保留相对 RootDir 的目录结构）而不是直接删除
+    TrashDir string `json:"trashDir"`
+    // 改写ES模块（JS文件和内联 <script type="module">）中 import/export ... from、import() 引用的本地模块地址为hash后的文件名
+    RewriteModuleImports bool `json:"rewriteModuleImports"`
+    // 自定义的资源引用模式（如内联脚本中的 asset("images/x.png")），在HTML和CSS文本中匹配，分组中的本地资源hash后替换
+    CustomPatterns []CustomPattern `json:"customPatterns"`
+    // 生成hash文件时复制失败的重试次数（如 Windows 上源文件被编辑器短暂占用），默认 2，负数表示不重试
+    CopyRetries int `json:"copyRetries"`
+    // 第一次重试前的等待时间（毫秒），之后每次重试加倍，默认 200
+    CopyRetryDelayMs int `json:"copyRetryDelayMs"`
+    // CSS 计算hash前执行的外部转换命令，{in}/{out} 替换为输入、输出临时文件
+    PreHashCommand string `json:"preHashCommand"`
+    // 按路径前缀（相对 RootDir）为不同资源目录指定CDN域名，第一条匹配的规则生效，没有匹配时使用 CDNDomain/CDNDomains
+    CDNRules []CDNRule `json:"cdnRules"`
+}
+
+// CustomPattern 自定义的资源引用模式
+type CustomPattern struct {
+    Regex string `json:"regex"` // 正则表达式（Go RE2 语法）
+    Group int    `json:"group"` // 资源路径所在的分组，未设置时为第1组
+}
+
+// CDNRule 按路径前缀指定CDN域名的规则
+type CDNRule struct {
+    PathPrefix string `json:"pathPrefix"` // 相对 RootDir 的路径前缀（如 "images"、"js/vendor"），按完整目录匹配，为空时匹配所有资源
+    Domain     string `json:"domain"`     // CDN域名，格式同 CDNDomain
+}
+
+// customPattern 编译后的自定义引用模式
+type customPattern struct {
+    re    *regexp.Regexp
+    group int
+}
+
+// 版本化方式
+const (
+    modeRename = "rename"
+    modeQuery  = "query"
+)
+
+// precompressFormats 预压缩格式对应的文件后缀
+var precompressFormats = map[string]string{
+    "gzip":   ".gz",
+    "brotli": ".br",
+}
+
+// precompressSkipExts 本身已压缩、不需要预压缩的扩展名
+var precompressSkipExts = map[string]bool{
+    ".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".webp": true,
+    ".woff": true, ".woff2": true, ".mp4": true, ".webm": true, ".ogg": true,
+}
+
+// defaultHashExtensions 默认参与hash处理的文件扩展名（样式脚本、图片、字体、媒体、字幕、Web App Manifest）
+var defaultHashExtensions = []string{
+    "css", "js",
+    "jpg", "jpeg", "png", "gif", "svg", "webp", "ico",
+    "woff", "woff2", "ttf", "eot", "otf",
+    "mp4", "webm", "ogg", "vtt",
+    "webmanifest", "json",
+}
+
+// VersionManager 版本管理器
+type VersionManager struct {
+    config         Config
+    versionMap     map[string]string
+    // 本次运行中已处理的组件资源（实际文件路径）-> 处理结果，同一资源只处理一次
+    processedFiles map[string]*processedResource
+    // 跨页面的已处理资源索引：源文件绝对路径（不含hash）-> hash结果，多个页面共享的组件只处理一次
+    resourceIndex  map[string]*FileInfo
+    // RewriteModuleImports 时正在处理的模块（绝对路径），用于发现循环 import
+    moduleVisiting map[string]bool
+    mu             sync.Mutex
+    debugMode      bool  // 调试模式
+    showProgress   bool  // 批量处理时在 stderr 显示单行进度（-progress）
+    showTiming     bool  // 输出每个HTML文件各阶段的耗时（-timing）
+    showDiff       bool  // 更新HTML/CSS引用时输出改动的 unified diff（-diff）
+    noMerge        bool  // 保存版本映射时直接覆盖已有文件，不合并（-no-merge）
+    // 增量模式（-incremental）：源文件hash与上次版本映射一致且hash文件存在时直接复用，不再复制
+    incremental    bool
+    previousMap    map[string]string
+    // 监听模式使用：记录每个HTML文件依赖的源文件（绝对路径）
+    dependencies   map[string]map[string]bool
+    currentDeps    map[string]bool
+    // 当前HTML处理期间引用路径不得越出的目录（HTML位于 RootDir 内时为 RootDir 的绝对路径，否则为空不检查）
+    guardRoot      string
+    // 当前HTML所在目录，HTML中的相对引用以此为基准（设置 URLBasePath 时用于换算引用路径）
+    refDir         string
+    // 运行结果报告（-report）
+    report         Report
+    // RootDir 下 .hashcdnignore 中的忽略规则
+    ignoreRules    []ignoreRule
+    // 匹配 name.hash.ext 格式文件名的正则（由 HashExtensions、HashLength 和 HashLengthByExt 生成，每种hash长度一个）
+    hashedNameRes  []*regexp.Regexp
+    // 本次运行内的文件hash缓存，键为 绝对路径|大小|修改时间
+    hashCache      map[string]string
+    // 本次运行生成的hash文件（绝对路径）-> 源文件（绝对路径），用于发现hash冲突
+    hashedOwners   map[string]string
+    // 读写源文件、hash文件和版本映射所用的文件系统
+    fsys           FileSystem
+    // 文件系统不区分大小写时，文件名匹配和路径比较均忽略大小写
+    caseInsensitive bool
+    // 由 CustomPatterns 编译的自定义引用模式
+    customPatterns []customPattern
+    // 批量处理时的运行日志（.hashcdn-journal），为 nil 时不记录
+    journal        *runJournal
+    // 当前正在改写引用的文件（HTML/CSS/manifest），记录添加CDN域名前的原始引用时使用
+    refOwner       string
+    // 本次运行添加了CDN域名的引用：文件（相对 RootDir）-> 去掉hash的CDN地址 -> 去掉hash的原始引用
+    cdnRefs        map[string]map[string]string
+    // 日志输出位置和格式
+    logger         *Logger
+}
+
+// ignoreFileName 忽略规则文件名（位于 RootDir 下，gitignore 风格）
+const ignoreFileName = ".hashcdnignore"
+
+// ignoreRule 忽略文件中的一条规则
+type ignoreRule struct {
+    pattern  string
+    negate   bool // 以 ! 开头：重新包含
+    dirOnly  bool // 以 / 结尾：只匹配目录
+    anchored bool // 包含 /：相对 RootDir 匹配，否则匹配任意层级的文件名
+}
+
+// FileInfo 文件信息
+type FileInfo struct {
+    OriginalPath string
+    HashedPath   string
+    Hash         string
+    Renamed      bool
+}
+
+// Report 运行结果报告
+type Report struct {
+    Files        []FileReport `json:"files"`
+    // 所有生成或复用的hash文件的总字节数，其中已存在相同内容、跳过复制的字节数
+    ProcessedBytes int64      `json:"processedBytes"`
+    SkippedBytes   int64      `json:"skippedBytes"`
+    DeletedCount int          `json:"deletedCount"`
+    // 内容被改写的HTML文件和无需改写的HTML文件（相对 RootDir）
+    Changed      []string     `json:"changed"`
+    Unchanged    []string     `json:"unchanged"`
+    ErrorCount   int          `json:"errorCount"`
+    Errors       []string     `json:"errors"`
+    Timings      []PageTiming `json:"timings,omitempty"` // 开启 -timing 时记录各HTML文件的阶段耗时
+}
+
+// PageTiming 单个HTML文件各处理阶段的耗时
+type PageTiming struct {
+    HTMLFile string        `json:"htmlFile"`
+    Phases   []PhaseTiming `json:"phases"`
+    TotalMs  float64       `json:"totalMs"`
+}
+
+// PhaseTiming 单个处理阶段的耗时
+type PhaseTiming struct {
+    Name string  `json:"name"`
+    Ms   float64 `json:"ms"`
+}
+
+// phaseTimer 依次记录 processHTMLFile 各阶段的耗时
+type phaseTimer struct {
+    start  time.Time
+    last   time.Time
+    phases []PhaseTiming
+}
+
+// newPhaseTimer 创建阶段计时器
+func newPhaseTimer() *phaseTimer {
+    now := time.Now()
+    return &phaseTimer{start: now, last: now}
+}
+
+// done 结束当前阶段，记录自上一阶段结束以来的耗时
+func (t *phaseTimer) done(name string) {
+    now := time.Now()
+    t.phases = append(t.phases, PhaseTiming{Name: name, Ms: durationMs(now.Sub(t.last))})
+    t.last = now
+}
+
+// durationMs 将耗时转换为毫秒（保留小数）
+func durationMs(d time.Duration) float64 {
+    return float64(d.Microseconds()) / 1000
+}
+
+// FileReport 单个文件的处理结果
+type FileReport struct {
+    OriginalPath string `json:"originalPath"`
+    HashedPath   string `json:"hashedPath"`
+    Hash         string `json:"hash"`
+    Bytes        int64  `json:"bytes"`
+    Status       string `json:"status"` // generated: 新生成, skipped: 已存在跳过
+}
+
+// 文件处理状态
+const (
+    statusGenerated = "generated"
+    statusSkipped   = "skipped"
+    statusVersioned = "versioned" // query 模式：文件不变，只更新引用中的 ?v= 参数
+)
+
+// ImageReference 图片引用信息
+type ImageReference struct {
+    OriginalPath string
+    AbsolutePath string
+    RelativePath string
+}
+
+// Logger 日志输出设置：输出位置、格式（text/json）和是否将图标替换为 ASCII 标签，每个 VersionManager 各自持有
+type Logger struct {
+    output    io.Writer
+    json      *slog.Logger // json 格式时使用的结构化日志，为 nil 时按原样输出文本
+    plainText bool         // 文本日志中的图标替换为 ASCII 标签
+    
+    // JSON 日志中附带的当前上下文
+    mu    sync.Mutex
+    file  string // 正在处理的HTML/CSS文件
+    phase string // 当前处理阶段
+}
+
+// NewLogger 创建日志输出：format 为 text（带图标的文本）或 json（每行一条结构化日志），plainText 为 true 时图标替换为 [OK] 等标签
+func NewLogger(output io.Writer, format string, plainText bool) (*Logger, error) {
+    logger := &Logger{output: output, plainText: plainText}
+    switch format {
+    case "", "text":
+    case "json":
+        logger.json = slog.New(slog.NewJSONHandler(output, nil))
+    default:
+        return nil, fmt.Errorf("不支持的日志格式: %s（可选 text, json）", format)
+    }
+    return logger, nil
+}
+
+// IsTerminal 判断输出是否为终端（重定向到文件或管道、CI 日志中不是终端，此时应使用纯文本图标）
+func IsTerminal(file *os.File) bool {
+    info, err := file.Stat()
+    return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// defaultLogger 未指定日志输出时使用：带图标的文本输出到标准输出
+func defaultLogger() *Logger {
+    return &Logger{output: os.Stdout}
+}
+
+// logIcons 日志前缀图标对应的动作（JSON 日志的 action 字段）和纯文本输出时替换图标的 ASCII 标签
+var logIcons = []struct {
+    icon   string
+    action string
+    level  slog.Level
+    tag    string
+}{
+    {"❌", "fail", slog.LevelError, "[FAIL]"},
+    {"⚠️", "warn", slog.LevelWarn, "[WARN]"},
+    {"✅", "done", slog.LevelInfo, "[OK]"},
+    {"🔄", "rewrite", slog.LevelInfo, "[UPD]"},
+    {"🗑️", "delete", slog.LevelInfo, "[DEL]"},
+    {"⏭️", "skip", slog.LevelInfo, "[SKIP]"},
+    {"🚫", "skip", slog.LevelInfo, "[SKIP]"},
+    {"📌", "collect", slog.LevelInfo, "[REF]"},
+    {"📸", "collect", slog.LevelInfo, "[IMG]"},
+    {"🔍", "collect", slog.LevelInfo, "[SCAN]"},
+    {"📦", "start", slog.LevelInfo, "[ZIP]"},
+    {"🎨", "start", slog.LevelInfo, "[CSS]"},
+    {"🔧", "start", slog.LevelInfo, "[JS]"},
+    {"🖼️", "start", slog.LevelInfo, "[IMG]"},
+    {"📄", "start", slog.LevelInfo, "[HTML]"},
+    {"📝", "start", slog.LevelInfo, "[CSS]"},
+    {"🚀", "start", slog.LevelInfo, "[START]"},
+    {"🧹", "start", slog.LevelInfo, "[CLEAN]"},
+    {"💾", "save", slog.LevelInfo, "[SAVE]"},
+    {"📊", "report", slog.LevelInfo, "[STAT]"},
+    {"🗜️", "compress", slog.LevelInfo, "[COMP]"},
+    {"✨", "finish", slog.LevelInfo, "[DONE]"},
+    {"🎉", "finish", slog.LevelInfo, "[DONE]"},
+    {"⏱️", "timing", slog.LevelInfo, "[TIME]"},
+    {"📋", "config", slog.LevelInfo, "[CONF]"},
+    {"📍", "config", slog.LevelInfo, "[CONF]"},
+    {"🏠", "config", slog.LevelInfo, "[CONF]"},
+    {"🏢", "config", slog.LevelInfo, "[CONF]"},
+    {"👀", "watch", slog.LevelInfo, "[WATCH]"},
+    {"🔁", "watch", slog.LevelInfo, "[WATCH]"},
+    {"👋", "watch", slog.LevelInfo, "[WATCH]"},
+    {"ℹ️", "info", slog.LevelInfo, "[INFO]"},
+    {"♻️", "reuse", slog.LevelInfo, "[REUSE]"},
+    {"⏳", "progress", slog.LevelInfo, "[PROG]"},
+}
+
+// plainIcons 将文本中的图标替换为对应的 ASCII 标签（如 ✅ -> [OK]），其余内容不变
+func plainIcons(text string) string {
+    for _, entry := range logIcons {
+        text = strings.ReplaceAll(text, entry.icon, entry.tag)
+    }
+    return text
+}
+
+// setFile 设置JSON日志的当前文件，并清空阶段
+func (l *Logger) setFile(file string) {
+    l.mu.Lock()
+    l.file = file
+    l.phase = ""
+    l.mu.Unlock()
+}
+
+// setPhase 设置JSON日志的当前处理阶段
+func (l *Logger) setPhase(phase string) {
+    l.mu.Lock()
+    l.phase = phase
+    l.mu.Unlock()
+}
+
+// Printf 输出一条日志：文本模式下与 fmt.Printf 相同，JSON 模式下按前缀图标推断级别和动作
+func (l *Logger) Printf(format string, args ...interface{}) {
+    l.event("", "", "", format, args...)
+}
+
+// Println 同 fmt.Println
+func (l *Logger) Println(args ...interface{}) {
+    l.Printf("%s", fmt.Sprintln(args...))
+}
+
+// event 输出一条带结构化字段的日志，action/file/hash 为空时分别使用图标推断的动作、当前文件、不输出
+func (l *Logger) event(action, file, hash string, format string, args ...interface{}) {
+    text := fmt.Sprintf(format, args...)
+    if l.json == nil {
+        if l.plainText {
+            text = plainIcons(text)
+        }
+        fmt.Fprint(l.output, text)
+        return
+    }
+    
+    // 空行和分隔线只用于文本排版
+    msg := strings.TrimSpace(text)
+    if strings.Trim(msg, "=") == "" {
+        return
+    }
+    
+    level := slog.LevelInfo
+    inferred := "info"
+    for _, entry := range logIcons {
+        if strings.HasPrefix(msg, entry.icon) {
+            msg = strings.TrimSpace(strings.TrimPrefix(msg, entry.icon))
+            inferred, level = entry.action, entry.level
+            break
+        }
+    }
+    if action == "" {
+        action = inferred
+    }
+    
+    l.mu.Lock()
+    page, phase := l.file, l.phase
+    l.mu.Unlock()
+    
+    attrs := []slog.Attr{slog.String("action", action)}
+    if phase != "" {
+        attrs = append(attrs, slog.String("phase", phase))
+    }
+    if file == "" {
+        file = page
+    } else if page != "" && page != file {
+        attrs = append(attrs, slog.String("page", page))
+    }
+    if file != "" {
+        attrs = append(attrs, slog.String("file", filepath.ToSlash(file)))
+    }
+    if hash != "" {
+        attrs = append(attrs, slog.String("hash", hash))
+    }
+    l.json.LogAttrs(context.Background(), level, msg, attrs...)
+}
+
+// SetLogger 设置版本管理器的日志输出，为 nil 时恢复为标准输出上的文本日志
+func (vm *VersionManager) SetLogger(logger *Logger) {
+    if logger == nil {
+        logger = defaultLogger()
+    }
+    vm.logger = logger
+}
+
+// logf 通过版本管理器的日志输出一条日志
+func (vm *VersionManager) logf(format string, args ...interface{}) {
+    vm.logger.Printf(format, args...)
+}
+
+// logln 同 fmt.Println
+func (vm *VersionManager) logln(args ...interface{}) {
+    vm.logger.Println(args...)
+}
+
+// logEvent 输出一条带结构化字段的日志
+func (vm *VersionManager) logEvent(action, file, hash string, format string, args ...interface{}) {
+    vm.logger.event(action, file, hash, format, args...)
+}
+
+// NewVersionManager 创建使用真实文件系统的版本管理器
+func NewVersionManager(config Config, debugMode bool) *VersionManager {
+    return NewVersionManagerFS(config, debugMode, osFS{})
+}
+
+// NewVersionManagerFS 创建使用指定文件系统的版本管理器（用于测试或处理内存中的资源）
+func NewVersionManagerFS(config Config, debugMode bool, fsys FileSystem) *VersionManager {
+    setConfigDefaults(&config)
+    return &VersionManager{
+        config:         config,
+        versionMap:     make(map[string]string),
+        processedFiles: make(map[string]*processedResource),
+        resourceIndex:  make(map[string]*FileInfo),
+        moduleVisiting: make(map[string]bool),
+        debugMode:      debugMode,
+        dependencies:   make(map[string]map[string]bool),
+        ignoreRules:    loadIgnoreRules(fsys, filepath.Join(config.RootDir, ignoreFileName)),
+        hashedNameRes:  compileHashedNameRes(config),
+        hashCache:      make(map[string]string),
+        hashedOwners:   make(map[string]string),
+        fsys:           fsys,
+        caseInsensitive: detectCaseInsensitive(config, fsys),
+        customPatterns: compileCustomPatterns(config.CustomPatterns),
+        logger:         defaultLogger(),
+    }
+}
+
+// detectCaseInsensitive 判断 RootDir 所在的文件系统是否不区分大小写：配置了 CaseInsensitiveFS 时直接使用，
+// 否则检查大小写互换后的 RootDir 能否访问（路径中没有字母时按操作系统判断）
+func detectCaseInsensitive(config Config, fsys FileSystem) bool {
+    if config.CaseInsensitiveFS != nil {
+        return *config.CaseInsensitiveFS
+    }
+    
+    if absRoot, err := filepath.Abs(config.RootDir); err == nil {
+        swapped := strings.Map(func(r rune) rune {
+            if unicode.IsUpper(r) {
+                return unicode.ToLower(r)
+            }
+            return unicode.ToUpper(r)
+        }, absRoot)
+        if swapped != absRoot {
+            _, err := fsys.Stat(swapped)
+            return err == nil
+        }
+    }
+    return runtime.GOOS == "windows" || runtime.GOOS == "darwin"
+}
+
+// nameRegexp 编译匹配文件名的正则，文件系统不区分大小写时忽略大小写
+func (vm *VersionManager) nameRegexp(pattern string) *regexp.Regexp {
+    if vm.caseInsensitive {
+        pattern = `(?i)` + pattern
+    }
+    return regexp.MustCompile(pattern)
+}
+
+// pathKey 返回用于比较和索引的路径，文件系统不区分大小写时统一为小写
+func (vm *VersionManager) pathKey(filePath string) string {
+    if vm.caseInsensitive {
+        return strings.ToLower(filePath)
+    }
+    return filePath
+}
+
+// effectiveHashLength 返回扩展名实际使用的hash长度（与 calculateFileHash 的截断规则一致）
+// ext 不区分大小写、可带点；HashLengthByExt 中没有时使用 HashLength
+func effectiveHashLength(config Config, ext string) int {
+    length := config.HashLength
+    ext = strings.ToLower(strings.TrimPrefix(ext, "."))
+    for key, extLength := range config.HashLengthByExt {
+        if strings.ToLower(strings.TrimPrefix(key, ".")) == ext {
+            length = extLength
+            break
+        }
+    }
+    if length > 0 && length < md5.Size*2 {
+        return length
+    }
+    return md5.Size * 2
+}
+
+// hashPattern 返回匹配文件名中hash部分的正则片段（长度按扩展名确定）
+func (vm *VersionManager) hashPattern(ext string) string {
+    return fmt.Sprintf(`[a-f0-9]{%d}`, effectiveHashLength(vm.config, ext))
+}
+
+// defaultFilenameTemplate 默认的hash文件名模板（name.hash.ext）
+const defaultFilenameTemplate = "{name}.{hash}{ext}"
+
+// templatePlaceholderRe 匹配文件名模板中的占位符
+var templatePlaceholderRe = regexp.MustCompile(`\{(name|hash|ext)\}`)
+
+// filenameTemplate 返回配置的hash文件名模板，未设置时为默认模板
+func filenameTemplate(config Config) string {
+    if config.FilenameTemplate == "" {
+        return defaultFilenameTemplate
+    }
+    return config.FilenameTemplate
+}
+
+// validateFilenameTemplate 检查模板中 {name}、{hash}、{ext} 各出现一次且不含路径分隔符
+func validateFilenameTemplate(template string) error {
+    if strings.ContainsAny(template, `/\`) {
+        return fmt.Errorf("filenameTemplate 不能包含路径分隔符: %s", template)
+    }
+    for _, placeholder := range []string{"{name}", "{hash}", "{ext}"} {
+        if strings.Count(template, placeholder) != 1 {
+            return fmt.Errorf("filenameTemplate 必须包含且只包含一次 %s: %s", placeholder, template)
+        }
+    }
+    return nil
+}
+
+// expandFilenameTemplate 将模板中的占位符替换为 values 中对应的内容，模板中的其他字符经 literal 处理（生成正则时为 regexp.QuoteMeta）
+func expandFilenameTemplate(template string, literal func(string) string, values map[string]string) string {
+    var builder strings.Builder
+    last := 0
+    for _, loc := range templatePlaceholderRe.FindAllStringSubmatchIndex(template, -1) {
+        builder.WriteString(literal(template[last:loc[0]]))
+        builder.WriteString(values[template[loc[2]:loc[3]]])
+        last = loc[1]
+    }
+    builder.WriteString(literal(template[last:]))
+    return builder.String()
+}
+
+// hashedNamePattern 按文件名模板生成匹配hash文件名的正则片段，参数均为正则片段
+func (vm *VersionManager) hashedNamePattern(namePattern, hashPattern, extPattern string) string {
+    return expandFilenameTemplate(filenameTemplate(vm.config), regexp.QuoteMeta, map[string]string{
+        "name": namePattern,
+        "hash": hashPattern,
+        "ext":  extPattern,
+    })
+}
+
+// optionalHashPattern 返回同时匹配 name+ext 原始文件名和其hash文件名的正则片段
+func (vm *VersionManager) optionalHashPattern(name, ext string) string {
+    return `(?:` + vm.hashedNamePattern(regexp.QuoteMeta(name), vm.hashPattern(ext), regexp.QuoteMeta(ext)) + `|` + regexp.QuoteMeta(name+ext) + `)`
+}
+
+// compileHashedNameRes 按文件名模板生成匹配hash文件名的正则（分组 name、hash、ext），name 可以包含点（如 vendor.min）
+// hash长度相同的扩展名共用一个正则，按长度从小到大排列
+func compileHashedNameRes(config Config) []*regexp.Regexp {
+    extsByLength := make(map[int][]string)
+    for _, ext := range hashExtensionList(config) {
+        length := effectiveHashLength(config, ext)
+        extsByLength[length] = append(extsByLength[length], regexp.QuoteMeta(strings.TrimPrefix(ext, ".")))
+    }
+    
+    lengths := make([]int, 0, len(extsByLength))
+    for length := range extsByLength {
+        lengths = append(lengths, length)
+    }
+    sort.Ints(lengths)
+    
+    res := make([]*regexp.Regexp, 0, len(lengths))
+    for _, length := range lengths {
+        pattern := expandFilenameTemplate(filenameTemplate(config), regexp.QuoteMeta, map[string]string{
+            "name": `(?P<name>.+)`,
+            "hash": fmt.Sprintf(`(?P<hash>[a-f0-9]{%d})`, length),
+            "ext":  `(?P<ext>\.(?i:` + strings.Join(extsByLength[length], "|") + `))`,
+        })
+        res = append(res, regexp.MustCompile(`^`+pattern+`$`))
+    }
+    return res
+}
+
+// loadIgnoreRules 读取 gitignore 风格的忽略文件，文件不存在时返回空规则
+func loadIgnoreRules(fsys FileSystem, path string) []ignoreRule {
+    data, err := fsys.ReadFile(path)
+    if err != nil {
+        return nil
+    }
+    
+    var rules []ignoreRule
+    for _, line := range strings.Split(string(data), "\n") {
+        line = strings.TrimSpace(line)
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        
+        rule := ignoreRule{}
+        if strings.HasPrefix(line, "!") {
+            rule.negate = true
+            line = line[1:]
+        }
+        if strings.HasSuffix(line, "/") {
+            rule.dirOnly = true
+            line = strings.TrimRight(line, "/")
+        }
+        if strings.Contains(line, "/") {
+            rule.anchored = true
+            line = strings.TrimPrefix(line, "/")
+        }
+        rule.pattern = line
+        rules = append(rules, rule)
+    }
+    
+    return rules
+}
+
+// matchIgnore 判断相对 RootDir 的路径（正斜杠）是否被忽略规则命中，后面的规则优先
+func (vm *VersionManager) matchIgnore(relPath string, isDir bool) bool {
+    ignored := false
+    for _, rule := range vm.ignoreRules {
+        if rule.dirOnly && !isDir {
+            continue
+        }
+        
+        var matched bool
+        if rule.anchored {
+            matched = matchGlob(rule.pattern, relPath)
+        } else {
+            matched, _ = filepath.Match(rule.pattern, path.Base(relPath))
+        }
+        
+        if matched {
+            ignored = !rule.negate
+        }
+    }
+    return ignored
+}
+
+// errExcluded 文件被 ExcludeFiles 排除，不做处理
+var errExcluded = errors.New("已被 excludeFiles 排除")
+
+// isExcludedFile 判断文件是否匹配 ExcludeFiles 中的glob
+func (vm *VersionManager) isExcludedFile(filePath string) bool {
+    if len(vm.config.ExcludeFiles) == 0 {
+        return false
+    }
+    
+    rootDir, err := filepath.Abs(vm.config.RootDir)
+    if err != nil {
+        return false
+    }
+    absPath, err := filepath.Abs(filePath)
+    if err != nil || !isWithinDir(rootDir, absPath) {
+        return false
+    }
+    
+    relPath, _ := filepath.Rel(rootDir, absPath)
+    relPath = filepath.ToSlash(relPath)
+    for _, pattern := range vm.config.ExcludeFiles {
+        if matchGlob(strings.TrimPrefix(filepath.ToSlash(pattern), "./"), relPath) {
+            return true
+        }
+    }
+    return false
+}
+
+// errOutsideRoot 引用解析后位于 RootDir 之外，不做处理
+var errOutsideRoot = errors.New("引用超出 RootDir")
+
+// isOutsideRoot 判断清理后的路径是否越出了 RootDir（HTML 本身在 RootDir 之外时不检查）
+func (vm *VersionManager) isOutsideRoot(filePath string) bool {
+    if vm.guardRoot == "" {
+        return false
+    }
+    absPath, err := filepath.Abs(filePath)
+    if err != nil {
+        return true
+    }
+    return !isWithinDir(vm.guardRoot, absPath)
+}
+
+// skipExcluded 资源被 ExcludeFiles 排除或超出 RootDir 时输出提示并返回 true
+func (vm *VersionManager) skipExcluded(err error, name string) bool {
+    switch {
+    case errors.Is(err, errExcluded):
+        vm.logf("  ⏭️  已排除: %s\n", name)
+    case errors.Is(err, errOutsideRoot):
+        vm.logf("  ⚠️  跳过超出 RootDir 的引用: %s\n", name)
+    default:
+        return false
+    }
+    return true
+}
+
+// isIgnoredPath 判断文件是否被 .hashcdnignore 忽略（包括其所在目录被忽略的情况）
+func (vm *VersionManager) isIgnoredPath(filePath string) bool {
+    if len(vm.ignoreRules) == 0 {
+        return false
+    }
+    
+    rootDir, err := filepath.Abs(vm.config.RootDir)
+    if err != nil {
+        return false
+    }
+    absPath, err := filepath.Abs(filePath)
+    if err != nil || !isWithinDir(rootDir, absPath) {
+        return false
+    }
+    
+    relPath, _ := filepath.Rel(rootDir, absPath)
+    segments := strings.Split(filepath.ToSlash(relPath), "/")
+    for i := 1; i < len(segments); i++ {
+        if vm.matchIgnore(strings.Join(segments[:i], "/"), true) {
+            return true
+        }
+    }
+    
+    return vm.matchIgnore(strings.Join(segments, "/"), false)
+}
+
+// reportPath 将路径转换为相对 RootDir 的正斜杠路径，用于报告输出
+func (vm *VersionManager) reportPath(path string) string {
+    if relPath, err := filepath.Rel(vm.config.RootDir, path); err == nil {
+        return filepath.ToSlash(relPath)
+    }
+    return filepath.ToSlash(path)
+}
+
+// recordFile 在报告中记录一个文件的处理结果，并记入版本映射
+func (vm *VersionManager) recordFile(info *FileInfo, status string) {
+    var size int64
+    if stat, err := vm.fsys.Stat(info.HashedPath); err == nil {
+        size = stat.Size()
+    }
+    
+    vm.mu.Lock()
+    defer vm.mu.Unlock()
+    // 所有生成或复用的hash文件都记入版本映射（-prune 据此判断哪些hash文件仍在使用）
+    if key, ok := vm.versionKey(info.OriginalPath); ok {
+        vm.versionMap[key] = info.Hash
+        vm.writeJournal(journalEntry{Op: "file", Path: key, Hash: info.Hash})
+    }
+    vm.report.Files = append(vm.report.Files, FileReport{
+        OriginalPath: vm.reportPath(info.OriginalPath),
+        HashedPath:   vm.reportPath(info.HashedPath),
+        Hash:         info.Hash,
+        Bytes:        size,
+        Status:       status,
+    })
+    vm.report.ProcessedBytes += size
+    if status == statusSkipped {
+        vm.report.SkippedBytes += size
+    }
+}
+
+// printByteSummary 输出本次运行处理的资源总大小和因内容相同而跳过复制的大小
+func (vm *VersionManager) printByteSummary() {
+    vm.mu.Lock()
+    processed, skipped := vm.report.ProcessedBytes, vm.report.SkippedBytes
+    vm.mu.Unlock()
+    vm.logf("📊 共处理 %s，其中 %s 已存在相同内容、跳过复制\n", formatBytes(processed), formatBytes(skipped))
+}
+
+// formatBytes 将字节数格式化为 B、KB、MB 或 GB
+func formatBytes(n int64) string {
+    const unit = 1024
+    if n < unit {
+        return fmt.Sprintf("%d B", n)
+    }
+    value := float64(n) / unit
+    for _, suffix := range []string{"KB", "MB"} {
+        if value < unit {
+            return fmt.Sprintf("%.2f %s", value, suffix)
+        }
+        value /= unit
+    }
+    return fmt.Sprintf("%.2f GB", value)
+}
+
+// recordError 在报告中记录一个错误
+func (vm *VersionManager) recordError(format string, args ...interface{}) {
+    vm.mu.Lock()
+    defer vm.mu.Unlock()
+    vm.report.ErrorCount++
+    vm.report.Errors = append(vm.report.Errors, fmt.Sprintf(format, args...))
+}
+
+// saveReport 将运行结果报告以JSON格式写入指定路径
+func (vm *VersionManager) saveReport(reportPath string) {
+    vm.mu.Lock()
+    report := vm.report
+    vm.mu.Unlock()
+    
+    // 空列表输出为 [] 而不是 null，方便下游解析
+    if report.Files == nil {
+        report.Files = []FileReport{}
+    }
+    if report.Changed == nil {
+        report.Changed = []string{}
+    }
+    if report.Unchanged == nil {
+        report.Unchanged = []string{}
+    }
+    if report.Errors == nil {
+        report.Errors = []string{}
+    }
+    
+    data, err := json.MarshalIndent(report, "", "  ")
+    if err != nil {
+        vm.logf("⚠️  生成报告失败: %v\n", err)
+        return
+    }
+    
+    if err := vm.fsys.WriteFile(reportPath, data, 0644); err != nil {
+        vm.logf("⚠️  写入报告失败: %v\n", err)
+        return
+    }
+    
+    vm.logf("📊 报告已保存: %s\n", reportPath)
+}
+
+// recordDependency 记录当前HTML依赖的源文件（统一为无hash的绝对路径）
+func (vm *VersionManager) recordDependency(filePath string) {
+    cleanPath := filepath.Join(filepath.Dir(filePath), vm.removeHashFromFilename(filepath.Base(filePath)))
+    if absPath, err := filepath.Abs(cleanPath); err == nil {
+        cleanPath = absPath
+    }
+    
+    vm.mu.Lock()
+    defer vm.mu.Unlock()
+    if vm.currentDeps != nil {
+        vm.currentDeps[cleanPath] = true
+    }
+}
+
+// defaultComponentPathPatterns 未配置 ComponentPathPatterns 时使用的组件路径规则
+var defaultComponentPathPatterns = []string{"components"}
+
+// isComponentPath 判断HTML引用的 CSS/JS 是否位于组件目录下
+func (vm *VersionManager) isComponentPath(refPath, absPath string) bool {
+    patterns := vm.config.ComponentPathPatterns
+    if len(patterns) == 0 {
+        patterns = defaultComponentPathPatterns
+    }
+    
+    for _, pattern := range patterns {
+        pattern = strings.TrimPrefix(filepath.ToSlash(pattern), "./")
+        if !isGlobPattern(pattern) {
+            if strings.Contains(filepath.ToSlash(refPath), pattern) {
+                return true
+            }
+            continue
+        }
+        
+        rootDir, err := filepath.Abs(vm.config.RootDir)
+        if err != nil {
+            continue
+        }
+        fullPath, err := filepath.Abs(absPath)
+        if err != nil || !isWithinDir(rootDir, fullPath) {
+            continue
+        }
+        relPath, _ := filepath.Rel(rootDir, fullPath)
+        if matchGlob(pattern, filepath.ToSlash(relPath)) {
+            return true
+        }
+    }
+    return false
+}
+
+// shouldProcessComponent 检查是否应该处理指定组件
+func (vm *VersionManager) shouldProcessComponent(componentPath string) bool {
+    // 如果没有配置包含的组件列表，则处理所有组件
+    if len(vm.config.IncludeComponents) == 0 {
+        return true
+    }
+    
+    // 检查组件路径是否匹配任何指定的组件
+    for _, componentName := range vm.config.IncludeComponents {
+        // 检查路径中是否包含该组件名
+        if strings.Contains(componentPath, "/"+componentName+"/") || 
+           strings.Contains(componentPath, "\\"+componentName+"\\") ||
+           strings.HasSuffix(componentPath, "/"+componentName) ||
+           strings.HasSuffix(componentPath, "\\"+componentName) ||
+           strings.HasPrefix(filepath.Base(componentPath), componentName+".") {
+            return true
+        }
+    }
+    
+    return false
+}
+
+// hashCacheKey 返回文件在hash缓存中的键（绝对路径 + 大小 + 修改时间）
+func (vm *VersionManager) hashCacheKey(filePath string) (string, error) {
+    absPath, err := filepath.Abs(filePath)
+    if err != nil {
+        return "", err
+    }
+    stat, err := vm.fsys.Stat(absPath)
+    if err != nil {
+        return "", err
+    }
+    return fmt.Sprintf("%s|%d|%d", absPath, stat.Size(), stat.ModTime().UnixNano()), nil
+}
+
+// invalidateHash 清除文件在hash缓存中的所有记录（文件被重写后调用）
+func (vm *VersionManager) invalidateHash(filePath string) {
+    absPath, err := filepath.Abs(filePath)
+    if err != nil {
+        return
+    }
+    
+    vm.mu.Lock()
+    defer vm.mu.Unlock()
+    for key := range vm.hashCache {
+        if strings.HasPrefix(key, absPath+"|") {
+            delete(vm.hashCache, key)
+        }
+    }
+}
+
+// calculateFileHash 计算文件hash（同一次运行中文件未变化时直接返回缓存结果）
+func (vm *VersionManager) calculateFileHash(filePath string) (string, error) {
+    key, err := vm.hashCacheKey(filePath)
+    if err != nil {
+        return "", err
+    }
+    
+    vm.mu.Lock()
+    cached, ok := vm.hashCache[key]
+    vm.mu.Unlock()
+    if ok {
+        return cached, nil
+    }
+    
+    hashString, err := vm.computeFileHash(filePath)
+    if err != nil {
+        return "", err
+    }
+    hashString = vm.truncateHash(filePath, hashString)
+    
+    vm.mu.Lock()
+    vm.hashCache[key] = hashString
+    vm.mu.Unlock()
+    
+    return hashString, nil
+}
+
+// truncateHash 按文件扩展名对应的hash长度（HashLengthByExt / HashLength）截断完整的md5
+func (vm *VersionManager) truncateHash(filePath, hashString string) string {
+    if length := effectiveHashLength(vm.config, filepath.Ext(filePath)); length < len(hashString) {
+        return hashString[:length]
+    }
+    return hashString
+}
+
+// computeFileHash 读取文件并计算完整的md5
+func (vm *VersionManager) computeFileHash(filePath string) (string, error) {
+    if vm.normalizesHash(filePath) || vm.minifiesSVG(filePath) {
+        content, err := vm.fsys.ReadFile(filePath)
+        if err != nil {
+            return "", err
+        }
+        return vm.hashContent(filePath, content), nil
+    }
+    
+    file, err := vm.fsys.Open(filePath)
+    if err != nil {
+        return "", err
+    }
+    defer file.Close()
+
+    hash := md5.New()
+    if _, err := io.Copy(hash, file); err != nil {
+        return "", err
+    }
+
+    hashBytes := hash.Sum(nil)
+    return hex.EncodeToString(hashBytes), nil
+}
+
+// normalizedHashExts HashNormalized 时按折叠空白后的内容计算hash的扩展名
+var normalizedHashExts = map[string]bool{".css": true, ".js": true}
+
+// normalizesHash 判断文件是否按折叠空白后的内容计算hash
+func (vm *VersionManager) normalizesHash(filePath string) bool {
+    return vm.config.HashNormalized && normalizedHashExts[strings.ToLower(filepath.Ext(filePath))]
+}
+
+// hashContent 计算内容的完整md5，HashNormalized 时CSS/JS先把连续空白折叠为一个空格并去掉首尾空白
+func (vm *VersionManager) hashContent(filePath string, content []byte) string {
+    if vm.normalizesHash(filePath) {
+        content = bytes.Join(bytes.Fields(content), []byte(" "))
+    }
+    if vm.minifiesSVG(filePath) {
+        content = minifySVG(content)
+    }
+    sum := md5.Sum(content)
+    return hex.EncodeToString(sum[:])
+}
+
+// minifiesSVG 判断hash副本是否写入压缩后的SVG（query 模式不生成副本，引用的仍是原文件，不压缩）
+func (vm *VersionManager) minifiesSVG(filePath string) bool {
+    return vm.config.MinifySVG && !vm.queryMode() && strings.EqualFold(filepath.Ext(filePath), ".svg")
+}
+
+var (
+    // svgCommentRe 匹配注释，CDATA 整段匹配以便原样保留其中的内容
+    svgCommentRe = regexp.MustCompile(`<!\[CDATA\[[\s\S]*?\]\]>|<!--[\s\S]*?-->`)
+    // svgBetweenTagsRe 匹配标签之间只有空白的部分（缩进、换行）
+    svgBetweenTagsRe = regexp.MustCompile(`>\s+<`)
+    // svgDeclarationRe 匹配 XML 声明、DOCTYPE 之后的空白
+    svgDeclarationRe = regexp.MustCompile(`(<\?xml[^>]*\?>|<!DOCTYPE[^>]*>)\s+`)
+    // svgDefaultAttrRe 匹配取值为默认值且不会被子元素继承的属性，去掉后渲染结果不变
+    svgDefaultAttrRe = regexp.MustCompile(`\s+(?:opacity=(?:"1"|'1')|preserveAspectRatio=(?:"xMidYMid meet"|'xMidYMid meet'))`)
+)
+
+// minifySVG 压缩SVG内容：去掉注释、XML 声明后和标签之间的空白，以及默认属性
+// 含 <text> 或 xml:space 的SVG中标签间空白会影响文字排版，保留不动
+func minifySVG(content []byte) []byte {
+    content = svgCommentRe.ReplaceAllFunc(content, func(match []byte) []byte {
+        if bytes.HasPrefix(match, []byte("<![CDATA[")) {
+            return match
+        }
+        return nil
+    })
+    content = svgDeclarationRe.ReplaceAll(content, []byte("$1"))
+    if !bytes.Contains(content, []byte("<text")) && !bytes.Contains(content, []byte("xml:space")) {
+        content = svgBetweenTagsRe.ReplaceAll(content, []byte("><"))
+    }
+    content = svgDefaultAttrRe.ReplaceAll(content, nil)
+    return bytes.TrimSpace(content)
+}
+
+// precompress 按 Precompress 配置为hash文件写入 .gz / .br 副本（已是压缩格式的文件跳过）
+// force 为 false 时只补写缺失的副本
+func (vm *VersionManager) precompress(hashedPath string, force bool) {
+    if len(vm.config.Precompress) == 0 || precompressSkipExts[strings.ToLower(filepath.Ext(hashedPath))] {
+        return
+    }
+    
+    for _, format := range vm.config.Precompress {
+        suffix, ok := precompressFormats[format]
+        if !ok {
+            if vm.debugMode {
+                vm.logf("  ⚠️  未知的预压缩格式: %s\n", format)
+            }
+            continue
+        }
+        
+        compressedPath := hashedPath + suffix
+        if !force && vm.fileExists(compressedPath) {
+            continue
+        }
+        
+        if err := vm.compressFile(hashedPath, compressedPath, format); err != nil {
+            vm.logf("  ⚠️  预压缩失败: %s (%v)\n", filepath.Base(compressedPath), err)
+            vm.recordError("%s: %v", compressedPath, err)
+            continue
+        }
+        if vm.debugMode {
+            vm.logEvent("compress", compressedPath, "", "  🗜️  已压缩: %s\n", filepath.Base(compressedPath))
+        }
+    }
+}
+
+// compressFile 将文件以 gzip 或 brotli 格式压缩写入 dst
+func (vm *VersionManager) compressFile(src, dst, format string) error {
+    data, err := vm.fsys.ReadFile(src)
+    if err != nil {
+        return err
+    }
+    
+    var buf bytes.Buffer
+    var writer io.WriteCloser
+    if format == "brotli" {
+        writer = brotli.NewWriterLevel(&buf, brotli.BestCompression)
+    } else {
+        writer, err = gzip.NewWriterLevel(&buf, gzip.BestCompression)
+        if err != nil {
+            return err
+        }
+    }
+    if _, err := writer.Write(data); err != nil {
+        writer.Close()
+        return err
+    }
+    if err := writer.Close(); err != nil {
+        return err
+    }
+    
+    return vm.fsys.WriteFile(dst, buf.Bytes(), 0644)
+}
+
+// trashDirPath 返回回收目录的路径，未设置 TrashDir 时返回空字符串
+func (vm *VersionManager) trashDirPath() string {
+    if vm.config.TrashDir == "" {
+        return ""
+    }
+    if filepath.IsAbs(vm.config.TrashDir) {
+        return filepath.Clean(vm.config.TrashDir)
+    }
+    return filepath.Join(vm.config.RootDir, vm.config.TrashDir)
+}
+
+// isTrashDir 判断目录是否为回收目录（扫描和监听时跳过）
+func (vm *VersionManager) isTrashDir(dir string) bool {
+    trashDir := vm.trashDirPath()
+    if trashDir == "" {
+        return false
+    }
+    absDir, err := filepath.Abs(dir)
+    if err != nil {
+        return false
+    }
+    absTrash, err := filepath.Abs(trashDir)
+    if err != nil {
+        return false
+    }
+    return vm.pathKey(absDir) == vm.pathKey(absTrash)
+}
+
+// removeFile 删除文件；设置了 TrashDir 时改为移动到回收目录，保留相对 RootDir 的目录结构，误删后可以恢复
+func (vm *VersionManager) removeFile(filePath string) error {
+    trashDir := vm.trashDirPath()
+    if trashDir == "" {
+        return vm.fsys.Remove(filePath)
+    }
+    if _, err := vm.fsys.Stat(filePath); err != nil {
+        return err
+    }
+    
+    relPath := filepath.Base(filePath)
+    absRoot, rootErr := filepath.Abs(vm.config.RootDir)
+    absPath, pathErr := filepath.Abs(filePath)
+    if rootErr == nil && pathErr == nil {
+        // RootDir 之外的文件（如绝对路径的版本映射文件）只保留文件名
+        if rel, err := filepath.Rel(absRoot, absPath); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+            relPath = rel
+        }
+    }
+    
+    trashPath := filepath.Join(trashDir, relPath)
+    if err := vm.fsys.MkdirAll(filepath.Dir(trashPath), 0755); err != nil {
+        return err
+    }
+    if err := vm.fsys.Rename(filePath, trashPath); err == nil {
+        return nil
+    }
+    
+    // 回收目录与文件不在同一设备等无法重命名的情况，先复制再删除
+    if err := vm.copyFile(filePath, trashPath); err != nil {
+        return err
+    }
+    return vm.fsys.Remove(filePath)
+}
+
+// removePrecompressed 删除hash文件对应的预压缩副本
+func (vm *VersionManager) removePrecompressed(hashedPath string) {
+    for _, suffix := range precompressFormats {
+        vm.removeFile(hashedPath + suffix)
+    }
+}
+
+// calculateSRI 计算文件的SRI摘要（sha384，base64编码）
+func (vm *VersionManager) calculateSRI(filePath string) (string, error) {
+    data, err := vm.fsys.ReadFile(filePath)
+    if err != nil {
+        return "", err
+    }
+    
+    sum := sha512.Sum384(data)
+    return "sha384-" + base64.StdEncoding.EncodeToString(sum[:]), nil
+}
+
+// sriAttrRe 匹配标签中已有的 integrity / crossorigin 属性
+var sriAttrRe = regexp.MustCompile(`\s+(?:integrity|crossorigin)(?:\s*=\s*(?:"[^"]*"|'[^']*'|[^\s>]+))?`)
+
+// setSRIAttributes 为标签设置 integrity 和 crossorigin 属性，已存在的属性会被替换
+func setSRIAttributes(tag, integrity string) string {
+    tag = sriAttrRe.ReplaceAllString(tag, "")
+    
+    body := strings.TrimSuffix(tag, ">")
+    closing := ">"
+    if strings.HasSuffix(body, "/") {
+        body = strings.TrimRight(strings.TrimSuffix(body, "/"), " \t\r\n")
+        closing = " />"
+    }
+    
+    return fmt.Sprintf(`%s integrity="%s" crossorigin="anonymous"%s`, body, integrity, closing)
+}
+
+// removeHashFromFilename 从文件名中移除hash
+func (vm *VersionManager) removeHashFromFilename(filename string) string {
+    // 按文件名模板匹配，默认格式: filename.hash.ext（filename 中的点会保留，如 vendor.min.abcd1234.js -> vendor.min.js）
+    if cleanFilename, _, ok := vm.splitHashedFilename(filename); ok {
+        return cleanFilename
+    }
+    
+    return filename
+}
+
+// splitHashedFilename 将hash文件名拆分为原始文件名和hash，不是hash文件名时 ok 为 false
+func (vm *VersionManager) splitHashedFilename(filename string) (cleanFilename, hash string, ok bool) {
+    for _, re := range vm.hashedNameRes {
+        if matches := re.FindStringSubmatch(filename); matches != nil {
+            return matches[re.SubexpIndex("name")] + matches[re.SubexpIndex("ext")], matches[re.SubexpIndex("hash")], true
+        }
+    }
+    return "", "", false
+}
+
+// queryMode 是否使用 ?v=hash 查询参数的版本化方式
+func (vm *VersionManager) queryMode() bool {
+    return vm.config.Mode == modeQuery
+}
+
+// addHashToFilename 给文件名添加hash（query 模式下返回 name.ext?v=hash 形式的引用名）
+func (vm *VersionManager) addHashToFilename(filename, hash string) string {
+    // 移除可能存在的旧hash（只识别 HashExtensions 中的扩展名，避免误删普通的名称片段）
+    cleanFilename := vm.removeHashFromFilename(filename)
+    if vm.queryMode() {
+        return cleanFilename + "?v=" + hash
+    }
+    ext := filepath.Ext(cleanFilename)
+    basename := strings.TrimSuffix(cleanFilename, ext)
+    
+    return expandFilenameTemplate(filenameTemplate(vm.config), func(literal string) string { return literal }, map[string]string{
+        "name": basename,
+        "hash": hash,
+        "ext":  ext,
+    })
+}
+
+// findAndDeleteOldHashFiles 查找并删除旧的hash文件
+func (vm *VersionManager) findAndDeleteOldHashFiles(dir, basename, ext, currentHash string) error {
+    if vm.debugMode {
+        vm.logf("  🔍 查找旧hash文件: %s%s (当前hash: %s)\n", basename, ext, currentHash)
+    }
+    
+    re := vm.nameRegexp(`^` + vm.hashedNamePattern(regexp.QuoteMeta(basename), `(`+vm.hashPattern(ext)+`)`, regexp.QuoteMeta(ext)) + `$`)
+    
+    files, err := vm.fsys.ReadDir(dir)
+    if err != nil {
+        return err
+    }
+    
+    // 收集所有非当前hash的旧文件
+    var oldFiles []os.FileInfo
+    for _, file := range files {
+        if !file.IsDir() {
+            filename := file.Name()
+            
+            if re.MatchString(filename) {
+                hashMatches := re.FindStringSubmatch(filename)
+                
+                if len(hashMatches) >= 2 {
+                    extractedHash := hashMatches[1]
+                    
+                    if extractedHash != currentHash {
+                        info, err := file.Info()
+                        if err != nil {
+                            continue
+                        }
+                        oldFiles = append(oldFiles, info)
+                    }
+                }
+            }
+        }
+    }
+    
+    // 按修改时间从新到旧排序，保留最近的 KeepOldVersions 个
+    sort.Slice(oldFiles, func(i, j int) bool {
+        return oldFiles[i].ModTime().After(oldFiles[j].ModTime())
+    })
+    if keep := vm.config.KeepOldVersions; keep > 0 {
+        if keep >= len(oldFiles) {
+            oldFiles = nil
+        } else {
+            oldFiles = oldFiles[keep:]
+        }
+    }
+    
+    var deletedCount int
+    for _, info := range oldFiles {
+        filename := info.Name()
+        oldFilePath := filepath.Join(dir, filename)
+        // 上次未完成的运行中已删除（如移入回收目录后未能删除原文件）的不再重复删除
+        deleteKey, inRoot := vm.versionKey(oldFilePath)
+        if inRoot && vm.journal != nil && vm.journal.deleted[deleteKey] {
+            continue
+        }
+        if err := vm.removeFile(oldFilePath); err != nil {
+            vm.logf("    ⚠️  删除失败: %s\n", filename)
+        } else {
+            vm.logEvent("delete", oldFilePath, "", "    🗑️  已删除: %s\n", filename)
+            vm.removePrecompressed(oldFilePath)
+            deletedCount++
+            vm.mu.Lock()
+            vm.report.DeletedCount++
+            if inRoot {
+                vm.writeJournal(journalEntry{Op: "delete", Path: deleteKey})
+            }
+            vm.mu.Unlock()
+        }
+    }
+    
+    if vm.debugMode && deletedCount > 0 {
+        vm.logf("  ✅ 共删除 %d 个旧文件\n", deletedCount)
+    }
+    
+    return nil
+}
+
+// errHashCollision 不同内容的文件得到了相同的hash文件名（HashLength 过短时可能发生）
+var errHashCollision = errors.New("hash冲突")
+
+// errCopyVerify 写入的hash文件重新计算的hash与源文件不一致（磁盘错误、写入不完整等）
+var errCopyVerify = errors.New("hash文件校验失败")
+
+// verifyHashedCopy 重新计算刚写入的hash文件的hash并与源文件的hash比较，不一致时删除损坏的文件并返回 errCopyVerify
+func (vm *VersionManager) verifyHashedCopy(hashedPath, expectedHash string) error {
+    actualHash, err := vm.calculateFileHash(hashedPath)
+    if err == nil && actualHash == expectedHash {
+        return nil
+    }
+    
+    vm.fsys.Remove(hashedPath)
+    vm.invalidateHash(hashedPath)
+    if err != nil {
+        return fmt.Errorf("%w: %s (%v)", errCopyVerify, filepath.Base(hashedPath), err)
+    }
+    return fmt.Errorf("%w: %s 的hash为 %s，应为 %s", errCopyVerify, filepath.Base(hashedPath), actualHash, expectedHash)
+}
+
+// claimHashedPath 登记hash文件由哪个源文件生成；同一次运行中另一个内容不同的源文件要写入同一路径时返回 errHashCollision
+func (vm *VersionManager) claimHashedPath(hashedPath, sourcePath string) error {
+    absHashed, err := filepath.Abs(hashedPath)
+    if err != nil {
+        return nil
+    }
+    absSource, err := filepath.Abs(sourcePath)
+    if err != nil {
+        return nil
+    }
+    
+    vm.mu.Lock()
+    owner, ok := vm.hashedOwners[vm.pathKey(absHashed)]
+    if !ok {
+        vm.hashedOwners[vm.pathKey(absHashed)] = absSource
+    }
+    vm.mu.Unlock()
+    
+    if !ok || vm.pathKey(owner) == vm.pathKey(absSource) {
+        return nil
+    }
+    if same, err := vm.sameFullHash(owner, absSource); err == nil && same {
+        return nil
+    }
+    return fmt.Errorf("%w: %s 与 %s 内容不同，但都生成了 %s（可增大 hashLength）",
+        errHashCollision, vm.reportPath(owner), vm.reportPath(absSource), filepath.Base(hashedPath))
+}
+
+// sameFullHash 比较两个文件的完整md5
+func (vm *VersionManager) sameFullHash(pathA, pathB string) (bool, error) {
+    hashA, err := vm.computeFileHash(pathA)
+    if err != nil {
+        return false, err
+    }
+    hashB, err := vm.computeFileHash(pathB)
+    if err != nil {
+        return false, err
+    }
+    return hashA == hashB, nil
+}
+
+// renameFileWithHash 重命名文件（如果hash改变）
+func (vm *VersionManager) renameFileWithHash(filePath string) (*FileInfo, error) {
+    dir := filepath.Dir(filePath)
+    filename := filepath.Base(filePath)
+    cleanFilename := vm.removeHashFromFilename(filename)
+    
+    // 确定源文件路径（优先使用无hash的原始文件）
+    cleanPath := filepath.Join(dir, cleanFilename)
+    sourcePath := filePath
+    if vm.fileExists(cleanPath) {
+        sourcePath = cleanPath
+    }
+    
+    if vm.isExcludedFile(sourcePath) {
+        return nil, errExcluded
+    }
+    
+    // ES模块需要先处理其中 import 的模块，hash 基于改写后的内容
+    if vm.rewritesModuleImports(sourcePath) {
+        return vm.processModuleJS(sourcePath)
+    }
+    
+    vm.recordDependency(sourcePath)
+    
+    // 计算hash（基于源文件）
+    hash, err := vm.calculateFileHash(sourcePath)
+    if err != nil {
+        return nil, err
+    }
+    
+    newFilename := vm.addHashToFilename(cleanFilename, hash)
+    newPath := filepath.Join(dir, newFilename)
+    
+    info := &FileInfo{
+        OriginalPath: sourcePath,
+        HashedPath:   newPath,
+        Hash:         hash,
+        Renamed:      true,
+    }
+    
+    // query 模式不生成副本，只在引用中使用 ?v=hash
+    if vm.queryMode() {
+        vm.recordFile(info, statusVersioned)
+        return info, nil
+    }
+    
+    if err := vm.claimHashedPath(newPath, sourcePath); err != nil {
+        return nil, err
+    }
+    
+    if vm.reuseHashed(sourcePath, hash, newPath) {
+        vm.precompress(newPath, false)
+        vm.recordFile(info, statusSkipped)
+        return info, nil
+    }
+    
+    // 检查目标文件是否已存在且内容相同（ForceRegen 时总是重新复制）
+    if vm.fileExists(newPath) && !vm.config.ForceRegen {
+        existingHash, err := vm.calculateFileHash(newPath)
+        if err == nil && existingHash == hash {
+            // 截断的hash相同但完整内容不同：已存在的文件不是这个源文件的副本，不能覆盖
+            if effectiveHashLength(vm.config, filepath.Ext(sourcePath)) < md5.Size*2 {
+                if same, err := vm.sameFullHash(sourcePath, newPath); err == nil && !same {
+                    return nil, fmt.Errorf("%w: 已存在的 %s 与 %s 内容不同（可增大 hashLength）", errHashCollision, newFilename, filepath.Base(sourcePath))
+                }
+            }
+            if vm.debugMode {
+                vm.logEvent("skip", newPath, hash, "  ⏭️  跳过（已存在）: %s\n", newFilename)
+            }
+            vm.precompress(newPath, false)
+            vm.recordFile(info, statusSkipped)
+            return info, nil
+        }
+        vm.removeFile(newPath)
+    }
+    
+    // 复制源文件到新路径（MinifySVG 时写入压缩后的内容）
+    if vm.minifiesSVG(sourcePath) {
+        err = vm.writeMinifiedSVG(sourcePath, newPath)
+    } else {
+        err = vm.copyFile(sourcePath, newPath)
+    }
+    if err == nil && vm.config.ForceRegen {
+        // 复制时保留了源文件的修改时间，强制重新生成时改为当前时间，便于确认文件确实已重新写入
+        now := time.Now()
+        err = vm.fsys.Chtimes(newPath, now, now)
+    }
+    vm.invalidateHash(newPath)
+    if err != nil {
+        return nil, fmt.Errorf("复制文件失败: %v", err)
+    }
+    if err := vm.verifyHashedCopy(newPath, hash); err != nil {
+        return nil, err
+    }
+    
+    vm.logEvent("generate", newPath, hash, "  ✅ 已生成: %s\n", newFilename)
+    vm.precompress(newPath, true)
+    vm.recordFile(info, statusGenerated)
+    
+    // 删除旧的hash文件
+    ext := filepath.Ext(cleanFilename)
+    basename := strings.TrimSuffix(cleanFilename, ext)
+    if err := vm.findAndDeleteOldHashFiles(dir, basename, ext, hash); err != nil {
+        if vm.debugMode {
+            vm.logf("  ⚠️  清理旧文件时出错: %v\n", err)
+        }
+    }
+    
+    return info, nil
+}
+
+// collectImagesFromCSS 收集CSS中引用的所有图片
+func (vm *VersionManager) collectImagesFromCSS(cssPath string) ([]ImageReference, error) {
+    content, err := vm.fsys.ReadFile(cssPath)
+    if err != nil {
+        return nil, err
+    }
+    
+    // CSS文件中自定义模式匹配到的引用同样作为图片处理
+    refs := append(cssURLRefs(string(content)), vm.customRefs(string(content))...)
+    return vm.cssImageReferences(refs, filepath.Dir(cssPath)), nil
+}
+
+// collectImagesFromCSSContent 收集CSS文本中引用的图片，相对路径基于 cssDir 解析
+func (vm *VersionManager) collectImagesFromCSSContent(content, cssDir string) []ImageReference {
+    return vm.cssImageReferences(cssURLRefs(content), cssDir)
+}
+
+// cssURLRe 匹配 url() 中的路径
+var cssURLRe = regexp.MustCompile(`url\(['"]?([^'")\s]+)['"]?\)`)
+
+// cssURLRefs 返回CSS文本中 url() 引用的路径
+func cssURLRefs(content string) []string {
+    var refs []string
+    for _, match := range cssURLRe.FindAllStringSubmatch(content, -1) {
+        refs = append(refs, match[1])
+    }
+    return refs
+}
+
+// cssImageReferences 将CSS中的引用解析为存在的本地文件（跳过远程地址、超出 RootDir 和重复的引用）
+func (vm *VersionManager) cssImageReferences(refs []string, cssDir string) []ImageReference {
+    var images []ImageReference
+    seen := make(map[string]bool)
+    
+    for _, imagePath := range refs {
+        
+        // 跳过绝对URL和data URI
+        if isExternalOrSpecial(imagePath) {
+            continue
+        }
+        
+        // 移除查询字符串和hash
+        imagePath = strings.Split(imagePath, "?")[0]
+        imagePath = strings.Split(imagePath, "#")[0]
+        
+        // 规范化写法：反斜杠转为正斜杠，去掉开头的 ./（同一文件的不同写法只处理一次）
+        imagePath = strings.ReplaceAll(imagePath, "\\", "/")
+        for strings.HasPrefix(imagePath, "./") {
+            imagePath = strings.TrimPrefix(imagePath, "./")
+        }
+        
+        // 计算绝对路径
+        absolutePath := vm.resolveRef(cssDir, imagePath)
+        
+        if vm.isOutsideRoot(absolutePath) {
+            vm.logf("    ⚠️  跳过超出 RootDir 的引用: %s\n", imagePath)
+            continue
+        }
+        
+        if vm.isIgnoredPath(absolutePath) {
+            continue
+        }
+        
+        if seen[absolutePath] {
+            continue
+        }
+        
+        if vm.fileExists(absolutePath) {
+            seen[absolutePath] = true
+            relativePath, _ := filepath.Rel(cssDir, absolutePath)
+            images = append(images, ImageReference{
+                OriginalPath: imagePath,
+                AbsolutePath: absolutePath,
+                RelativePath: relativePath,
+            })
+        }
+    }
+    
+    return images
+}
+
+// updateCSSImageReferences 更新CSS文件中的图片引用 - 只更新指定的CSS文件
+func (vm *VersionManager) updateCSSImageReferences(cssPath string, imageMap map[string]string) error {
+    content, err := vm.fsys.ReadFile(cssPath)
+    if err != nil {
+        return err
+    }
+    
+    bom, content := splitBOM(content)
+    contentStr, updated := vm.replaceCSSImageURLs(string(content), filepath.Dir(cssPath), imageMap)
+    contentStr, customUpdated := vm.replaceCustomCSSRefs(contentStr, filepath.Dir(cssPath), imageMap)
+    
+    if updated || customUpdated {
+        vm.printDiff(cssPath, string(content), contentStr)
+        return vm.writeFile(cssPath, append(bom, contentStr...))
+    }
+    
+    return nil
+}
+
+// replaceCSSImageURLs 将CSS文本中 url() 引用的图片替换为hash后的文件名
+// baseDir 为CSS中相对路径的基准目录（CSS文件所在目录，内联样式为HTML所在目录）
+func (vm *VersionManager) replaceCSSImageURLs(contentStr, baseDir string, imageMap map[string]string) (string, bool) {
+    updated := false
+    
+    // 按路径排序遍历，重叠的引用每次运行都按相同顺序替换，输出和日志可重现
+    for _, originalPath := range sortedKeys(imageMap) {
+        newFilename := imageMap[originalPath]
+        oldFilename := filepath.Base(originalPath)
+        cleanOldFilename := vm.removeHashFromFilename(oldFilename)
+        
+        // 同时匹配原始文件名和已带hash的文件名
+        ext := filepath.Ext(cleanOldFilename)
+        namePattern := vm.optionalHashPattern(strings.TrimSuffix(cleanOldFilename, ext), ext)
+        
+        // 引号和空白原样保留（分组1、4），只替换路径和文件名部分，保留 ?query 和 #fragment（如 SVG sprite 的 #home）
+        pattern := fmt.Sprintf(`(url\(\s*['"]?\s*)([^'")\s]*[/\\])?%s([?#][^'")\s]*)?(\s*['"]?\s*\))`, namePattern)
+        re := regexp.MustCompile(pattern)
+        
+        newContent := re.ReplaceAllStringFunc(contentStr, func(match string) string {
+            submatches := re.FindStringSubmatch(match)
+            opening := submatches[1]
+            pathPrefix := submatches[2]
+            urlSuffix := submatches[3]
+            closing := submatches[4]
+            
+            newURL := pathPrefix + newFilename
+            hashedPath := filepath.Join(filepath.Dir(vm.resolveRef(baseDir, originalPath)), newFilename)
+            baseRef, hasBase := vm.basePathRef(hashedPath)
+            if hasBase {
+                newURL = baseRef
+            }
+            // 图片匹配 CDNRules 时改为CDN地址：CDN域名 + 相对 RootDir 的路径（query 模式直接修改原CSS，不添加）
+            if rootRel, err := relPathBetween(vm.config.RootDir, hashedPath); err == nil && !vm.queryMode() {
+                if domain := vm.cdnRuleDomain(rootRel); domain != "" {
+                    cdnPath := filepath.ToSlash(rootRel)
+                    if hasBase {
+                        cdnPath = baseRef
+                    }
+                    newURL = joinCDNPath(domain, cdnPath)
+                    vm.recordCDNRef(newURL, pathPrefix+cleanOldFilename)
+                }
+            }
+            result := opening + vm.joinURLSuffix(newURL, urlSuffix) + closing
+            
+            if match != result {
+                updated = true
+                vm.logf("    🔄 %s -> %s\n", cleanOldFilename, newFilename)
+            }
+            return result
+        })
+        
+        contentStr = newContent
+    }
+    
+    return contentStr, updated
+}
+
+// compileCustomPatterns 编译 CustomPatterns，无效的模式跳过（由 validateConfig 报告）
+func compileCustomPatterns(patterns []CustomPattern) []customPattern {
+    var compiled []customPattern
+    for _, pattern := range patterns {
+        re, err := regexp.Compile(pattern.Regex)
+        if err != nil {
+            continue
+        }
+        group := pattern.Group
+        if group == 0 {
+            group = 1
+        }
+        if group > re.NumSubexp() {
+            continue
+        }
+        compiled = append(compiled, customPattern{re: re, group: group})
+    }
+    return compiled
+}
+
+// forEachCustomRef 依次用每个自定义模式匹配文本，replace 返回分组内容的替换值（分组之外的文本原样保留）
+func (vm *VersionManager) forEachCustomRef(content string, replace func(ref string) string) string {
+    for _, pattern := range vm.customPatterns {
+        var builder strings.Builder
+        last := 0
+        for _, loc := range pattern.re.FindAllStringSubmatchIndex(content, -1) {
+            start, end := loc[2*pattern.group], loc[2*pattern.group+1]
+            if start < 0 {
+                continue
+            }
+            builder.WriteString(content[last:start])
+            builder.WriteString(replace(content[start:end]))
+            last = end
+        }
+        builder.WriteString(content[last:])
+        content = builder.String()
+    }
+    return content
+}
+
+// customRefs 返回文本中自定义模式匹配到的引用
+func (vm *VersionManager) customRefs(content string) []string {
+    var refs []string
+    vm.forEachCustomRef(content, func(ref string) string {
+        refs = append(refs, ref)
+        return ref
+    })
+    return refs
+}
+
+// replaceCustomCSSRefs 将CSS文本中自定义模式匹配到的图片替换为hash后的文件名（imageMap 同 replaceCSSImageURLs）
+func (vm *VersionManager) replaceCustomCSSRefs(contentStr, baseDir string, imageMap map[string]string) (string, bool) {
+    updated := false
+    newContent := vm.forEachCustomRef(contentStr, func(ref string) string {
+        refPath, suffix := splitURLSuffix(ref)
+        key := strings.ReplaceAll(refPath, "\\", "/")
+        for strings.HasPrefix(key, "./") {
+            key = strings.TrimPrefix(key, "./")
+        }
+        newFilename, ok := imageMap[key]
+        if !ok {
+            return ref
+        }
+        
+        newRef := refPath[:strings.LastIndexAny(refPath, "/\\")+1] + newFilename
+        if baseRef, ok := vm.basePathRef(filepath.Join(filepath.Dir(vm.resolveRef(baseDir, key)), newFilename)); ok {
+            newRef = baseRef
+        }
+        newRef = vm.joinURLSuffix(newRef, suffix)
+        if newRef != ref {
+            updated = true
+            vm.logf("    🔄 %s -> %s\n", filepath.Base(refPath), newFilename)
+        }
+        return newRef
+    })
+    return newContent, updated
+}
+
+// collectCustomRefs 收集HTML中自定义模式匹配到的本地资源
+func (vm *VersionManager) collectCustomRefs(htmlPath string) ([]string, error) {
+    if len(vm.customPatterns) == 0 {
+        return nil, nil
+    }
+    content, err := vm.readHTMLSource(htmlPath)
+    if err != nil {
+        return nil, err
+    }
+    
+    htmlDir := filepath.Dir(htmlPath)
+    var refs []string
+    for _, ref := range vm.customRefs(string(content)) {
+        if _, isCDN := vm.stripCDNPrefix(ref); isExternalOrSpecial(ref) && !isCDN {
+            continue
+        }
+        refs = append(refs, vm.localFileRef(htmlDir, ref))
+    }
+    
+    return refs, nil
+}
+
+// updateCustomReferences 改写HTML中自定义模式匹配到的已hash资源
+func (vm *VersionManager) updateCustomReferences(contentStr string, assetMap map[string]string) (string, bool) {
+    updated := false
+    newContent := vm.forEachCustomRef(contentStr, func(ref string) string {
+        if _, isCDN := vm.stripCDNPrefix(ref); isExternalOrSpecial(ref) && !isCDN {
+            return ref
+        }
+        assetPath, suffix := splitURLSuffix(vm.localAssetRef(ref, assetMap))
+        key := strings.TrimPrefix(filepath.ToSlash(assetPath), "./")
+        newHashedPath, ok := assetMap[key]
+        if !ok {
+            return ref
+        }
+        
+        newRef := vm.joinURLSuffix(vm.buildReferencePath(key, assetPath, newHashedPath), suffix)
+        if newRef != ref {
+            updated = true
+            vm.logf("  ✅ CUSTOM: %s -> %s\n", filepath.Base(assetPath), filepath.Base(newRef))
+        }
+        return newRef
+    })
+    return newContent, updated
+}
+
+// scriptBlockRe 匹配 <script> 块，处理内联样式时跳过其中的内容
+var scriptBlockRe = regexp.MustCompile(`(?is)<script\b[^>]*>.*?</script\s*>`)
+
+// styleAttrRe 匹配 style 属性
+var styleAttrRe = regexp.MustCompile(`(?i)(\sstyle\s*=\s*)("[^"]*"|'[^']*')`)
+
+// styleBlockRe 匹配 <style> 块
+var styleBlockRe = regexp.MustCompile(`(?is)(<style\b[^>]*>)(.*?)(</style\s*>)`)
+
+// replaceOutsideScripts 仅对 <script> 块之外的HTML内容应用 replace
+func replaceOutsideScripts(content string, replace func(string) string) string {
+    var builder strings.Builder
+    last := 0
+    for _, loc := range scriptBlockRe.FindAllStringIndex(content, -1) {
+        builder.WriteString(replace(content[last:loc[0]]))
+        builder.WriteString(content[loc[0]:loc[1]])
+        last = loc[1]
+    }
+    builder.WriteString(replace(content[last:]))
+    return builder.String()
+}
+
+// replaceInlineStyles 对HTML中的 style 属性和 <style> 块内的CSS文本应用 replace（跳过 <script> 块）
+func replaceInlineStyles(content string, replace func(css string) string) string {
+    return replaceOutsideScripts(content, func(segment string) string {
+        segment = styleAttrRe.ReplaceAllStringFunc(segment, func(match string) string {
+            submatches := styleAttrRe.FindStringSubmatch(match)
+            value := submatches[2]
+            quote := value[:1]
+            return submatches[1] + quote + replace(value[1:len(value)-1]) + quote
+        })
+        return styleBlockRe.ReplaceAllStringFunc(segment, func(match string) string {
+            submatches := styleBlockRe.FindStringSubmatch(match)
+            return submatches[1] + replace(submatches[2]) + submatches[3]
+        })
+    })
+}
+
+// collectInlineStyleImages 收集HTML内联样式（style属性和<style>块）中引用的图片
+func (vm *VersionManager) collectInlineStyleImages(htmlPath string) ([]ImageReference, error) {
+    content, err := vm.readHTMLSource(htmlPath)
+    if err != nil {
+        return nil, err
+    }
+    
+    htmlDir := filepath.Dir(htmlPath)
+    var images []ImageReference
+    replaceInlineStyles(string(content), func(css string) string {
+        images = append(images, vm.collectImagesFromCSSContent(css, htmlDir)...)
+        return css
+    })
+    
+    return images, nil
+}
+
+// updateInlineStyleReferences 更新HTML内联样式中的图片引用
+func (vm *VersionManager) updateInlineStyleReferences(contentStr string, imageMap map[string]string) (string, bool) {
+    updated := false
+    newContent := replaceInlineStyles(contentStr, func(css string) string {
+        newCSS, cssUpdated := vm.replaceCSSImageURLs(css, vm.refDir, imageMap)
+        if cssUpdated {
+            updated = true
+        }
+        return newCSS
+    })
+    return newContent, updated
+}
+
+// findFile 查找文件（支持带hash版本）
+func (vm *VersionManager) findFile(basePath string) string {
+    // 先检查原始路径
+    if vm.fileExists(basePath) {
+        return basePath
+    }
+    
+    // 查找带hash的版本
+    dir := filepath.Dir(basePath)
+    name := filepath.Base(basePath)
+    ext := filepath.Ext(name)
+    nameWithoutExt := strings.TrimSuffix(name, ext)
+    
+    if !vm.fileExists(dir) {
+        return ""
+    }
+    
+    files, err := vm.fsys.ReadDir(dir)
+    if err != nil {
+        return ""
+    }
+    
+    pattern := vm.nameRegexp(`^` + vm.hashedNamePattern(regexp.QuoteMeta(nameWithoutExt), vm.hashPattern(ext), regexp.QuoteMeta(ext)) + `$`)
+    
+    for _, file := range files {
+        if pattern.MatchString(file.Name()) {
+            return filepath.Join(dir, file.Name())
+        }
+    }
+    
+    return ""
+}
+
+// collectResourcesFromHTML 从HTML中收集所有资源引用（包括组件）
+func (vm *VersionManager) collectResourcesFromHTML(htmlPath string) (map[string][]string, error) {
+    content, err := vm.readHTMLSource(htmlPath)
+    if err != nil {
+        return nil, err
+    }
+    
+    htmlDir := filepath.Dir(htmlPath)
+    // 移除未使用的变量
+    // htmlBasename := strings.TrimSuffix(filepath.Base(htmlPath), ".html")
+    
+    resources := map[string][]string{
+        "css": {},
+        "js":  {},
+    }
+    
+    contentStr := string(content)
+    
+    // 收集CSS文件（只收集组件CSS，主CSS会单独处理）
+    for _, match := range tagAttrValues(contentStr, "link", "href") {
+        ref := vm.trimVersionParam(match[1])
+        if strings.HasSuffix(ref, ".css") {
+            cssPath := vm.localFileRef(htmlDir, ref)
+            // 跳过外部URL
+            if isExternalOrSpecial(cssPath) {
+                continue
+            }
+            
+            // 转换为绝对路径（使用系统路径分隔符）
+            absolutePath := filepath.Join(htmlDir, filepath.FromSlash(cssPath))
+            absolutePath = filepath.Clean(absolutePath)
+            
+            // 只收集组件目录（ComponentPathPatterns，默认 components）下的CSS
+            if !vm.isComponentPath(cssPath, absolutePath) {
+                continue
+            }
+            
+            // 检查是否应该处理此组件
+            if !vm.shouldProcessComponent(cssPath) {
+                if vm.debugMode {
+                    vm.logf("    🚫 跳过组件CSS: %s (不在处理列表中)\n", cssPath)
+                }
+                continue
+            }
+            
+            if vm.isIgnoredPath(absolutePath) {
+                if vm.debugMode {
+                    vm.logf("    🚫 跳过组件CSS: %s (已被 %s 忽略)\n", cssPath, ignoreFileName)
+                }
+                continue
+            }
+            
+            if vm.fileExists(absolutePath) || vm.findFile(absolutePath) != "" {
+                // 保存时使用正斜杠（HTML标准）
+                normalizedPath := filepath.ToSlash(cssPath)
+                resources["css"] = append(resources["css"], normalizedPath)
+                vm.logf("    📌 收集组件CSS: %s\n", normalizedPath)
+            }
+        }
+    }
+    
+    // 收集JS文件（只收集组件目录下的JS，主JS会单独处理）
+    jsMatches := tagAttrValues(contentStr, "script", "src")
+    
+    // 同时收集 <link rel="preload"> / <link rel="modulepreload"> 预加载的JS
+    for _, match := range tagAttrValues(contentStr, "link", "href") {
+        if isPreloadLink(match[0]) {
+            jsMatches = append(jsMatches, match)
+        }
+    }
+    
+    for _, match := range jsMatches {
+        ref := vm.trimVersionParam(match[1])
+        if strings.HasSuffix(ref, ".js") {
+            jsPath := vm.localFileRef(htmlDir, ref)
+            // 跳过外部URL
+            if isExternalOrSpecial(jsPath) {
+                continue
+            }
+            
+            // 转换为绝对路径（使用系统路径分隔符）
+            absolutePath := filepath.Join(htmlDir, filepath.FromSlash(jsPath))
+            absolutePath = filepath.Clean(absolutePath)
+            
+            // 只收集组件目录（ComponentPathPatterns，默认 components）下的JS
+            if !vm.isComponentPath(jsPath, absolutePath) {
+                continue
+            }
+            
+            // 检查是否应该处理此组件
+            if !vm.shouldProcessComponent(jsPath) {
+                if vm.debugMode {
+                    vm.logf("    🚫 跳过组件JS: %s (不在处理列表中)\n", jsPath)
+                }
+                continue
+            }
+            
+            if vm.isIgnoredPath(absolutePath) {
+                if vm.debugMode {
+                    vm.logf("    🚫 跳过组件JS: %s (已被 %s 忽略)\n", jsPath, ignoreFileName)
+                }
+                continue
+            }
+            
+            if vm.fileExists(absolutePath) || vm.findFile(absolutePath) != "" {
+                // 保存时使用正斜杠（HTML标准）
+                normalizedPath := filepath.ToSlash(jsPath)
+                resources["js"] = append(resources["js"], normalizedPath)
+                vm.logf("    📌 收集组件JS: %s\n", normalizedPath)
+            }
+        }
+    }
+    
+    return resources, nil
+}
+
+// processComponentResource 处理组件资源（JS或CSS）
+func (vm *VersionManager) processComponentResource(htmlDir, relativePath string) (*FileInfo, error) {
+    absolutePath := filepath.Join(htmlDir, filepath.FromSlash(relativePath))
+    absolutePath = filepath.Clean(absolutePath)
+    
+    if vm.isOutsideRoot(absolutePath) {
+        return nil, errOutsideRoot
+    }
+    
+    // 查找实际文件（可能是带hash的版本）
+    actualPath := vm.findFile(absolutePath)
+    if actualPath == "" {
+        actualPath = absolutePath
+    }
+    
+    if !vm.fileExists(actualPath) {
+        return nil, fmt.Errorf("文件不存在: %s", actualPath)
+    }
+    
+    sourcePath := filepath.Join(filepath.Dir(actualPath), vm.removeHashFromFilename(filepath.Base(actualPath)))
+    if vm.isExcludedFile(sourcePath) {
+        return nil, errExcluded
+    }
+    
+    // 其他页面已处理过时直接复用结果
+    if info, ok := vm.indexedResource(sourcePath); ok {
+        return info, nil
+    }
+    
+    // 已经处理过时复用第一次处理的结果：CSS的hash按改写后的内容计算，不能用源文件重新计算
+    vm.mu.Lock()
+    processed, ok := vm.processedFiles[actualPath]
+    vm.mu.Unlock()
+    if ok {
+        vm.recordDependency(actualPath)
+        return processed.info, processed.err
+    }
+    
+    processed = &processedResource{}
+    if strings.HasSuffix(strings.ToLower(actualPath), ".css") {
+        // 处理CSS文件时，先处理其中的图片引用
+        processed.info, processed.err = vm.processComponentCSS(actualPath)
+    } else {
+        // 处理JS文件
+        processed.info, processed.err = vm.renameFileWithHash(actualPath)
+    }
+    vm.mu.Lock()
+    vm.processedFiles[actualPath] = processed
+    vm.mu.Unlock()
+    if processed.err != nil {
+        return nil, processed.err
+    }
+    
+    vm.indexResource(sourcePath, processed.info)
+    return processed.info, nil
+}
+
+// processedResource 一个组件资源的处理结果
+type processedResource struct {
+    info *FileInfo
+    err  error
+}
+
+// indexedResource 查找跨页面索引中已处理的资源，命中时记录为当前HTML的依赖
+func (vm *VersionManager) indexedResource(sourcePath string) (*FileInfo, bool) {
+    vm.mu.Lock()
+    info, ok := vm.resourceIndex[vm.pathKey(sourcePath)]
+    vm.mu.Unlock()
+    if !ok {
+        return nil, false
+    }
+    
+    vm.recordDependency(info.OriginalPath)
+    if vm.debugMode {
+        vm.logf("    ♻️  复用已处理: %s\n", filepath.Base(info.HashedPath))
+    }
+    return info, true
+}
+
+// indexResource 将处理结果加入跨页面索引
+func (vm *VersionManager) indexResource(sourcePath string, info *FileInfo) {
+    vm.mu.Lock()
+    vm.resourceIndex[vm.pathKey(sourcePath)] = info
+    vm.mu.Unlock()
+}
+
+// versionCSSInPlace query 模式下处理CSS：在原文件中更新图片引用的 ?v= 参数，返回以 ?v=hash 引用的文件信息
+func (vm *VersionManager) versionCSSInPlace(cssPath string, imageMap map[string]string) (*FileInfo, error) {
+    if len(imageMap) > 0 {
+        err := vm.updateCSSImageReferences(cssPath, imageMap)
+        vm.invalidateHash(cssPath)
+        if err != nil {
+            vm.logf("      ⚠️  更新CSS图片引用失败: %v\n", err)
+        }
+    }
+    
+    hash, err := vm.calculateFileHash(cssPath)
+    if err != nil {
+        return nil, err
+    }
+    
+    // 版本映射由 recordFile 在 vm.mu 下写入
+    info := &FileInfo{
+        OriginalPath: cssPath,
+        HashedPath:   filepath.Join(filepath.Dir(cssPath), vm.addHashToFilename(filepath.Base(cssPath), hash)),
+        Hash:         hash,
+        Renamed:      true,
+    }
+    vm.recordFile(info, statusVersioned)
+    
+    return info, nil
+}
+
+// processComponentCSS 处理组件CSS文件（包括其中的图片）：先hash引用的图片，再按改写后的最终内容计算hash，只写入一次
+func (vm *VersionManager) processComponentCSS(cssPath string) (*FileInfo, error) {
+    defer vm.setRefOwner(cssPath)()
+    cssDir := filepath.Dir(cssPath)
+    filename := filepath.Base(cssPath)
+    cleanFilename := vm.removeHashFromFilename(filename)
+    
+    // 确保使用原始CSS文件
+    originalCssPath := filepath.Join(cssDir, cleanFilename)
+    if !vm.fileExists(originalCssPath) {
+        originalCssPath = cssPath
+    }
+    
+    if vm.isExcludedFile(originalCssPath) {
+        return nil, errExcluded
+    }
+    
+    vm.recordDependency(originalCssPath)
+    
+    if vm.debugMode {
+        vm.logf("    📝 处理CSS: %s\n", cleanFilename)
+    }
+    
+    // 收集并处理CSS中的图片（依赖先于CSS本身处理）
+    images, err := vm.collectImagesFromCSS(originalCssPath)
+    if err != nil {
+        return nil, err
+    }
+    
+    imageMap := make(map[string]string)
+    
+    if len(images) > 0 {
+        vm.logf("    📸 处理 %d 个图片引用\n", len(images))
+        
+        for _, image := range images {
+            info, err := vm.hashImage(image.AbsolutePath)
+            if errors.Is(err, errExcluded) {
+                if vm.debugMode {
+                    vm.logf("      ⏭️  已排除: %s\n", image.OriginalPath)
+                }
+                continue
+            }
+            if err != nil {
+                vm.logf("      ⚠️  失败: %s (%v)\n", filepath.Base(image.AbsolutePath), err)
+                vm.recordError("%s: %v", image.AbsolutePath, err)
+                continue
+            }
+            
+            imageMap[image.OriginalPath] = filepath.Base(info.HashedPath)
+        }
+    }
+    
+    // query 模式直接更新原CSS中的图片引用，hash 基于更新后的内容
+    if vm.queryMode() {
+        return vm.versionCSSInPlace(originalCssPath, imageMap)
+    }
+    
+    // 在内存中改写图片引用得到最终内容，hash 基于最终内容
+    content, err := vm.renderCSS(originalCssPath, imageMap)
+    if err != nil {
+        return nil, err
+    }
+    if vm.config.PreHashCommand != "" {
+        content, err = vm.runPreHashCommand(originalCssPath, content)
+        if err != nil {
+            return nil, err
+        }
+    }
+    return vm.writeHashedContent(originalCssPath, content)
+}
+
+// writeHashedContent 按改写后的最终内容计算hash并写入hash文件（CSS、ES模块），内容相同的已有文件直接复用
+func (vm *VersionManager) writeHashedContent(sourcePath string, content []byte) (*FileInfo, error) {
+    dir := filepath.Dir(sourcePath)
+    cleanFilename := vm.removeHashFromFilename(filepath.Base(sourcePath))
+    hash := vm.truncateHash(sourcePath, vm.hashContent(sourcePath, content))
+    hashedPath := filepath.Join(dir, vm.addHashToFilename(cleanFilename, hash))
+    
+    info := &FileInfo{
+        OriginalPath: sourcePath,
+        HashedPath:   hashedPath,
+        Hash:         hash,
+        Renamed:      true,
+    }
+    
+    // 增量模式：最终内容的hash与上次一致时直接复用已有的hash文件
+    if vm.reuseHashed(sourcePath, hash, hashedPath) {
+        vm.precompress(hashedPath, false)
+        vm.recordFile(info, statusSkipped)
+        return info, nil
+    }
+    
+    if err := vm.claimHashedPath(hashedPath, sourcePath); err != nil {
+        return nil, err
+    }
+    
+    if existing, err := vm.fsys.ReadFile(hashedPath); err == nil && bytes.Equal(existing, content) && !vm.config.ForceRegen {
+        if vm.debugMode {
+            vm.logEvent("skip", hashedPath, hash, "      ⏭️  跳过（已存在）: %s\n", filepath.Base(hashedPath))
+        }
+        vm.precompress(hashedPath, false)
+        vm.recordFile(info, statusSkipped)
+        return info, nil
+    }
+    
+    perm := os.FileMode(0644)
+    if stat, err := vm.fsys.Stat(sourcePath); err == nil {
+        perm = stat.Mode().Perm()
+    }
+    if err := vm.fsys.WriteFile(hashedPath, content, perm); err != nil {
+        return nil, fmt.Errorf("写入%s失败: %v", strings.ToUpper(strings.TrimPrefix(filepath.Ext(cleanFilename), ".")), err)
+    }
+    vm.invalidateHash(hashedPath)
+    vm.logEvent("generate", hashedPath, hash, "  ✅ 已生成: %s\n", filepath.Base(hashedPath))
+    
+    // 删除旧的hash文件
+    ext := filepath.Ext(cleanFilename)
+    basename := strings.TrimSuffix(cleanFilename, ext)
+    if err := vm.findAndDeleteOldHashFiles(dir, basename, ext, hash); err != nil {
+        if vm.debugMode {
+            vm.logf("      ⚠️  清理旧文件时出错: %v\n", err)
+        }
+    }
+    
+    vm.precompress(hashedPath, true)
+    vm.recordFile(info, statusGenerated)
+    
+    return info, nil
+}
+
+// moduleImportRe 匹配ES模块中的 import/export ... from '地址'、import '地址' 和 import('地址')（分组3为模块地址）
+var moduleImportRe = regexp.MustCompile(`(\b(?:import|export)\b(?:[^'";()]*?\bfrom)?\s*(?:\(\s*)?)(['"])([^'"\s]+)(['"])`)
+
+// moduleScriptRe 匹配内联的 <script type="module"> 块：开始标签、脚本内容、结束标签
+var moduleScriptRe = regexp.MustCompile(`(?is)(<script\b[^>]*\btype\s*=\s*['"]?module['"]?[^>]*>)(.*?)(</script\s*>)`)
+
+// errModuleCycle 模块之间存在循环 import，无法按内容计算hash
+var errModuleCycle = errors.New("循环 import")
+
+// rewritesModuleImports 判断是否按ES模块处理JS文件（RewriteModuleImports 时改写其中的本地 import 地址）
+func (vm *VersionManager) rewritesModuleImports(filePath string) bool {
+    if !vm.config.RewriteModuleImports {
+        return false
+    }
+    ext := strings.ToLower(filepath.Ext(filePath))
+    return ext == ".js" || ext == ".mjs"
+}
+
+// replaceModuleImports 将JS代码中 import 的模块地址交给 replace 改写，replace 返回新的地址
+func replaceModuleImports(code string, replace func(specifier string) string) string {
+    return moduleImportRe.ReplaceAllStringFunc(code, func(match string) string {
+        submatches := moduleImportRe.FindStringSubmatch(match)
+        return submatches[1] + submatches[2] + replace(submatches[3]) + submatches[4]
+    })
+}
+
+// processModuleJS 处理ES模块：先hash其中 import 的本地模块（./、../ 开头），再按改写地址后的最终内容计算hash，只写入一次
+// 裸模块名和远程地址保持不变；query 模式直接在原文件中更新地址的 ?v= 参数
+func (vm *VersionManager) processModuleJS(jsPath string) (*FileInfo, error) {
+    absPath, err := filepath.Abs(jsPath)
+    if err != nil {
+        return nil, err
+    }
+    vm.mu.Lock()
+    if vm.moduleVisiting[absPath] {
+        vm.mu.Unlock()
+        return nil, errModuleCycle
+    }
+    vm.moduleVisiting[absPath] = true
+    vm.mu.Unlock()
+    defer func() {
+        vm.mu.Lock()
+        delete(vm.moduleVisiting, absPath)
+        vm.mu.Unlock()
+    }()
+    
+    vm.recordDependency(jsPath)
+    content, err := vm.fsys.ReadFile(jsPath)
+    if err != nil {
+        return nil, err
+    }
+    
+    // 先处理 import 的模块（依赖先于模块本身），得到 原地址 -> 新地址
+    jsDir := filepath.Dir(jsPath)
+    specifierMap := make(map[string]string)
+    for _, match := range moduleImportRe.FindAllStringSubmatch(string(content), -1) {
+        specifier := match[3]
+        if _, done := specifierMap[specifier]; done || !isLocalImportTarget(specifier) {
+            continue
+        }
+        
+        modulePath, suffix := splitURLSuffix(specifier)
+        absolutePath := filepath.Clean(filepath.Join(jsDir, filepath.FromSlash(modulePath)))
+        if vm.isOutsideRoot(absolutePath) {
+            vm.logf("      ⚠️  跳过: %s (%v)\n", specifier, errOutsideRoot)
+            continue
+        }
+        actualPath := vm.findFile(absolutePath)
+        if actualPath == "" {
+            vm.logf("      ⚠️  跳过: %s (文件不存在)\n", specifier)
+            continue
+        }
+        
+        info, err := vm.hashImage(actualPath)
+        if errors.Is(err, errExcluded) {
+            continue
+        }
+        if err != nil {
+            // 循环 import 时保留原地址，由最先开始处理的模块负责
+            vm.logf("      ⚠️  失败: %s (%v)\n", specifier, err)
+            if !errors.Is(err, errModuleCycle) {
+                vm.recordError("%s: %v", absolutePath, err)
+            }
+            continue
+        }
+        
+        newSpecifier := modulePath[:strings.LastIndex(modulePath, "/")+1] + filepath.Base(info.HashedPath)
+        specifierMap[specifier] = vm.joinURLSuffix(newSpecifier, suffix)
+    }
+    
+    bom, body := splitBOM(content)
+    rendered := replaceModuleImports(string(body), func(specifier string) string {
+        if newSpecifier, ok := specifierMap[specifier]; ok {
+            if newSpecifier != specifier {
+                vm.logf("    🔄 %s -> %s\n", specifier, newSpecifier)
+            }
+            return newSpecifier
+        }
+        return specifier
+    })
+    
+    if !vm.queryMode() {
+        return vm.writeHashedContent(jsPath, append(bom, rendered...))
+    }
+    
+    // query 模式不生成副本：import 地址直接写回原文件，hash 基于更新后的内容
+    if rendered != string(body) {
+        err := vm.writeFile(jsPath, append(bom, rendered...))
+        vm.invalidateHash(jsPath)
+        if err != nil {
+            return nil, err
+        }
+    }
+    hash, err := vm.calculateFileHash(jsPath)
+    if err != nil {
+        return nil, err
+    }
+    info := &FileInfo{
+        OriginalPath: jsPath,
+        HashedPath:   filepath.Join(jsDir, vm.addHashToFilename(filepath.Base(jsPath), hash)),
+        Hash:         hash,
+        Renamed:      true,
+    }
+    vm.recordFile(info, statusVersioned)
+    return info, nil
+}
+
+// forEachInlineModuleImport 遍历内联 <script type="module"> 中 import 的本地模块地址（及带CDN前缀的地址），replace 返回新地址
+func (vm *VersionManager) forEachInlineModuleImport(content string, replace func(specifier string) string) string {
+    return moduleScriptRe.ReplaceAllStringFunc(content, func(block string) string {
+        submatches := moduleScriptRe.FindStringSubmatch(block)
+        code := replaceModuleImports(submatches[2], func(specifier string) string {
+            if _, isCDN := vm.stripCDNPrefix(specifier); !isCDN && !isLocalImportTarget(specifier) {
+                return specifier
+            }
+            return replace(specifier)
+        })
+        return submatches[1] + code + submatches[3]
+    })
+}
+
+// collectInlineModuleRefs 收集内联 <script type="module"> 中 import 的本地模块（未开启 RewriteModuleImports 时不收集）
+func (vm *VersionManager) collectInlineModuleRefs(htmlPath string) ([]string, error) {
+    if !vm.config.RewriteModuleImports {
+        return nil, nil
+    }
+    content, err := vm.readHTMLSource(htmlPath)
+    if err != nil {
+        return nil, err
+    }
+    
+    htmlDir := filepath.Dir(htmlPath)
+    var refs []string
+    vm.forEachInlineModuleImport(string(content), func(specifier string) string {
+        refs = append(refs, vm.localFileRef(htmlDir, specifier))
+        return specifier
+    })
+    
+    return refs, nil
+}
+
+// updateInlineModuleReferences 改写内联 <script type="module"> 中已hash的本地模块地址
+func (vm *VersionManager) updateInlineModuleReferences(contentStr string, assetMap map[string]string) (string, bool) {
+    if !vm.config.RewriteModuleImports {
+        return contentStr, false
+    }
+    updated := false
+    newContent := vm.forEachInlineModuleImport(contentStr, func(specifier string) string {
+        modulePath, suffix := splitURLSuffix(vm.localAssetRef(specifier, assetMap))
+        key := strings.TrimPrefix(modulePath, "./")
+        newHashedPath, ok := assetMap[key]
+        if !ok {
+            return specifier
+        }
+        
+        newSpecifier := vm.joinURLSuffix(vm.buildReferencePath(key, modulePath, newHashedPath), suffix)
+        if newSpecifier != specifier {
+            updated = true
+            vm.logf("  ✅ MODULE: %s -> %s\n", filepath.Base(modulePath), filepath.Base(newSpecifier))
+        }
+        return newSpecifier
+    })
+    return newContent, updated
+}
+
+// renderCSS 返回改写图片引用后的CSS内容（保留开头的BOM），不修改文件
+func (vm *VersionManager) renderCSS(cssPath string, imageMap map[string]string) ([]byte, error) {
+    content, err := vm.fsys.ReadFile(cssPath)
+    if err != nil {
+        return nil, err
+    }
+    if len(imageMap) == 0 {
+        return content, nil
+    }
+    
+    bom, body := splitBOM(content)
+    contentStr, _ := vm.replaceCSSImageURLs(string(body), filepath.Dir(cssPath), imageMap)
+    contentStr, _ = vm.replaceCustomCSSRefs(contentStr, filepath.Dir(cssPath), imageMap)
+    return append(bom, contentStr...), nil
+}
+
+// preHashTempSeq 为 PreHashCommand 的临时文件生成不重复的文件名
+var preHashTempSeq atomic.Int64
+
+// runPreHashCommand 用 PreHashCommand 转换CSS内容：在 RootDir 下通过系统 shell（sh -c / cmd /C）执行命令，
+// {in}/{out} 替换为带引号的临时文件路径（位于CSS所在目录，通过 vm.fsys 读写），没有 {in} 时从标准输入传入，
+// 没有 {out} 时取标准输出，返回转换后的内容。外部命令直接访问磁盘，vm.fsys 需对应真实目录
+func (vm *VersionManager) runPreHashCommand(cssPath string, content []byte) ([]byte, error) {
+    command := vm.config.PreHashCommand
+    ext := filepath.Ext(cssPath)
+    tempPath := func(kind string) (string, error) {
+        name := fmt.Sprintf(".%s.prehash-%d-%d-%s%s", strings.TrimSuffix(filepath.Base(cssPath), ext), os.Getpid(), preHashTempSeq.Add(1), kind, ext)
+        return filepath.Abs(filepath.Join(filepath.Dir(cssPath), name))
+    }
+    
+    var stdin io.Reader = bytes.NewReader(content)
+    if strings.Contains(command, "{in}") {
+        inPath, err := tempPath("in")
+        if err != nil {
+            return nil, err
+        }
+        if err := vm.fsys.WriteFile(inPath, content, 0644); err != nil {
+            return nil, err
+        }
+        defer vm.fsys.Remove(inPath)
+        command = strings.ReplaceAll(command, "{in}", `"`+inPath+`"`)
+        stdin = nil
+    }
+    
+    outPath := ""
+    if strings.Contains(command, "{out}") {
+        var err error
+        outPath, err = tempPath("out")
+        if err != nil {
+            return nil, err
+        }
+        defer vm.fsys.Remove(outPath)
+        command = strings.ReplaceAll(command, "{out}", `"`+outPath+`"`)
+    }
+    
+    var cmd *exec.Cmd
+    if runtime.GOOS == "windows" {
+        cmd = exec.Command("cmd", "/C", command)
+    } else {
+        cmd = exec.Command("sh", "-c", command)
+    }
+    cmd.Dir = vm.config.RootDir
+    cmd.Stdin = stdin
+    var stdout, stderr bytes.Buffer
+    cmd.Stdout = &stdout
+    cmd.Stderr = &stderr
+    if err := cmd.Run(); err != nil {
+        if msg := strings.TrimSpace(stderr.String()); msg != "" {
+            return nil, fmt.Errorf("preHashCommand 执行失败: %v: %s", err, msg)
+        }
+        return nil, fmt.Errorf("preHashCommand 执行失败: %v", err)
+    }
+    
+    if outPath == "" {
+        return stdout.Bytes(), nil
+    }
+    return vm.fsys.ReadFile(outPath)
+}
+
+// hashImage 处理CSS或HTML引用的图片，同一次运行中已处理过的直接复用结果
+func (vm *VersionManager) hashImage(imagePath string) (*FileInfo, error) {
+    sourcePath := filepath.Join(filepath.Dir(imagePath), vm.removeHashFromFilename(filepath.Base(imagePath)))
+    if info, ok := vm.indexedResource(sourcePath); ok {
+        return info, nil
+    }
+    
+    info, err := vm.renameFileWithHash(imagePath)
+    if err != nil {
+        return nil, err
+    }
+    vm.indexResource(sourcePath, info)
+    return info, nil
+}
+
+// reuseHashed 判断能否复用已有的hash文件（不再复制，也不再清理旧版本）：hash文件仍然存在，且源文件hash与
+// 上次未完成运行的日志中已生成的记录一致，或增量模式下与上次版本映射中的记录一致
+func (vm *VersionManager) reuseHashed(sourcePath, hash, hashedPath string) bool {
+    if vm.config.ForceRegen {
+        return false
+    }
+    key, _ := vm.versionKey(sourcePath)
+    if vm.journal != nil && vm.journal.files[key] == hash && vm.fileExists(hashedPath) {
+        if vm.debugMode {
+            vm.logEvent("reuse", hashedPath, hash, "  ♻️  上次运行已生成: %s\n", filepath.Base(hashedPath))
+        }
+        return true
+    }
+    if !vm.incremental || vm.previousMap[key] != hash || !vm.fileExists(hashedPath) {
+        return false
+    }
+    if vm.debugMode {
+        vm.logEvent("skip", hashedPath, hash, "  ⏭️  未变化: %s\n", filepath.Base(hashedPath))
+    }
+    return true
+}
+
+// loadPreviousVersionMap 读取上次保存的版本映射，供增量模式比较
+func (vm *VersionManager) loadPreviousVersionMap() {
+    vm.previousMap = make(map[string]string)
+    data, err := vm.fsys.ReadFile(vm.versionMapPath())
+    if err != nil {
+        return
+    }
+    if err := json.Unmarshal(data, &vm.previousMap); err != nil {
+        vm.logf("⚠️  已有版本映射格式错误，不使用增量模式: %v\n", err)
+        vm.previousMap = make(map[string]string)
+        return
+    }
+    vm.previousMap = normalizeVersionKeys(vm.previousMap)
+}
+
+// versionKey 返回文件在版本映射中的键：相对 RootDir 的路径，统一使用正斜杠（与操作系统无关）
+func (vm *VersionManager) versionKey(filePath string) (string, bool) {
+    relPath, err := filepath.Rel(vm.config.RootDir, filePath)
+    if err != nil {
+        return "", false
+    }
+    return filepath.ToSlash(relPath), true
+}
+
+// normalizeVersionKeys 将已有版本映射中的反斜杠键（Windows 上生成的旧文件）统一为正斜杠
+func normalizeVersionKeys(versionMap map[string]string) map[string]string {
+    normalized := make(map[string]string, len(versionMap))
+    for key, hash := range versionMap {
+        normalized[strings.ReplaceAll(key, `\`, "/")] = hash
+    }
+    return normalized
+}
+
+// buildReferencePath 构建改写后的引用路径：保持原有目录结构和 ./ ../ 前缀格式，并添加CDN域名
+func (vm *VersionManager) buildReferencePath(originalRelPath, oldPath, newHashedPath string) string {
+    // 提取原始路径的目录部分
+    oldDir := filepath.Dir(originalRelPath)
+    newFilename := filepath.Base(newHashedPath)
+    
+    // 构建新路径，保持原有的目录结构
+    var newPath string
+    if oldDir != "." && oldDir != "/" {
+        newPath = filepath.Join(oldDir, newFilename)
+        newPath = strings.ReplaceAll(newPath, `\`, "/")
+    } else {
+        newPath = newFilename
+    }
+    
+    // 如果原始路径是相对路径（以./或../开头），保持相对路径格式
+    if strings.HasPrefix(oldPath, "../") || strings.HasPrefix(oldPath, "..\\") {
+        // 保持../格式
+        if !strings.HasPrefix(newPath, "../") && !strings.HasPrefix(newPath, "..\\") {
+            newPath = "../" + newPath
+        }
+    } else if strings.HasPrefix(oldPath, "./") || strings.HasPrefix(oldPath, ".\\") {
+        // 保持./格式
+        if !strings.HasPrefix(newPath, "./") && !strings.HasPrefix(newPath, ".\\") {
+            newPath = "./" + newPath
+        }
+    }
+    
+    // 设置了 URLBasePath 时改为 前缀 + 相对 RootDir 的路径
+    if vm.refDir != "" {
+        if baseRef, ok := vm.basePathRef(filepath.Join(vm.refDir, filepath.FromSlash(newHashedPath))); ok {
+            newPath = baseRef
+        }
+    }
+    
+    rootRel := newHashedPath
+    if vm.refDir != "" {
+        if relPath, err := relPathBetween(vm.config.RootDir, filepath.Join(vm.refDir, filepath.FromSlash(newHashedPath))); err == nil {
+            rootRel = relPath
+        }
+    }
+    cdnDomain := vm.cdnRuleDomain(rootRel)
+    if cdnDomain == "" {
+        cdnDomain = vm.cdnDomainFor(newFilename)
+    }
+    if cdnDomain != "" && !isExternalOrSpecial(newPath) {
+        cleanNewPath := strings.TrimPrefix(newPath, "./")
+        cleanNewPath = strings.TrimPrefix(cleanNewPath, "../")
+        newPath = joinCDNPath(cdnDomain, cleanNewPath)
+        vm.recordCDNRef(newPath, oldPath)
+    }
+    
+    return newPath
+}
+
+// cdnRefsFileName 记录添加CDN域名前的原始引用（位于 RootDir 下）：添加CDN域名时会去掉 ./ ../ 前缀或改为相对 RootDir 的路径，
+// -clean 据此还原引用的原始写法
+const cdnRefsFileName = ".hashcdn-cdn-refs.json"
+
+// setRefOwner 设置当前正在改写引用的文件，返回恢复之前设置的函数（组件CSS在HTML处理过程中处理，需要嵌套）
+func (vm *VersionManager) setRefOwner(filePath string) func() {
+    previous := vm.refOwner
+    vm.refOwner = filePath
+    return func() { vm.refOwner = previous }
+}
+
+// recordCDNRef 记录添加了CDN域名的引用对应的原始引用（都去掉文件名中的hash）；原始引用已经是CDN地址时保留之前的记录
+func (vm *VersionManager) recordCDNRef(cdnRef, originalRef string) {
+    if vm.refOwner == "" || isExternalOrSpecial(originalRef) {
+        return
+    }
+    owner, ok := vm.versionKey(vm.refOwner)
+    if !ok {
+        return
+    }
+    
+    vm.mu.Lock()
+    defer vm.mu.Unlock()
+    if vm.cdnRefs == nil {
+        vm.cdnRefs = make(map[string]map[string]string)
+    }
+    if vm.cdnRefs[owner] == nil {
+        vm.cdnRefs[owner] = make(map[string]string)
+    }
+    vm.cdnRefs[owner][vm.unhashedRef(cdnRef)] = vm.unhashedRef(originalRef)
+}
+
+// unhashedRef 去掉引用中文件名的hash，目录部分不变
+func (vm *VersionManager) unhashedRef(ref string) string {
+    filename := path.Base(ref)
+    return strings.TrimSuffix(ref, filename) + vm.removeHashFromFilename(filename)
+}
+
+// loadCDNRefs 读取已保存的原始引用记录，文件不存在或格式错误时返回空记录
+func (vm *VersionManager) loadCDNRefs() map[string]map[string]string {
+    refs := make(map[string]map[string]string)
+    data, err := vm.fsys.ReadFile(filepath.Join(vm.config.RootDir, cdnRefsFileName))
+    if err != nil {
+        return refs
+    }
+    if err := json.Unmarshal(data, &refs); err != nil {
+        vm.logf("⚠️  原始引用记录 %s 格式错误，已忽略: %v\n", cdnRefsFileName, err)
+        return make(map[string]map[string]string)
+    }
+    return refs
+}
+
+// saveCDNRefs 将本次运行添加CDN域名的原始引用合并保存到 cdnRefsFileName
+func (vm *VersionManager) saveCDNRefs() {
+    vm.mu.Lock()
+    defer vm.mu.Unlock()
+    if len(vm.cdnRefs) == 0 {
+        return
+    }
+    
+    refs := vm.loadCDNRefs()
+    for owner, ownerRefs := range vm.cdnRefs {
+        if refs[owner] == nil {
+            refs[owner] = make(map[string]string)
+        }
+        for cdnRef, originalRef := range ownerRefs {
+            refs[owner][cdnRef] = originalRef
+        }
+    }
+    data, err := json.MarshalIndent(refs, "", "  ")
+    if err != nil {
+        return
+    }
+    if err := vm.fsys.WriteFile(filepath.Join(vm.config.RootDir, cdnRefsFileName), data, 0644); err != nil {
+        vm.logf("⚠️  保存原始引用记录失败: %v\n", err)
+    }
+}
+
+// stripCDNPrefix 去掉引用中的CDN域名前缀，返回可能的本地相对路径
+// （buildReferencePath 添加CDN前缀时会去掉一层 ./ 或 ../，因此两种形式都可能）
+func (vm *VersionManager) stripCDNPrefix(ref string) ([]string, bool) {
+    for _, domain := range vm.cdnDomainList() {
+        if strings.HasPrefix(ref, domain+"/") {
+            rest := strings.TrimPrefix(ref, domain+"/")
+            return []string{rest, "../" + rest}, true
+        }
+    }
+    return nil, false
+}
+
+// localRefPath 将带CDN前缀的引用还原为本地相对路径，exists 判断候选路径是否有效；没有CDN前缀时原样返回
+func (vm *VersionManager) localRefPath(ref string, exists func(candidate string) bool) string {
+    if rest, ok := vm.trimBasePath(ref); ok && vm.refDir != "" {
+        if relPath, err := relPathBetween(vm.refDir, filepath.Join(vm.config.RootDir, filepath.FromSlash(rest))); err == nil {
+            return filepath.ToSlash(relPath)
+        }
+    }
+    
+    candidates, ok := vm.stripCDNPrefix(ref)
+    if !ok {
+        return ref
+    }
+    for _, candidate := range candidates {
+        if exists(candidate) {
+            return candidate
+        }
+    }
+    return candidates[0]
+}
+
+// localFileRef 将带CDN前缀的引用还原为相对 htmlDir 的本地路径
+func (vm *VersionManager) localFileRef(htmlDir, ref string) string {
+    return vm.localRefPath(ref, func(candidate string) bool {
+        imagePath, _ := splitURLSuffix(candidate)
+        return vm.findFile(filepath.Join(htmlDir, filepath.FromSlash(imagePath))) != ""
+    })
+}
+
+// localAssetRef 将带CDN前缀的引用还原为 assetMap 中已处理资源的本地相对路径
+func (vm *VersionManager) localAssetRef(ref string, assetMap map[string]string) string {
+    return vm.localRefPath(ref, func(candidate string) bool {
+        assetPath, _ := splitURLSuffix(candidate)
+        _, ok := assetMap[strings.TrimPrefix(assetPath, "./")]
+        return ok
+    })
+}
+
+// escapeRefPath 将引用路径转换为正则片段：文件名可带或不带hash，路径分隔符兼容 / 和 \
+func (vm *VersionManager) escapeRefPath(relPath string) string {
+    dir, filename := path.Split(filepath.ToSlash(relPath))
+    cleanFilename := vm.removeHashFromFilename(filename)
+    ext := path.Ext(cleanFilename)
+    name := strings.TrimSuffix(cleanFilename, ext)
+    
+    escapedPath := regexp.QuoteMeta(dir) + vm.optionalHashPattern(name, ext)
+    escapedPath = strings.ReplaceAll(escapedPath, "/", `[/\\]`)
+    if vm.queryMode() {
+        // 上次运行添加的 ?v=hash 一并替换
+        escapedPath += `(?:\?v=[a-f0-9]+)?`
+    }
+    return escapedPath
+}
+
+// tagAttrPrefix 返回匹配标签开始到指定属性名的正则片段：标签名不区分大小写，属性可在任意位置（允许跨行）
+func tagAttrPrefix(tag, attr string) string {
+    return `(?i:<` + regexp.QuoteMeta(tag) + `)\b[^>]*\s(?i:` + regexp.QuoteMeta(attr) + `)`
+}
+
+// tagRefPattern 返回匹配标签属性中资源引用的正则（第1组为属性名、等号和引号，第2组为路径，第3组为引号及标签剩余部分），
+// 属性值可带双引号、单引号或不带引号
+func tagRefPattern(tagAttr, pathPattern string) string {
+    return fmt.Sprintf(`(%s\s*=\s*['"]?)(%s)(['"]?(?:\s[^>]*)?/?>)`, tagAttr, pathPattern)
+}
+
+// tagRefPatterns 返回匹配标签属性中资源引用的正则列表（tagAttr 由 tagAttrPrefix 生成）：
+// 原始路径、带 ./ 或 ../ 前缀的路径，以及上次运行添加了CDN域名前缀的路径
+func (vm *VersionManager) tagRefPatterns(tagAttr, relPath string) []string {
+    escapedPath := vm.escapeRefPath(relPath)
+    patterns := []string{
+        tagRefPattern(tagAttr, escapedPath),
+        tagRefPattern(tagAttr, `\.{1,2}[/\\]`+escapedPath),
+    }
+    
+    domains := vm.cdnDomainList()
+    if len(domains) > 0 {
+        quoted := make([]string, len(domains))
+        for i, domain := range domains {
+            quoted[i] = regexp.QuoteMeta(domain)
+        }
+        cdnPath := strings.TrimPrefix(strings.TrimPrefix(filepath.ToSlash(relPath), "./"), "../")
+        patterns = append(patterns, tagRefPattern(tagAttr, `(?:`+strings.Join(quoted, "|")+`)/`+vm.escapeRefPath(cdnPath)))
+    }
+    
+    // 上次运行按 URLBasePath 改写过的引用（可能带CDN域名）
+    if base, ok := vm.urlBasePath(); ok && vm.refDir != "" {
+        if rootRel, err := relPathBetween(vm.config.RootDir, filepath.Join(vm.refDir, filepath.FromSlash(relPath))); err == nil {
+            cdnPrefix := ""
+            if len(domains) > 0 {
+                quoted := make([]string, len(domains))
+                for i, domain := range domains {
+                    quoted[i] = regexp.QuoteMeta(domain)
+                }
+                cdnPrefix = `(?:` + strings.Join(quoted, "|") + `)?`
+            }
+            patterns = append(patterns, tagRefPattern(tagAttr, cdnPrefix+regexp.QuoteMeta(base)+`/`+vm.escapeRefPath(rootRel)))
+        }
+    }
+    
+    return patterns
+}
+
+// urlBasePath 返回规范化的 URLBasePath（以 / 开头、不以 / 结尾，"/" 规范化为空串），未设置时 ok 为 false
+func (vm *VersionManager) urlBasePath() (string, bool) {
+    base := strings.TrimSpace(filepath.ToSlash(vm.config.URLBasePath))
+    if base == "" {
+        return "", false
+    }
+    if base = strings.Trim(base, "/"); base == "" {
+        return "", true
+    }
+    return "/" + base, true
+}
+
+// basePathRef 设置了 URLBasePath 时，返回文件对外访问的路径：前缀 + 相对 RootDir 的路径（文件位于 RootDir 之外时 ok 为 false）
+func (vm *VersionManager) basePathRef(filePath string) (string, bool) {
+    base, ok := vm.urlBasePath()
+    if !ok {
+        return "", false
+    }
+    relPath, err := relPathBetween(vm.config.RootDir, filePath)
+    if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+        return "", false
+    }
+    return base + "/" + filepath.ToSlash(relPath), true
+}
+
+// trimBasePath 去掉引用中的CDN域名和 URLBasePath 前缀，返回相对 RootDir 的路径；不是按 URLBasePath 生成的引用时 ok 为 false
+func (vm *VersionManager) trimBasePath(ref string) (string, bool) {
+    base, ok := vm.urlBasePath()
+    if !ok {
+        return "", false
+    }
+    for _, domain := range vm.cdnDomainList() {
+        if strings.HasPrefix(ref, domain+"/") {
+            ref = strings.TrimPrefix(ref, domain)
+            break
+        }
+    }
+    if !strings.HasPrefix(ref, base+"/") {
+        return "", false
+    }
+    return strings.TrimPrefix(ref, base+"/"), true
+}
+
+// resolveRef 将资源中的引用解析为文件路径：按 URLBasePath 生成的引用和以 / 开头的根路径相对 RootDir，其余相对 baseDir
+func (vm *VersionManager) resolveRef(baseDir, ref string) string {
+    if rest, ok := vm.trimBasePath(ref); ok {
+        return filepath.Join(vm.config.RootDir, filepath.FromSlash(rest))
+    }
+    if strings.HasPrefix(ref, "/") && !strings.HasPrefix(ref, "//") {
+        return filepath.Join(vm.config.RootDir, filepath.FromSlash(ref))
+    }
+    return filepath.Join(baseDir, filepath.FromSlash(ref))
+}
+
+// relPathBetween 计算 target 相对 base 的路径（两者可以一个是相对路径、一个是绝对路径）
+func relPathBetween(base, target string) (string, error) {
+    absBase, err := filepath.Abs(base)
+    if err != nil {
+        return "", err
+    }
+    absTarget, err := filepath.Abs(target)
+    if err != nil {
+        return "", err
+    }
+    return filepath.Rel(absBase, absTarget)
+}
+
+// cdnDomainFor 为文件选择CDN域名：配置了多个域名时按文件名hash取模，保证同一文件始终映射到同一域名
+func (vm *VersionManager) cdnDomainFor(filename string) string {
+    if len(vm.config.CDNDomains) == 0 {
+        return normalizeCDNDomain(vm.config.CDNDomain)
+    }
+    
+    h := fnv.New32a()
+    h.Write([]byte(filename))
+    return normalizeCDNDomain(vm.config.CDNDomains[h.Sum32()%uint32(len(vm.config.CDNDomains))])
+}
+
+// cdnRuleDomain 返回第一条路径前缀匹配 rootRel（相对 RootDir 的路径）的 CDNRules 域名，没有匹配时返回空串
+func (vm *VersionManager) cdnRuleDomain(rootRel string) string {
+    rootRel = strings.TrimPrefix(path.Clean(filepath.ToSlash(rootRel)), "/")
+    for _, rule := range vm.config.CDNRules {
+        prefix := strings.Trim(path.Clean("/"+filepath.ToSlash(rule.PathPrefix)), "/")
+        if prefix == "" || rootRel == prefix || strings.HasPrefix(rootRel, prefix+"/") {
+            return normalizeCDNDomain(rule.Domain)
+        }
+    }
+    return ""
+}
+
+// normalizeCDNDomain 规范化CDN前缀：去掉首尾空白和结尾的 /。可以是完整域名（https://cdn.x.com）、
+// 协议相对域名（//cdn.x.com）或站内路径（/assets）；只有 / 时视为未设置
+func normalizeCDNDomain(domain string) string {
+    return strings.TrimRight(strings.TrimSpace(domain), "/")
+}
+
+// joinCDNPath 拼接CDN前缀和资源路径，两者之间只保留一个 /
+func joinCDNPath(domain, refPath string) string {
+    return normalizeCDNDomain(domain) + "/" + strings.TrimLeft(refPath, "/")
+}
+
+// srcsetAttrRe 匹配 <img>/<source> 的 srcset 属性
+var srcsetAttrRe = regexp.MustCompile(`(\ssrcset\s*=\s*)(?:"([^"]*)"|'([^']*)')`)
+
+// isSrcsetAttr 判断 DataAttributes 中的属性是否按 srcset 解析（如 data-srcset）
+func isSrcsetAttr(attr string) bool {
+    return strings.HasSuffix(strings.ToLower(attr), "srcset")
+}
+
+// srcsetRe 返回匹配 srcset 属性的正则，包括 DataAttributes 中以 srcset 结尾的 data-* 属性
+func (vm *VersionManager) srcsetRe() *regexp.Regexp {
+    attrs := []string{"srcset"}
+    for _, attr := range vm.config.DataAttributes {
+        if isSrcsetAttr(attr) {
+            attrs = append(attrs, regexp.QuoteMeta(attr))
+        }
+    }
+    if len(attrs) == 1 {
+        return srcsetAttrRe
+    }
+    return regexp.MustCompile(`(\s(?:` + strings.Join(attrs, "|") + `)\s*=\s*)(?:"([^"]*)"|'([^']*)')`)
+}
+
+// srcsetCandidate srcset 中的单个候选项
+type srcsetCandidate struct {
+    URL        string
+    Descriptor string // 如 2x、640w，可能为空
+}
+
+// parseSrcset 按HTML规范解析 srcset：URL 为连续的非空白字符，描述符到下一个逗号为止
+// （因此 data URI 中的逗号不会被误拆分）
+func parseSrcset(value string) []srcsetCandidate {
+    var candidates []srcsetCandidate
+    i := 0
+    for i < len(value) {
+        // 跳过空白和多余的逗号
+        for i < len(value) && (isHTMLSpace(value[i]) || value[i] == ',') {
+            i++
+        }
+        if i >= len(value) {
+            break
+        }
+        
+        start := i
+        for i < len(value) && !isHTMLSpace(value[i]) {
+            i++
+        }
+        url := value[start:i]
+        
+        // URL 以逗号结尾时表示没有描述符
+        if strings.HasSuffix(url, ",") {
+            candidates = append(candidates, srcsetCandidate{URL: strings.TrimRight(url, ",")})
+            continue
+        }
+        
+        start = i
+        for i < len(value) && value[i] != ',' {
+            i++
+        }
+        candidates = append(candidates, srcsetCandidate{
+            URL:        url,
+            Descriptor: strings.TrimSpace(value[start:i]),
+        })
+    }
+    return candidates
+}
+
+// formatSrcset 将候选项重新组装为 srcset 属性值
+func formatSrcset(candidates []srcsetCandidate) string {
+    parts := make([]string, 0, len(candidates))
+    for _, candidate := range candidates {
+        if candidate.Descriptor != "" {
+            parts = append(parts, candidate.URL+" "+candidate.Descriptor)
+        } else {
+            parts = append(parts, candidate.URL)
+        }
+    }
+    return strings.Join(parts, ", ")
+}
+
+func isHTMLSpace(c byte) bool {
+    return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+// splitURLSuffix 拆分引用中的路径与查询字符串/片段部分
+func splitURLSuffix(ref string) (string, string) {
+    if idx := strings.IndexAny(ref, "?#"); idx >= 0 {
+        return ref[:idx], ref[idx:]
+    }
+    return ref, ""
+}
+
+// versionParamRe 匹配 query 模式添加的 v=<hash> 参数
+var versionParamRe = regexp.MustCompile(`^v=[a-f0-9]+$`)
+
+// removeVersionParam 去掉 ?query#fragment 后缀中的 v=<hash> 参数，其余参数和片段保持不变
+func removeVersionParam(suffix string) string {
+    query, fragment := suffix, ""
+    if idx := strings.Index(suffix, "#"); idx >= 0 {
+        query, fragment = suffix[:idx], suffix[idx:]
+    }
+    
+    var kept []string
+    for _, param := range strings.Split(strings.TrimPrefix(query, "?"), "&") {
+        if param == "" || versionParamRe.MatchString(param) {
+            continue
+        }
+        kept = append(kept, param)
+    }
+    
+    if len(kept) > 0 {
+        return "?" + strings.Join(kept, "&") + fragment
+    }
+    return fragment
+}
+
+// trimVersionParam 在 query 模式下去掉上次运行添加的 ?v=<hash>，使重复运行时仍能识别该引用
+func (vm *VersionManager) trimVersionParam(ref string) string {
+    if !vm.queryMode() {
+        return ref
+    }
+    refPath, suffix := splitURLSuffix(ref)
+    if suffix != "" && removeVersionParam(suffix) == "" {
+        return refPath
+    }
+    return ref
+}
+
+// joinURLSuffix 将引用原有的 ?query/#fragment 拼接到新引用之后
+// query 模式下新引用已带 ?v=hash，去掉旧的 v= 参数并把其余参数用 & 连接
+func (vm *VersionManager) joinURLSuffix(newRef, suffix string) string {
+    if !vm.queryMode() {
+        return newRef + suffix
+    }
+    
+    rest := removeVersionParam(suffix)
+    if strings.HasPrefix(rest, "?") && strings.Contains(newRef, "?") {
+        rest = "&" + rest[1:]
+    }
+    return newRef + rest
+}
+
+// uriSchemeRe 匹配引用开头的 URI scheme（如 https:、data:、mailto:），单个字母视为 Windows 盘符而不是 scheme
+var uriSchemeRe = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]+:`)
+
+// isExternalOrSpecial 判断引用是否不是本地资源：带任意 scheme 的URI（不区分大小写，如 HTTPS://、data:、mailto:、tel:、javascript:）
+// 或协议相对URL（//cdn.x.com/a.js），这些引用一律不做hash
+func isExternalOrSpecial(ref string) bool {
+    ref = strings.TrimSpace(ref)
+    return strings.HasPrefix(ref, "//") || uriSchemeRe.MatchString(ref)
+}
+
+// collectSrcsetImages 收集HTML中 srcset 属性引用的本地图片
+func (vm *VersionManager) collectSrcsetImages(htmlPath string) ([]string, error) {
+    content, err := vm.readHTMLSource(htmlPath)
+    if err != nil {
+        return nil, err
+    }
+    
+    htmlDir := filepath.Dir(htmlPath)
+    var images []string
+    for _, match := range vm.srcsetRe().FindAllStringSubmatch(string(content), -1) {
+        value := match[2] + match[3]
+        for _, candidate := range parseSrcset(value) {
+            ref := vm.localFileRef(htmlDir, candidate.URL)
+            if isExternalOrSpecial(ref) {
+                continue
+            }
+            images = append(images, ref)
+        }
+    }
+    
+    return images, nil
+}
+
+// assetAttrRule 描述HTML中通过标签属性引用本地资源的规则
+type assetAttrRule struct {
+    Label  string                // 日志中显示的类型
+    Tag    string                // 标签名，为空时匹配任意标签
+    Attr   string                // 属性名
+    Accept func(tag string) bool // 额外的标签过滤条件，为 nil 时不过滤
+    Exts   []string              // 允许的扩展名，为空时不限制
+}
+
+// iconRelRe 匹配 rel="icon" / "shortcut icon" / "apple-touch-icon" 等图标链接
+var iconRelRe = regexp.MustCompile(`(?i)\srel\s*=\s*(?:"[^"]*\b(?:icon|apple-touch-icon(?:-precomposed)?)\b[^"]*"|'[^']*\b(?:icon|apple-touch-icon(?:-precomposed)?)\b[^']*'|(?:icon|apple-touch-icon(?:-precomposed)?)\b)`)
+
+// shareImageMetaRe 匹配社交分享图片的 meta 标签（og:image、twitter:image 及其变体）
+var shareImageMetaRe = regexp.MustCompile(`(?i)\s(?:property|name)\s*=\s*['"]?(?:og:image(?::url|:secure_url)?|twitter:image(?::src)?)['"\s/>]`)
+
+// manifestRelRe 匹配 rel="manifest" 链接
+var manifestRelRe = regexp.MustCompile(`(?i)\srel\s*=\s*(?:"[^"]*\bmanifest\b[^"]*"|'[^']*\bmanifest\b[^']*'|manifest\b)`)
+
+// assetAttrRules HTML中需要hash的标签属性引用
+var assetAttrRules = []assetAttrRule{
+    {
+        Label:  "ICON",
+        Tag:    "link",
+        Attr:   "href",
+        Accept: func(tag string) bool { return iconRelRe.MatchString(tag) },
+        Exts:   []string{".ico", ".png", ".svg"},
+    },
+    {
+        // <video>/<audio> 中的 <source src>（<picture> 中的 <source> 使用 srcset，不在此处理）
+        Label: "MEDIA",
+        Tag:   "source",
+        Attr:  "src",
+        Exts:  []string{".mp4", ".webm", ".ogg"},
+    },
+    {
+        Label: "TRACK",
+        Tag:   "track",
+        Attr:  "src",
+        Exts:  []string{".vtt"},
+    },
+    {
+        // <video poster> 视频封面图
+        Label: "POSTER",
+        Tag:   "video",
+        Attr:  "poster",
+        Exts:  []string{".jpg", ".jpeg", ".png", ".gif", ".webp", ".svg"},
+    },
+    {
+        // 内联SVG中 <use href="icons.svg#home"> 引用的外部 sprite，#片段保留（只有 #id 的文档内引用没有扩展名，不处理）
+        Label: "SPRITE",
+        Tag:   "use",
+        Attr:  "href",
+        Exts:  []string{".svg"},
+    },
+    {
+        // SVG 1.1 的旧写法 xlink:href
+        Label: "SPRITE",
+        Tag:   "use",
+        Attr:  "xlink:href",
+        Exts:  []string{".svg"},
+    },
+    {
+        // 分享图片由外部平台抓取，设置CDN域名后改写为完整的CDN地址
+        Label:  "SHARE",
+        Tag:    "meta",
+        Attr:   "content",
+        Accept: func(tag string) bool { return shareImageMetaRe.MatchString(tag) },
+        Exts:   []string{".jpg", ".jpeg", ".png", ".gif", ".webp", ".svg"},
+    },
+    {
+        // Web App Manifest 由 processManifest 改写其中的图标后再生成hash版本
+        Label:  "MANIFEST",
+        Tag:    "link",
+        Attr:   "href",
+        Accept: func(tag string) bool { return manifestRelRe.MatchString(tag) },
+        Exts:   []string{".webmanifest", ".json"},
+    },
+}
+
+// attrRules 返回需要hash的标签属性规则：内置规则加上 DataAttributes 中的 data-* 属性（任意标签，只接受 HashExtensions 中的扩展名）
+func (vm *VersionManager) attrRules() []assetAttrRule {
+    rules := append([]assetAttrRule(nil), assetAttrRules...)
+    exts := hashExtensionList(vm.config)
+    for _, attr := range vm.config.DataAttributes {
+        if isSrcsetAttr(attr) {
+            continue
+        }
+        rules = append(rules, assetAttrRule{
+            Label: "DATA",
+            Attr:  attr,
+            Exts:  exts,
+        })
+    }
+    return rules
+}
+
+// hashExtensionList 返回参与hash处理的扩展名（小写，带点）
+func hashExtensionList(config Config) []string {
+    extensions := config.HashExtensions
+    if len(extensions) == 0 {
+        extensions = defaultHashExtensions
+    }
+    
+    exts := make([]string, 0, len(extensions))
+    for _, ext := range extensions {
+        ext = strings.TrimPrefix(strings.TrimSpace(ext), ".")
+        if ext != "" {
+            exts = append(exts, "."+strings.ToLower(ext))
+        }
+    }
+    return exts
+}
+
+// tagRe 返回匹配指定标签开始标记的正则，tag 为空时匹配任意标签
+func tagRe(tag string) *regexp.Regexp {
+    if tag == "" {
+        return regexp.MustCompile(`(?is)<[a-z][a-z0-9-]*\b[^>]*>`)
+    }
+    return regexp.MustCompile(`(?is)<` + regexp.QuoteMeta(tag) + `\b[^>]*>`)
+}
+
+// attrRe 返回匹配指定属性的正则（第1组为属性名及等号，第2组为属性值，带引号时包含引号）
+func attrRe(attr string) *regexp.Regexp {
+    return regexp.MustCompile(`(?i)(\s` + regexp.QuoteMeta(attr) + `\s*=\s*)("[^"]*"|'[^']*'|[^\s"'=<>` + "`" + `]+)`)
+}
+
+// unquoteAttr 去掉属性值两端的引号，返回值和所用的引号（不带引号时为空）
+func unquoteAttr(raw string) (value, quote string) {
+    if len(raw) >= 2 && (raw[0] == '"' || raw[0] == '\'') && raw[len(raw)-1] == raw[0] {
+        return raw[1 : len(raw)-1], raw[:1]
+    }
+    return raw, ""
+}
+
+// tagAttrValues 返回HTML中所有 tag 标签的 attr 属性，每项为 [标签, 属性值]（属性顺序、换行、大小写和引号均不限）
+func tagAttrValues(content, tag, attr string) [][]string {
+    attrPattern := attrRe(attr)
+    var values [][]string
+    for _, match := range tagRe(tag).FindAllString(content, -1) {
+        if submatches := attrPattern.FindStringSubmatch(match); submatches != nil {
+            value, _ := unquoteAttr(submatches[2])
+            values = append(values, []string{match, value})
+        }
+    }
+    return values
+}
+
+// forEachAssetAttr 遍历HTML中符合规则的属性值，replace 返回新的属性值（不含引号）
+func (vm *VersionManager) forEachAssetAttr(content string, rule assetAttrRule, replace func(value string) string) string {
+    attrPattern := attrRe(rule.Attr)
+    return tagRe(rule.Tag).ReplaceAllStringFunc(content, func(tag string) string {
+        if rule.Accept != nil && !rule.Accept(tag) {
+            return tag
+        }
+        return attrPattern.ReplaceAllStringFunc(tag, func(attr string) string {
+            submatches := attrPattern.FindStringSubmatch(attr)
+            value, quote := unquoteAttr(submatches[2])
+            
+            if _, isCDN := vm.stripCDNPrefix(value); (isExternalOrSpecial(value) && !isCDN) || !rule.acceptsExt(value) {
+                return attr
+            }
+            return submatches[1] + quote + replace(value) + quote
+        })
+    })
+}
+
+// acceptsExt 判断引用的文件扩展名是否符合规则
+func (rule assetAttrRule) acceptsExt(ref string) bool {
+    if len(rule.Exts) == 0 {
+        return true
+    }
+    refPath, _ := splitURLSuffix(ref)
+    ext := strings.ToLower(path.Ext(refPath))
+    for _, allowed := range rule.Exts {
+        if ext == allowed {
+            return true
+        }
+    }
+    return false
+}
+
+// collectAttrAssets 收集HTML标签属性中引用的本地资源
+func (vm *VersionManager) collectAttrAssets(htmlPath string) ([]string, error) {
+    content, err := vm.readHTMLSource(htmlPath)
+    if err != nil {
+        return nil, err
+    }
+    
+    htmlDir := filepath.Dir(htmlPath)
+    var refs []string
+    for _, rule := range vm.attrRules() {
+        vm.forEachAssetAttr(string(content), rule, func(value string) string {
+            refs = append(refs, vm.localFileRef(htmlDir, value))
+            return value
+        })
+    }
+    
+    return refs, nil
+}
+
+// updateAttrAssetReferences 改写HTML标签属性中已hash的资源引用
+func (vm *VersionManager) updateAttrAssetReferences(contentStr string, assetMap map[string]string) (string, bool) {
+    updated := false
+    for _, rule := range vm.attrRules() {
+        label := rule.Label
+        contentStr = vm.forEachAssetAttr(contentStr, rule, func(value string) string {
+            assetPath, suffix := splitURLSuffix(vm.localAssetRef(value, assetMap))
+            key := strings.TrimPrefix(filepath.ToSlash(assetPath), "./")
+            newHashedPath, ok := assetMap[key]
+            if !ok {
+                return value
+            }
+            
+            newValue := vm.joinURLSuffix(vm.buildReferencePath(key, assetPath, newHashedPath), suffix)
+            if newValue != value {
+                updated = true
+                vm.logf("  ✅ %s: %s -> %s\n", label, filepath.Base(assetPath), filepath.Base(newValue))
+            }
+            return newValue
+        })
+    }
+    return contentStr, updated
+}
+
+// importMapRe 匹配 <script type="importmap"> 块：开始标签、JSON内容、结束标签
+var importMapRe = regexp.MustCompile(`(?is)(<script[^>]*\btype\s*=\s*['"]?importmap['"]?[^>]*>)(.*?)(</script>)`)
+
+// isLocalImportTarget 判断importmap中的地址是否为本地模块文件（以 ./ 或 ../ 开头，且不是以 / 结尾的目录映射）
+func isLocalImportTarget(value string) bool {
+    if !strings.HasPrefix(value, "./") && !strings.HasPrefix(value, "../") {
+        return false
+    }
+    return !strings.HasSuffix(value, "/")
+}
+
+// forEachImportMapTarget 遍历所有importmap块（imports 和 scopes）中的本地模块地址，replace 返回新地址
+// 有地址变化的块重新序列化写回，JSON无法解析或没有变化的块原样保留
+func (vm *VersionManager) forEachImportMapTarget(content string, replace func(value string) string) string {
+    return importMapRe.ReplaceAllStringFunc(content, func(block string) string {
+        submatches := importMapRe.FindStringSubmatch(block)
+        body := submatches[2]
+        
+        var importMap map[string]json.RawMessage
+        if err := json.Unmarshal([]byte(body), &importMap); err != nil {
+            return block
+        }
+        
+        changed := false
+        rewrite := func(specifiers map[string]string) {
+            for specifier, value := range specifiers {
+                _, isCDN := vm.stripCDNPrefix(value)
+                if !isCDN && !isLocalImportTarget(value) {
+                    continue
+                }
+                if newValue := replace(value); newValue != value {
+                    specifiers[specifier] = newValue
+                    changed = true
+                }
+            }
+        }
+        
+        var imports map[string]string
+        if raw, ok := importMap["imports"]; ok {
+            if err := json.Unmarshal(raw, &imports); err != nil {
+                return block
+            }
+            rewrite(imports)
+        }
+        
+        var scopes map[string]map[string]string
+        if raw, ok := importMap["scopes"]; ok {
+            if err := json.Unmarshal(raw, &scopes); err != nil {
+                return block
+            }
+            for _, specifiers := range scopes {
+                rewrite(specifiers)
+            }
+        }
+        
+        if !changed {
+            return block
+        }
+        
+        if imports != nil {
+            importMap["imports"], _ = marshalJSON(imports, "")
+        }
+        if scopes != nil {
+            importMap["scopes"], _ = marshalJSON(scopes, "")
+        }
+        
+        // 原内容是多行的，保持缩进格式输出
+        indent := ""
+        if strings.Contains(strings.TrimSpace(body), "\n") {
+            indent = "  "
+        }
+        data, err := marshalJSON(importMap, indent)
+        if err != nil {
+            return block
+        }
+        
+        newBody := string(data)
+        if indent != "" {
+            newBody = "\n" + newBody + "\n"
+        }
+        return submatches[1] + newBody + submatches[3]
+    })
+}
+
+// marshalJSON 序列化JSON（不转义 <、>、&），indent 非空时按缩进格式输出
+func marshalJSON(v interface{}, indent string) ([]byte, error) {
+    var buf strings.Builder
+    encoder := json.NewEncoder(&buf)
+    encoder.SetEscapeHTML(false)
+    if indent != "" {
+        encoder.SetIndent("", indent)
+    }
+    if err := encoder.Encode(v); err != nil {
+        return nil, err
+    }
+    return []byte(strings.TrimSuffix(buf.String(), "\n")), nil
+}
+
+// collectImportMapRefs 收集importmap中引用的本地模块文件
+func (vm *VersionManager) collectImportMapRefs(htmlPath string) ([]string, error) {
+    content, err := vm.readHTMLSource(htmlPath)
+    if err != nil {
+        return nil, err
+    }
+    
+    htmlDir := filepath.Dir(htmlPath)
+    var refs []string
+    vm.forEachImportMapTarget(string(content), func(value string) string {
+        refs = append(refs, vm.localFileRef(htmlDir, value))
+        return value
+    })
+    
+    return refs, nil
+}
+
+// updateImportMapReferences 改写importmap中已hash的本地模块地址
+func (vm *VersionManager) updateImportMapReferences(contentStr string, assetMap map[string]string) (string, bool) {
+    updated := false
+    newContent := vm.forEachImportMapTarget(contentStr, func(value string) string {
+        modulePath, suffix := splitURLSuffix(vm.localAssetRef(value, assetMap))
+        key := strings.TrimPrefix(modulePath, "./")
+        newHashedPath, ok := assetMap[key]
+        if !ok {
+            return value
+        }
+        
+        newValue := vm.joinURLSuffix(vm.buildReferencePath(key, modulePath, newHashedPath), suffix)
+        if newValue != value {
+            updated = true
+            vm.logf("  ✅ IMPORTMAP: %s -> %s\n", filepath.Base(modulePath), filepath.Base(newValue))
+        }
+        return newValue
+    })
+    return newContent, updated
+}
+
+// processHTMLImage 处理HTML直接引用的本地图片，返回hash后的文件信息
+func (vm *VersionManager) processHTMLImage(htmlDir, ref string) (*FileInfo, error) {
+    imagePath, _ := splitURLSuffix(ref)
+    absolutePath := filepath.Clean(filepath.Join(htmlDir, filepath.FromSlash(imagePath)))
+    
+    if vm.isOutsideRoot(absolutePath) {
+        return nil, errOutsideRoot
+    }
+    
+    if vm.isIgnoredPath(absolutePath) {
+        return nil, fmt.Errorf("已被 %s 忽略", ignoreFileName)
+    }
+    
+    actualPath := vm.findFile(absolutePath)
+    if actualPath == "" {
+        return nil, fmt.Errorf("文件不存在: %s", absolutePath)
+    }
+    
+    sourcePath := filepath.Join(filepath.Dir(actualPath), vm.removeHashFromFilename(filepath.Base(actualPath)))
+    if info, ok := vm.indexedResource(sourcePath); ok {
+        return info, nil
+    }
+    
+    var info *FileInfo
+    var err error
+    if isManifestFile(actualPath) {
+        info, err = vm.processManifest(actualPath)
+    } else {
+        info, err = vm.renameFileWithHash(actualPath)
+    }
+    if err != nil {
+        return nil, err
+    }
+    vm.indexResource(sourcePath, info)
+    
+    key, _ := vm.versionKey(info.OriginalPath)
+    vm.mu.Lock()
+    vm.versionMap[key] = info.Hash
+    vm.mu.Unlock()
+    
+    return info, nil
+}
+
+// manifestImageFields Web App Manifest 中包含图片 src 的数组字段
+var manifestImageFields = []string{"icons", "screenshots"}
+
+// isManifestFile 判断是否为 Web App Manifest 文件
+func isManifestFile(filePath string) bool {
+    ext := strings.ToLower(filepath.Ext(filePath))
+    return ext == ".webmanifest" || ext == ".json"
+}
+
+// forEachManifestImage 遍历 manifest 中 icons、screenshots 以及 shortcuts[].icons 的 src，replace 返回新的 src
+func forEachManifestImage(manifest map[string]interface{}, replace func(src string) string) {
+    rewrite := func(list interface{}) {
+        items, _ := list.([]interface{})
+        for _, item := range items {
+            image, ok := item.(map[string]interface{})
+            if !ok {
+                continue
+            }
+            if src, ok := image["src"].(string); ok && src != "" {
+                image["src"] = replace(src)
+            }
+        }
+    }
+    
+    for _, field := range manifestImageFields {
+        rewrite(manifest[field])
+    }
+    shortcuts, _ := manifest["shortcuts"].([]interface{})
+    for _, shortcut := range shortcuts {
+        if entry, ok := shortcut.(map[string]interface{}); ok {
+            rewrite(entry["icons"])
+        }
+    }
+}
+
+// processManifest 处理 Web App Manifest：hash其中引用的本地图标并改写 src，再生成hash版本的manifest
+func (vm *VersionManager) processManifest(manifestPath string) (*FileInfo, error) {
+    defer vm.setRefOwner(manifestPath)()
+    manifestDir := filepath.Dir(manifestPath)
+    cleanFilename := vm.removeHashFromFilename(filepath.Base(manifestPath))
+    
+    // 确保使用原始manifest文件
+    originalPath := filepath.Join(manifestDir, cleanFilename)
+    if !vm.fileExists(originalPath) {
+        originalPath = manifestPath
+    }
+    
+    if vm.isExcludedFile(originalPath) {
+        return nil, errExcluded
+    }
+    
+    vm.recordDependency(originalPath)
+    
+    content, err := vm.fsys.ReadFile(originalPath)
+    if err != nil {
+        return nil, err
+    }
+    bom, body := splitBOM(content)
+    
+    var manifest map[string]interface{}
+    if err := json.Unmarshal(body, &manifest); err != nil {
+        return nil, fmt.Errorf("解析manifest失败: %v", err)
+    }
+    
+    // 图标路径相对 manifest 所在目录解析，改写时也以该目录为基准
+    prevRefDir := vm.refDir
+    vm.refDir = manifestDir
+    defer func() { vm.refDir = prevRefDir }()
+    
+    forEachManifestImage(manifest, func(src string) string {
+        ref := vm.localFileRef(manifestDir, src)
+        if isExternalOrSpecial(ref) {
+            return src
+        }
+        
+        info, err := vm.processHTMLImage(manifestDir, ref)
+        if err != nil {
+            vm.logf("    ⚠️  跳过图标: %s (%v)\n", src, err)
+            return src
+        }
+        
+        assetPath, suffix := splitURLSuffix(ref)
+        key := strings.TrimPrefix(filepath.ToSlash(assetPath), "./")
+        hashedRelPath, _ := filepath.Rel(manifestDir, info.HashedPath)
+        newSrc := vm.joinURLSuffix(vm.buildReferencePath(key, assetPath, filepath.ToSlash(hashedRelPath)), suffix)
+        if newSrc != src {
+            vm.logf("    ✅ ICON: %s -> %s\n", filepath.Base(assetPath), filepath.Base(newSrc))
+        }
+        return newSrc
+    })
+    
+    data, err := marshalJSON(manifest, "  ")
+    if err != nil {
+        return nil, err
+    }
+    data = append(bom, data...)
+    
+    hash := vm.truncateHash(manifestPath, vm.hashContent(manifestPath, data))
+    info := &FileInfo{
+        OriginalPath: originalPath,
+        HashedPath:   filepath.Join(manifestDir, vm.addHashToFilename(cleanFilename, hash)),
+        Hash:         hash,
+        Renamed:      true,
+    }
+    
+    // query 模式直接更新原manifest，引用中使用 ?v=hash
+    if vm.queryMode() {
+        if !bytes.Equal(content, data) {
+            if err := vm.writeFile(originalPath, data); err != nil {
+                return nil, err
+            }
+            vm.invalidateHash(originalPath)
+        }
+        vm.recordFile(info, statusVersioned)
+        return info, nil
+    }
+    
+    if err := vm.claimHashedPath(info.HashedPath, originalPath); err != nil {
+        return nil, err
+    }
+    
+    if existing, err := vm.fsys.ReadFile(info.HashedPath); err == nil && bytes.Equal(existing, data) && !vm.config.ForceRegen {
+        vm.precompress(info.HashedPath, false)
+        vm.recordFile(info, statusSkipped)
+        return info, nil
+    }
+    
+    if err := vm.fsys.WriteFile(info.HashedPath, data, 0644); err != nil {
+        return nil, fmt.Errorf("写入manifest失败: %v", err)
+    }
+    vm.invalidateHash(info.HashedPath)
+    vm.logEvent("generate", info.HashedPath, hash, "  ✅ 已生成: %s\n", filepath.Base(info.HashedPath))
+    vm.precompress(info.HashedPath, true)
+    vm.recordFile(info, statusGenerated)
+    
+    // 删除旧的manifest hash文件
+    ext := filepath.Ext(cleanFilename)
+    if err := vm.findAndDeleteOldHashFiles(manifestDir, strings.TrimSuffix(cleanFilename, ext), ext, hash); err != nil {
+        if vm.debugMode {
+            vm.logf("  ⚠️  清理旧文件时出错: %v\n", err)
+        }
+    }
+    
+    return info, nil
+}
+
+// updateSrcsetReferences 改写 srcset 中已hash的图片，未处理的候选项原样保留
+func (vm *VersionManager) updateSrcsetReferences(contentStr string, assetMap map[string]string) (string, bool) {
+    updated := false
+    
+    re := vm.srcsetRe()
+    newContent := re.ReplaceAllStringFunc(contentStr, func(match string) string {
+        submatches := re.FindStringSubmatch(match)
+        quote := `"`
+        value := submatches[2]
+        if strings.HasPrefix(strings.TrimPrefix(match, submatches[1]), "'") {
+            quote = "'"
+            value = submatches[3]
+        }
+        
+        candidates := parseSrcset(value)
+        changed := false
+        for i, candidate := range candidates {
+            ref := vm.localAssetRef(candidate.URL, assetMap)
+            if isExternalOrSpecial(ref) {
+                continue
+            }
+            
+            imagePath, suffix := splitURLSuffix(ref)
+            key := strings.TrimPrefix(filepath.ToSlash(imagePath), "./")
+            newHashedPath, ok := assetMap[key]
+            if !ok {
+                continue
+            }
+            
+            newURL := vm.joinURLSuffix(vm.buildReferencePath(key, imagePath, newHashedPath), suffix)
+            if newURL != candidate.URL {
+                vm.logf("  ✅ IMG: %s -> %s\n", filepath.Base(imagePath), filepath.Base(newURL))
+                candidates[i].URL = newURL
+                changed = true
+            }
+        }
+        
+        if !changed {
+            return match
+        }
+        updated = true
+        return submatches[1] + quote + formatSrcset(candidates) + quote
+    })
+    
+    return newContent, updated
+}
+
+// preloadRelRe 匹配 rel="preload" 或 rel="modulepreload"
+var preloadRelRe = regexp.MustCompile(`(?i)\srel\s*=\s*(?:"[^"]*\b(?:module)?preload\b[^"]*"|'[^']*\b(?:module)?preload\b[^']*'|(?:module)?preload\b)`)
+
+// isPreloadLink 判断 <link> 标签是否为 preload / modulepreload
+func isPreloadLink(tag string) bool {
+    return preloadRelRe.MatchString(tag)
+}
+
+// replaceTagReferences 依次尝试 patterns，将标签中的资源路径改写为hash后的路径，
+// 第一个发生替换的模式生效；accept 不为 nil 时只改写其返回 true 的标签
+func (vm *VersionManager) replaceTagReferences(contentStr, htmlDir, label string, patterns []string, originalRelPath, newHashedPath string, accept func(tag string) bool) (string, bool) {
+    matched := false
+    for _, pattern := range patterns {
+        re := regexp.MustCompile(pattern)
+        if !re.MatchString(contentStr) {
+            continue
+        }
+        
+        contentStr = re.ReplaceAllStringFunc(contentStr, func(match string) string {
+            if accept != nil && !accept(match) {
+                return match
+            }
+            
+            submatches := re.FindStringSubmatch(match)
+            if len(submatches) < 4 {
+                return match
+            }
+            prefix := submatches[1]
+            oldPath := submatches[2]
+            suffix := submatches[3]
+            
+            newPath := vm.buildReferencePath(originalRelPath, oldPath, newHashedPath)
+            
+            result := fmt.Sprintf("%s%s%s", prefix, newPath, suffix)
+            
+            if vm.config.EmitSRI {
+                hashedRelPath, _ := splitURLSuffix(newHashedPath)
+                hashedFile := filepath.Join(htmlDir, filepath.FromSlash(hashedRelPath))
+                integrity, err := vm.calculateSRI(hashedFile)
+                if err != nil {
+                    vm.logf("  ⚠️  计算SRI失败: %s (%v)\n", filepath.Base(hashedFile), err)
+                } else {
+                    result = setSRIAttributes(result, integrity)
+                }
+            }
+            
+            if match != result {
+                matched = true
+                vm.logf("  ✅ %s: %s -> %s\n", label, filepath.Base(oldPath), filepath.Base(newPath))
+            }
+            return result
+        })
+        
+        if matched {
+            break
+        }
+    }
+    
+    return contentStr, matched
+}
+
+// updateHTMLReferences 更新HTML中的资源引用
+func (vm *VersionManager) updateHTMLReferences(htmlPath string, resources map[string]map[string]string) error {
+    content, err := vm.fsys.ReadFile(htmlPath)
+    if err != nil {
+        return err
+    }
+    
+    htmlDir := filepath.Dir(htmlPath)
+    bom, content := splitBOM(content)
+    // 注释中的引用不做替换，写回前原样还原
+    contentStr, comments := maskHTMLComments(string(content))
+    updated := false
+    
+    // 处理CSS引用（包括 rel="preload" 的CSS）
+    if cssMap, ok := resources["css"]; ok {
+        for _, originalRelPath := range sortedKeys(cssMap) {
+            newHashedPath := cssMap[originalRelPath]
+            // 支持多种引用格式的正则表达式
+            patterns := vm.tagRefPatterns(tagAttrPrefix("link", "href"), originalRelPath)
+            
+            newContent, matched := vm.replaceTagReferences(contentStr, htmlDir, "CSS", patterns, originalRelPath, newHashedPath, nil)
+            contentStr = newContent
+            if matched {
+                updated = true
+            } else if vm.debugMode {
+                vm.logf("  ⚠️  未匹配CSS: %s\n", originalRelPath)
+            }
+        }
+    }
+    
+    // 处理JS引用
+    if jsMap, ok := resources["js"]; ok {
+        for _, originalRelPath := range sortedKeys(jsMap) {
+            newHashedPath := jsMap[originalRelPath]
+            patterns := vm.tagRefPatterns(tagAttrPrefix("script", "src"), originalRelPath)
+            
+            newContent, matched := vm.replaceTagReferences(contentStr, htmlDir, "JS", patterns, originalRelPath, newHashedPath, nil)
+            contentStr = newContent
+            
+            // <link rel="preload"> / <link rel="modulepreload"> 预加载的JS
+            preloadPatterns := vm.tagRefPatterns(tagAttrPrefix("link", "href"), originalRelPath)
+            
+            newContent, preloadMatched := vm.replaceTagReferences(contentStr, htmlDir, "JS(preload)", preloadPatterns, originalRelPath, newHashedPath, isPreloadLink)
+            contentStr = newContent
+            
+            if matched || preloadMatched {
+                updated = true
+            } else if vm.debugMode {
+                vm.logf("  ⚠️  未匹配JS: %s\n", originalRelPath)
+            }
+        }
+    }
+    
+    // 处理内联样式中的图片引用
+    if styleMap, ok := resources["style"]; ok && len(styleMap) > 0 {
+        newContent, styleUpdated := vm.updateInlineStyleReferences(contentStr, styleMap)
+        if styleUpdated {
+            contentStr = newContent
+            updated = true
+        }
+    }
+    
+    // 处理 srcset、标签属性（图标等）和 importmap 中直接引用的资源
+    if assetMap, ok := resources["asset"]; ok && len(assetMap) > 0 {
+        newContent, srcsetUpdated := vm.updateSrcsetReferences(contentStr, assetMap)
+        if srcsetUpdated {
+            contentStr = newContent
+            updated = true
+        }
+        
+        newContent, attrUpdated := vm.updateAttrAssetReferences(contentStr, assetMap)
+        if attrUpdated {
+            contentStr = newContent
+            updated = true
+        }
+        
+        newContent, importMapUpdated := vm.updateImportMapReferences(contentStr, assetMap)
+        if importMapUpdated {
+            contentStr = newContent
+            updated = true
+        }
+        
+        newContent, moduleUpdated := vm.updateInlineModuleReferences(contentStr, assetMap)
+        if moduleUpdated {
+            contentStr = newContent
+            updated = true
+        }
+        
+        newContent, customUpdated := vm.updateCustomReferences(contentStr, assetMap)
+        if customUpdated {
+            contentStr = newContent
+            updated = true
+        }
+    }
+    
+    // 引用已是最新（如重复运行）时内容不变，不写回文件
+    if updated {
+        contentStr = restoreHTMLComments(contentStr, comments)
+        updated = contentStr != string(content)
+    }
+    
+    if updated {
+        vm.printDiff(htmlPath, string(content), contentStr)
+        if err := vm.writeFile(htmlPath, append(bom, contentStr...)); err != nil {
+            return err
+        }
+        vm.logf("\n✅ HTML文件已更新\n")
+    } else {
+        vm.logf("\n⚠️  没有内容需要更新\n")
+    }
+    vm.recordHTMLResult(htmlPath, updated)
+    
+    return nil
+}
+
+// recordHTMLResult 在报告中记录HTML文件是否被改写
+func (vm *VersionManager) recordHTMLResult(htmlPath string, changed bool) {
+    vm.mu.Lock()
+    defer vm.mu.Unlock()
+    if changed {
+        vm.report.Changed = append(vm.report.Changed, vm.reportPath(htmlPath))
+    } else {
+        vm.report.Unchanged = append(vm.report.Unchanged, vm.reportPath(htmlPath))
+    }
+}
+
+// printHTMLResults 批量处理结束时列出被改写和无需改写的HTML文件
+func (vm *VersionManager) printHTMLResults() {
+    vm.mu.Lock()
+    changed, unchanged := vm.report.Changed, vm.report.Unchanged
+    vm.mu.Unlock()
+    
+    vm.logf("📊 已改写 %d 个HTML文件:\n", len(changed))
+    for _, htmlPath := range changed {
+        vm.logf("   - %s\n", htmlPath)
+    }
+    vm.logf("📊 未变化 %d 个HTML文件:\n", len(unchanged))
+    for _, htmlPath := range unchanged {
+        vm.logf("   - %s\n", htmlPath)
+    }
+}
+
+// reportTiming 开启 -timing 时输出各阶段耗时表，并写入运行报告
+func (vm *VersionManager) reportTiming(htmlPath string, timer *phaseTimer) {
+    if !vm.showTiming {
+        return
+    }
+    
+    timing := PageTiming{
+        HTMLFile: vm.reportPath(htmlPath),
+        Phases:   timer.phases,
+        TotalMs:  durationMs(time.Since(timer.start)),
+    }
+    
+    vm.logln("\n⏱️  阶段耗时:")
+    for i, phase := range timing.Phases {
+        vm.logf("  %d. %10.2f ms  %s\n", i+1, phase.Ms, phase.Name)
+    }
+    vm.logf("     %10.2f ms  合计\n", timing.TotalMs)
+    
+    vm.mu.Lock()
+    vm.report.Timings = append(vm.report.Timings, timing)
+    vm.mu.Unlock()
+}
+
+// depKind 依赖图中资源的类型，按处理顺序排列
+type depKind int
+
+const (
+    depImage depKind = iota // 图片等不依赖其他资源的文件
+    depCSS                  // CSS，依赖其中引用的图片
+    depJS                   // JS
+    depHTML                 // HTML，依赖以上所有资源
+)
+
+// phaseName 返回该类资源处理阶段的名称（用于 -timing 和日志的 phase 字段）
+func (kind depKind) phaseName() string {
+    switch kind {
+    case depImage:
+        return "图片"
+    case depCSS:
+        return "CSS"
+    case depJS:
+        return "JS"
+    default:
+        return "更新 HTML"
+    }
+}
+
+// header 返回开始处理该类资源时输出的标题
+func (kind depKind) header() string {
+    switch kind {
+    case depImage:
+        return "\n🖼️  处理图片等资源..."
+    case depCSS:
+        return "\n🎨 处理 CSS 文件..."
+    case depJS:
+        return "\n📦 处理 JavaScript 文件..."
+    default:
+        return ""
+    }
+}
+
+// depNode 依赖图中的一个待处理资源
+type depNode struct {
+    key     string
+    kind    depKind
+    deps    []string     // 必须先处理的节点
+    process func() error // 处理该资源并记录结果
+    seq     int          // 加入顺序，同类资源按加入顺序处理
+}
+
+// depGraph 一个HTML页面的资源依赖图
+type depGraph struct {
+    nodes map[string]*depNode
+    seq   []string
+}
+
+func newDepGraph() *depGraph {
+    return &depGraph{nodes: make(map[string]*depNode)}
+}
+
+// add 添加节点，同一个 key 只保留第一次添加的节点
+func (g *depGraph) add(key string, kind depKind, deps []string, process func() error) {
+    if _, exists := g.nodes[key]; exists {
+        return
+    }
+    g.nodes[key] = &depNode{key: key, kind: kind, deps: deps, process: process, seq: len(g.seq)}
+    g.seq = append(g.seq, key)
+}
+
+// keys 返回已添加节点的 key（按加入顺序）
+func (g *depGraph) keys() []string {
+    return append([]string(nil), g.seq...)
+}
+
+// order 按拓扑顺序返回节点：依赖总在被依赖者之前，可同时处理的节点按类型、再按加入顺序排列
+func (g *depGraph) order() ([]*depNode, error) {
+    pending := make(map[string]int, len(g.nodes))
+    dependents := make(map[string][]string)
+    for key, node := range g.nodes {
+        for _, dep := range node.deps {
+            if _, ok := g.nodes[dep]; !ok {
+                continue
+            }
+            pending[key]++
+            dependents[dep] = append(dependents[dep], key)
+        }
+    }
+    
+    var ready []*depNode
+    for _, key := range g.seq {
+        if pending[key] == 0 {
+            ready = append(ready, g.nodes[key])
+        }
+    }
+    
+    ordered := make([]*depNode, 0, len(g.nodes))
+    for len(ready) > 0 {
+        sort.SliceStable(ready, func(i, j int) bool {
+            if ready[i].kind != ready[j].kind {
+                return ready[i].kind < ready[j].kind
+            }
+            return ready[i].seq < ready[j].seq
+        })
+        node := ready[0]
+        ready = ready[1:]
+        ordered = append(ordered, node)
+        
+        for _, key := range dependents[node.key] {
+            if pending[key]--; pending[key] == 0 {
+                ready = append(ready, g.nodes[key])
+            }
+        }
+    }
+    
+    if len(ordered) != len(g.nodes) {
+        return nil, fmt.Errorf("资源依赖存在循环")
+    }
+    return ordered, nil
+}
+
+// processHTMLFile 处理单个HTML文件及其关联资源
+func (vm *VersionManager) processHTMLFile(htmlPath string) error {
+    vm.logger.setFile(htmlPath)
+    defer vm.logger.setFile("")
+    defer vm.setRefOwner(htmlPath)()
+    
+    vm.logln(strings.Repeat("=", 60))
+    vm.logf("📄 处理: %s\n", htmlPath)
+    vm.logln(strings.Repeat("=", 60))
+    
+    if !vm.fileExists(htmlPath) {
+        return fmt.Errorf("文件不存在: %s", htmlPath)
+    }
+    
+    // 记录本HTML依赖的源文件，供监听模式判断哪些HTML需要重新处理
+    vm.mu.Lock()
+    vm.currentDeps = make(map[string]bool)
+    vm.mu.Unlock()
+    defer func() {
+        vm.mu.Lock()
+        if absPath, err := filepath.Abs(htmlPath); err == nil {
+            vm.dependencies[absPath] = vm.currentDeps
+        }
+        vm.currentDeps = nil
+        vm.mu.Unlock()
+    }()
+    
+    // HTML 位于 RootDir 内时，其引用的资源也必须位于 RootDir 内
+    vm.guardRoot = vm.guardRootFor(htmlPath)
+    vm.refDir = filepath.Dir(htmlPath)
+    defer func() { vm.guardRoot, vm.refDir = "", "" }()
+    
+    htmlDir := filepath.Dir(htmlPath)
+    htmlBasename := strings.TrimSuffix(filepath.Base(htmlPath), ".html")
+    
+    resources := map[string]map[string]string{
+        "css": make(map[string]string),
+        "js":  make(map[string]string),
+        // HTML直接引用的资源（srcset、图标等）：规范化路径 -> hash后的相对路径
+        "asset": make(map[string]string),
+        // 内联样式中的图片：原始引用 -> hash后的文件名
+        "style": make(map[string]string),
+    }
+    
+    // 记录各阶段耗时（-timing）
+    timer := newPhaseTimer()
+    vm.logger.setPhase("扫描依赖")
+    
+    // 1. 收集本页面引用的资源，建立依赖图：图片 → CSS → JS → HTML
+    vm.logln("\n🔍 扫描依赖...")
+    graph := newDepGraph()
+    
+    // addResult 记录处理结果：resources[kind][key] = hash后相对 htmlDir 的路径
+    addResult := func(kind, key string, info *FileInfo) {
+        hashedRelPath, _ := filepath.Rel(htmlDir, info.HashedPath)
+        resources[kind][key] = filepath.ToSlash(hashedRelPath)
+    }
+    
+    // addCSS 添加CSS节点，CSS中引用的图片作为其依赖先处理
+    addCSS := func(key, cssPath string, process func() error) {
+        var deps []string
+        if cssPath != "" {
+            images, err := vm.collectImagesFromCSS(cssPath)
+            if err != nil {
+                vm.logf("  ⚠️  扫描CSS失败: %s (%v)\n", filepath.Base(cssPath), err)
+            }
+            for _, image := range images {
+                imagePath := image.AbsolutePath
+                depKey := "image:" + imagePath
+                // 失败时不在这里报告，由CSS处理图片引用时统一报告
+                graph.add(depKey, depImage, nil, func() error {
+                    vm.hashImage(imagePath)
+                    return nil
+                })
+                deps = append(deps, depKey)
+            }
+        }
+        graph.add("css:"+key, depCSS, deps, process)
+    }
+    
+    // 主JS文件
+    jsPaths := []string{
+        filepath.Join(htmlDir, htmlBasename+".js"),
+        filepath.Join(htmlDir, "js", htmlBasename+".js"),
+        filepath.Join(htmlDir, "scripts", "js", htmlBasename+".js"),
+    }
+    
+    mainJsFound := false
+    for _, jsPath := range jsPaths {
+        actualJsPath := vm.findFile(jsPath)
+        if actualJsPath == "" || vm.isIgnoredPath(actualJsPath) {
+            continue
+        }
+        
+        relPath, _ := filepath.Rel(htmlDir, actualJsPath)
+        key := strings.TrimPrefix(filepath.ToSlash(relPath), "./")
+        graph.add("js:"+key, depJS, nil, func() error {
+            info, err := vm.renameFileWithHash(actualJsPath)
+            if vm.skipExcluded(err, filepath.Base(actualJsPath)) {
+                return nil
+            }
+            if err != nil {
+                return err
+            }
+            if _, exists := resources["js"][key]; !exists {
+                addResult("js", key, info)
+            }
+            return nil
+        })
+        mainJsFound = true
+        break
+    }
+    
+    if !mainJsFound {
+        vm.logf("  ℹ️  未找到主JS文件\n")
+    }
+    
+    // 主CSS文件
+    cssPaths := []string{
+        filepath.Join(htmlDir, htmlBasename+".css"),
+        filepath.Join(htmlDir, "css", htmlBasename+".css"),
+    }
+    
+    mainCssFound := false
+    for _, cssPath := range cssPaths {
+        actualCssPath := vm.findFile(cssPath)
+        if actualCssPath == "" || vm.isIgnoredPath(actualCssPath) {
+            continue
+        }
+        
+        relPath, _ := filepath.Rel(htmlDir, actualCssPath)
+        key := strings.TrimPrefix(filepath.ToSlash(relPath), "./")
+        addCSS(key, actualCssPath, func() error {
+            info, err := vm.processComponentCSS(actualCssPath)
+            if vm.skipExcluded(err, filepath.Base(actualCssPath)) {
+                return nil
+            }
+            if err != nil {
+                return err
+            }
+            if _, exists := resources["css"][key]; !exists {
+                addResult("css", key, info)
+            }
+            return nil
+        })
+        mainCssFound = true
+        break
+    }
+    
+    if !mainCssFound {
+        vm.logf("  ℹ️  未找到主CSS文件\n")
+    }
+    
+    // 组件资源
+    htmlResources, err := vm.collectResourcesFromHTML(htmlPath)
+    if err != nil {
+        return fmt.Errorf("扫描HTML失败: %v", err)
+    }
+    
+    vm.logf("  找到 %d 个组件CSS, %d 个组件JS\n", len(htmlResources["css"]), len(htmlResources["js"]))
+    
+    // componentProcess 返回处理组件资源的函数，失败时记录错误后继续处理其他资源
+    componentProcess := func(kind, relPath, key string) func() error {
+        return func() error {
+            if _, exists := resources[kind][key]; exists {
+                return nil
+            }
+            info, err := vm.processComponentResource(htmlDir, relPath)
+            if vm.skipExcluded(err, relPath) {
+                return nil
+            }
+            if err != nil {
+                vm.logf("  ❌ 失败: %s\n", relPath)
+                vm.recordError("%s: %v", relPath, err)
+                return nil
+            }
+            addResult(kind, key, info)
+            return nil
+        }
+    }
+    
+    for _, jsRelPath := range htmlResources["js"] {
+        key := strings.TrimPrefix(strings.ReplaceAll(jsRelPath, "\\", "/"), "./")
+        graph.add("js:"+key, depJS, nil, componentProcess("js", jsRelPath, key))
+    }
+    for _, cssRelPath := range htmlResources["css"] {
+        key := strings.TrimPrefix(strings.ReplaceAll(cssRelPath, "\\", "/"), "./")
+        cssPath := vm.findFile(filepath.Clean(filepath.Join(htmlDir, filepath.FromSlash(cssRelPath))))
+        if cssPath != "" && vm.isOutsideRoot(cssPath) {
+            cssPath = ""
+        }
+        addCSS(key, cssPath, componentProcess("css", cssRelPath, key))
+    }
+    
+    // HTML直接引用的资源（srcset 响应式图片、图标、importmap 模块等）
+    assetRefs, err := vm.collectSrcsetImages(htmlPath)
+    if err != nil {
+        return fmt.Errorf("扫描HTML失败: %v", err)
+    }
+    attrRefs, err := vm.collectAttrAssets(htmlPath)
+    if err != nil {
+        return fmt.Errorf("扫描HTML失败: %v", err)
+    }
+    assetRefs = append(assetRefs, attrRefs...)
+    importRefs, err := vm.collectImportMapRefs(htmlPath)
+    if err != nil {
+        return fmt.Errorf("扫描HTML失败: %v", err)
+    }
+    assetRefs = append(assetRefs, importRefs...)
+    moduleRefs, err := vm.collectInlineModuleRefs(htmlPath)
+    if err != nil {
+        return fmt.Errorf("扫描HTML失败: %v", err)
+    }
+    assetRefs = append(assetRefs, moduleRefs...)
+    customRefs, err := vm.collectCustomRefs(htmlPath)
+    if err != nil {
+        return fmt.Errorf("扫描HTML失败: %v", err)
+    }
+    assetRefs = append(assetRefs, customRefs...)
+    
+    for _, assetRef := range assetRefs {
+        imageRef := assetRef
+        imagePath, _ := splitURLSuffix(imageRef)
+        key := strings.TrimPrefix(filepath.ToSlash(imagePath), "./")
+        graph.add("asset:"+key, depImage, nil, func() error {
+            info, err := vm.processHTMLImage(htmlDir, imageRef)
+            if err != nil {
+                vm.logf("  ⚠️  跳过: %s (%v)\n", imageRef, err)
+                return nil
+            }
+            addResult("asset", key, info)
+            return nil
+        })
+    }
+    
+    // 内联样式中的图片
+    styleImages, err := vm.collectInlineStyleImages(htmlPath)
+    if err != nil {
+        return fmt.Errorf("扫描HTML失败: %v", err)
+    }
+    
+    for _, styleImage := range styleImages {
+        image := styleImage
+        graph.add("style:"+image.OriginalPath, depImage, nil, func() error {
+            info, err := vm.hashImage(image.AbsolutePath)
+            if vm.skipExcluded(err, image.OriginalPath) {
+                return nil
+            }
+            if err != nil {
+                vm.logf("  ⚠️  失败: %s (%v)\n", filepath.Base(image.AbsolutePath), err)
+                vm.recordError("%s: %v", image.AbsolutePath, err)
+                return nil
+            }
+            resources["style"][image.OriginalPath] = filepath.Base(info.HashedPath)
+            return nil
+        })
+    }
+    
+    // HTML 依赖以上所有资源，最后更新
+    graph.add("html:"+htmlPath, depHTML, graph.keys(), func() error {
+        vm.logln("\n🔄 更新HTML中的资源引用...")
+        vm.logf("  📋 CSS: %d 项, JS: %d 项, 图片: %d 项\n", len(resources["css"]), len(resources["js"]), len(resources["asset"])+len(resources["style"]))
+        
+        if err := vm.updateHTMLReferences(htmlPath, resources); err != nil {
+            return fmt.Errorf("更新HTML失败: %v", err)
+        }
+        return nil
+    })
+    
+    nodes, err := graph.order()
+    if err != nil {
+        return err
+    }
+    
+    timer.done("扫描依赖")
+    
+    // 2. 按依赖自底向上处理：每个文件在其依赖处理完之后按最终内容hash一次
+    phase := ""
+    for _, node := range nodes {
+        if name := node.kind.phaseName(); name != phase {
+            if phase != "" {
+                timer.done(phase)
+            }
+            phase = name
+            vm.logger.setPhase(phase)
+            if header := node.kind.header(); header != "" {
+                vm.logln(header)
+            }
+        }
+        
+        if err := node.process(); err != nil {
+            if node.kind == depHTML {
+                return err
+            }
+            vm.logf("  ❌ 处理失败: %v\n", err)
+            vm.recordError("%v", err)
+        }
+    }
+    timer.done(phase)
+    vm.reportTiming(htmlPath, timer)
+    
+    vm.logln("\n✨ 处理完成!")
+    return nil
+}
+
+// stdinHTMLName -stdin 模式下HTML的虚拟文件名（位于 -base-dir 中，主JS/CSS按此名称查找）
+const stdinHTMLName = "stdin.html"
+
+// processHTMLStream 处理从 r 读入的HTML，相对引用以 baseDir 为基准解析，改写后的HTML写入 w；
+// 引用的资源照常在磁盘上生成hash文件，HTML本身不读写磁盘
+func (vm *VersionManager) processHTMLStream(r io.Reader, w io.Writer, baseDir string) error {
+    content, err := io.ReadAll(r)
+    if err != nil {
+        return fmt.Errorf("读取输入失败: %v", err)
+    }
+    
+    htmlPath := filepath.Join(baseDir, stdinHTMLName)
+    memFS := &memFileFS{FileSystem: vm.fsys, name: filepath.Clean(htmlPath), content: content, modTime: time.Now()}
+    prevFS := vm.fsys
+    vm.fsys = memFS
+    defer func() { vm.fsys = prevFS }()
+    
+    if err := vm.processHTMLFile(htmlPath); err != nil {
+        return err
+    }
+    
+    _, err = w.Write(memFS.content)
+    return err
+}
+
+// guardRootFor 文件位于 RootDir 内时返回 RootDir 的绝对路径，否则返回空（不限制引用范围）
+func (vm *VersionManager) guardRootFor(filePath string) string {
+    rootDir, err := filepath.Abs(vm.config.RootDir)
+    if err != nil {
+        return ""
+    }
+    absPath, err := filepath.Abs(filePath)
+    if err != nil || !isWithinDir(rootDir, absPath) {
+        return ""
+    }
+    return rootDir
+}
+
+// processCSSFile 单独处理一个CSS文件（不依赖HTML）：hash其中的图片并生成hash版本的CSS
+func (vm *VersionManager) processCSSFile(cssPath string) error {
+    vm.logger.setFile(cssPath)
+    defer vm.logger.setFile("")
+    defer vm.setRefOwner(cssPath)()
+    
+    vm.logln(strings.Repeat("=", 60))
+    vm.logf("🎨 处理CSS: %s\n", cssPath)
+    vm.logln(strings.Repeat("=", 60))
+    
+    if !vm.fileExists(cssPath) {
+        return fmt.Errorf("文件不存在: %s", cssPath)
+    }
+    
+    vm.guardRoot = vm.guardRootFor(cssPath)
+    defer func() { vm.guardRoot = "" }()
+    
+    info, err := vm.processComponentCSS(cssPath)
+    if errors.Is(err, errExcluded) {
+        vm.logf("  ⏭️  已排除: %s\n", cssPath)
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    
+    vm.logEvent("generate", info.HashedPath, info.Hash, "  ✅ %s -> %s\n", filepath.Base(info.OriginalPath), filepath.Base(info.HashedPath))
+    vm.logln("\n✨ 处理完成!")
+    return nil
+}
+
+// isGlobPattern 判断路径是否包含通配符
+func isGlobPattern(path string) bool {
+    return strings.ContainsAny(path, "*?[")
+}
+
+// matchGlob 匹配 doublestar 风格的通配符（路径使用正斜杠，** 匹配任意层目录）
+func matchGlob(pattern, name string) bool {
+    return matchGlobSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchGlobSegments(patterns, names []string) bool {
+    for len(patterns) > 0 {
+        if patterns[0] == "**" {
+            // ** 可匹配零个或多个目录
+            for i := 0; i <= len(names); i++ {
+                if matchGlobSegments(patterns[1:], names[i:]) {
+                    return true
+                }
+            }
+            return false
+        }
+        
+        if len(names) == 0 {
+            return false
+        }
+        if ok, err := filepath.Match(patterns[0], names[0]); err != nil || !ok {
+            return false
+        }
+        patterns = patterns[1:]
+        names = names[1:]
+    }
+    
+    return len(names) == 0
+}
+
+// expandHTMLFiles 展开 HTMLFiles 中的通配符（相对 RootDir，跳过排除的目录）并去重
+func (vm *VersionManager) expandHTMLFiles(entries []string) []string {
+    var expanded []string
+    seen := make(map[string]bool)
+    add := func(path string) {
+        key := filepath.Clean(path)
+        if !seen[key] {
+            seen[key] = true
+            expanded = append(expanded, path)
+        }
+    }
+    
+    var allFiles []string
+    for _, entry := range entries {
+        if !isGlobPattern(entry) {
+            add(entry)
+            continue
+        }
+        
+        if allFiles == nil {
+            allFiles = vm.walkFiles()
+        }
+        
+        pattern := strings.TrimPrefix(filepath.ToSlash(entry), "./")
+        matchedCount := 0
+        for _, relPath := range allFiles {
+            if matchGlob(pattern, filepath.ToSlash(relPath)) {
+                add(relPath)
+                matchedCount++
+            }
+        }
+        
+        if matchedCount == 0 {
+            vm.logf("⚠️  通配符未匹配到文件: %s\n", entry)
+        }
+    }
+    
+    return expanded
+}
+
+// walkFiles 列出 RootDir 下的所有文件（相对路径，跳过排除的目录）
+func (vm *VersionManager) walkFiles() []string {
+    var files []string
+    
+    err := vm.walk(vm.config.RootDir, func(path string, info fs.DirEntry) error {
+        relPath, _ := filepath.Rel(vm.config.RootDir, path)
+        
+        if info.IsDir() {
+            for _, excludeDir := range vm.config.ExcludeDirs {
+                if info.Name() == excludeDir {
+                    return filepath.SkipDir
+                }
+            }
+            if vm.isTrashDir(path) {
+                return filepath.SkipDir
+            }
+            if relPath != "." && vm.matchIgnore(filepath.ToSlash(relPath), true) {
+                return filepath.SkipDir
+            }
+            return nil
+        }
+        
+        if vm.matchIgnore(filepath.ToSlash(relPath), false) {
+            return nil
+        }
+        
+        files = append(files, relPath)
+        return nil
+    })
+    
+    if err != nil {
+        vm.logf("⚠️  扫描目录失败: %v\n", err)
+    }
+    
+    return files
+}
+
+// FailedFile 处理失败的HTML文件及其过程中记录的错误
+type FailedFile struct {
+    Path   string
+    Errors []string
+}
+
+// errorCount 返回当前已记录的错误数量
+func (vm *VersionManager) errorCount() int {
+    vm.mu.Lock()
+    defer vm.mu.Unlock()
+    return len(vm.report.Errors)
+}
+
+// errorsSince 返回从第 n 个开始记录的错误
+func (vm *VersionManager) errorsSince(n int) []string {
+    vm.mu.Lock()
+    defer vm.mu.Unlock()
+    return append([]string(nil), vm.report.Errors[n:]...)
+}
+
+// processMultipleHTMLFiles 批量处理多个HTML文件，返回处理失败的文件
+func (vm *VersionManager) processMultipleHTMLFiles(htmlPaths []string) []FailedFile {
+    vm.logf("🚀 开始批量处理HTML文件...\n\n")
+    
+    htmlPaths = vm.expandHTMLFiles(htmlPaths)
+    
+    vm.openJournal()
+    
+    var failed []FailedFile
+    startTime := time.Now()
+    for i, htmlPath := range htmlPaths {
+        vm.logf("[%d/%d] %s\n", i+1, len(htmlPaths), htmlPath)
+        
+        absolutePath := rootJoin(vm.config.RootDir, htmlPath)
+        if vm.completedInJournal(htmlPath, absolutePath) {
+            vm.logf("⏭️  上次运行已完成，跳过: %s\n", htmlPath)
+            if vm.showProgress {
+                vm.printProgress(i+1, len(htmlPaths), startTime)
+            }
+            continue
+        }
+        
+        before := vm.errorCount()
+        if err := vm.processHTMLFile(absolutePath); err != nil {
+            vm.logf("❌ 处理失败 %s: %v\n", htmlPath, err)
+            vm.recordError("%s: %v", htmlPath, err)
+        }
+        
+        // 处理过程中记录了任何错误，都视为该文件失败
+        if vm.errorCount() > before {
+            failed = append(failed, FailedFile{Path: htmlPath, Errors: vm.errorsSince(before)})
+        } else if stat, err := vm.fsys.Stat(absolutePath); err == nil {
+            vm.mu.Lock()
+            vm.writeJournal(journalEntry{Op: "html", Path: filepath.ToSlash(htmlPath), ModTime: stat.ModTime().UnixNano()})
+            vm.mu.Unlock()
+        }
+        
+        if vm.showProgress {
+            vm.printProgress(i+1, len(htmlPaths), startTime)
+        }
+    }
+    if vm.showProgress {
+        fmt.Fprintln(os.Stderr)
+    }
+    
+    vm.saveVersionMap()
+    vm.closeJournal(len(failed) == 0)
+    vm.logln("\n" + strings.Repeat("=", 60))
+    vm.logln("🎉 全部处理完成！")
+    vm.logf("⏱️  共 %d 个文件，耗时 %s\n", len(htmlPaths), time.Since(startTime).Round(time.Millisecond))
+    vm.printHTMLResults()
+    vm.printByteSummary()
+    vm.logln(strings.Repeat("=", 60))
+    
+    return failed
+}
+
+// journalFileName 批量处理的运行日志（位于 RootDir 下），记录已完成的操作；运行中断后再次运行时据此继续，正常完成后删除
+const journalFileName = ".hashcdn-journal"
+
+// journalEntry 运行日志中的一条记录（每行一个JSON）
+type journalEntry struct {
+    Op      string `json:"op"`                // file：hash文件已生成或复用；delete：旧hash文件已删除；html：HTML已处理完成
+    Path    string `json:"path"`              // file 为源文件在版本映射中的键，delete 为删除的文件、html 为HTML相对 RootDir 的路径
+    Hash    string `json:"hash,omitempty"`    // file：源文件的hash
+    ModTime int64  `json:"modTime,omitempty"` // html：处理完成后HTML的修改时间（UnixNano）
+}
+
+// runJournal 本次运行的日志内容，以及从上次未完成的运行日志中恢复的记录
+type runJournal struct {
+    path    string
+    failed  bool              // 追加记录失败过（只提示一次）
+    html    map[string]int64  // 已处理完成的HTML（相对 RootDir 的路径）-> 完成时的修改时间
+    files   map[string]string // 已生成的hash文件：源文件在版本映射中的键 -> hash
+    deleted map[string]bool   // 已删除的旧hash文件（相对 RootDir 的路径）
+}
+
+// openJournal 开始记录运行日志；存在上次未完成的运行日志时，恢复其中的版本映射并记下已完成的HTML、hash文件和删除（-force 时重新开始）
+func (vm *VersionManager) openJournal() {
+    journal := &runJournal{
+        path:    filepath.Join(vm.config.RootDir, journalFileName),
+        html:    make(map[string]int64),
+        files:   make(map[string]string),
+        deleted: make(map[string]bool),
+    }
+    
+    // 开始时只写回上次日志中完整的记录，之后逐行追加
+    var recovered []byte
+    if data, err := vm.fsys.ReadFile(journal.path); err == nil && !vm.config.ForceRegen {
+        for _, line := range strings.Split(string(data), "\n") {
+            var entry journalEntry
+            if json.Unmarshal([]byte(line), &entry) != nil {
+                // 中断时可能只写了半行
+                continue
+            }
+            switch entry.Op {
+            case "file":
+                vm.versionMap[entry.Path] = entry.Hash
+                journal.files[entry.Path] = entry.Hash
+            case "delete":
+                journal.deleted[entry.Path] = true
+            case "html":
+                journal.html[entry.Path] = entry.ModTime
+            }
+            recovered = append(recovered, line+"\n"...)
+        }
+        vm.logf("♻️  发现上次未完成的运行，继续处理（已完成 %d 个HTML、%d 个资源）\n\n", len(journal.html), len(journal.files))
+    }
+    
+    if err := vm.fsys.WriteFile(journal.path, recovered, 0644); err != nil {
+        vm.logf("⚠️  无法写入运行日志，中断后将无法继续: %v\n", err)
+        return
+    }
+    vm.journal = journal
+}
+
+// completedInJournal 判断HTML是否已在上次未完成的运行中处理完成（之后没有再修改）
+func (vm *VersionManager) completedInJournal(htmlPath, absolutePath string) bool {
+    if vm.journal == nil {
+        return false
+    }
+    modTime, ok := vm.journal.html[filepath.ToSlash(htmlPath)]
+    if !ok {
+        return false
+    }
+    stat, err := vm.fsys.Stat(absolutePath)
+    return err == nil && stat.ModTime().UnixNano() == modTime
+}
+
+// writeJournal 向运行日志末尾追加一条记录（调用方持有 vm.mu）
+func (vm *VersionManager) writeJournal(entry journalEntry) {
+    if vm.journal == nil {
+        return
+    }
+    data, err := json.Marshal(entry)
+    if err != nil {
+        return
+    }
+    if err := vm.fsys.AppendFile(vm.journal.path, append(data, '\n'), 0644); err != nil && !vm.journal.failed {
+        vm.journal.failed = true
+        vm.logf("⚠️  无法写入运行日志，中断后将无法继续: %v\n", err)
+    }
+}
+
+// closeJournal 结束记录运行日志；completed 为 true（没有失败）时删除日志，否则保留供下次运行继续
+func (vm *VersionManager) closeJournal(completed bool) {
+    if vm.journal == nil {
+        return
+    }
+    journalPath := vm.journal.path
+    vm.mu.Lock()
+    vm.journal = nil
+    vm.mu.Unlock()
+    if completed {
+        vm.fsys.Remove(journalPath)
+    }
+}
+
+// printProgress 在 stderr 上输出单行刷新的进度：已处理文件数、资源数、已用时间和预计剩余时间
+func (vm *VersionManager) printProgress(done, total int, startTime time.Time) {
+    vm.mu.Lock()
+    resourceCount := len(vm.report.Files)
+    vm.mu.Unlock()
+    
+    elapsed := time.Since(startTime)
+    remaining := elapsed / time.Duration(done) * time.Duration(total-done)
+    line := fmt.Sprintf("\r⏳ %d/%d 个文件, %d 个资源, 已用时 %s, 预计剩余 %s   ",
+        done, total, resourceCount, elapsed.Round(time.Second), remaining.Round(time.Second))
+    if vm.logger.plainText {
+        line = plainIcons(line)
+    }
+    fmt.Fprint(os.Stderr, line)
+}
+
+// printFailureSummary 输出失败文件汇总
+func (vm *VersionManager) printFailureSummary(failed []FailedFile) {
+    if len(failed) == 0 {
+        return
+    }
+    
+    vm.logf("\n❌ %d 个文件处理失败:\n", len(failed))
+    for _, file := range failed {
+        vm.logf("  - %s\n", file.Path)
+        for _, msg := range file.Errors {
+            vm.logf("      %s\n", msg)
+        }
+    }
+}
+
+// RunHTMLFiles 批量处理HTML文件并输出失败汇总，任一文件失败时返回非零退出码
+func RunHTMLFiles(vm *VersionManager, htmlPaths []string) int {
+    failed := vm.processMultipleHTMLFiles(htmlPaths)
+    vm.printFailureSummary(failed)
+    if len(failed) > 0 {
+        return 1
+    }
+    return 0
+}
+
+// ProcessHTML 处理单个HTML文件（路径与 -file 相同，相对当前目录或绝对路径）及其引用的资源，并保存版本映射；
+// 返回截至目前的运行报告，处理过程中记录了错误时返回 error
+func (vm *VersionManager) ProcessHTML(htmlPath string) (Report, error) {
+    before := vm.errorCount()
+    if err := vm.processHTMLFile(htmlPath); err != nil {
+        vm.recordError("%s: %v", htmlPath, err)
+        return vm.Report(), err
+    }
+    vm.saveVersionMap()
+    if errs := vm.errorsSince(before); len(errs) > 0 {
+        return vm.Report(), fmt.Errorf("%s: %s", htmlPath, strings.Join(errs, "; "))
+    }
+    return vm.Report(), nil
+}
+
+// ProcessAll 扫描 RootDir 下的所有HTML文件（与 -all 相同）并批量处理，返回运行报告；
+// 没有找到HTML文件或有文件处理失败时返回 error
+func (vm *VersionManager) ProcessAll() (Report, error) {
+    htmlFiles := vm.findAllHTMLFiles()
+    if len(htmlFiles) == 0 {
+        return vm.Report(), fmt.Errorf("未找到HTML文件: %s", vm.config.RootDir)
+    }
+    failed := vm.processMultipleHTMLFiles(htmlFiles)
+    vm.printFailureSummary(failed)
+    if len(failed) > 0 {
+        return vm.Report(), fmt.Errorf("%d 个HTML文件处理失败", len(failed))
+    }
+    return vm.Report(), nil
+}
+
+// Report 返回截至目前的运行报告
+func (vm *VersionManager) Report() Report {
+    vm.mu.Lock()
+    defer vm.mu.Unlock()
+    report := vm.report
+    report.Files = append([]FileReport(nil), vm.report.Files...)
+    report.Changed = append([]string(nil), vm.report.Changed...)
+    report.Unchanged = append([]string(nil), vm.report.Unchanged...)
+    report.Errors = append([]string(nil), vm.report.Errors...)
+    report.Timings = append([]PageTiming(nil), vm.report.Timings...)
+    return report
+}
+
+// defaultVersionMapFile 默认的版本映射文件名
+const defaultVersionMapFile = ".version-map.json"
+
+// versionMapPath 返回版本映射文件路径（相对路径按 RootDir 解析）
+func (vm *VersionManager) versionMapPath() string {
+    mapFile := vm.config.VersionMapFile
+    if mapFile == "" {
+        mapFile = defaultVersionMapFile
+    }
+    if filepath.IsAbs(mapFile) {
+        return mapFile
+    }
+    return filepath.Join(vm.config.RootDir, mapFile)
+}
+
+// mergedVersionMap 返回本次运行的版本映射与已有映射文件合并后的结果（-no-merge 时只有本次运行的）
+func (vm *VersionManager) mergedVersionMap() map[string]string {
+    versionMap := make(map[string]string)
+    if !vm.noMerge {
+        if data, err := vm.fsys.ReadFile(vm.versionMapPath()); err == nil {
+            if err := json.Unmarshal(data, &versionMap); err != nil {
+                vm.logf("⚠️  已有版本映射格式错误，将直接覆盖: %v\n", err)
+                versionMap = make(map[string]string)
+            }
+        }
+    }
+    versionMap = normalizeVersionKeys(versionMap)
+    for key, hash := range vm.versionMap {
+        versionMap[key] = hash
+    }
+    return versionMap
+}
+
+// saveVersionMap 保存版本映射（默认合并到已有的映射文件中，本次运行的结果优先）
+func (vm *VersionManager) saveVersionMap() {
+    mapPath := vm.versionMapPath()
+    versionMap := vm.mergedVersionMap()
+    
+    data, err := json.MarshalIndent(versionMap, "", "  ")
+    if err != nil {
+        vm.logf("⚠️  保存版本映射失败: %v\n", err)
+        return
+    }
+    if err := vm.fsys.MkdirAll(filepath.Dir(mapPath), 0755); err != nil {
+        vm.logf("⚠️  创建版本映射目录失败: %v\n", err)
+        return
+    }
+    if err := vm.fsys.WriteFile(mapPath, data, 0644); err != nil {
+        vm.logf("⚠️  写入版本映射失败: %v\n", err)
+        return
+    }
+    vm.saveCDNRefs()
+    
+    vm.logf("💾 版本映射已保存\n")
+}
+
+// findAllHTMLFiles 扫描目录查找所有HTML文件
+func (vm *VersionManager) findAllHTMLFiles() []string {
+    var htmlFiles []string
+    
+    for _, relPath := range vm.walkFiles() {
+        if filepath.Ext(relPath) == ".html" {
+            htmlFiles = append(htmlFiles, relPath)
+        }
+    }
+    
+    return htmlFiles
+}
+
+// parseSince 解析 -since 参数：RFC3339 时间，或 @标记文件（取其修改时间；标记文件不存在时视为首次运行，处理所有文件）
+func parseSince(value string, logger *Logger) (time.Time, error) {
+    if markerPath, ok := strings.CutPrefix(value, "@"); ok {
+        stat, err := os.Stat(markerPath)
+        if os.IsNotExist(err) {
+            logger.Printf("⚠️  标记文件 %s 不存在，处理所有HTML文件\n", markerPath)
+            return time.Time{}, nil
+        }
+        if err != nil {
+            return time.Time{}, err
+        }
+        return stat.ModTime(), nil
+    }
+    
+    sinceTime, err := time.Parse(time.RFC3339, value)
+    if err != nil {
+        return time.Time{}, fmt.Errorf("%q 不是 RFC3339 时间（如 2024-01-02T15:04:05+08:00）或 @标记文件", value)
+    }
+    return sinceTime, nil
+}
+
+// filterModifiedSince 返回修改时间晚于 since 的HTML文件（相对 RootDir 的路径）
+func (vm *VersionManager) filterModifiedSince(relPaths []string, since time.Time) []string {
+    var modified []string
+    for _, relPath := range relPaths {
+        stat, err := vm.fsys.Stat(filepath.Join(vm.config.RootDir, relPath))
+        if err != nil || stat.ModTime().After(since) {
+            modified = append(modified, relPath)
+        }
+    }
+    return modified
+}
+
+// refTokenRe 匹配文本中可能是资源引用的片段（不含空白、引号、括号、尖括号、逗号和等号，查询字符串中允许等号）
+var refTokenRe = regexp.MustCompile(`[^\s'"()<>,=?]+(?:\?[^\s'"()<>,]*)?`)
+
+// cdnDomainList 返回所有配置的CDN域名（包括 CDNRules 中的）
+func (vm *VersionManager) cdnDomainList() []string {
+    var domains []string
+    all := append([]string{vm.config.CDNDomain}, vm.config.CDNDomains...)
+    for _, rule := range vm.config.CDNRules {
+        all = append(all, rule.Domain)
+    }
+    for _, domain := range all {
+        if domain = normalizeCDNDomain(domain); domain != "" {
+            domains = append(domains, domain)
+        }
+    }
+    // 较长的域名优先匹配（如规则中的 https://cdn.x.com/img 先于 https://cdn.x.com）
+    sort.SliceStable(domains, func(i, j int) bool {
+        return len(domains[i]) > len(domains[j])
+    })
+    return domains
+}
+
+// revertHashedReferences 将文本中带hash的资源引用还原为原始文件名，并去掉CDN域名前缀
+// originals 为该文件添加CDN域名时记录的原始引用，有记录的CDN地址还原为原始写法（保留 ./ ../ 前缀）
+func (vm *VersionManager) revertHashedReferences(content string, originals map[string]string) (string, bool) {
+    updated := false
+    newContent := refTokenRe.ReplaceAllStringFunc(content, func(token string) string {
+        refPath, suffix := splitURLSuffix(token)
+        filename := path.Base(refPath)
+        cleanFilename := vm.removeHashFromFilename(filename)
+        newSuffix := suffix
+        if vm.queryMode() {
+            // query 模式：去掉引用中的 ?v=hash 参数
+            newSuffix = removeVersionParam(suffix)
+        }
+        if cleanFilename == filename && newSuffix == suffix {
+            return token
+        }
+        
+        refPath = strings.TrimSuffix(refPath, filename) + cleanFilename
+        if original, ok := originals[refPath]; ok {
+            updated = true
+            return original + newSuffix
+        }
+        for _, domain := range vm.cdnDomainList() {
+            if strings.HasPrefix(refPath, domain+"/") {
+                refPath = strings.TrimPrefix(refPath, domain+"/")
+                break
+            }
+        }
+        
+        updated = true
+        return refPath + newSuffix
+    })
+    return newContent, updated
+}
+
+// revertFileReferences 还原HTML或CSS文件中的hash引用，返回文件是否被修改（originals 同 revertHashedReferences）
+func (vm *VersionManager) revertFileReferences(filePath string, originals map[string]string) (bool, error) {
+    content, err := vm.fsys.ReadFile(filePath)
+    if err != nil {
+        return false, err
+    }
+    contentStr := string(content)
+    
+    // 开启SRI时，还原过的 <script>/<link> 标签同时去掉 integrity 和 crossorigin 属性
+    if vm.config.EmitSRI {
+        for _, tag := range []string{"script", "link"} {
+            contentStr = tagRe(tag).ReplaceAllStringFunc(contentStr, func(match string) string {
+                reverted, changed := vm.revertHashedReferences(match, originals)
+                if !changed {
+                    return match
+                }
+                return sriAttrRe.ReplaceAllString(reverted, "")
+            })
+        }
+    }
+    
+    contentStr, _ = vm.revertHashedReferences(contentStr, originals)
+    if contentStr == string(content) {
+        return false, nil
+    }
+    
+    return true, vm.writeFile(filePath, []byte(contentStr))
+}
+
+// verifyRefAttrs -verify 检查的标签属性
+var verifyRefAttrs = []struct{ tag, attr string }{
+    {"link", "href"},
+    {"script", "src"},
+    {"img", "src"},
+    {"source", "src"},
+    {"track", "src"},
+    {"video", "poster"},
+    {"use", "href"},
+    {"use", "xlink:href"},
+}
+
+// verifyReferences 检查HTML中的 CSS/JS/图片等引用是否都指向存在的文件，返回不存在的引用数
+func (vm *VersionManager) verifyReferences(htmlPaths []string) int {
+    vm.logln("🔍 开始校验HTML引用...")
+    
+    exts := make(map[string]bool)
+    for _, ext := range hashExtensionList(vm.config) {
+        exts[ext] = true
+    }
+    
+    dangling := 0
+    for _, htmlPath := range htmlPaths {
+        content, err := vm.readHTMLSource(htmlPath)
+        if err != nil {
+            vm.logf("  ❌ 读取失败: %s (%v)\n", htmlPath, err)
+            dangling++
+            continue
+        }
+        
+        var refs []string
+        for _, ta := range verifyRefAttrs {
+            for _, match := range tagAttrValues(string(content), ta.tag, ta.attr) {
+                refs = append(refs, match[1])
+            }
+        }
+        for _, tag := range []string{"img", "source"} {
+            for _, match := range tagAttrValues(string(content), tag, "srcset") {
+                for _, candidate := range parseSrcset(match[1]) {
+                    refs = append(refs, candidate.URL)
+                }
+            }
+        }
+        
+        htmlDir := filepath.Dir(htmlPath)
+        checked := make(map[string]bool)
+        for _, ref := range refs {
+            refPath, _ := splitURLSuffix(strings.TrimSpace(ref))
+            if refPath == "" || checked[refPath] || !exts[strings.ToLower(path.Ext(refPath))] {
+                continue
+            }
+            checked[refPath] = true
+            
+            if candidates, ok := vm.verifyCandidates(htmlDir, refPath); ok && !vm.anyFileExists(candidates) {
+                vm.logf("  ❌ %s: 引用的文件不存在: %s\n", filepath.ToSlash(htmlPath), ref)
+                dangling++
+            }
+        }
+    }
+    
+    if dangling > 0 {
+        vm.logf("\n❌ 校验完成，共 %d 个HTML文件，%d 个引用无法找到\n", len(htmlPaths), dangling)
+    } else {
+        vm.logf("\n✅ 校验完成，共 %d 个HTML文件，所有引用均存在\n", len(htmlPaths))
+    }
+    return dangling
+}
+
+// verifyCandidates 返回引用可能对应的本地文件：去掉CDN域名和 URLBasePath 前缀后，
+// 以 / 开头或带 URLBasePath 的按 RootDir 解析，其余按HTML所在目录解析；远程地址和 data URI 返回 false
+func (vm *VersionManager) verifyCandidates(htmlDir, ref string) ([]string, bool) {
+    if rest, ok := vm.trimBasePath(ref); ok {
+        return []string{filepath.Join(vm.config.RootDir, filepath.FromSlash(rest))}, true
+    }
+    
+    // buildReferencePath 添加CDN前缀时去掉了一层 ./ 或 ../，因此同时尝试HTML所在目录、上一级目录和 RootDir
+    if rests, isCDN := vm.stripCDNPrefix(ref); isCDN {
+        candidates := []string{filepath.Join(vm.config.RootDir, filepath.FromSlash(rests[0]))}
+        for _, rest := range rests {
+            candidates = append(candidates, filepath.Join(htmlDir, filepath.FromSlash(rest)))
+        }
+        return candidates, true
+    }
+    
+    if isExternalOrSpecial(ref) {
+        return nil, false
+    }
+    return []string{vm.resolveRef(htmlDir, ref)}, true
+}
+
+// anyFileExists 判断路径中是否有存在的文件
+func (vm *VersionManager) anyFileExists(paths []string) bool {
+    for _, p := range paths {
+        if vm.fileExists(p) {
+            return true
+        }
+    }
+    return false
+}
+
+// pruneHashedFiles 删除不再使用的hash文件：原始文件已不存在，或hash与版本映射中记录的当前hash不一致
+// 只处理本工具生成的hash文件（原始文件存在，或在本次/上次的版本映射中有记录），打包工具输出的 index.6707935d.js 等
+// 没有原始文件的文件不会删除；每个原始文件按修改时间保留最近的 KeepOldVersions 个旧版本
+func (vm *VersionManager) pruneHashedFiles() {
+    vm.logln("\n🧹 清理不再使用的hash文件...")
+    
+    versionMap := vm.mergedVersionMap()
+    // 原始文件（相对 RootDir）-> 不再使用的hash文件
+    staleFiles := make(map[string][]string)
+    var keys []string
+    for _, relPath := range vm.walkFiles() {
+        cleanFilename, hash, ok := vm.splitHashedFilename(filepath.Base(relPath))
+        if !ok {
+            continue
+        }
+        
+        key := filepath.ToSlash(filepath.Join(filepath.Dir(relPath), cleanFilename))
+        _, recorded := versionMap[key]
+        if _, ok := vm.previousMap[key]; ok {
+            recorded = true
+        }
+        sourceExists := vm.fileExists(filepath.Join(vm.config.RootDir, filepath.FromSlash(key)))
+        if !sourceExists && !recorded {
+            continue
+        }
+        if versionMap[key] == hash && sourceExists {
+            continue
+        }
+        
+        if _, ok := staleFiles[key]; !ok {
+            keys = append(keys, key)
+        }
+        staleFiles[key] = append(staleFiles[key], relPath)
+    }
+    
+    deletedCount := 0
+    for _, key := range keys {
+        for _, relPath := range vm.keepRecentVersions(staleFiles[key]) {
+            hashedPath := filepath.Join(vm.config.RootDir, relPath)
+            if err := vm.removeFile(hashedPath); err != nil {
+                vm.logf("  ⚠️  删除失败: %s\n", relPath)
+                continue
+            }
+            vm.removePrecompressed(hashedPath)
+            _, hash, _ := vm.splitHashedFilename(filepath.Base(relPath))
+            vm.logEvent("delete", hashedPath, hash, "  🗑️  已删除: %s\n", filepath.ToSlash(relPath))
+            deletedCount++
+        }
+    }
+    
+    vm.logf("✨ 清理完成! 删除 %d 个不再使用的hash文件\n", deletedCount)
+}
+
+// keepRecentVersions 按修改时间从新到旧排序，去掉最近的 KeepOldVersions 个，返回其余需要删除的文件（相对 RootDir）
+func (vm *VersionManager) keepRecentVersions(relPaths []string) []string {
+    keep := vm.config.KeepOldVersions
+    if keep <= 0 {
+        return relPaths
+    }
+    if keep >= len(relPaths) {
+        return nil
+    }
+    modTimes := make(map[string]time.Time, len(relPaths))
+    for _, relPath := range relPaths {
+        if stat, err := vm.fsys.Stat(filepath.Join(vm.config.RootDir, relPath)); err == nil {
+            modTimes[relPath] = stat.ModTime()
+        }
+    }
+    sorted := append([]string(nil), relPaths...)
+    sort.SliceStable(sorted, func(i, j int) bool {
+        return modTimes[sorted[i]].After(modTimes[sorted[j]])
+    })
+    return sorted[keep:]
+}
+
+// cleanHashedFiles 删除所有hash文件（原始文件存在时），并将HTML/CSS中的引用还原为原始文件名
+func (vm *VersionManager) cleanHashedFiles() {
+    vm.logln("🧹 开始清理hash文件...")
+    
+    files := vm.walkFiles()
+    cdnRefs := vm.loadCDNRefs()
+    
+    // 1. 还原HTML和CSS中的引用（添加过CDN域名的引用按记录还原为原始写法）
+    revertedCount := 0
+    for _, relPath := range files {
+        filename := filepath.Base(relPath)
+        ext := strings.ToLower(filepath.Ext(filename))
+        if ext != ".html" && ext != ".htm" && ext != ".css" {
+            continue
+        }
+        if vm.removeHashFromFilename(filename) != filename {
+            continue
+        }
+        
+        changed, err := vm.revertFileReferences(filepath.Join(vm.config.RootDir, relPath), cdnRefs[filepath.ToSlash(relPath)])
+        if err != nil {
+            vm.logf("  ⚠️  还原失败: %s (%v)\n", relPath, err)
+            continue
+        }
+        if changed {
+            vm.logf("  🔄 已还原: %s\n", filepath.ToSlash(relPath))
+            revertedCount++
+        }
+    }
+    
+    // 2. 删除原始文件存在的hash文件
+    deletedCount := 0
+    for _, relPath := range files {
+        filename := filepath.Base(relPath)
+        cleanFilename := vm.removeHashFromFilename(filename)
+        if cleanFilename == filename {
+            continue
+        }
+        
+        hashedPath := filepath.Join(vm.config.RootDir, relPath)
+        if !vm.fileExists(filepath.Join(filepath.Dir(hashedPath), cleanFilename)) {
+            continue
+        }
+        
+        if err := vm.removeFile(hashedPath); err != nil {
+            vm.logf("  ⚠️  删除失败: %s\n", relPath)
+            continue
+        }
+        vm.removePrecompressed(hashedPath)
+        vm.logEvent("delete", hashedPath, "", "  🗑️  已删除: %s\n", filepath.ToSlash(relPath))
+        deletedCount++
+    }
+    
+    // 3. 删除版本映射文件和原始引用记录
+    for _, recordPath := range []string{vm.versionMapPath(), filepath.Join(vm.config.RootDir, cdnRefsFileName)} {
+        if err := vm.removeFile(recordPath); err == nil {
+            vm.logf("  🗑️  已删除: %s\n", recordPath)
+        }
+    }
+    
+    vm.logf("\n✨ 清理完成! 删除 %d 个hash文件, 还原 %d 个文件\n", deletedCount, revertedCount)
+}
+
+// watchDebounce 监听模式下合并连续文件事件的等待时间
+const watchDebounce = 300 * time.Millisecond
+
+// watch 监听 RootDir（以及RootDir之外的HTML所在目录）的文件变化，
+// 重新处理发生变化的HTML或依赖了变化文件的HTML，直到 stop 关闭
+func (vm *VersionManager) watch(htmlPaths []string, stop <-chan struct{}) error {
+    watcher, err := fsnotify.NewWatcher()
+    if err != nil {
+        return err
+    }
+    defer watcher.Close()
+    
+    rootDir, err := filepath.Abs(vm.config.RootDir)
+    if err != nil {
+        return err
+    }
+    
+    var absHTMLPaths []string
+    watchRoots := []string{rootDir}
+    for _, htmlPath := range htmlPaths {
+        absPath, err := filepath.Abs(htmlPath)
+        if err != nil {
+            return err
+        }
+        absHTMLPaths = append(absHTMLPaths, absPath)
+        if !isWithinDir(rootDir, absPath) {
+            watchRoots = append(watchRoots, filepath.Dir(absPath))
+        }
+    }
+    
+    for _, root := range watchRoots {
+        if err := vm.addWatchDirs(watcher, root); err != nil {
+            return err
+        }
+    }
+    
+    // 记录HTML最近一次由本工具写入后的修改时间，避免自身写入触发重复处理
+    lastWritten := make(map[string]time.Time)
+    recordWritten := func() {
+        for _, htmlPath := range absHTMLPaths {
+            if info, err := os.Stat(htmlPath); err == nil {
+                lastWritten[htmlPath] = info.ModTime()
+            }
+        }
+    }
+    recordWritten()
+    
+    vm.logf("👀 监听模式已启动，按 Ctrl-C 退出\n")
+    
+    pending := make(map[string]bool)
+    timer := time.NewTimer(watchDebounce)
+    timer.Stop()
+    
+    for {
+        select {
+        case <-stop:
+            vm.logf("\n👋 监听已停止\n")
+            return nil
+            
+        case err, ok := <-watcher.Errors:
+            if !ok {
+                return nil
+            }
+            vm.logf("⚠️  监听出错: %v\n", err)
+            
+        case event, ok := <-watcher.Events:
+            if !ok {
+                return nil
+            }
+            
+            // 新建的目录也需要加入监听
+            if event.Has(fsnotify.Create) {
+                if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+                    vm.addWatchDirs(watcher, event.Name)
+                    continue
+                }
+            }
+            
+            if vm.isGeneratedFile(filepath.Base(event.Name)) {
+                continue
+            }
+            
+            pending[event.Name] = true
+            timer.Reset(watchDebounce)
+            
+        case <-timer.C:
+            affected := vm.affectedHTMLFiles(absHTMLPaths, pending, lastWritten)
+            pending = make(map[string]bool)
+            
+            for _, htmlPath := range affected {
+                vm.logf("🔁 [%s] 检测到变化，重新处理: %s\n", time.Now().Format("15:04:05"), htmlPath)
+                
+                vm.mu.Lock()
+                vm.processedFiles = make(map[string]*processedResource)
+                vm.resourceIndex = make(map[string]*FileInfo)
+                vm.mu.Unlock()
+                
+                if err := vm.processHTMLFile(htmlPath); err != nil {
+                    vm.logf("❌ 处理失败 %s: %v\n", htmlPath, err)
+                }
+            }
+            
+            if len(affected) > 0 {
+                vm.saveVersionMap()
+                recordWritten()
+            }
+        }
+    }
+}
+
+// addWatchDirs 递归地将目录加入监听（跳过排除的目录）
+func (vm *VersionManager) addWatchDirs(watcher *fsnotify.Watcher, root string) error {
+    return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+        if err != nil {
+            return err
+        }
+        if !info.IsDir() {
+            return nil
+        }
+        for _, excludeDir := range vm.config.ExcludeDirs {
+            if info.Name() == excludeDir {
+                return filepath.SkipDir
+            }
+        }
+        if vm.isTrashDir(path) {
+            return filepath.SkipDir
+        }
+        return watcher.Add(path)
+    })
+}
+
+// isGeneratedFile 判断是否为本工具生成的文件（带hash的文件或原子写入的临时文件）
+func (vm *VersionManager) isGeneratedFile(filename string) bool {
+    if vm.removeHashFromFilename(filename) != filename {
+        return true
+    }
+    return strings.HasPrefix(filename, ".") && strings.Contains(filename, ".tmp-")
+}
+
+// affectedHTMLFiles 根据变化的文件找出需要重新处理的HTML
+func (vm *VersionManager) affectedHTMLFiles(htmlPaths []string, changed map[string]bool, lastWritten map[string]time.Time) []string {
+    vm.mu.Lock()
+    defer vm.mu.Unlock()
+    
+    var affected []string
+    for _, htmlPath := range htmlPaths {
+        if changed[htmlPath] {
+            // HTML自身的修改时间与上次写入一致，说明是本工具的写入
+            info, err := os.Stat(htmlPath)
+            if err == nil && !info.ModTime().Equal(lastWritten[htmlPath]) {
+                affected = append(affected, htmlPath)
+                continue
+            }
+        }
+        
+        for changedPath := range changed {
+            if vm.dependencies[htmlPath][changedPath] {
+                affected = append(affected, htmlPath)
+                break
+            }
+        }
+    }
+    
+    return affected
+}
+
+// 辅助函数
+
+// sortedKeys 返回按字典序排序的键，用于需要确定顺序的 map 遍历
+func sortedKeys(m map[string]string) []string {
+    keys := make([]string, 0, len(m))
+    for key := range m {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+// utf8BOM UTF-8 字节顺序标记
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// splitBOM 分离文件开头的 UTF-8 BOM：匹配时不带BOM，写回时再加上，保留文件原有的编码标记
+func splitBOM(content []byte) ([]byte, []byte) {
+    if bytes.HasPrefix(content, utf8BOM) {
+        return utf8BOM, content[len(utf8BOM):]
+    }
+    return nil, content
+}
+
+// htmlCommentRe 匹配HTML注释，以及需要原样保留的 <script>/<style> 块（块内的 <!-- 不是注释）
+var htmlCommentRe = regexp.MustCompile(`(?is)<script\b[^>]*>.*?</script\s*>|<style\b[^>]*>.*?</style\s*>|<!--.*?-->`)
+
+// commentPlaceholderRe 匹配 maskHTMLComments 留下的占位符
+var commentPlaceholderRe = regexp.MustCompile(`<!--hashcdn:(\d+)-->`)
+
+// maskHTMLComments 将HTML注释替换为占位符，使收集和改写跳过注释掉的引用；
+// 返回被替换的注释原文，写回前用 restoreHTMLComments 原样还原。
+// IE 条件注释（<!--[if ...]>）中的引用在旧版IE下仍会加载，不做替换
+func maskHTMLComments(content string) (string, []string) {
+    var comments []string
+    masked := htmlCommentRe.ReplaceAllStringFunc(content, func(match string) string {
+        if !strings.HasPrefix(match, "<!--") || strings.HasPrefix(match, "<!--[if") {
+            return match
+        }
+        comments = append(comments, match)
+        return fmt.Sprintf("<!--hashcdn:%d-->", len(comments)-1)
+    })
+    return masked, comments
+}
+
+// restoreHTMLComments 将 maskHTMLComments 留下的占位符还原为注释原文
+func restoreHTMLComments(content string, comments []string) string {
+    if len(comments) == 0 {
+        return content
+    }
+    return commentPlaceholderRe.ReplaceAllStringFunc(content, func(match string) string {
+        index, err := strconv.Atoi(commentPlaceholderRe.FindStringSubmatch(match)[1])
+        if err != nil || index >= len(comments) {
+            return match
+        }
+        return comments[index]
+    })
+}
+
+// readHTMLSource 读取HTML文件用于收集引用，注释中的内容已替换为占位符
+func (vm *VersionManager) readHTMLSource(htmlPath string) ([]byte, error) {
+    content, err := vm.fsys.ReadFile(htmlPath)
+    if err != nil {
+        return nil, err
+    }
+    masked, _ := maskHTMLComments(string(content))
+    return []byte(masked), nil
+}
+
+// FileSystem 版本管理器读写文件所用的文件系统，默认 osFS 使用真实文件系统，
+// 测试时可注入内存实现
+type FileSystem interface {
+    Open(name string) (fs.File, error)
+    ReadFile(name string) ([]byte, error)
+    ReadDir(name string) ([]fs.DirEntry, error)
+    Stat(name string) (fs.FileInfo, error)
+    // WriteFrom 将 r 的内容写入文件并设置权限位，写入中断时目标文件应保持原样
+    WriteFrom(name string, r io.Reader, perm fs.FileMode) error
+    // WriteFile 写入文件，要求同 WriteFrom
+    WriteFile(name string, data []byte, perm fs.FileMode) error
+    // AppendFile 在文件末尾追加内容，文件不存在时创建（不要求原子，用于逐行追加的运行日志）
+    AppendFile(name string, data []byte, perm fs.FileMode) error
+    Remove(name string) error
+    Rename(oldpath, newpath string) error
+    MkdirAll(path string, perm fs.FileMode) error
+    Chtimes(name string, atime, mtime time.Time) error
+}
+
+// osFS 基于 os 包的文件系统，写入均为原子替换
+type osFS struct{}
+
+func (osFS) Open(name string) (fs.File, error)          { return os.Open(name) }
+func (osFS) ReadFile(name string) ([]byte, error)       { return os.ReadFile(name) }
+func (osFS) ReadDir(name string) ([]fs.DirEntry, error) { return os.ReadDir(name) }
+func (osFS) Stat(name string) (fs.FileInfo, error)      { return os.Stat(name) }
+func (osFS) Remove(name string) error                   { return os.Remove(name) }
+func (osFS) Rename(oldpath, newpath string) error       { return os.Rename(oldpath, newpath) }
+func (osFS) MkdirAll(path string, perm fs.FileMode) error {
+    return os.MkdirAll(path, perm)
+}
+func (osFS) Chtimes(name string, atime, mtime time.Time) error {
+    return os.Chtimes(name, atime, mtime)
+}
+
+func (osFS) WriteFrom(name string, r io.Reader, perm fs.FileMode) error {
+    return writeAtomic(name, func(tmpFile *os.File) error {
+        if _, err := io.Copy(tmpFile, r); err != nil {
+            return err
+        }
+        return tmpFile.Chmod(perm)
+    })
+}
+
+func (osFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+    return writeFileAtomic(name, data, perm)
+}
+
+func (osFS) AppendFile(name string, data []byte, perm fs.FileMode) error {
+    file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, perm)
+    if err != nil {
+        return err
+    }
+    if _, err := file.Write(data); err != nil {
+        file.Close()
+        return err
+    }
+    return file.Close()
+}
+
+// memFileFS 在底层文件系统之上覆盖一个只存在于内存中的文件（-stdin 模式的HTML），其他文件照常访问
+type memFileFS struct {
+    FileSystem
+    name    string
+    content []byte
+    modTime time.Time
+}
+
+func (m *memFileFS) isMemFile(name string) bool {
+    return filepath.Clean(name) == m.name
+}
+
+func (m *memFileFS) ReadFile(name string) ([]byte, error) {
+    if m.isMemFile(name) {
+        return append([]byte(nil), m.content...), nil
+    }
+    return m.FileSystem.ReadFile(name)
+}
+
+func (m *memFileFS) Stat(name string) (fs.FileInfo, error) {
+    if m.isMemFile(name) {
+        return memFileInfo{m}, nil
+    }
+    return m.FileSystem.Stat(name)
+}
+
+func (m *memFileFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+    if m.isMemFile(name) {
+        m.content = append([]byte(nil), data...)
+        m.modTime = time.Now()
+        return nil
+    }
+    return m.FileSystem.WriteFile(name, data, perm)
+}
+
+func (m *memFileFS) WriteFrom(name string, r io.Reader, perm fs.FileMode) error {
+    if m.isMemFile(name) {
+        data, err := io.ReadAll(r)
+        if err != nil {
+            return err
+        }
+        return m.WriteFile(name, data, perm)
+    }
+    return m.FileSystem.WriteFrom(name, r, perm)
+}
+
+// memFileInfo memFileFS 中内存文件的信息
+type memFileInfo struct{ file *memFileFS }
+
+func (info memFileInfo) Name() string       { return filepath.Base(info.file.name) }
+func (info memFileInfo) Size() int64        { return int64(len(info.file.content)) }
+func (info memFileInfo) Mode() fs.FileMode  { return 0644 }
+func (info memFileInfo) ModTime() time.Time { return info.file.modTime }
+func (info memFileInfo) IsDir() bool        { return false }
+func (info memFileInfo) Sys() interface{}   { return nil }
+
+func (vm *VersionManager) fileExists(path string) bool {
+    _, err := vm.fsys.Stat(path)
+    return err == nil
+}
+
+// walk 按字典序遍历 root 下的文件和目录（包括 root 本身），fn 返回 filepath.SkipDir 时跳过该目录
+func (vm *VersionManager) walk(root string, fn func(path string, entry fs.DirEntry) error) error {
+    info, err := vm.fsys.Stat(root)
+    if err != nil {
+        return err
+    }
+    err = vm.walkEntry(root, fs.FileInfoToDirEntry(info), fn)
+    if err == filepath.SkipDir {
+        return nil
+    }
+    return err
+}
+
+func (vm *VersionManager) walkEntry(path string, entry fs.DirEntry, fn func(path string, entry fs.DirEntry) error) error {
+    if err := fn(path, entry); err != nil || !entry.IsDir() {
+        return err
+    }
+    
+    entries, err := vm.fsys.ReadDir(path)
+    if err != nil {
+        return err
+    }
+    for _, child := range entries {
+        if err := vm.walkEntry(filepath.Join(path, child.Name()), child, fn); err != nil && err != filepath.SkipDir {
+            return err
+        }
+    }
+    return nil
+}
+
+// isWithinDir 判断 path 是否位于 dir 目录之内
+func isWithinDir(dir, path string) bool {
+    rel, err := filepath.Rel(dir, path)
+    if err != nil {
+        return false
+    }
+    return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// writeFileAtomic 原子写入文件：先写入同目录下的临时文件，再重命名覆盖目标文件
+// 写入过程中被中断时，目标文件保持原样
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+    return writeAtomic(path, func(tmpFile *os.File) error {
+        if _, err := tmpFile.Write(data); err != nil {
+            return err
+        }
+        return tmpFile.Chmod(perm)
+    })
+}
+
+// writeAtomic 创建临时文件并交给 write 写入，成功后重命名为目标文件，失败时清理临时文件
+func writeAtomic(path string, write func(tmpFile *os.File) error) (err error) {
+    tmpFile, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+    if err != nil {
+        return err
+    }
+    tmpPath := tmpFile.Name()
+    
+    defer func() {
+        if err != nil {
+            tmpFile.Close()
+            os.Remove(tmpPath)
+        }
+    }()
+    
+    if err = write(tmpFile); err != nil {
+        return err
+    }
+    if err = tmpFile.Sync(); err != nil {
+        return err
+    }
+    if err = tmpFile.Close(); err != nil {
+        return err
+    }
+    
+    return os.Rename(tmpPath, path)
+}
+
+// writeFile 重写已有文件的内容，保留其权限位（文件不存在时使用 0644）
+func (vm *VersionManager) writeFile(path string, data []byte) error {
+    perm := fs.FileMode(0644)
+    if info, err := vm.fsys.Stat(path); err == nil {
+        perm = info.Mode().Perm()
+    }
+    return vm.fsys.WriteFile(path, data, perm)
+}
+
+// printDiff 开启 -diff 时输出文件改写前后的 unified diff（路径相对 RootDir）
+func (vm *VersionManager) printDiff(path, oldContent, newContent string) {
+    if !vm.showDiff || oldContent == newContent {
+        return
+    }
+    name := path
+    if rel, err := filepath.Rel(vm.config.RootDir, path); err == nil && !strings.HasPrefix(rel, "..") {
+        name = filepath.ToSlash(rel)
+    }
+    vm.logf("%s", unifiedDiff(name, oldContent, newContent))
+}
+
+// diffContext unified diff 中每处改动前后保留的上下文行数
+const diffContext = 3
+
+// diffLine 行级 diff 的一行：kind 为 ' '（相同）、'-'（删除）或 '+'（新增）
+type diffLine struct {
+    kind byte
+    text string
+}
+
+// unifiedDiff 按行比较新旧内容（最长公共子序列），生成 unified diff 格式的文本
+func unifiedDiff(name, oldText, newText string) string {
+    a := strings.Split(oldText, "\n")
+    b := strings.Split(newText, "\n")
+    
+    // 先去掉相同的开头和结尾，只对中间部分计算最长公共子序列
+    prefix := 0
+    for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+        prefix++
+    }
+    suffix := 0
+    for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+        suffix++
+    }
+    midA := a[prefix : len(a)-suffix]
+    midB := b[prefix : len(b)-suffix]
+    
+    // lcs[i][j] 为 midA[i:] 与 midB[j:] 的最长公共子序列长度
+    lcs := make([][]int, len(midA)+1)
+    for i := range lcs {
+        lcs[i] = make([]int, len(midB)+1)
+    }
+    for i := len(midA) - 1; i >= 0; i-- {
+        for j := len(midB) - 1; j >= 0; j-- {
+            if midA[i] == midB[j] {
+                lcs[i][j] = lcs[i+1][j+1] + 1
+            } else if lcs[i+1][j] >= lcs[i][j+1] {
+                lcs[i][j] = lcs[i+1][j]
+            } else {
+                lcs[i][j] = lcs[i][j+1]
+            }
+        }
+    }
+    
+    lines := make([]diffLine, 0, len(a)+len(b))
+    for _, line := range a[:prefix] {
+        lines = append(lines, diffLine{' ', line})
+    }
+    i, j := 0, 0
+    for i < len(midA) || j < len(midB) {
+        switch {
+        case i < len(midA) && j < len(midB) && midA[i] == midB[j]:
+            lines = append(lines, diffLine{' ', midA[i]})
+            i++
+            j++
+        case j < len(midB) && (i == len(midA) || lcs[i][j+1] > lcs[i+1][j]):
+            lines = append(lines, diffLine{'+', midB[j]})
+            j++
+        default:
+            lines = append(lines, diffLine{'-', midA[i]})
+            i++
+        }
+    }
+    for _, line := range a[len(a)-suffix:] {
+        lines = append(lines, diffLine{' ', line})
+    }
+    
+    // 每行之前已经过的旧/新行数，用于计算 hunk 头中的行号
+    oldBefore := make([]int, len(lines)+1)
+    newBefore := make([]int, len(lines)+1)
+    for k, line := range lines {
+        oldBefore[k+1], newBefore[k+1] = oldBefore[k], newBefore[k]
+        if line.kind != '+' {
+            oldBefore[k+1]++
+        }
+        if line.kind != '-' {
+            newBefore[k+1]++
+        }
+    }
+    
+    var sb strings.Builder
+    fmt.Fprintf(&sb, "--- a/%s\n+++ b/%s\n", name, name)
+    for k := 0; k < len(lines); {
+        if lines[k].kind == ' ' {
+            k++
+            continue
+        }
+        
+        // 相邻改动之间的相同行不超过 2*diffContext 时合并为一个 hunk
+        start := k - diffContext
+        if start < 0 {
+            start = 0
+        }
+        end := k
+        for end < len(lines) {
+            if lines[end].kind != ' ' {
+                end++
+                continue
+            }
+            next := end
+            for next < len(lines) && lines[next].kind == ' ' {
+                next++
+            }
+            if next == len(lines) || next-end > 2*diffContext {
+                break
+            }
+            end = next
+        }
+        stop := end + diffContext
+        if stop > len(lines) {
+            stop = len(lines)
+        }
+        
+        oldCount := oldBefore[stop] - oldBefore[start]
+        newCount := newBefore[stop] - newBefore[start]
+        oldStart, newStart := oldBefore[start]+1, newBefore[start]+1
+        if oldCount == 0 {
+            oldStart--
+        }
+        if newCount == 0 {
+            newStart--
+        }
+        fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n", oldStart, oldCount, newStart, newCount)
+        for _, line := range lines[start:stop] {
+            sb.WriteByte(line.kind)
+            sb.WriteString(line.text)
+            sb.WriteByte('\n')
+        }
+        k = stop
+    }
+    return sb.String()
+}
+
+// copyFile 复制文件，并保留源文件的权限位和修改时间，失败时按 CopyRetries 重试
+// 内容先写入临时文件再重命名，避免中断时留下不完整的目标文件
+func (vm *VersionManager) copyFile(src, dst string) error {
+    return vm.retryCopy(src, func() error { return vm.copyFileOnce(src, dst) })
+}
+
+// 复制失败时的默认重试次数和第一次重试前的等待时间
+const (
+    defaultCopyRetries    = 2
+    defaultCopyRetryDelay = 200 * time.Millisecond
+)
+
+// retryCopy 执行复制操作，失败时按 CopyRetries 重试，每次重试前的等待时间加倍；源文件不存在时不重试
+func (vm *VersionManager) retryCopy(src string, copyOnce func() error) error {
+    delay := time.Duration(vm.config.CopyRetryDelayMs) * time.Millisecond
+    for attempt := 1; ; attempt++ {
+        err := copyOnce()
+        if err == nil || attempt > vm.config.CopyRetries || errors.Is(err, fs.ErrNotExist) {
+            return err
+        }
+        vm.logf("  ⚠️  复制 %s 失败，%v 后重试 (%d/%d): %v\n", filepath.Base(src), delay, attempt, vm.config.CopyRetries, err)
+        time.Sleep(delay)
+        delay *= 2
+    }
+}
+
+// copyFileOnce 复制一次文件，不重试
+func (vm *VersionManager) copyFileOnce(src, dst string) error {
+    sourceFile, err := vm.fsys.Open(src)
+    if err != nil {
+        return err
+    }
+    defer sourceFile.Close()
+    
+    sourceInfo, err := sourceFile.Stat()
+    if err != nil {
+        return err
+    }
+    
+    if err := vm.fsys.WriteFrom(dst, sourceFile, sourceInfo.Mode().Perm()); err != nil {
+        return err
+    }
+    
+    return vm.fsys.Chtimes(dst, sourceInfo.ModTime(), sourceInfo.ModTime())
+}
+
+// writeMinifiedSVG 将压缩后的SVG写入hash文件，保留源文件的权限位和修改时间
+func (vm *VersionManager) writeMinifiedSVG(src, dst string) error {
+    return vm.retryCopy(src, func() error { return vm.writeMinifiedSVGOnce(src, dst) })
+}
+
+// writeMinifiedSVGOnce 写入一次压缩后的SVG，不重试
+func (vm *VersionManager) writeMinifiedSVGOnce(src, dst string) error {
+    content, err := vm.fsys.ReadFile(src)
+    if err != nil {
+        return err
+    }
+    
+    sourceInfo, err := vm.fsys.Stat(src)
+    if err != nil {
+        return err
+    }
+    
+    if err := vm.fsys.WriteFile(dst, minifySVG(content), sourceInfo.Mode().Perm()); err != nil {
+        return err
+    }
+    
+    return vm.fsys.Chtimes(dst, sourceInfo.ModTime(), sourceInfo.ModTime())
+}
+
+// LoadConfig 加载配置文件并检查配置是否可用，提示信息输出到标准输出
+// needHTMLFiles 为 true 时（命令行没有 -file/-all 等目标）配置中必须指定要处理的HTML文件
+func LoadConfig(configPath string, needHTMLFiles bool) (*Config, error) {
+    return loadConfig(configPath, needHTMLFiles, defaultLogger())
+}
+
+// loadConfig 同 LoadConfig，提示信息输出到指定的日志
+func loadConfig(configPath string, needHTMLFiles bool, logger *Logger) (*Config, error) {
+    var config Config
+    data, err := os.ReadFile(configPath)
+    if os.IsNotExist(err) {
+        logger.Printf("⚠️  未找到配置文件 %s，使用默认配置\n", configPath)
+    } else if err != nil {
+        return nil, fmt.Errorf("读取配置文件失败: %v", err)
+    } else {
+        // 拒绝未知字段，避免拼错的配置项被静默忽略
+        decoder := json.NewDecoder(bytes.NewReader(data))
+        decoder.DisallowUnknownFields()
+        if err := decoder.Decode(&config); err != nil {
+            return nil, fmt.Errorf("解析配置文件 %s 失败: %v", configPath, err)
+        }
+    }
+    
+    expandConfigPaths(&config, logger)
+    setConfigDefaults(&config)
+    
+    // 根据环境变量 IS_HOME 选择路径
+    isHome := os.Getenv("IS_HOME")
+    logger.Printf("📍 环境变量 IS_HOME=%s\n", isHome)
+    
+    if config.HomeHTMLFile != "" || config.CompanyHTMLFile != "" {
+        if isHome == "1" {
+            if config.HomeHTMLFile != "" {
+                config.SingleHTMLFile = config.HomeHTMLFile
+                logger.Printf("🏠 使用家里电脑路径: %s\n", config.SingleHTMLFile)
+            }
+        } else {
+            if config.CompanyHTMLFile != "" {
+                config.SingleHTMLFile = config.CompanyHTMLFile
+                logger.Printf("🏢 使用公司电脑路径: %s\n", config.SingleHTMLFile)
+            }
+        }
+    }
+    
+    if err := validateConfig(&config, needHTMLFiles); err != nil {
+        return nil, err
+    }
+    
+    return &config, nil
+}
+
+// setConfigDefaults 为未设置的配置项填入默认值（LoadConfig 和 NewVersionManager 都会调用，库调用方可以只设置 RootDir）
+func setConfigDefaults(config *Config) {
+    if config.RootDir == "" {
+        config.RootDir = "."
+    }
+    if config.HashLength == 0 {
+        config.HashLength = 8
+    }
+    if config.CopyRetries == 0 {
+        config.CopyRetries = defaultCopyRetries
+    }
+    if config.CopyRetryDelayMs == 0 {
+        config.CopyRetryDelayMs = int(defaultCopyRetryDelay / time.Millisecond)
+    }
+    if len(config.ExcludeDirs) == 0 {
+        config.ExcludeDirs = []string{"node_modules", ".git", "dist", "build"}
+    }
+}
+
+// expandConfigPaths 展开配置中路径字段里的 ${VAR} / $VAR 环境变量，使同一份配置可在不同机器上使用
+func expandConfigPaths(config *Config, logger *Logger) {
+    expand := func(value string) string {
+        return os.Expand(value, func(name string) string {
+            envValue, ok := os.LookupEnv(name)
+            if !ok {
+                logger.Printf("⚠️  配置中的环境变量 %s 未设置，按空字符串处理\n", name)
+            }
+            return envValue
+        })
+    }
+    
+    for _, field := range []*string{
+        &config.RootDir,
+        &config.SingleHTMLFile,
+        &config.HomeHTMLFile,
+        &config.CompanyHTMLFile,
+        &config.VersionMapFile,
+        &config.TrashDir,
+    } {
+        *field = expand(*field)
+    }
+    for _, list := range [][]string{config.HTMLFiles, config.ExcludeFiles} {
+        for i := range list {
+            list[i] = expand(list[i])
+        }
+    }
+}
+
+// dataAttrNameRe 匹配合法的 data-* 属性名
+var dataAttrNameRe = regexp.MustCompile(`(?i)^data-[a-z0-9_.:-]+$`)
+
+// validateConfig 检查配置是否可用，返回具体的问题说明
+func validateConfig(config *Config, needHTMLFiles bool) error {
+    stat, err := os.Stat(config.RootDir)
+    if err != nil {
+        return fmt.Errorf("rootDir 不存在: %s", config.RootDir)
+    }
+    if !stat.IsDir() {
+        return fmt.Errorf("rootDir 不是目录: %s", config.RootDir)
+    }
+    
+    if config.HashLength <= 0 || config.HashLength > md5.Size*2 {
+        return fmt.Errorf("hashLength 必须在 1 到 %d 之间，当前为 %d", md5.Size*2, config.HashLength)
+    }
+    for ext, length := range config.HashLengthByExt {
+        if length <= 0 || length > md5.Size*2 {
+            return fmt.Errorf("hashLengthByExt[%q] 必须在 1 到 %d 之间，当前为 %d", ext, md5.Size*2, length)
+        }
+    }
+    
+    if config.FilenameTemplate != "" {
+        if err := validateFilenameTemplate(config.FilenameTemplate); err != nil {
+            return err
+        }
+    }
+    
+    for i, pattern := range config.CustomPatterns {
+        re, err := regexp.Compile(pattern.Regex)
+        if err != nil {
+            return fmt.Errorf("customPatterns[%d] 正则无效: %v", i, err)
+        }
+        if pattern.Group < 0 || re.NumSubexp() < 1 || pattern.Group > re.NumSubexp() {
+            return fmt.Errorf("customPatterns[%d] 的 group 为 %d，但正则只有 %d 个分组", i, pattern.Group, re.NumSubexp())
+        }
+    }
+    
+    for i, rule := range config.CDNRules {
+        if normalizeCDNDomain(rule.Domain) == "" {
+            return fmt.Errorf("cdnRules[%d] 缺少 domain", i)
+        }
+    }
+    
+    if config.CopyRetryDelayMs < 0 {
+        return fmt.Errorf("copyRetryDelayMs 不能为负数，当前为 %d", config.CopyRetryDelayMs)
+    }
+    
+    for _, attr := range config.DataAttributes {
+        if !dataAttrNameRe.MatchString(attr) {
+            return fmt.Errorf("dataAttributes 只能包含 data-* 属性名，当前为 %q", attr)
+        }
+    }
+    
+    if needHTMLFiles && len(config.HTMLFiles) == 0 && config.SingleHTMLFile == "" {
+        return fmt.Errorf("未指定要处理的HTML文件：请在配置文件中设置 htmlFiles，或使用 -file 指定文件、-all 扫描所有")
+    }
+    
+    return nil
+}
+
+// runWatch 启动监听模式，收到 Ctrl-C 后返回退出码
+func runWatch(vm *VersionManager, htmlPaths []string) int {
+    stop := make(chan struct{})
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, os.Interrupt)
+    go func() {
+        <-signals
+        close(stop)
+    }()
+    
+    if err := vm.watch(htmlPaths, stop); err != nil {
+        vm.logf("❌ 监听失败: %v\n", err)
+        return 1
+    }
+    return 0
+}
+
+// joinRootDir 将相对 RootDir 的路径列表转换为完整路径（绝对路径原样保留）
+func joinRootDir(rootDir string, paths []string) []string {
+    joined := make([]string, 0, len(paths))
+    for _, path := range paths {
+        joined = append(joined, rootJoin(rootDir, path))
+    }
+    return joined
+}
+
+// rootJoin 将 HTMLFiles 中的路径解析为实际路径：绝对路径原样使用（HTML可以位于 RootDir 之外），相对路径相对 rootDir
+func rootJoin(rootDir, path string) string {
+    if filepath.IsAbs(path) {
+        return path
+    }
+    return filepath.Join(rootDir, path)
+}
+
+// extractZip 将zip归档解压到新建的临时目录并返回该目录，拒绝解压到目录之外的条目
+func extractZip(archivePath string) (string, error) {
+    reader, err := zip.OpenReader(archivePath)
+    if err != nil {
+        return "", err
+    }
+    defer reader.Close()
+    
+    dir, err := os.MkdirTemp("", "hashcdn-zip-")
+    if err != nil {
+        return "", err
+    }
+    
+    extract := func(file *zip.File) error {
+        name := filepath.FromSlash(file.Name)
+        if !filepath.IsLocal(name) {
+            return fmt.Errorf("zip 条目路径无效: %s", file.Name)
+        }
+        target := filepath.Join(dir, name)
+        if file.FileInfo().IsDir() {
+            return os.MkdirAll(target, 0755)
+        }
+        if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+            return err
+        }
+        
+        src, err := file.Open()
+        if err != nil {
+            return err
+        }
+        defer src.Close()
+        
+        perm := file.Mode().Perm()
+        if perm == 0 {
+            perm = 0644
+        }
+        dst, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+        if err != nil {
+            return err
+        }
+        if _, err := io.Copy(dst, src); err != nil {
+            dst.Close()
+            return err
+        }
+        if err := dst.Close(); err != nil {
+            return err
+        }
+        return os.Chtimes(target, file.Modified, file.Modified)
+    }
+    
+    for _, file := range reader.File {
+        if err := extract(file); err != nil {
+            os.RemoveAll(dir)
+            return "", err
+        }
+    }
+    return dir, nil
+}
+
+// writeZip 将目录中的所有文件按相对路径重新打包为zip归档，先写入临时文件再替换，失败时原归档保持不变
+func writeZip(dir, archivePath string) error {
+    tmpFile, err := os.CreateTemp(filepath.Dir(archivePath), "."+filepath.Base(archivePath)+".tmp-*")
+    if err != nil {
+        return err
+    }
+    tmpPath := tmpFile.Name()
+    defer os.Remove(tmpPath)
+    
+    writer := zip.NewWriter(tmpFile)
+    err = filepath.WalkDir(dir, func(filePath string, entry fs.DirEntry, err error) error {
+        if err != nil || filePath == dir {
+            return err
+        }
+        info, err := entry.Info()
+        if err != nil {
+            return err
+        }
+        rel, err := filepath.Rel(dir, filePath)
+        if err != nil {
+            return err
+        }
+        
+        header, err := zip.FileInfoHeader(info)
+        if err != nil {
+            return err
+        }
+        header.Name = filepath.ToSlash(rel)
+        if entry.IsDir() {
+            header.Name += "/"
+            _, err := writer.CreateHeader(header)
+            return err
+        }
+        header.Method = zip.Deflate
+        
+        dst, err := writer.CreateHeader(header)
+        if err != nil {
+            return err
+        }
+        src, err := os.Open(filePath)
+        if err != nil {
+            return err
+        }
+        defer src.Close()
+        _, err = io.Copy(dst, src)
+        return err
+    })
+    if err == nil {
+        err = writer.Close()
+    }
+    if closeErr := tmpFile.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        return err
+    }
+    return os.Rename(tmpPath, archivePath)
+}
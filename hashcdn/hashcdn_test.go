@@ -0,0 +1,2911 @@
+package hashcdn
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+// writeTree 在临时目录中按 相对路径 -> 内容 创建文件，返回目录的绝对路径
+func writeTree(t *testing.T, files map[string]string) string {
+    t.Helper()
+    root := t.TempDir()
+    for rel, content := range files {
+        path := filepath.Join(root, filepath.FromSlash(rel))
+        if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+            t.Fatal(err)
+        }
+        if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return root
+}
+
+// newTestVM 创建日志写入 logs（为 nil 时丢弃）的版本管理器
+func newTestVM(t *testing.T, config Config, logs io.Writer) *VersionManager {
+    t.Helper()
+    if logs == nil {
+        logs = io.Discard
+    }
+    logger, err := NewLogger(logs, "text", false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    vm := NewVersionManager(config, false)
+    vm.SetLogger(logger)
+    return vm
+}
+
+// readFile 读取 root 下的文件内容
+func readFile(t *testing.T, root, rel string) string {
+    t.Helper()
+    data, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(rel)))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return string(data)
+}
+
+// shortHash 返回内容md5的前 n 位，即默认配置下hash文件名中的hash
+func shortHash(content string, n int) string {
+    sum := md5.Sum([]byte(content))
+    return hex.EncodeToString(sum[:])[:n]
+}
+
+// assertExists 检查 root 下的文件存在
+func assertExists(t *testing.T, root, rel string) {
+    t.Helper()
+    if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(rel))); err != nil {
+        t.Errorf("%s 应存在: %v", rel, err)
+    }
+}
+
+// assertNotExists 检查 root 下的文件不存在
+func assertNotExists(t *testing.T, root, rel string) {
+    t.Helper()
+    if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(rel))); !os.IsNotExist(err) {
+        t.Errorf("%s 应不存在 (stat: %v)", rel, err)
+    }
+}
+
+// snapshotTree 读取 root 下所有文件，返回 相对路径 -> 内容
+func snapshotTree(t *testing.T, root string) map[string]string {
+    t.Helper()
+    files := make(map[string]string)
+    err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+        if err != nil || entry.IsDir() {
+            return err
+        }
+        data, err := os.ReadFile(path)
+        if err != nil {
+            return err
+        }
+        rel, _ := filepath.Rel(root, path)
+        files[filepath.ToSlash(rel)] = string(data)
+        return nil
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    return files
+}
+
+// captureStderr 运行 fn 并返回其间写入标准错误的内容
+func captureStderr(t *testing.T, fn func()) string {
+    t.Helper()
+    r, w, err := os.Pipe()
+    if err != nil {
+        t.Fatal(err)
+    }
+    saved := os.Stderr
+    os.Stderr = w
+    output := make(chan string)
+    go func() {
+        data, _ := io.ReadAll(r)
+        output <- string(data)
+    }()
+    defer func() {
+        os.Stderr = saved
+    }()
+    fn()
+    w.Close()
+    return <-output
+}
+
+func TestEmitSRIMatchesOpenSSL(t *testing.T) {
+    if _, err := exec.LookPath("openssl"); err != nil {
+        t.Skip("未安装 openssl")
+    }
+    root := writeTree(t, map[string]string{
+        "index.html": `<link rel="stylesheet" href="components/a/a.css" integrity="sha384-old" crossorigin="anonymous">
+<script src="components/a/a.js"></script>`,
+        "components/a/a.css":  "body{background:url(bg.png)}",
+        "components/a/bg.png": "PNG",
+        "components/a/a.js":   "console.log(1)",
+    })
+    vm := newTestVM(t, Config{RootDir: root, EmitSRI: true}, nil)
+    if _, err := vm.ProcessHTML(filepath.Join(root, "index.html")); err != nil {
+        t.Fatal(err)
+    }
+    
+    html := readFile(t, root, "index.html")
+    if n := strings.Count(html, "integrity="); n != 2 {
+        t.Fatalf("integrity 属性应为 2 个，实际 %d 个:\n%s", n, html)
+    }
+    
+    tags := regexp.MustCompile(`(?:href|src)="(components/a/[^"]+)"[^>]*integrity="sha384-([^"]+)" crossorigin="anonymous"`).FindAllStringSubmatch(html, -1)
+    if len(tags) != 2 {
+        t.Fatalf("未找到带 integrity 的 link/script 标签:\n%s", html)
+    }
+    for _, tag := range tags {
+        // CSS 中的图片引用改写后才计算摘要
+        if strings.HasSuffix(tag[1], ".css") && !strings.Contains(readFile(t, root, tag[1]), "bg."+shortHash("PNG", 8)+".png") {
+            t.Fatalf("%s 中的图片引用未改写", tag[1])
+        }
+        digest, err := exec.Command("openssl", "dgst", "-sha384", "-binary", filepath.Join(root, tag[1])).Output()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if want := base64.StdEncoding.EncodeToString(digest); tag[2] != want {
+            t.Errorf("%s 的 integrity 为 %s，openssl 计算为 %s", tag[1], tag[2], want)
+        }
+    }
+}
+
+func TestCopyFilePreservesModeAndModTime(t *testing.T) {
+    root := writeTree(t, map[string]string{"logo.png": "PNG"})
+    src := filepath.Join(root, "logo.png")
+    if err := os.Chmod(src, 0640); err != nil {
+        t.Fatal(err)
+    }
+    modTime := time.Date(2024, 5, 1, 8, 30, 0, 0, time.Local)
+    if err := os.Chtimes(src, modTime, modTime); err != nil {
+        t.Fatal(err)
+    }
+    
+    vm := newTestVM(t, Config{RootDir: root}, nil)
+    dst := filepath.Join(root, "logo.abcd1234.png")
+    if err := vm.copyFile(src, dst); err != nil {
+        t.Fatal(err)
+    }
+    
+    info, err := os.Stat(dst)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if info.Mode().Perm() != 0640 {
+        t.Errorf("权限位为 %v，应为 0640", info.Mode().Perm())
+    }
+    if !info.ModTime().Equal(modTime) {
+        t.Errorf("修改时间为 %v，应为 %v", info.ModTime(), modTime)
+    }
+}
+
+// failingReader 读出部分内容后返回错误，模拟写入中途失败
+type failingReader struct {
+    data string
+    done bool
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+    if r.done {
+        return 0, errors.New("模拟的写入中断")
+    }
+    r.done = true
+    return copy(p, r.data), nil
+}
+
+func TestAtomicWriteFailureKeepsOriginal(t *testing.T) {
+    root := writeTree(t, map[string]string{"style.css": "body{color:red}"})
+    target := filepath.Join(root, "style.css")
+    
+    if err := (osFS{}).WriteFrom(target, &failingReader{data: "body{col"}, 0644); err == nil {
+        t.Fatal("写入中断时应返回错误")
+    }
+    if got := readFile(t, root, "style.css"); got != "body{color:red}" {
+        t.Errorf("原文件被改动: %q", got)
+    }
+    
+    // 临时文件已清理
+    entries, err := os.ReadDir(root)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(entries) != 1 {
+        var names []string
+        for _, entry := range entries {
+            names = append(names, entry.Name())
+        }
+        t.Errorf("写入失败后残留了临时文件: %v", names)
+    }
+}
+
+// syncBuffer 可在多个协程间共享的日志缓冲
+type syncBuffer struct {
+    mu  sync.Mutex
+    buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.buf.String()
+}
+
+// waitFor 在 timeout 内轮询 cond，超时返回 false
+func waitFor(timeout time.Duration, cond func() bool) bool {
+    deadline := time.Now().Add(timeout)
+    for time.Now().Before(deadline) {
+        if cond() {
+            return true
+        }
+        time.Sleep(20 * time.Millisecond)
+    }
+    return cond()
+}
+
+func TestWatchReprocessesHTMLWhenCSSChanges(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "index.html":         `<link rel="stylesheet" href="components/a/a.css">`,
+        "components/a/a.css": "body{color:red}",
+    })
+    htmlPath := filepath.Join(root, "index.html")
+    logs := &syncBuffer{}
+    vm := newTestVM(t, Config{RootDir: root}, logs)
+    if _, err := vm.ProcessHTML(htmlPath); err != nil {
+        t.Fatal(err)
+    }
+    if html := readFile(t, root, "index.html"); !strings.Contains(html, "a."+shortHash("body{color:red}", 8)+".css") {
+        t.Fatalf("首次处理未改写引用: %s", html)
+    }
+    
+    stop := make(chan struct{})
+    done := make(chan error, 1)
+    go func() { done <- vm.watch([]string{htmlPath}, stop) }()
+    defer func() {
+        close(stop)
+        if err := <-done; err != nil {
+            t.Error(err)
+        }
+    }()
+    if !waitFor(5*time.Second, func() bool { return strings.Contains(logs.String(), "监听模式已启动") }) {
+        t.Fatal("监听未启动")
+    }
+    
+    if err := os.WriteFile(filepath.Join(root, "components/a/a.css"), []byte("body{color:blue}"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    want := "a." + shortHash("body{color:blue}", 8) + ".css"
+    if !waitFor(5*time.Second, func() bool { return strings.Contains(readFile(t, root, "index.html"), want) }) {
+        t.Fatalf("修改CSS后HTML未重新处理:\n%s", logs.String())
+    }
+    if !strings.Contains(logs.String(), "检测到变化，重新处理") {
+        t.Errorf("重新处理时未输出日志:\n%s", logs.String())
+    }
+}
+
+// processIndex 用 config 处理 root 下的 index.html，返回处理后的HTML
+func processIndex(t *testing.T, root string, config Config) string {
+    t.Helper()
+    config.RootDir = root
+    vm := newTestVM(t, config, nil)
+    if _, err := vm.ProcessHTML(filepath.Join(root, "index.html")); err != nil {
+        t.Fatal(err)
+    }
+    return readFile(t, root, "index.html")
+}
+
+func TestSrcsetRewritesExistingCandidateOnly(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "index.html": `<picture><source srcset="images/b.webp 640w" type="image/webp">
+<img src="images/a.png" srcset="images/a.png 1x, images/missing@2x.png 2x, https://x.com/c.png 3x"></picture>`,
+        "images/a.png":  "PNG-A",
+        "images/b.webp": "WEBP-B",
+    })
+    html := processIndex(t, root, Config{})
+    
+    hashed := "images/a." + shortHash("PNG-A", 8) + ".png"
+    want := `srcset="` + hashed + ` 1x, images/missing@2x.png 2x, https://x.com/c.png 3x"`
+    if !strings.Contains(html, want) {
+        t.Errorf("srcset 改写不正确:\n%s\n应包含 %s", html, want)
+    }
+    if want := `<source srcset="images/b.` + shortHash("WEBP-B", 8) + `.webp 640w"`; !strings.Contains(html, want) {
+        t.Errorf("<source srcset> 未改写:\n%s", html)
+    }
+}
+
+func TestInlineStyleURLsRewritten(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "index.html": `<div style="background:url(images/hero.png)"></div>
+<style>.icon { background: url('images/icon.png') }</style>
+<script>var s = "url(images/hero.png)";</script>`,
+        "images/hero.png": "HERO",
+        "images/icon.png": "ICON",
+    })
+    html := processIndex(t, root, Config{})
+    
+    hero := "images/hero." + shortHash("HERO", 8) + ".png"
+    for _, want := range []string{
+        `style="background:url(` + hero + `)"`,
+        `url('images/icon.` + shortHash("ICON", 8) + `.png')`,
+        `var s = "url(images/hero.png)";`,
+    } {
+        if !strings.Contains(html, want) {
+            t.Errorf("处理结果应包含 %s:\n%s", want, html)
+        }
+    }
+}
+
+func TestExpandHTMLFilesGlob(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "pages/index.html":              "",
+        "pages/shop/cart.html":          "",
+        "pages/shop/deep/item.html":     "",
+        "pages/node_modules/pkg/x.html": "",
+        "pages/readme.txt":              "",
+        "admin/login.html":              "",
+        "admin/sub/skip.html":           "",
+        "home.html":                     "",
+    })
+    vm := newTestVM(t, Config{RootDir: root}, nil)
+    
+    got := vm.expandHTMLFiles([]string{"pages/**/*.html", "admin/*.html", "home.html", "admin/login.html"})
+    for i := range got {
+        got[i] = filepath.ToSlash(got[i])
+    }
+    want := []string{
+        "pages/index.html",
+        "pages/shop/cart.html",
+        "pages/shop/deep/item.html",
+        "admin/login.html",
+        "home.html",
+    }
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("展开结果为 %v，应为 %v", got, want)
+    }
+}
+
+func TestCDNDomainsShardByFilename(t *testing.T) {
+    domains := []string{"https://cdn1.x.com", "https://cdn2.x.com", "https://cdn3.x.com"}
+    first := newTestVM(t, Config{RootDir: t.TempDir(), CDNDomains: domains}, nil)
+    second := newTestVM(t, Config{RootDir: t.TempDir(), CDNDomains: domains}, nil)
+    
+    used := make(map[string]int)
+    for i := 0; i < 30; i++ {
+        filename := fmt.Sprintf("img%d.%s.png", i, shortHash(fmt.Sprint(i), 8))
+        host := first.cdnDomainFor(filename)
+        if again := second.cdnDomainFor(filename); again != host {
+            t.Errorf("%s 两次运行分配的域名不同: %s, %s", filename, host, again)
+        }
+        used[host]++
+    }
+    for _, domain := range domains {
+        if used[domain] == 0 {
+            t.Errorf("30 个文件都没有分配到 %s: %v", domain, used)
+        }
+    }
+    
+    single := newTestVM(t, Config{RootDir: t.TempDir(), CDNDomain: "https://cdn.x.com/"}, nil)
+    if got := single.cdnDomainFor("a.png"); got != "https://cdn.x.com" {
+        t.Errorf("单个 CDNDomain 应返回 https://cdn.x.com，实际为 %s", got)
+    }
+}
+
+func TestSaveReportCounts(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "index.html": `<link rel="stylesheet" href="components/a/a.css">
+<script src="components/a/a.js"></script>`,
+        "plain.html":          `<p>no assets</p>`,
+        "components/a/a.css":  "body{background:url(bg.png)}",
+        "components/a/bg.png": "PNG",
+        "components/a/a.js":   "console.log(1)",
+    })
+    vm := newTestVM(t, Config{RootDir: root}, nil)
+    if code := RunHTMLFiles(vm, []string{"index.html", "plain.html"}); code != 0 {
+        t.Fatalf("退出码为 %d", code)
+    }
+    reportPath := filepath.Join(t.TempDir(), "report.json")
+    vm.saveReport(reportPath)
+    
+    data, err := os.ReadFile(reportPath)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var report Report
+    if err := json.Unmarshal(data, &report); err != nil {
+        t.Fatal(err)
+    }
+    
+    var files []string
+    for _, file := range report.Files {
+        if file.Status != statusGenerated {
+            t.Errorf("%s 的状态为 %s，应为 %s", file.OriginalPath, file.Status, statusGenerated)
+        }
+        files = append(files, file.OriginalPath)
+    }
+    sort.Strings(files)
+    if want := []string{"components/a/a.css", "components/a/a.js", "components/a/bg.png"}; !reflect.DeepEqual(files, want) {
+        t.Errorf("报告中的文件为 %v，应为 %v", files, want)
+    }
+    if !reflect.DeepEqual(report.Changed, []string{"index.html"}) || !reflect.DeepEqual(report.Unchanged, []string{"plain.html"}) {
+        t.Errorf("changed=%v unchanged=%v", report.Changed, report.Unchanged)
+    }
+    if report.ErrorCount != 0 || len(report.Errors) != 0 {
+        t.Errorf("不应有错误: %v", report.Errors)
+    }
+}
+
+func TestIgnoreFileExcludesFromScan(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        ".hashcdnignore":       "# 草稿\ndrafts/\n*.tmp.html\n",
+        "index.html":           "",
+        "page.tmp.html":        "",
+        "drafts/new.html":      "",
+        "sub/about.html":       "",
+        "sub/preview.tmp.html": "",
+    })
+    vm := newTestVM(t, Config{RootDir: root}, nil)
+    
+    got := vm.findAllHTMLFiles()
+    for i := range got {
+        got[i] = filepath.ToSlash(got[i])
+    }
+    sort.Strings(got)
+    if want := []string{"index.html", "sub/about.html"}; !reflect.DeepEqual(got, want) {
+        t.Errorf("扫描结果为 %v，应为 %v", got, want)
+    }
+}
+
+func TestKeepOldVersionsKeepsNewest(t *testing.T) {
+    files := map[string]string{"js/app.js": "v6"}
+    var old []string
+    for i := 1; i <= 5; i++ {
+        name := fmt.Sprintf("js/app.%s.js", shortHash(fmt.Sprintf("v%d", i), 8))
+        files[name] = fmt.Sprintf("v%d", i)
+        old = append(old, name)
+    }
+    root := writeTree(t, files)
+    // 按 v1..v5 的顺序依次变新
+    base := time.Now().Add(-time.Hour)
+    for i, name := range old {
+        modTime := base.Add(time.Duration(i) * time.Minute)
+        if err := os.Chtimes(filepath.Join(root, name), modTime, modTime); err != nil {
+            t.Fatal(err)
+        }
+    }
+    
+    vm := newTestVM(t, Config{RootDir: root, KeepOldVersions: 2}, nil)
+    if _, err := vm.renameFileWithHash(filepath.Join(root, "js/app.js")); err != nil {
+        t.Fatal(err)
+    }
+    
+    for i, name := range old {
+        _, err := os.Stat(filepath.Join(root, name))
+        if keep := i >= 3; keep != (err == nil) {
+            t.Errorf("%s: 应保留=%v，stat 错误=%v", name, keep, err)
+        }
+    }
+    if _, err := os.Stat(filepath.Join(root, "js/app."+shortHash("v6", 8)+".js")); err != nil {
+        t.Errorf("当前hash文件不存在: %v", err)
+    }
+}
+
+func TestPreloadAndStylesheetLinksShareHash(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "index.html": `<link rel="preload" href="components/a/a.css" as="style">
+<link rel="stylesheet" href="components/a/a.css">
+<link rel="modulepreload" href="components/a/main.js">`,
+        "components/a/a.css":   "body{color:red}",
+        "components/a/main.js": "export default 1",
+    })
+    logs := &syncBuffer{}
+    vm := newTestVM(t, Config{RootDir: root}, logs)
+    if _, err := vm.ProcessHTML(filepath.Join(root, "index.html")); err != nil {
+        t.Fatal(err)
+    }
+    html := readFile(t, root, "index.html")
+    
+    css := "components/a/a." + shortHash("body{color:red}", 8) + ".css"
+    for _, want := range []string{
+        `<link rel="preload" href="` + css + `" as="style">`,
+        `<link rel="stylesheet" href="` + css + `">`,
+        `<link rel="modulepreload" href="components/a/main.` + shortHash("export default 1", 8) + `.js">`,
+    } {
+        if !strings.Contains(html, want) {
+            t.Errorf("处理结果应包含 %s:\n%s", want, html)
+        }
+    }
+    if n := strings.Count(logs.String(), "已生成: a."); n != 1 {
+        t.Errorf("a.css 应只生成一次，实际 %d 次:\n%s", n, logs.String())
+    }
+}
+
+func TestIconLinksRewritten(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "index.html": `<link rel="icon" type="image/png" href="favicon.png">
+<link rel="apple-touch-icon" href="images/touch.png">
+<link rel="icon" href="https://x.com/remote.png">`,
+        "favicon.png":      "FAV",
+        "images/touch.png": "TOUCH",
+    })
+    html := processIndex(t, root, Config{})
+    
+    for _, want := range []string{
+        `<link rel="icon" type="image/png" href="favicon.` + shortHash("FAV", 8) + `.png">`,
+        `<link rel="apple-touch-icon" href="images/touch.` + shortHash("TOUCH", 8) + `.png">`,
+        `<link rel="icon" href="https://x.com/remote.png">`,
+    } {
+        if !strings.Contains(html, want) {
+            t.Errorf("处理结果应包含 %s:\n%s", want, html)
+        }
+    }
+}
+
+func TestIconLinksWithCDN(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "index.html": `<link rel="shortcut icon" href="favicon.ico">
+<link rel="icon" type="image/svg+xml" href="images/logo.svg">
+<link rel="apple-touch-icon" href="images/touch.png">`,
+        "favicon.ico":      "ICO",
+        "images/logo.svg":  "<svg/>",
+        "images/touch.png": "TOUCH",
+    })
+    html := processIndex(t, root, Config{CDNDomain: "https://cdn.x.com"})
+    
+    for _, want := range []string{
+        `<link rel="shortcut icon" href="https://cdn.x.com/favicon.` + shortHash("ICO", 8) + `.ico">`,
+        `<link rel="icon" type="image/svg+xml" href="https://cdn.x.com/images/logo.` + shortHash("<svg/>", 8) + `.svg">`,
+        `<link rel="apple-touch-icon" href="https://cdn.x.com/images/touch.` + shortHash("TOUCH", 8) + `.png">`,
+    } {
+        if !strings.Contains(html, want) {
+            t.Errorf("处理结果应包含 %s:\n%s", want, html)
+        }
+    }
+}
+
+func TestHashFilenameRoundTrip(t *testing.T) {
+    vm := newTestVM(t, Config{RootDir: t.TempDir()}, nil)
+    tests := []struct {
+        clean  string
+        hashed string
+    }{
+        {"app.js", "app.abcd1234.js"},
+        {"vendor.min.js", "vendor.min.abcd1234.js"},
+        {"jquery.ui.theme.css", "jquery.ui.theme.abcd1234.css"},
+        {"icons.woff2", "icons.abcd1234.woff2"},
+        {"font.ttf", "font.abcd1234.ttf"},
+        {"PHOTO.JPG", "PHOTO.abcd1234.JPG"},
+        {"Logo.Png", "Logo.abcd1234.Png"},
+        {"intro.mp4", "intro.abcd1234.mp4"},
+    }
+    for _, tt := range tests {
+        if got := vm.addHashToFilename(tt.clean, "abcd1234"); got != tt.hashed {
+            t.Errorf("addHashToFilename(%q) = %q，应为 %q", tt.clean, got, tt.hashed)
+        }
+        if got := vm.removeHashFromFilename(tt.hashed); got != tt.clean {
+            t.Errorf("removeHashFromFilename(%q) = %q，应为 %q", tt.hashed, got, tt.clean)
+        }
+    }
+    
+    // 不是hash段或扩展名不参与处理的文件名保持不变
+    for _, name := range []string{"vendor.min.js", "report.2024.pdf", "app.abcd123.js", "app.ABCD1234.js"} {
+        if got := vm.removeHashFromFilename(name); got != name {
+            t.Errorf("removeHashFromFilename(%q) = %q，应保持不变", name, got)
+        }
+    }
+}
+
+func TestFontFaceURLHashedAndOldVersionDeleted(t *testing.T) {
+    css := `@font-face{font-family:Icons;src:url("../fonts/icons.woff2") format("woff2"),url(../fonts/icons.ttf?#iefix) format("truetype")}`
+    root := writeTree(t, map[string]string{
+        "index.html":                            `<link rel="stylesheet" href="components/css/a.css">`,
+        "components/css/a.css":                  css,
+        "components/fonts/icons.woff2":          "WOFF2-NEW",
+        "components/fonts/icons.ttf":            "TTF",
+        "components/fonts/icons.0123abcd.woff2": "WOFF2-OLD",
+    })
+    processIndex(t, root, Config{})
+    
+    woff2 := "icons." + shortHash("WOFF2-NEW", 8) + ".woff2"
+    assertExists(t, root, "components/fonts/"+woff2)
+    assertNotExists(t, root, "components/fonts/icons.0123abcd.woff2")
+    
+    hashedCSS := "components/css/a." + shortHash(`@font-face{font-family:Icons;src:url("../fonts/`+woff2+`") format("woff2"),url(../fonts/icons.`+shortHash("TTF", 8)+`.ttf?#iefix) format("truetype")}`, 8) + ".css"
+    assertExists(t, root, hashedCSS)
+}
+
+func TestCleanRestoresOriginalTree(t *testing.T) {
+    for _, cdn := range []string{"", "https://cdn.x.com"} {
+        t.Run("cdn="+cdn, func(t *testing.T) {
+            root := writeTree(t, map[string]string{
+                "index.html": `<link rel="stylesheet" href="./components/a/a.css">
+<script src="components/a/a.js"></script>
+<img src="images/logo.png">`,
+                "pages/about.html":   `<link rel="stylesheet" href="../components/a/a.css">`,
+                "components/a/a.css": "body{background:url('../../images/bg.png')}",
+                "components/a/a.js":  "console.log(1)",
+                "images/bg.png":      "BG",
+                "images/logo.png":    "LOGO",
+            })
+            before := snapshotTree(t, root)
+    
+            vm := newTestVM(t, Config{RootDir: root, CDNDomain: cdn}, nil)
+            if code := RunHTMLFiles(vm, []string{"index.html", "pages/about.html"}); code != 0 {
+                t.Fatalf("退出码为 %d", code)
+            }
+            if reflect.DeepEqual(snapshotTree(t, root), before) {
+                t.Fatal("处理后目录没有变化")
+            }
+    
+            newTestVM(t, Config{RootDir: root, CDNDomain: cdn}, nil).cleanHashedFiles()
+            after := snapshotTree(t, root)
+            if !reflect.DeepEqual(after, before) {
+                t.Errorf("清理后与处理前不一致:\n处理前: %v\n清理后: %v", before, after)
+            }
+        })
+    }
+}
+
+func TestRunHTMLFilesReportsFailures(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "index.html":        `<script src="components/a/a.js"></script>`,
+        "components/a/a.js": "console.log(1)",
+    })
+    logs := &syncBuffer{}
+    vm := newTestVM(t, Config{RootDir: root}, logs)
+    
+    if code := RunHTMLFiles(vm, []string{"index.html", "missing.html"}); code == 0 {
+        t.Fatal("有文件处理失败时退出码不应为 0")
+    }
+    _, failures, ok := strings.Cut(logs.String(), "1 个文件处理失败:")
+    if !ok || !strings.Contains(failures, "- missing.html") {
+        t.Errorf("失败汇总中没有列出 missing.html:\n%s", logs.String())
+    }
+    if strings.Contains(failures, "- index.html") {
+        t.Errorf("index.html 处理成功，不应列在失败汇总中:\n%s", failures)
+    }
+    if report := vm.Report(); report.ErrorCount == 0 {
+        t.Error("报告中没有记录错误")
+    }
+}
+
+// countingFS 记录每个文件被 Open 的次数（计算hash时按 Open 读取文件内容）
+type countingFS struct {
+    FileSystem
+    mu    sync.Mutex
+    opens map[string]int
+}
+
+func (c *countingFS) Open(name string) (fs.File, error) {
+    c.mu.Lock()
+    c.opens[filepath.Base(name)]++
+    c.mu.Unlock()
+    return c.FileSystem.Open(name)
+}
+
+func (c *countingFS) count(name string) int {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.opens[name]
+}
+
+func TestCalculateFileHashCached(t *testing.T) {
+    root := writeTree(t, map[string]string{"logo.png": "PNG"})
+    fsys := &countingFS{FileSystem: osFS{}, opens: make(map[string]int)}
+    vm := NewVersionManagerFS(Config{RootDir: root}, false, fsys)
+    path := filepath.Join(root, "logo.png")
+    
+    if hash, err := vm.calculateFileHash(path); err != nil || hash != shortHash("PNG", 8) {
+        t.Fatalf("hash 为 %s (%v)", hash, err)
+    }
+    // 之后的并发调用都命中缓存
+    var wg sync.WaitGroup
+    for i := 0; i < 8; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            if hash, err := vm.calculateFileHash(path); err != nil || hash != shortHash("PNG", 8) {
+                t.Errorf("hash 为 %s (%v)", hash, err)
+            }
+        }()
+    }
+    wg.Wait()
+    if n := fsys.count("logo.png"); n != 1 {
+        t.Errorf("文件未变化时应只计算一次，实际 %d 次", n)
+    }
+    
+    // 文件内容和修改时间变化后重新计算
+    if err := os.WriteFile(path, []byte("PNG2"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    later := time.Now().Add(time.Minute)
+    os.Chtimes(path, later, later)
+    if hash, _ := vm.calculateFileHash(path); hash != shortHash("PNG2", 8) {
+        t.Errorf("文件变化后 hash 为 %s，应为 %s", hash, shortHash("PNG2", 8))
+    }
+    if n := fsys.count("logo.png"); n != 2 {
+        t.Errorf("文件变化后应重新计算一次，实际共 %d 次", n)
+    }
+}
+
+func TestExcludeFilesKeepsReference(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "index.html": `<link rel="stylesheet" href="components/a/legacy.css">
+<link rel="stylesheet" href="components/a/main.css">
+<script src="components/a/main.js"></script>`,
+        "components/a/legacy.css": "a{}",
+        "components/a/main.css":   "b{}",
+        "components/a/main.js":    "c()",
+    })
+    html := processIndex(t, root, Config{ExcludeFiles: []string{"components/**/legacy.css"}})
+    
+    for _, want := range []string{
+        `href="components/a/legacy.css"`,
+        `href="components/a/main.` + shortHash("b{}", 8) + `.css"`,
+        `src="components/a/main.` + shortHash("c()", 8) + `.js"`,
+    } {
+        if !strings.Contains(html, want) {
+            t.Errorf("处理结果应包含 %s:\n%s", want, html)
+        }
+    }
+    assertNotExists(t, root, "components/a/legacy."+shortHash("a{}", 8)+".css")
+}
+
+func TestCSSReferenceOutsideRootSkipped(t *testing.T) {
+    parent := writeTree(t, map[string]string{
+        "outside.png":                "OUT",
+        "site/index.html":            `<link rel="stylesheet" href="components/a.css">`,
+        "site/components/a.css":      "a{background:url(../../outside.png)}b{background:url(inside.png)}",
+        "site/components/inside.png": "IN",
+    })
+    root := filepath.Join(parent, "site")
+    logs := &syncBuffer{}
+    vm := newTestVM(t, Config{RootDir: root}, logs)
+    if _, err := vm.ProcessHTML(filepath.Join(root, "index.html")); err != nil {
+        t.Fatal(err)
+    }
+    
+    if !strings.Contains(logs.String(), "跳过超出 RootDir 的引用: ../../outside.png") {
+        t.Errorf("未输出超出 RootDir 的警告:\n%s", logs.String())
+    }
+    assertNotExists(t, parent, "outside."+shortHash("OUT", 8)+".png")
+    css := "a{background:url(../../outside.png)}b{background:url(inside." + shortHash("IN", 8) + ".png)}"
+    assertExists(t, root, "components/a."+shortHash(css, 8)+".css")
+}
+
+func TestCDNRewriteIdempotent(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "index.html":         `<script src="components/a/a.js"></script><link rel="stylesheet" href="components/a/a.css">`,
+        "components/a/a.js":  "v1",
+        "components/a/a.css": "a{}",
+    })
+    config := Config{CDNDomain: "https://cdn.x.com"}
+    first := processIndex(t, root, config)
+    want := `<script src="https://cdn.x.com/components/a/a.` + shortHash("v1", 8) + `.js"></script><link rel="stylesheet" href="https://cdn.x.com/components/a/a.` + shortHash("a{}", 8) + `.css">`
+    if first != want {
+        t.Fatalf("首次处理结果:\n%s\n应为:\n%s", first, want)
+    }
+    if second := processIndex(t, root, config); second != first {
+        t.Errorf("再次处理结果不同:\n%s", second)
+    }
+    
+    // hash 变化后仍能匹配已带CDN域名的引用
+    if err := os.WriteFile(filepath.Join(root, "components/a/a.js"), []byte("v2"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    third := processIndex(t, root, config)
+    if want := strings.Replace(first, shortHash("v1", 8), shortHash("v2", 8), 1); third != want {
+        t.Errorf("hash 变化后处理结果:\n%s\n应为:\n%s", third, want)
+    }
+}
+
+func TestImportMapAndModuleScriptRewritten(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "index.html": `<script type="importmap">
+{
+  "imports": {
+    "app": "./components/app/main.js",
+    "utils/": "./components/utils/",
+    "lodash": "./components/vendor/lodash.js",
+    "react": "https://esm.sh/react"
+  }
+}
+</script>
+<script type="module" src="components/app/main.js"></script>`,
+        "components/app/main.js":      "import 'lodash'",
+        "components/vendor/lodash.js": "export default {}",
+    })
+    html := processIndex(t, root, Config{})
+    
+    main := "components/app/main." + shortHash("import 'lodash'", 8) + ".js"
+    for _, want := range []string{
+        `"app": "./` + main + `"`,
+        `"lodash": "./components/vendor/lodash.` + shortHash("export default {}", 8) + `.js"`,
+        `"utils/": "./components/utils/"`,
+        `"react": "https://esm.sh/react"`,
+        `<script type="module" src="` + main + `"></script>`,
+    } {
+        if !strings.Contains(html, want) {
+            t.Errorf("处理结果应包含 %s:\n%s", want, html)
+        }
+    }
+}
+
+func TestBatchProgressMarkers(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "a.html":          `<script src="components/x.js"></script>`,
+        "b.html":          `<p></p>`,
+        "sub/c.html":      `<p></p>`,
+        "components/x.js": "x()",
+    })
+    logs := &syncBuffer{}
+    vm := newTestVM(t, Config{RootDir: root}, logs)
+    vm.showProgress = true
+    progress := captureStderr(t, func() {
+        if _, err := vm.ProcessAll(); err != nil {
+            t.Fatal(err)
+        }
+    })
+    if !strings.Contains(progress, "⏳ 3/3 个文件") || !strings.Contains(progress, "预计剩余") {
+        t.Errorf("进度行不正确: %q", progress)
+    }
+    
+    output := logs.String()
+    last := -1
+    for _, marker := range []string{"[1/3]", "[2/3]", "[3/3]"} {
+        index := strings.Index(output, marker)
+        if index < 0 || index < last {
+            t.Errorf("输出中没有按顺序出现 %s:\n%s", marker, output)
+        }
+        last = index
+    }
+}
+
+func TestPrecompressHashedJS(t *testing.T) {
+    js := strings.Repeat("console.log('hello');\n", 50)
+    root := writeTree(t, map[string]string{
+        "index.html":        `<script src="components/a/a.js"></script><link rel="icon" href="favicon.png">`,
+        "components/a/a.js": js,
+        "favicon.png":       "PNG",
+    })
+    processIndex(t, root, Config{Precompress: []string{"gzip", "brotli"}})
+    
+    hashed := filepath.Join(root, "components/a/a."+shortHash(js, 8)+".js")
+    gz, err := os.Open(hashed + ".gz")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer gz.Close()
+    gzReader, err := gzip.NewReader(gz)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if data, err := io.ReadAll(gzReader); err != nil || string(data) != js {
+        t.Errorf(".gz 解压后与原文件不同 (%v)", err)
+    }
+    
+    br, err := os.Open(hashed + ".br")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer br.Close()
+    if data, err := io.ReadAll(brotli.NewReader(br)); err != nil || string(data) != js {
+        t.Errorf(".br 解压后与原文件不同 (%v)", err)
+    }
+    
+    // 已压缩的图片格式不生成预压缩副本
+    assertExists(t, root, "favicon."+shortHash("PNG", 8)+".png")
+    assertNotExists(t, root, "favicon."+shortHash("PNG", 8)+".png.gz")
+}
+
+func TestVersionMapCustomNestedPath(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "index.html":        `<script src="components/a/a.js"></script>`,
+        "components/a/a.js": "a()",
+    })
+    processIndex(t, root, Config{VersionMapFile: "build/meta/versions.json"})
+    
+    var versionMap map[string]string
+    if err := json.Unmarshal([]byte(readFile(t, root, "build/meta/versions.json")), &versionMap); err != nil {
+        t.Fatal(err)
+    }
+    if want := map[string]string{"components/a/a.js": shortHash("a()", 8)}; !reflect.DeepEqual(versionMap, want) {
+        t.Errorf("版本映射为 %v，应为 %v", versionMap, want)
+    }
+    assertNotExists(t, root, defaultVersionMapFile)
+}
+
+func TestVersionMapMergesAcrossRuns(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "a.html":          `<script src="components/a.js"></script>`,
+        "b.html":          `<script src="components/b.js"></script>`,
+        "components/a.js": "a()",
+        "components/b.js": "b()",
+    })
+    for _, page := range []string{"a.html", "b.html"} {
+        vm := newTestVM(t, Config{RootDir: root}, nil)
+        if _, err := vm.ProcessHTML(filepath.Join(root, page)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    
+    var versionMap map[string]string
+    if err := json.Unmarshal([]byte(readFile(t, root, defaultVersionMapFile)), &versionMap); err != nil {
+        t.Fatal(err)
+    }
+    want := map[string]string{
+        "components/a.js": shortHash("a()", 8),
+        "components/b.js": shortHash("b()", 8),
+    }
+    if !reflect.DeepEqual(versionMap, want) {
+        t.Errorf("版本映射为 %v，应为 %v", versionMap, want)
+    }
+    
+    // -no-merge 时直接覆盖
+    vm := newTestVM(t, Config{RootDir: root}, nil)
+    vm.noMerge = true
+    if _, err := vm.ProcessHTML(filepath.Join(root, "a.html")); err != nil {
+        t.Fatal(err)
+    }
+    versionMap = nil
+    if err := json.Unmarshal([]byte(readFile(t, root, defaultVersionMapFile)), &versionMap); err != nil {
+        t.Fatal(err)
+    }
+    if want := map[string]string{"components/a.js": shortHash("a()", 8)}; !reflect.DeepEqual(versionMap, want) {
+        t.Errorf("-no-merge 后版本映射为 %v，应为 %v", versionMap, want)
+    }
+}
+
+func TestCSSURLFragmentKept(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "index.html":               `<link rel="stylesheet" href="components/a.css">`,
+        "components/a.css":         `.home{background:url("img/icons.svg#home")}.mask{mask:url(img/icons.svg?v=1#user)}`,
+        "components/img/icons.svg": `<svg xmlns="http://www.w3.org/2000/svg"><symbol id="home"/><symbol id="user"/></svg>`,
+    })
+    processIndex(t, root, Config{})
+    
+    svg := "img/icons." + shortHash(`<svg xmlns="http://www.w3.org/2000/svg"><symbol id="home"/><symbol id="user"/></svg>`, 8) + ".svg"
+    css := `.home{background:url("` + svg + `#home")}.mask{mask:url(` + svg + `?v=1#user)}`
+    assertExists(t, root, "components/"+svg)
+    assertExists(t, root, "components/a."+shortHash(css, 8)+".css")
+}
+
+func TestQueryModeAddsVersionParams(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "index.html": `<link rel="stylesheet" href="components/a.css">
+<script src="components/a.js?v=0123abcd"></script>`,
+        "components/a.css":  "a{background:url(bg.png)}",
+        "components/bg.png": "PNG",
+        "components/a.js":   "a()",
+    })
+    before := snapshotTree(t, root)
+    html := processIndex(t, root, Config{Mode: modeQuery})
+    
+    css := "a{background:url(bg.png?v=" + shortHash("PNG", 8) + ")}"
+    if got := readFile(t, root, "components/a.css"); got != css {
+        t.Errorf("CSS 为 %s，应为 %s", got, css)
+    }
+    for _, want := range []string{
+        `href="components/a.css?v=` + shortHash(css, 8) + `"`,
+        `src="components/a.js?v=` + shortHash("a()", 8) + `"`,
+    } {
+        if !strings.Contains(html, want) {
+            t.Errorf("处理结果应包含 %s:\n%s", want, html)
+        }
+    }
+    
+    // 除版本映射外不生成新文件
+    after := snapshotTree(t, root)
+    delete(after, defaultVersionMapFile)
+    for name := range after {
+        if _, ok := before[name]; !ok {
+            t.Errorf("query 模式不应生成 %s", name)
+        }
+    }
+}
+
+func TestTimingReportsEachPhase(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "index.html": `<link rel="stylesheet" href="components/a.css">
+<script src="components/a.js"></script>`,
+        "components/a.css":  "a{background:url(bg.png)}",
+        "components/bg.png": "PNG",
+        "components/a.js":   "a()",
+    })
+    var logs bytes.Buffer
+    vm := newTestVM(t, Config{RootDir: root}, &logs)
+    vm.showTiming = true
+    report, err := vm.ProcessHTML(filepath.Join(root, "index.html"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    
+    phases := []string{"扫描依赖", "图片", "CSS", "JS", "更新 HTML"}
+    if len(report.Timings) != 1 {
+        t.Fatalf("报告应包含 1 个文件的耗时，实际 %d 个", len(report.Timings))
+    }
+    var got []string
+    for _, phase := range report.Timings[0].Phases {
+        got = append(got, phase.Name)
+    }
+    if !reflect.DeepEqual(got, phases) {
+        t.Errorf("阶段为 %v，应为 %v", got, phases)
+    }
+    
+    output := logs.String()
+    _, table, ok := strings.Cut(output, "阶段耗时:")
+    if !ok {
+        t.Fatalf("日志缺少阶段耗时表:\n%s", output)
+    }
+    for i, phase := range phases {
+        if !regexp.MustCompile(fmt.Sprintf(`%d\.\s+[\d.]+ ms  %s\n`, i+1, regexp.QuoteMeta(phase))).MatchString(table) {
+            t.Errorf("耗时表缺少阶段 %s:\n%s", phase, table)
+        }
+    }
+    if !strings.Contains(table, "ms  合计") {
+        t.Errorf("耗时表缺少合计:\n%s", table)
+    }
+}
+
+func TestForceRegenRewritesExistingHashedFile(t *testing.T) {
+    hashed := "js/app." + shortHash("v2", 8) + ".js"
+    stale := "js/app." + shortHash("v1", 8) + ".js"
+    root := writeTree(t, map[string]string{
+        "js/app.js": "v2",
+        hashed:      "v2",
+        stale:       "v1",
+    })
+    old := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+    if err := os.Chtimes(filepath.Join(root, hashed), old, old); err != nil {
+        t.Fatal(err)
+    }
+    
+    vm := newTestVM(t, Config{RootDir: root, ForceRegen: true}, nil)
+    if _, err := vm.renameFileWithHash(filepath.Join(root, "js/app.js")); err != nil {
+        t.Fatal(err)
+    }
+    
+    info, err := os.Stat(filepath.Join(root, hashed))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !info.ModTime().After(old) {
+        t.Errorf("-force 后 %s 的修改时间 %v 未更新", hashed, info.ModTime())
+    }
+    if got := readFile(t, root, hashed); got != "v2" {
+        t.Errorf("%s 内容为 %q", hashed, got)
+    }
+    // 强制重新生成后仍清理旧版本
+    assertNotExists(t, root, stale)
+}
+
+func TestCSSImageSpellingsDeduplicated(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "components/a.css": `.a{background:url(images/x.png)}
+.b{background:url('./images/x.png')}
+.c{background:url("images\x.png")}`,
+        "components/images/x.png": "PNG",
+    })
+    var logs bytes.Buffer
+    vm := newTestVM(t, Config{RootDir: root}, &logs)
+    cssPath := filepath.Join(root, "components/a.css")
+    
+    images, err := vm.collectImagesFromCSS(cssPath)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(images) != 1 || images[0].OriginalPath != "images/x.png" {
+        t.Fatalf("三种写法应合并为一个引用 images/x.png，实际 %+v", images)
+    }
+    
+    info, err := vm.processComponentCSS(cssPath)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !strings.Contains(logs.String(), "处理 1 个图片引用") {
+        t.Errorf("图片应只处理一次:\n%s", logs.String())
+    }
+    hashed := "x." + shortHash("PNG", 8) + ".png"
+    want := `.a{background:url(images/` + hashed + `)}
+.b{background:url('./images/` + hashed + `')}
+.c{background:url("images\` + hashed + `")}`
+    if got := readFile(t, root, "components/"+filepath.Base(info.HashedPath)); got != want {
+        t.Errorf("CSS 为:\n%s\n应为:\n%s", got, want)
+    }
+}
+
+func TestRunCSSFileHashesImages(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "styles/site.css":  `.a{background:url(img/a.png)}.b{background:url(img/b.png)}`,
+        "styles/img/a.png": "PNG-A",
+        "styles/img/b.png": "PNG-B",
+    })
+    configPath := filepath.Join(root, "hashcdn.config.json")
+    if err := os.WriteFile(configPath, []byte(fmt.Sprintf(`{"rootDir": %q}`, root)), 0644); err != nil {
+        t.Fatal(err)
+    }
+    logger, err := NewLogger(io.Discard, "text", false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    
+    if code := Run(Options{ConfigPath: configPath, CSSFile: filepath.Join(root, "styles/site.css"), Logger: logger}); code != 0 {
+        t.Fatalf("退出码为 %d", code)
+    }
+    
+    hashedA := "a." + shortHash("PNG-A", 8) + ".png"
+    hashedB := "b." + shortHash("PNG-B", 8) + ".png"
+    assertExists(t, root, "styles/img/"+hashedA)
+    assertExists(t, root, "styles/img/"+hashedB)
+    css := `.a{background:url(img/` + hashedA + `)}.b{background:url(img/` + hashedB + `)}`
+    hashedCSS := "styles/site." + shortHash(css, 8) + ".css"
+    if got := readFile(t, root, hashedCSS); got != css {
+        t.Errorf("%s 为 %s，应为 %s", hashedCSS, got, css)
+    }
+    
+    var versionMap map[string]string
+    if err := json.Unmarshal([]byte(readFile(t, root, defaultVersionMapFile)), &versionMap); err != nil {
+        t.Fatal(err)
+    }
+    if versionMap["styles/site.css"] != shortHash(css, 8) {
+        t.Errorf("版本映射中缺少 styles/site.css: %v", versionMap)
+    }
+}
+
+func TestMediaSourceAndTrackRewritten(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "index.html": `<video controls><source src="media/clip.mp4" type="video/mp4"><source src="https://x.com/clip.webm" type="video/webm">
+<track kind="subtitles" src="media/subs.vtt" srclang="zh"></video>`,
+        "media/clip.mp4": "MP4",
+        "media/subs.vtt": "WEBVTT",
+    })
+    html := processIndex(t, root, Config{})
+    
+    for _, want := range []string{
+        `<source src="media/clip.` + shortHash("MP4", 8) + `.mp4" type="video/mp4">`,
+        `<source src="https://x.com/clip.webm" type="video/webm">`,
+        `<track kind="subtitles" src="media/subs.` + shortHash("WEBVTT", 8) + `.vtt" srclang="zh">`,
+    } {
+        if !strings.Contains(html, want) {
+            t.Errorf("处理结果应包含 %s:\n%s", want, html)
+        }
+    }
+    assertExists(t, root, "media/clip."+shortHash("MP4", 8)+".mp4")
+    assertExists(t, root, "media/subs."+shortHash("WEBVTT", 8)+".vtt")
+}
+
+func TestShareImageMetaAbsoluteURL(t *testing.T) {
+    for _, cdn := range []string{"https://cdn.x.com", ""} {
+        t.Run("cdn="+cdn, func(t *testing.T) {
+            root := writeTree(t, map[string]string{
+                "index.html": `<meta property="og:image" content="images/share.png">
+<meta name="twitter:image" content="images/share.png">`,
+                "images/share.png": "SHARE",
+            })
+            html := processIndex(t, root, Config{CDNDomain: cdn})
+    
+            want := "images/share." + shortHash("SHARE", 8) + ".png"
+            if cdn != "" {
+                want = cdn + "/" + want
+            }
+            for _, tag := range []string{
+                `<meta property="og:image" content="` + want + `">`,
+                `<meta name="twitter:image" content="` + want + `">`,
+            } {
+                if !strings.Contains(html, tag) {
+                    t.Errorf("处理结果应包含 %s:\n%s", tag, html)
+                }
+            }
+        })
+    }
+}
+
+func TestComponentPathPatternsCollectWidgets(t *testing.T) {
+    files := map[string]string{
+        "index.html":          `<link rel="stylesheet" href="widgets/nav/nav.css">`,
+        "widgets/nav/nav.css": "nav{color:red}",
+    }
+    hashed := `href="widgets/nav/nav.` + shortHash("nav{color:red}", 8) + `.css"`
+    
+    // 默认只收集 components 下的资源
+    if html := processIndex(t, writeTree(t, files), Config{}); strings.Contains(html, hashed) {
+        t.Errorf("未配置时不应收集 widgets 下的CSS:\n%s", html)
+    }
+    if html := processIndex(t, writeTree(t, files), Config{ComponentPathPatterns: []string{"widgets"}}); !strings.Contains(html, hashed) {
+        t.Errorf("配置 widgets 后应收集其中的CSS，处理结果应包含 %s:\n%s", hashed, html)
+    }
+}
+
+func TestHashCollisionReported(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "js/app.js":    "app()",
+        "other/app.js": "other()",
+    })
+    vm := newTestVM(t, Config{RootDir: root}, nil)
+    hashed := "js/app." + shortHash("app()", 8) + ".js"
+    
+    // 模拟另一个内容不同的源文件已经生成了同名hash文件
+    absHashed, err := filepath.Abs(filepath.Join(root, hashed))
+    if err != nil {
+        t.Fatal(err)
+    }
+    vm.hashedOwners[vm.pathKey(absHashed)] = filepath.Join(root, "other/app.js")
+    
+    _, err = vm.renameFileWithHash(filepath.Join(root, "js/app.js"))
+    if !errors.Is(err, errHashCollision) {
+        t.Fatalf("错误为 %v，应为 hash冲突", err)
+    }
+    assertNotExists(t, root, hashed)
+}
+
+// memFS 内存文件系统，路径按去掉开头 / 的正斜杠形式存放在 fstest.MapFS 中
+type memFS struct {
+    mu    sync.Mutex
+    files fstest.MapFS
+}
+
+func newMemFS(files map[string]string) *memFS {
+    m := &memFS{files: fstest.MapFS{}}
+    for name, content := range files {
+        m.files[m.key(name)] = &fstest.MapFile{Data: []byte(content), Mode: 0644, ModTime: time.Now()}
+    }
+    return m
+}
+
+func (m *memFS) key(name string) string {
+    return strings.TrimPrefix(filepath.ToSlash(filepath.Clean(name)), "/")
+}
+
+func (m *memFS) Open(name string) (fs.File, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    return m.files.Open(m.key(name))
+}
+
+func (m *memFS) ReadFile(name string) ([]byte, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    return m.files.ReadFile(m.key(name))
+}
+
+func (m *memFS) ReadDir(name string) ([]fs.DirEntry, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    return m.files.ReadDir(m.key(name))
+}
+
+func (m *memFS) Stat(name string) (fs.FileInfo, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    return m.files.Stat(m.key(name))
+}
+
+func (m *memFS) WriteFrom(name string, r io.Reader, perm fs.FileMode) error {
+    data, err := io.ReadAll(r)
+    if err != nil {
+        return err
+    }
+    return m.WriteFile(name, data, perm)
+}
+
+func (m *memFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.files[m.key(name)] = &fstest.MapFile{Data: append([]byte(nil), data...), Mode: perm, ModTime: time.Now()}
+    return nil
+}
+
+func (m *memFS) AppendFile(name string, data []byte, perm fs.FileMode) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if file, ok := m.files[m.key(name)]; ok {
+        data = append(append([]byte(nil), file.Data...), data...)
+    }
+    m.files[m.key(name)] = &fstest.MapFile{Data: append([]byte(nil), data...), Mode: perm, ModTime: time.Now()}
+    return nil
+}
+
+func (m *memFS) Remove(name string) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if _, ok := m.files[m.key(name)]; !ok {
+        return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+    }
+    delete(m.files, m.key(name))
+    return nil
+}
+
+func (m *memFS) Rename(oldpath, newpath string) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    file, ok := m.files[m.key(oldpath)]
+    if !ok {
+        return &fs.PathError{Op: "rename", Path: oldpath, Err: fs.ErrNotExist}
+    }
+    delete(m.files, m.key(oldpath))
+    m.files[m.key(newpath)] = file
+    return nil
+}
+
+func (m *memFS) MkdirAll(path string, perm fs.FileMode) error {
+    return nil
+}
+
+func (m *memFS) Chtimes(name string, atime, mtime time.Time) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    file, ok := m.files[m.key(name)]
+    if !ok {
+        return &fs.PathError{Op: "chtimes", Path: name, Err: fs.ErrNotExist}
+    }
+    file.ModTime = mtime
+    return nil
+}
+
+func TestProcessComponentCSSInMemory(t *testing.T) {
+    // 根目录在磁盘上不存在，所有读写都必须经过内存文件系统
+    root := filepath.Join(t.TempDir(), "site")
+    fsys := newMemFS(map[string]string{
+        filepath.Join(root, "components/a.css"):      ".a{background:url(img/bg.png)}",
+        filepath.Join(root, "components/img/bg.png"): "PNG",
+    })
+    vm := NewVersionManagerFS(Config{RootDir: root}, false, fsys)
+    logger, err := NewLogger(io.Discard, "text", false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    vm.SetLogger(logger)
+    
+    info, err := vm.processComponentCSS(filepath.Join(root, "components/a.css"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    
+    hashedImage := "img/bg." + shortHash("PNG", 8) + ".png"
+    if data, err := fsys.ReadFile(filepath.Join(root, "components", hashedImage)); err != nil || string(data) != "PNG" {
+        t.Errorf("内存中的 %s 为 %q (%v)", hashedImage, data, err)
+    }
+    css := ".a{background:url(" + hashedImage + ")}"
+    if want := filepath.Join(root, "components/a."+shortHash(css, 8)+".css"); info.HashedPath != want {
+        t.Errorf("hash CSS 为 %s，应为 %s", info.HashedPath, want)
+    }
+    if data, err := fsys.ReadFile(info.HashedPath); err != nil || string(data) != css {
+        t.Errorf("内存中的 hash CSS 为 %q (%v)，应为 %q", data, err, css)
+    }
+    if _, err := os.Stat(root); !os.IsNotExist(err) {
+        t.Errorf("不应在磁盘上创建 %s", root)
+    }
+}
+
+func TestJSONLogLines(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "index.html":        `<script src="components/a/a.js"></script>`,
+        "components/a/a.js": "a()",
+    })
+    var logs bytes.Buffer
+    logger, err := NewLogger(&logs, "json", false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    vm := NewVersionManager(Config{RootDir: root}, false)
+    vm.SetLogger(logger)
+    if _, err := vm.ProcessHTML(filepath.Join(root, "index.html")); err != nil {
+        t.Fatal(err)
+    }
+    
+    lines := strings.Split(strings.TrimRight(logs.String(), "\n"), "\n")
+    var generated bool
+    for _, line := range lines {
+        var record map[string]interface{}
+        if err := json.Unmarshal([]byte(line), &record); err != nil {
+            t.Fatalf("不是合法的JSON: %s (%v)", line, err)
+        }
+        for _, key := range []string{"time", "level", "msg", "action"} {
+            if _, ok := record[key]; !ok {
+                t.Errorf("缺少字段 %s: %s", key, line)
+            }
+        }
+        if record["action"] == "generate" {
+            generated = true
+            if record["phase"] != "JS" || record["hash"] != shortHash("a()", 8) || !strings.HasSuffix(fmt.Sprint(record["file"]), "components/a/a."+shortHash("a()", 8)+".js") {
+                t.Errorf("generate 记录的字段不正确: %s", line)
+            }
+        }
+    }
+    if !generated {
+        t.Errorf("日志中没有 generate 记录:\n%s", logs.String())
+    }
+}
+
+func TestIncrementalRegeneratesOnlyChangedFile(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "a.html":          `<script src="components/a.js"></script>`,
+        "b.html":          `<script src="components/b.js"></script>`,
+        "components/a.js": "a()",
+        "components/b.js": "b()",
+    })
+    run := func() Report {
+        vm := newTestVM(t, Config{RootDir: root}, nil)
+        vm.incremental = true
+        vm.loadPreviousVersionMap()
+        if code := RunHTMLFiles(vm, []string{"a.html", "b.html"}); code != 0 {
+            t.Fatalf("退出码为 %d", code)
+        }
+        return vm.Report()
+    }
+    run()
+    
+    if err := os.WriteFile(filepath.Join(root, "components/b.js"), []byte("b(2)"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    report := run()
+    
+    statuses := map[string]string{}
+    for _, file := range report.Files {
+        statuses[filepath.Base(file.OriginalPath)] = file.Status
+    }
+    if want := map[string]string{"a.js": statusSkipped, "b.js": statusGenerated}; !reflect.DeepEqual(statuses, want) {
+        t.Errorf("文件状态为 %v，应为 %v", statuses, want)
+    }
+    if !reflect.DeepEqual(report.Changed, []string{"b.html"}) || !reflect.DeepEqual(report.Unchanged, []string{"a.html"}) {
+        t.Errorf("改写的HTML为 %v，未改写的为 %v，应为 [b.html] 和 [a.html]", report.Changed, report.Unchanged)
+    }
+    if html := readFile(t, root, "b.html"); !strings.Contains(html, "b."+shortHash("b(2)", 8)+".js") {
+        t.Errorf("b.html 未更新: %s", html)
+    }
+}
+
+func TestBOMPreservedWhenRewriting(t *testing.T) {
+    const bom = "\uFEFF"
+    root := writeTree(t, map[string]string{
+        "index.html":        bom + `<link rel="stylesheet" href="components/a.css">`,
+        "components/a.css":  bom + `.a{background:url(bg.png) no-repeat}.b{background:url(bg.png)}`,
+        "components/bg.png": "PNG",
+    })
+    html := processIndex(t, root, Config{})
+    
+    if !strings.HasPrefix(html, bom+`<link rel="stylesheet" href="components/a.`) {
+        t.Fatalf("HTML 的 BOM 丢失或首个标签未改写: %q", html)
+    }
+    _, rest, _ := strings.Cut(html, `href="`)
+    cssRef, _, _ := strings.Cut(rest, `"`)
+    hashedImage := "bg." + shortHash("PNG", 8) + ".png"
+    want := bom + ".a{background:url(" + hashedImage + ") no-repeat}.b{background:url(" + hashedImage + ")}"
+    if got := readFile(t, root, cssRef); got != want {
+        t.Errorf("%s 为 %q，应为 %q", cssRef, got, want)
+    }
+}
+
+func TestURLBasePathPrefixesReferences(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "index.html": `<script src="js/app.js"></script>`,
+        "js/app.js":  "app()",
+    })
+    html := processIndex(t, root, Config{URLBasePath: "/static", ComponentPathPatterns: []string{"js"}})
+    
+    hashed := "js/app." + shortHash("app()", 8) + ".js"
+    if want := `src="/static/` + hashed + `"`; !strings.Contains(html, want) {
+        t.Errorf("处理结果应包含 %s:\n%s", want, html)
+    }
+    // 磁盘上的文件不带 URL 前缀
+    assertExists(t, root, hashed)
+    assertNotExists(t, root, "static")
+}
+
+func TestWebManifestIconsRewritten(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "index.html": `<link rel="manifest" href="site.webmanifest">`,
+        "site.webmanifest": `{
+  "name": "App",
+  "icons": [
+    {"src": "icons/192.png", "sizes": "192x192", "type": "image/png"},
+    {"src": "icons/512.png", "sizes": "512x512", "type": "image/png"}
+  ]
+}`,
+        "icons/192.png": "ICON-192",
+        "icons/512.png": "ICON-512",
+    })
+    html := processIndex(t, root, Config{})
+    
+    // manifest 改写图标后生成hash版本，HTML 引用hash后的 manifest
+    _, rest, _ := strings.Cut(html, `href="`)
+    manifestRef, _, _ := strings.Cut(rest, `"`)
+    if !strings.HasPrefix(manifestRef, "site.") || manifestRef == "site.webmanifest" {
+        t.Fatalf("manifest 引用未改写: %s", html)
+    }
+    var manifest struct {
+        Name  string `json:"name"`
+        Icons []struct {
+            Src   string `json:"src"`
+            Sizes string `json:"sizes"`
+        } `json:"icons"`
+    }
+    if err := json.Unmarshal([]byte(readFile(t, root, manifestRef)), &manifest); err != nil {
+        t.Fatal(err)
+    }
+    want := []string{"icons/192." + shortHash("ICON-192", 8) + ".png", "icons/512." + shortHash("ICON-512", 8) + ".png"}
+    if len(manifest.Icons) != 2 || manifest.Icons[0].Src != want[0] || manifest.Icons[1].Src != want[1] {
+        t.Errorf("icons 为 %+v，src 应为 %v", manifest.Icons, want)
+    }
+    if manifest.Name != "App" || manifest.Icons[0].Sizes != "192x192" {
+        t.Errorf("其他字段应保持不变: %+v", manifest)
+    }
+    for _, icon := range want {
+        assertExists(t, root, icon)
+    }
+}
+
+func TestSharedComponentHashedOnce(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "a.html":               `<script src="components/shared.js"></script>`,
+        "b.html":               `<script src="components/shared.js"></script>`,
+        "components/shared.js": "shared()",
+    })
+    fsys := &countingFS{FileSystem: osFS{}, opens: make(map[string]int)}
+    vm := NewVersionManagerFS(Config{RootDir: root}, false, fsys)
+    logger, err := NewLogger(io.Discard, "text", false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    vm.SetLogger(logger)
+    if code := RunHTMLFiles(vm, []string{"a.html", "b.html"}); code != 0 {
+        t.Fatalf("退出码为 %d", code)
+    }
+    
+    var generated int
+    for _, file := range vm.Report().Files {
+        if filepath.Base(file.OriginalPath) == "shared.js" {
+            generated++
+        }
+    }
+    if generated != 1 {
+        t.Errorf("共享组件应只处理一次，报告中出现 %d 次", generated)
+    }
+    // 计算hash和复制各读取一次
+    if n := fsys.count("shared.js"); n != 2 {
+        t.Errorf("shared.js 被读取 %d 次", n)
+    }
+    want := "components/shared." + shortHash("shared()", 8) + ".js"
+    for _, page := range []string{"a.html", "b.html"} {
+        if html := readFile(t, root, page); !strings.Contains(html, want) {
+            t.Errorf("%s 应引用 %s: %s", page, want, html)
+        }
+    }
+}
+
+func TestRootAbsoluteCSSURL(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "components/nav/nav.css": `.logo{background:url(/assets/logo.png)}.cdn{background:url(//cdn.x.com/a.png)}`,
+        "assets/logo.png":        "LOGO",
+    })
+    vm := newTestVM(t, Config{RootDir: root}, nil)
+    info, err := vm.processComponentCSS(filepath.Join(root, "components/nav/nav.css"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    
+    hashed := "assets/logo." + shortHash("LOGO", 8) + ".png"
+    assertExists(t, root, hashed)
+    want := `.logo{background:url(/` + hashed + `)}.cdn{background:url(//cdn.x.com/a.png)}`
+    if got := readFile(t, root, "components/nav/"+filepath.Base(info.HashedPath)); got != want {
+        t.Errorf("CSS 为 %s，应为 %s", got, want)
+    }
+}
+
+func TestHashNormalizedIgnoresWhitespace(t *testing.T) {
+    root := writeTree(t, map[string]string{"components/app.js": "function a() {\n  return 1\n}\n"})
+    path := filepath.Join(root, "components/app.js")
+    
+    vm := newTestVM(t, Config{RootDir: root, HashNormalized: true}, nil)
+    first, err := vm.renameFileWithHash(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // 写入的内容不做规范化
+    if got := readFile(t, root, "components/"+filepath.Base(first.HashedPath)); got != "function a() {\n  return 1\n}\n" {
+        t.Errorf("hash文件内容为 %q，应与源文件相同", got)
+    }
+    
+    edited := "function a() {   \n\n    return 1  \n}\n\n\n"
+    if err := os.WriteFile(path, []byte(edited), 0644); err != nil {
+        t.Fatal(err)
+    }
+    vm = newTestVM(t, Config{RootDir: root, HashNormalized: true}, nil)
+    second, err := vm.renameFileWithHash(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    
+    if filepath.Base(second.HashedPath) != filepath.Base(first.HashedPath) {
+        t.Errorf("只改动空白后hash文件名从 %s 变为 %s", filepath.Base(first.HashedPath), filepath.Base(second.HashedPath))
+    }
+}
+
+func TestLoadConfigRejectsInvalidConfig(t *testing.T) {
+    root := t.TempDir()
+    file := filepath.Join(root, "file.txt")
+    if err := os.WriteFile(file, nil, 0644); err != nil {
+        t.Fatal(err)
+    }
+    tests := []struct {
+        name          string
+        config        string
+        needHTMLFiles bool
+        wantErr       string
+    }{
+        {"rootDir 不存在", fmt.Sprintf(`{"rootDir": %q}`, filepath.Join(root, "missing")), false, "rootDir 不存在"},
+        {"rootDir 不是目录", fmt.Sprintf(`{"rootDir": %q}`, file), false, "rootDir 不是目录"},
+        {"hashLength 过小", fmt.Sprintf(`{"rootDir": %q, "hashLength": -1}`, root), false, "hashLength 必须在 1 到 32 之间"},
+        {"hashLength 过大", fmt.Sprintf(`{"rootDir": %q, "hashLength": 33}`, root), false, "hashLength 必须在 1 到 32 之间"},
+        {"未知字段", fmt.Sprintf(`{"rootDir": %q, "hashLenght": 8}`, root), false, `unknown field "hashLenght"`},
+        {"没有HTML文件", fmt.Sprintf(`{"rootDir": %q}`, root), true, "未指定要处理的HTML文件"},
+        {"有效配置", fmt.Sprintf(`{"rootDir": %q, "htmlFiles": ["index.html"]}`, root), true, ""},
+    }
+    logger, err := NewLogger(io.Discard, "text", false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            configPath := filepath.Join(t.TempDir(), "config.json")
+            if err := os.WriteFile(configPath, []byte(tt.config), 0644); err != nil {
+                t.Fatal(err)
+            }
+            _, err := loadConfig(configPath, tt.needHTMLFiles, logger)
+            if tt.wantErr == "" {
+                if err != nil {
+                    t.Errorf("有效配置返回错误: %v", err)
+                }
+                return
+            }
+            if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                t.Errorf("错误为 %v，应包含 %q", err, tt.wantErr)
+            }
+        })
+    }
+    
+    // 命令行入口打印具体问题并以 1 退出
+    configPath := filepath.Join(t.TempDir(), "config.json")
+    if err := os.WriteFile(configPath, []byte(`{"rootDir": "/nonexistent/site"}`), 0644); err != nil {
+        t.Fatal(err)
+    }
+    var logs bytes.Buffer
+    runLogger, err := NewLogger(&logs, "text", false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if code := Run(Options{ConfigPath: configPath, ScanAll: true, Logger: runLogger}); code != 1 || !strings.Contains(logs.String(), "rootDir 不存在: /nonexistent/site") {
+        t.Errorf("退出码为 %d，输出:\n%s", code, logs.String())
+    }
+}
+
+func TestPruneRemovesOrphanedHashedFiles(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "index.html":             `<script src="components/a.js"></script><script src="components/old.js"></script>`,
+        "components/a.js":        "a()",
+        "components/old.js":      "old()",
+        "vendor/lib.0123abcd.js": "lib()",
+    })
+    configPath := filepath.Join(t.TempDir(), "config.json")
+    if err := os.WriteFile(configPath, []byte(fmt.Sprintf(`{"rootDir": %q}`, root)), 0644); err != nil {
+        t.Fatal(err)
+    }
+    logger, err := NewLogger(io.Discard, "text", false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if code := Run(Options{ConfigPath: configPath, ScanAll: true, Logger: logger}); code != 0 {
+        t.Fatalf("第一次运行退出码为 %d", code)
+    }
+    assertExists(t, root, "components/old."+shortHash("old()", 8)+".js")
+    
+    // 删除 old.js 后，上次生成的 old.<hash>.js 不再使用
+    if err := os.Remove(filepath.Join(root, "components/old.js")); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(filepath.Join(root, "index.html"), []byte(`<script src="components/a.js"></script>`), 0644); err != nil {
+        t.Fatal(err)
+    }
+    if code := Run(Options{ConfigPath: configPath, ScanAll: true, Prune: true, Logger: logger}); code != 0 {
+        t.Fatalf("-prune 运行退出码为 %d", code)
+    }
+    
+    assertNotExists(t, root, "components/old."+shortHash("old()", 8)+".js")
+    assertExists(t, root, "components/a."+shortHash("a()", 8)+".js")
+    // 不是本工具生成的文件（没有源文件也没有版本记录）保持不变
+    assertExists(t, root, "vendor/lib.0123abcd.js")
+}
+
+func TestCSSURLQuotingPreserved(t *testing.T) {
+    tests := []struct {
+        name string
+        css  string
+        want string
+    }{
+        {"无引号", `.a{background:url(img/a.png)}`, `.a{background:url(img/a.0123abcd.png)}`},
+        {"单引号", `.a{background:url('img/a.png')}`, `.a{background:url('img/a.0123abcd.png')}`},
+        {"双引号", `.a{background:url("img/a.png")}`, `.a{background:url("img/a.0123abcd.png")}`},
+        {"混合", `.a{background:url(img/a.png), url("img/a.png");src:url('img/a.png')}`, `.a{background:url(img/a.0123abcd.png), url("img/a.0123abcd.png");src:url('img/a.0123abcd.png')}`},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            root := writeTree(t, map[string]string{"a.css": tt.css, "img/a.png": "PNG"})
+            vm := newTestVM(t, Config{RootDir: root}, nil)
+            if err := vm.updateCSSImageReferences(filepath.Join(root, "a.css"), map[string]string{"img/a.png": "a.0123abcd.png"}); err != nil {
+                t.Fatal(err)
+            }
+            if got := readFile(t, root, "a.css"); got != tt.want {
+                t.Errorf("CSS 为 %s，应为 %s", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestDashFilenameTemplate(t *testing.T) {
+    root := writeTree(t, map[string]string{"js/app.min.js": "v1"})
+    config := Config{RootDir: root, FilenameTemplate: "{name}-{hash}{ext}"}
+    path := filepath.Join(root, "js/app.min.js")
+    
+    vm := newTestVM(t, config, nil)
+    first, err := vm.renameFileWithHash(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    firstName := "app.min-" + shortHash("v1", 8) + ".js"
+    if filepath.Base(first.HashedPath) != firstName {
+        t.Fatalf("生成 %s，应为 %s", filepath.Base(first.HashedPath), firstName)
+    }
+    if clean := vm.removeHashFromFilename(firstName); clean != "app.min.js" {
+        t.Errorf("从 %s 去掉hash得到 %s，应为 app.min.js", firstName, clean)
+    }
+    
+    if err := os.WriteFile(path, []byte("v2"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    vm = newTestVM(t, config, nil)
+    if _, err := vm.renameFileWithHash(path); err != nil {
+        t.Fatal(err)
+    }
+    assertExists(t, root, "js/app.min-"+shortHash("v2", 8)+".js")
+    assertNotExists(t, root, "js/"+firstName)
+}
+
+// writeCountingFS 记录写入和重命名到每个目标路径（按扩展名统计）的次数
+type writeCountingFS struct {
+    FileSystem
+    mu     sync.Mutex
+    writes map[string]int
+}
+
+func (w *writeCountingFS) record(name string) {
+    w.mu.Lock()
+    w.writes[filepath.Ext(name)]++
+    w.mu.Unlock()
+}
+
+func (w *writeCountingFS) WriteFrom(name string, r io.Reader, perm fs.FileMode) error {
+    w.record(name)
+    return w.FileSystem.WriteFrom(name, r, perm)
+}
+
+func (w *writeCountingFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+    w.record(name)
+    return w.FileSystem.WriteFile(name, data, perm)
+}
+
+func (w *writeCountingFS) Rename(oldpath, newpath string) error {
+    w.record(newpath)
+    return w.FileSystem.Rename(oldpath, newpath)
+}
+
+func TestCSSWrittenOnceWithImages(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "index.html":       `<link rel="stylesheet" href="components/a.css"><link rel="stylesheet" href="components/b.css">`,
+        "components/a.css": ".a{background:url(x.png)}.b{background:url(y.png)}",
+        "components/b.css": ".c{background:url(x.png)}",
+        "components/x.png": "X",
+        "components/y.png": "Y",
+    })
+    fsys := &writeCountingFS{FileSystem: osFS{}, writes: make(map[string]int)}
+    vm := NewVersionManagerFS(Config{RootDir: root}, false, fsys)
+    logger, err := NewLogger(io.Discard, "text", false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    vm.SetLogger(logger)
+    if _, err := vm.ProcessHTML(filepath.Join(root, "index.html")); err != nil {
+        t.Fatal(err)
+    }
+    
+    // 每个CSS按最终内容只写入一次，不再写入后重命名
+    if n := fsys.writes[".css"]; n != 2 {
+        t.Errorf("2 个CSS共写入/重命名 %d 次，应为 2 次", n)
+    }
+    css := ".a{background:url(x." + shortHash("X", 8) + ".png)}.b{background:url(y." + shortHash("Y", 8) + ".png)}"
+    assertExists(t, root, "components/a."+shortHash(css, 8)+".css")
+}
+
+func TestConfigExpandsEnvInRootDir(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "public/index.html":      `<script src="components/a.js"></script>`,
+        "public/components/a.js": "a()",
+    })
+    t.Setenv("HASHCDN_TEST_SITE", root)
+    configPath := filepath.Join(t.TempDir(), "config.json")
+    if err := os.WriteFile(configPath, []byte(`{"rootDir": "${HASHCDN_TEST_SITE}/public", "htmlFiles": ["$HASHCDN_TEST_SITE/public/index.html"]}`), 0644); err != nil {
+        t.Fatal(err)
+    }
+    logger, err := NewLogger(io.Discard, "text", false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    
+    config, err := loadConfig(configPath, true, logger)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := root + "/public"; config.RootDir != want || config.HTMLFiles[0] != want+"/index.html" {
+        t.Errorf("rootDir=%s htmlFiles=%v，应展开为 %s", config.RootDir, config.HTMLFiles, want)
+    }
+    
+    if code := Run(Options{ConfigPath: configPath, ScanAll: true, Logger: logger}); code != 0 {
+        t.Fatalf("退出码为 %d", code)
+    }
+    assertExists(t, root, "public/components/a."+shortHash("a()", 8)+".js")
+}
+
+func TestVersionMapKeysUseForwardSlashes(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "index.html":             `<script src="components/nav/menu.js"></script>`,
+        "components/nav/menu.js": "menu()",
+        // Windows 上生成的旧映射使用反斜杠
+        defaultVersionMapFile: `{"components\\nav\\menu.js": "00000000", "components\\old\\old.js": "11111111"}`,
+    })
+    processIndex(t, root, Config{})
+    
+    var versionMap map[string]string
+    if err := json.Unmarshal([]byte(readFile(t, root, defaultVersionMapFile)), &versionMap); err != nil {
+        t.Fatal(err)
+    }
+    want := map[string]string{
+        "components/nav/menu.js": shortHash("menu()", 8),
+        "components/old/old.js":  "11111111",
+    }
+    if !reflect.DeepEqual(versionMap, want) {
+        t.Errorf("版本映射为 %v，应为 %v", versionMap, want)
+    }
+}
+
+func TestProcessHTMLStream(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "components/a.js":  "a()",
+        "components/a.css": "a{color:red}",
+    })
+    input := `<link rel="stylesheet" href="components/a.css"><script src="components/a.js"></script>`
+    vm := newTestVM(t, Config{RootDir: root}, nil)
+    
+    var out bytes.Buffer
+    if err := vm.processHTMLStream(strings.NewReader(input), &out, root); err != nil {
+        t.Fatal(err)
+    }
+    
+    want := `<link rel="stylesheet" href="components/a.` + shortHash("a{color:red}", 8) + `.css"><script src="components/a.` + shortHash("a()", 8) + `.js"></script>`
+    if out.String() != want {
+        t.Errorf("输出为 %s，应为 %s", out.String(), want)
+    }
+    assertExists(t, root, "components/a."+shortHash("a()", 8)+".js")
+    // 不在磁盘上留下HTML文件
+    entries, err := os.ReadDir(root)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, entry := range entries {
+        if strings.HasSuffix(entry.Name(), ".html") {
+            t.Errorf("不应写入 %s", entry.Name())
+        }
+    }
+}
+
+func TestFindFileCaseInsensitive(t *testing.T) {
+    root := writeTree(t, map[string]string{"images/Logo.abcd1234.png": "LOGO"})
+    lookup := filepath.Join(root, "images/logo.png")
+    
+    for _, insensitive := range []bool{true, false} {
+        vm := newTestVM(t, Config{RootDir: root, CaseInsensitiveFS: &insensitive}, nil)
+        found := vm.findFile(lookup)
+        if insensitive && found != filepath.Join(root, "images/Logo.abcd1234.png") {
+            t.Errorf("不区分大小写时应找到 Logo.abcd1234.png，实际 %q", found)
+        }
+        if !insensitive && found != "" {
+            t.Errorf("区分大小写时不应找到 %q", found)
+        }
+    }
+}
+
+func TestMinifySVGHashedCopy(t *testing.T) {
+    svg := `<?xml version="1.0" encoding="UTF-8"?>
+<!-- 由设计工具导出 -->
+<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 24 24">
+    <!-- 图标主体 -->
+    <g fill="none">
+        <path d="M12 2 L22 22 L2 22 Z" />
+    </g>
+</svg>
+`
+    root := writeTree(t, map[string]string{"icons/a.svg": svg})
+    vm := newTestVM(t, Config{RootDir: root, MinifySVG: true}, nil)
+    info, err := vm.renameFileWithHash(filepath.Join(root, "icons/a.svg"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    
+    minified := readFile(t, root, "icons/"+filepath.Base(info.HashedPath))
+    if len(minified) >= len(svg) || strings.Contains(minified, "<!--") {
+        t.Errorf("hash文件未压缩:\n%s", minified)
+    }
+    // hash 基于压缩后的内容
+    if info.Hash != shortHash(minified, 8) {
+        t.Errorf("hash 为 %s，应为压缩后内容的 %s", info.Hash, shortHash(minified, 8))
+    }
+    decoder := xml.NewDecoder(strings.NewReader(minified))
+    for {
+        if _, err := decoder.Token(); err == io.EOF {
+            break
+        } else if err != nil {
+            t.Fatalf("压缩后不是合法的XML: %v\n%s", err, minified)
+        }
+    }
+    if got := readFile(t, root, "icons/a.svg"); got != svg {
+        t.Errorf("原始SVG被修改:\n%s", got)
+    }
+}
+
+func TestDataAttributesRewritten(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "index.html": `<img class="lazy" data-src="images/big.jpg" alt="">
+<div data-bg="images/hero.png"></div>
+<img data-src="https://x.com/remote.jpg">`,
+        "images/big.jpg":  "JPG",
+        "images/hero.png": "HERO",
+    })
+    html := processIndex(t, root, Config{DataAttributes: []string{"data-src", "data-bg"}})
+    
+    for _, want := range []string{
+        `<img class="lazy" data-src="images/big.` + shortHash("JPG", 8) + `.jpg" alt="">`,
+        `<div data-bg="images/hero.` + shortHash("HERO", 8) + `.png"></div>`,
+        `<img data-src="https://x.com/remote.jpg">`,
+    } {
+        if !strings.Contains(html, want) {
+            t.Errorf("处理结果应包含 %s:\n%s", want, html)
+        }
+    }
+    assertExists(t, root, "images/big."+shortHash("JPG", 8)+".jpg")
+}
+
+func TestTrashDirKeepsDeletedOldVersion(t *testing.T) {
+    old := "js/app." + shortHash("v1", 8) + ".js"
+    root := writeTree(t, map[string]string{"js/app.js": "v2", old: "v1"})
+    vm := newTestVM(t, Config{RootDir: root, TrashDir: ".trash"}, nil)
+    if _, err := vm.renameFileWithHash(filepath.Join(root, "js/app.js")); err != nil {
+        t.Fatal(err)
+    }
+    
+    assertNotExists(t, root, old)
+    if got := readFile(t, root, ".trash/"+old); got != "v1" {
+        t.Errorf("回收目录中的旧版本内容为 %q", got)
+    }
+    assertExists(t, root, "js/app."+shortHash("v2", 8)+".js")
+}
+
+// truncatingFS 写入时只写入前一半内容且不报错，模拟磁盘静默损坏
+type truncatingFS struct {
+    FileSystem
+}
+
+func (f truncatingFS) WriteFrom(name string, r io.Reader, perm fs.FileMode) error {
+    data, err := io.ReadAll(r)
+    if err != nil {
+        return err
+    }
+    return f.FileSystem.WriteFile(name, data[:len(data)/2], perm)
+}
+
+func (f truncatingFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+    return f.FileSystem.WriteFile(name, data[:len(data)/2], perm)
+}
+
+func TestRenameFileWithHashDetectsTruncatedWrite(t *testing.T) {
+    root := writeTree(t, map[string]string{"js/app.js": "console.log('app')"})
+    vm := NewVersionManagerFS(Config{RootDir: root}, false, truncatingFS{osFS{}})
+    logger, err := NewLogger(io.Discard, "text", false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    vm.SetLogger(logger)
+    
+    _, err = vm.renameFileWithHash(filepath.Join(root, "js/app.js"))
+    if !errors.Is(err, errCopyVerify) {
+        t.Fatalf("错误为 %v，应为hash文件校验失败", err)
+    }
+    // 损坏的文件被删除，不会被引用
+    assertNotExists(t, root, "js/app."+shortHash("console.log('app')", 8)+".js")
+}
+
+func TestModuleImportsRewritten(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "index.html":             `<script type="module" src="components/app/main.js"></script>`,
+        "components/app/main.js": "import { a } from './lib.js'\nimport React from 'react'\nimport('./lazy.js')\n",
+        "components/app/lib.js":  "export const a = 1",
+        "components/app/lazy.js": "export default 2",
+    })
+    html := processIndex(t, root, Config{RewriteModuleImports: true})
+    
+    lib := "lib." + shortHash("export const a = 1", 8) + ".js"
+    lazy := "lazy." + shortHash("export default 2", 8) + ".js"
+    main := "import { a } from './" + lib + "'\nimport React from 'react'\nimport('./" + lazy + "')\n"
+    hashedMain := "components/app/main." + shortHash(main, 8) + ".js"
+    if got := readFile(t, root, hashedMain); got != main {
+        t.Errorf("%s 为:\n%s\n应为:\n%s", hashedMain, got, main)
+    }
+    if !strings.Contains(html, `src="`+hashedMain+`"`) {
+        t.Errorf("HTML 应引用 %s:\n%s", hashedMain, html)
+    }
+    assertExists(t, root, "components/app/"+lib)
+    assertExists(t, root, "components/app/"+lazy)
+}
+
+func TestSinceProcessesOnlyNewerHTML(t *testing.T) {
+    const page = `<script src="components/a.js"></script>`
+    hashed := "components/a." + shortHash("a()", 8) + ".js"
+    for _, useMarker := range []bool{false, true} {
+        t.Run(fmt.Sprintf("marker=%v", useMarker), func(t *testing.T) {
+            root := writeTree(t, map[string]string{
+                "old.html":        page,
+                "new.html":        page,
+                "components/a.js": "a()",
+            })
+            now := time.Now()
+            cutoff := now.Add(-time.Hour)
+            oldTime := now.Add(-2 * time.Hour)
+            if err := os.Chtimes(filepath.Join(root, "old.html"), oldTime, oldTime); err != nil {
+                t.Fatal(err)
+            }
+    
+            since := cutoff.Format(time.RFC3339)
+            if useMarker {
+                marker := filepath.Join(t.TempDir(), "last-run")
+                if err := os.WriteFile(marker, nil, 0644); err != nil {
+                    t.Fatal(err)
+                }
+                if err := os.Chtimes(marker, cutoff, cutoff); err != nil {
+                    t.Fatal(err)
+                }
+                since = "@" + marker
+            }
+            configPath := filepath.Join(t.TempDir(), "config.json")
+            if err := os.WriteFile(configPath, []byte(fmt.Sprintf(`{"rootDir": %q}`, root)), 0644); err != nil {
+                t.Fatal(err)
+            }
+            logger, err := NewLogger(io.Discard, "text", false)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if code := Run(Options{ConfigPath: configPath, ScanAll: true, Since: since, Logger: logger}); code != 0 {
+                t.Fatalf("退出码为 %d", code)
+            }
+    
+            if html := readFile(t, root, "new.html"); !strings.Contains(html, hashed) {
+                t.Errorf("new.html 应被处理: %s", html)
+            }
+            if html := readFile(t, root, "old.html"); html != page {
+                t.Errorf("old.html 不应被处理: %s", html)
+            }
+        })
+    }
+}
+
+func TestCustomPatternAssetHelper(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "index.html":      `<script>loadHero(asset("images/hero.png"), asset("https://x.com/y.png"))</script>`,
+        "images/hero.png": "HERO",
+    })
+    html := processIndex(t, root, Config{CustomPatterns: []CustomPattern{{Regex: `asset\("([^"]+)"\)`}}})
+    
+    hashed := "images/hero." + shortHash("HERO", 8) + ".png"
+    if want := `loadHero(asset("` + hashed + `"), asset("https://x.com/y.png"))`; !strings.Contains(html, want) {
+        t.Errorf("处理结果应包含 %s:\n%s", want, html)
+    }
+    assertExists(t, root, hashed)
+}
+
+func TestJournalResumesInterruptedRun(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "a.html":               `<script src="components/shared.js"></script>`,
+        "b.html":               `<script src="components/shared.js"></script><script src="components/b.js"></script>`,
+        "components/shared.js": "shared()",
+        "components/b.js":      "b()",
+    })
+    // 模拟上次运行处理完 a.html（生成了 shared.js 的hash文件）后中断
+    if _, err := newTestVM(t, Config{RootDir: root}, nil).ProcessHTML(filepath.Join(root, "a.html")); err != nil {
+        t.Fatal(err)
+    }
+    stat, err := os.Stat(filepath.Join(root, "a.html"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    var journal bytes.Buffer
+    for _, entry := range []journalEntry{
+        {Op: "file", Path: "components/shared.js", Hash: shortHash("shared()", 8)},
+        {Op: "html", Path: "a.html", ModTime: stat.ModTime().UnixNano()},
+    } {
+        data, err := json.Marshal(entry)
+        if err != nil {
+            t.Fatal(err)
+        }
+        journal.Write(append(data, '\n'))
+    }
+    // 中断时最后一行只写了一半
+    journal.WriteString(`{"op":"file","path":"compo`)
+    if err := os.WriteFile(filepath.Join(root, journalFileName), journal.Bytes(), 0644); err != nil {
+        t.Fatal(err)
+    }
+    
+    logs := &syncBuffer{}
+    vm := newTestVM(t, Config{RootDir: root}, logs)
+    if code := RunHTMLFiles(vm, []string{"a.html", "b.html"}); code != 0 {
+        t.Fatalf("退出码为 %d:\n%s", code, logs.String())
+    }
+    
+    if !strings.Contains(logs.String(), "上次运行已完成，跳过: a.html") {
+        t.Errorf("应跳过上次已完成的 a.html:\n%s", logs.String())
+    }
+    statuses := map[string]string{}
+    for _, file := range vm.Report().Files {
+        statuses[filepath.Base(file.OriginalPath)] = file.Status
+    }
+    if want := map[string]string{"shared.js": statusSkipped, "b.js": statusGenerated}; !reflect.DeepEqual(statuses, want) {
+        t.Errorf("文件状态为 %v，应为 %v", statuses, want)
+    }
+    if html := readFile(t, root, "b.html"); !strings.Contains(html, "shared."+shortHash("shared()", 8)+".js") || !strings.Contains(html, "b."+shortHash("b()", 8)+".js") {
+        t.Errorf("b.html 未更新: %s", html)
+    }
+    // 正常完成后删除运行日志
+    assertNotExists(t, root, journalFileName)
+}
+
+func TestHashLengthByExt(t *testing.T) {
+    oldImage := "img/logo." + shortHash("old", 8) + ".png"
+    oldJS := "js/app." + shortHash("old", 16) + ".js"
+    root := writeTree(t, map[string]string{
+        "img/logo.png": "LOGO",
+        "js/app.js":    "app()",
+        oldImage:       "old",
+        oldJS:          "old",
+    })
+    vm := newTestVM(t, Config{RootDir: root, HashLength: 8, HashLengthByExt: map[string]int{".js": 16}}, nil)
+    
+    image, err := vm.renameFileWithHash(filepath.Join(root, "img/logo.png"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    js, err := vm.renameFileWithHash(filepath.Join(root, "js/app.js"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    
+    if image.Hash != shortHash("LOGO", 8) || js.Hash != shortHash("app()", 16) {
+        t.Errorf("图片hash为 %s，JS hash为 %s，应分别为 8 位和 16 位", image.Hash, js.Hash)
+    }
+    for hashed, clean := range map[string]string{
+        filepath.Base(image.HashedPath): "logo.png",
+        filepath.Base(js.HashedPath):    "app.js",
+    } {
+        if got := vm.removeHashFromFilename(hashed); got != clean {
+            t.Errorf("从 %s 去掉hash得到 %s，应为 %s", hashed, got, clean)
+        }
+    }
+    // 按各自长度识别并清理旧版本
+    assertNotExists(t, root, oldImage)
+    assertNotExists(t, root, oldJS)
+}
+
+func TestDiffOutputForReferenceChange(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "index.html":      "<html>\n<script src=\"components/a.js\"></script>\n</html>",
+        "components/a.js": "a()",
+    })
+    var logs bytes.Buffer
+    vm := newTestVM(t, Config{RootDir: root}, &logs)
+    vm.showDiff = true
+    if _, err := vm.ProcessHTML(filepath.Join(root, "index.html")); err != nil {
+        t.Fatal(err)
+    }
+    
+    output := logs.String()
+    for _, want := range []string{
+        "--- a/index.html\n",
+        "+++ b/index.html\n",
+        "\n-<script src=\"components/a.js\"></script>\n",
+        "\n+<script src=\"components/a." + shortHash("a()", 8) + ".js\"></script>\n",
+        "\n <html>\n",
+    } {
+        if !strings.Contains(output, want) {
+            t.Errorf("diff 应包含 %q:\n%s", want, output)
+        }
+    }
+    if strings.Contains(output, "\n-<html>") || strings.Contains(output, "\n+<html>") {
+        t.Errorf("未改动的行不应出现在 -/+ 行中:\n%s", output)
+    }
+}
+
+func TestTagAttributeVariants(t *testing.T) {
+    css := shortHash("a{}", 8)
+    js := shortHash("a()", 8)
+    tests := []struct {
+        name string
+        html string
+        want string
+    }{
+        {
+            "多行标签",
+            "<link\n    rel=\"stylesheet\"\n    href=\"components/a.css\"\n>",
+            "<link\n    rel=\"stylesheet\"\n    href=\"components/a." + css + ".css\"\n>",
+        },
+        {
+            "无引号属性",
+            `<link rel=stylesheet href=components/a.css><script src=components/a.js defer></script>`,
+            `<link rel=stylesheet href=components/a.` + css + `.css><script src=components/a.` + js + `.js defer></script>`,
+        },
+        {
+            "属性顺序",
+            `<link href="components/a.css" type="text/css" rel="stylesheet"><script defer src='components/a.js' type="module"></script>`,
+            `<link href="components/a.` + css + `.css" type="text/css" rel="stylesheet"><script defer src='components/a.` + js + `.js' type="module"></script>`,
+        },
+        {
+            "大写标签和属性",
+            `<LINK REL="stylesheet" HREF="components/a.css"><SCRIPT SRC="components/a.js"></SCRIPT>`,
+            `<LINK REL="stylesheet" HREF="components/a.` + css + `.css"><SCRIPT SRC="components/a.` + js + `.js"></SCRIPT>`,
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            root := writeTree(t, map[string]string{
+                "index.html":       tt.html,
+                "components/a.css": "a{}",
+                "components/a.js":  "a()",
+            })
+            if html := processIndex(t, root, Config{}); html != tt.want {
+                t.Errorf("处理结果为:\n%s\n应为:\n%s", html, tt.want)
+            }
+        })
+    }
+}
+
+// flakyWriteFS 前 failures 次 WriteFrom 返回“文件被占用”错误，之后正常写入
+type flakyWriteFS struct {
+    FileSystem
+    failures int
+    attempts int
+}
+
+func (f *flakyWriteFS) WriteFrom(name string, r io.Reader, perm fs.FileMode) error {
+    f.attempts++
+    if f.attempts <= f.failures {
+        return errors.New("文件被占用")
+    }
+    return f.FileSystem.WriteFrom(name, r, perm)
+}
+
+func TestCopyFileRetries(t *testing.T) {
+    tests := []struct {
+        name     string
+        retries  int
+        failures int
+        wantErr  bool
+    }{
+        {"第一次失败后重试成功", 2, 1, false},
+        {"重试次数用完", 1, 2, true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            root := writeTree(t, map[string]string{"js/app.js": "app()"})
+            fsys := &flakyWriteFS{FileSystem: osFS{}, failures: tt.failures}
+            vm := NewVersionManagerFS(Config{RootDir: root, CopyRetries: tt.retries, CopyRetryDelayMs: 1}, false, fsys)
+            logs := &bytes.Buffer{}
+            logger, err := NewLogger(logs, "text", false)
+            if err != nil {
+                t.Fatal(err)
+            }
+            vm.SetLogger(logger)
+    
+            _, err = vm.renameFileWithHash(filepath.Join(root, "js/app.js"))
+            hashed := "js/app." + shortHash("app()", 8) + ".js"
+            if tt.wantErr {
+                if err == nil {
+                    t.Fatal("重试次数用完后应返回错误")
+                }
+                assertNotExists(t, root, hashed)
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if got := readFile(t, root, hashed); got != "app()" {
+                t.Errorf("%s 内容为 %q", hashed, got)
+            }
+            if fsys.attempts != 2 || !strings.Contains(logs.String(), "复制 app.js 失败") {
+                t.Errorf("应重试一次，实际尝试 %d 次:\n%s", fsys.attempts, logs.String())
+            }
+        })
+    }
+}
+
+func TestVerifyReportsDanglingReference(t *testing.T) {
+    hashed := "components/a." + shortHash("a()", 8) + ".js"
+    root := writeTree(t, map[string]string{
+        "index.html": `<script src="https://cdn.x.com/` + hashed + `"></script>
+<link rel="stylesheet" href="components/gone.0123abcd.css">`,
+        hashed: "a()",
+    })
+    configPath := filepath.Join(t.TempDir(), "config.json")
+    if err := os.WriteFile(configPath, []byte(fmt.Sprintf(`{"rootDir": %q, "cdnDomain": "https://cdn.x.com"}`, root)), 0644); err != nil {
+        t.Fatal(err)
+    }
+    var logs bytes.Buffer
+    logger, err := NewLogger(&logs, "text", false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    
+    if code := Run(Options{ConfigPath: configPath, Verify: true, HTMLFile: filepath.Join(root, "index.html"), Logger: logger}); code == 0 {
+        t.Errorf("有失效引用时退出码不应为 0:\n%s", logs.String())
+    }
+    output := logs.String()
+    if !strings.Contains(output, "引用的文件不存在: components/gone.0123abcd.css\n") {
+        t.Errorf("应报告失效的引用:\n%s", output)
+    }
+    if strings.Count(output, "引用的文件不存在") != 1 || !strings.Contains(output, "1 个引用无法找到") {
+        t.Errorf("只有一个引用失效:\n%s", output)
+    }
+}
+
+func TestZipArchiveProcessedInPlace(t *testing.T) {
+    archive := filepath.Join(t.TempDir(), "site.zip")
+    var buf bytes.Buffer
+    zw := zip.NewWriter(&buf)
+    for name, content := range map[string]string{
+        "index.html":      `<script src="components/a.js"></script>`,
+        "components/a.js": "a()",
+    } {
+        w, err := zw.Create(name)
+        if err != nil {
+            t.Fatal(err)
+        }
+        io.WriteString(w, content)
+    }
+    if err := zw.Close(); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(archive, buf.Bytes(), 0644); err != nil {
+        t.Fatal(err)
+    }
+    logger, err := NewLogger(io.Discard, "text", false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    
+    configPath := filepath.Join(t.TempDir(), "missing.json")
+    if code := Run(Options{ConfigPath: configPath, ZipArchive: archive, Logger: logger}); code != 0 {
+        t.Fatalf("退出码为 %d", code)
+    }
+    
+    zr, err := zip.OpenReader(archive)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer zr.Close()
+    files := map[string]string{}
+    for _, f := range zr.File {
+        rc, err := f.Open()
+        if err != nil {
+            t.Fatal(err)
+        }
+        data, err := io.ReadAll(rc)
+        rc.Close()
+        if err != nil {
+            t.Fatal(err)
+        }
+        files[f.Name] = string(data)
+    }
+    
+    hashed := "components/a." + shortHash("a()", 8) + ".js"
+    if files[hashed] != "a()" {
+        t.Errorf("zip 中缺少 %s: %v", hashed, files)
+    }
+    if want := `<script src="` + hashed + `"></script>`; files["index.html"] != want {
+        t.Errorf("zip 中的 index.html 为 %s，应为 %s", files["index.html"], want)
+    }
+    if _, ok := files[defaultVersionMapFile]; !ok {
+        t.Errorf("zip 中缺少版本映射: %v", files)
+    }
+}
+
+func TestByteTotals(t *testing.T) {
+    logo := strings.Repeat("L", 2048)
+    css := ".a{background:url(logo.png)}"
+    root := writeTree(t, map[string]string{
+        "index.html":          `<script src="components/a.js"></script><script src="components/b.js"></script><link rel="stylesheet" href="components/a.css">`,
+        "components/a.js":     "0123456789",
+        "components/b.js":     "b()()",
+        "components/a.css":    css,
+        "components/logo.png": logo,
+        // b.js 的hash文件已存在，跳过复制
+        "components/b." + shortHash("b()()", 8) + ".js": "b()()",
+    })
+    logs := &syncBuffer{}
+    vm := newTestVM(t, Config{RootDir: root}, logs)
+    if code := RunHTMLFiles(vm, []string{"index.html"}); code != 0 {
+        t.Fatalf("退出码为 %d", code)
+    }
+    
+    hashedCSS := ".a{background:url(logo." + shortHash(logo, 8) + ".png)}"
+    processed := int64(len("0123456789") + len("b()()") + len(hashedCSS) + len(logo))
+    report := vm.Report()
+    if report.ProcessedBytes != processed || report.SkippedBytes != 5 {
+        t.Errorf("处理 %d 字节、跳过 %d 字节，应为 %d 和 5", report.ProcessedBytes, report.SkippedBytes, processed)
+    }
+    if want := fmt.Sprintf("共处理 %s，其中 5 B 已存在相同内容", formatBytes(processed)); !strings.Contains(logs.String(), want) {
+        t.Errorf("输出应包含 %q:\n%s", want, logs.String())
+    }
+}
+
+func TestCommentedOutScriptUntouched(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "index.html": `<!-- <script src="components/old.js"></script> -->
+<script src="components/app.js"></script>
+<!--[if lt IE 9]><script src="components/shim.js"></script><![endif]-->`,
+        "components/old.js":  "OLD",
+        "components/app.js":  "APP",
+        "components/shim.js": "SHIM",
+    })
+    html := processIndex(t, root, Config{})
+    
+    for _, want := range []string{
+        `<!-- <script src="components/old.js"></script> -->`,
+        `<script src="components/app.` + shortHash("APP", 8) + `.js"></script>`,
+        `<!--[if lt IE 9]><script src="components/shim.` + shortHash("SHIM", 8) + `.js"></script><![endif]-->`,
+    } {
+        if !strings.Contains(html, want) {
+            t.Errorf("处理结果应包含 %s:\n%s", want, html)
+        }
+    }
+    assertNotExists(t, root, "components/old."+shortHash("OLD", 8)+".js")
+}
+
+func TestCDNDomainForms(t *testing.T) {
+    hashed := "components/a/a." + shortHash("v1", 8) + ".js"
+    tests := []struct {
+        domain string
+        want   string
+    }{
+        {"https://cdn.x.com", "https://cdn.x.com/" + hashed},
+        {"https://cdn.x.com/", "https://cdn.x.com/" + hashed},
+        {"//cdn.x.com", "//cdn.x.com/" + hashed},
+        {"/assets", "/assets/" + hashed},
+        {"/", hashed},
+    }
+    for _, tt := range tests {
+        t.Run(tt.domain, func(t *testing.T) {
+            root := writeTree(t, map[string]string{
+                "index.html":        `<script src="components/a/a.js"></script>`,
+                "components/a/a.js": "v1",
+            })
+            html := processIndex(t, root, Config{CDNDomain: tt.domain})
+            if want := `<script src="` + tt.want + `"></script>`; html != want {
+                t.Errorf("处理结果为 %s，应为 %s", html, want)
+            }
+        })
+    }
+}
+
+func TestReportClassifiesChangedHTML(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "a.html":            `<script src="components/a/a.js"></script>`,
+        "plain.html":        `<p>no assets</p>`,
+        "components/a/a.js": "v1",
+    })
+    logs := &syncBuffer{}
+    vm := newTestVM(t, Config{RootDir: root}, logs)
+    
+    if code := RunHTMLFiles(vm, []string{"a.html", "plain.html"}); code != 0 {
+        t.Fatalf("退出码为 %d:\n%s", code, logs.String())
+    }
+    report := vm.Report()
+    if !reflect.DeepEqual(report.Changed, []string{"a.html"}) {
+        t.Errorf("已改写的HTML为 %v，应为 [a.html]", report.Changed)
+    }
+    if !reflect.DeepEqual(report.Unchanged, []string{"plain.html"}) {
+        t.Errorf("未变化的HTML为 %v，应为 [plain.html]", report.Unchanged)
+    }
+    for _, want := range []string{"已改写 1 个HTML文件:\n   - a.html", "未变化 1 个HTML文件:\n   - plain.html"} {
+        if !strings.Contains(logs.String(), want) {
+            t.Errorf("输出中没有 %q:\n%s", want, logs.String())
+        }
+    }
+    if got := readFile(t, root, "plain.html"); got != `<p>no assets</p>` {
+        t.Errorf("plain.html 被改写为 %s", got)
+    }
+}
+
+func TestVideoPosterRewritten(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "index.html":       `<video poster="images/cover.jpg" controls><source src="https://x.com/clip.mp4"></video>`,
+        "images/cover.jpg": "COVER",
+    })
+    html := processIndex(t, root, Config{})
+    
+    hashed := "images/cover." + shortHash("COVER", 8) + ".jpg"
+    if want := `<video poster="` + hashed + `" controls>`; !strings.Contains(html, want) {
+        t.Errorf("处理结果应包含 %s:\n%s", want, html)
+    }
+    assertExists(t, root, hashed)
+}
+
+func TestNoEmojiOutput(t *testing.T) {
+    // 表情和符号图标所在的区段（中文不在其中）
+    isEmoji := func(r rune) bool {
+        return r >= 0x1F000 || (r >= 0x2190 && r < 0x2C00) || r == 0xFE0F
+    }
+    // file: 日志写入普通文件（不是终端），按 cmd/hashCdn 的方式自动使用纯文本
+    for _, output := range []string{"default", "no-emoji", "file"} {
+        t.Run(output, func(t *testing.T) {
+            root := writeTree(t, map[string]string{
+                "index.html":         `<link rel="stylesheet" href="components/a/a.css"><script src="components/a/a.js"></script>`,
+                "components/a/a.css": "body{background:url(../../images/bg.png)}",
+                "components/a/a.js":  "a()",
+                "images/bg.png":      "BG",
+            })
+            configPath := filepath.Join(t.TempDir(), "config.json")
+            if err := os.WriteFile(configPath, []byte(fmt.Sprintf(`{"rootDir": %q}`, root)), 0644); err != nil {
+                t.Fatal(err)
+            }
+            var logs bytes.Buffer
+            var logOutput io.Writer = &logs
+            plainText := output == "no-emoji"
+            var logFile *os.File
+            if output == "file" {
+                var err error
+                logFile, err = os.Create(filepath.Join(t.TempDir(), "hashcdn.log"))
+                if err != nil {
+                    t.Fatal(err)
+                }
+                defer logFile.Close()
+                if IsTerminal(logFile) {
+                    t.Fatal("普通文件不应被判断为终端")
+                }
+                logOutput, plainText = logFile, !IsTerminal(logFile)
+            }
+            logger, err := NewLogger(logOutput, "text", plainText)
+            if err != nil {
+                t.Fatal(err)
+            }
+            code := Run(Options{ConfigPath: configPath, ScanAll: true, Timing: true, Logger: logger})
+            if logFile != nil {
+                data, err := os.ReadFile(logFile.Name())
+                if err != nil {
+                    t.Fatal(err)
+                }
+                logs.Write(data)
+            }
+            if code != 0 {
+                t.Fatalf("退出码为 %d:\n%s", code, logs.String())
+            }
+    
+            var emoji []string
+            for _, r := range logs.String() {
+                if isEmoji(r) {
+                    emoji = append(emoji, string(r))
+                }
+            }
+            if output != "default" && len(emoji) > 0 {
+                t.Errorf("输出中有图标 %v:\n%s", emoji, logs.String())
+            }
+            if output == "default" && len(emoji) == 0 {
+                t.Errorf("默认输出中应有图标:\n%s", logs.String())
+            }
+            if !strings.Contains(logs.String(), "处理完成") {
+                t.Errorf("没有捕获到处理日志:\n%s", logs.String())
+            }
+        })
+    }
+}
+
+func TestIsExternalOrSpecial(t *testing.T) {
+    tests := []struct {
+        ref  string
+        want bool
+    }{
+        {"https://cdn.x.com/a.js", true},
+        {"HTTPS://cdn.x.com/a.js", true},
+        {"Http://cdn.x.com/a.js", true},
+        {"//cdn.x.com/a.js", true},
+        {"DATA:image/png;base64,AAAA", true},
+        {"data:image/svg+xml,%3Csvg%3E", true},
+        {"Mailto:a@x.com", true},
+        {"tel:+8610", true},
+        {"JavaScript:void(0)", true},
+        {"blob:https://x.com/uuid", true},
+        {"  https://cdn.x.com/a.js", true},
+        {"images/a.png", false},
+        {"/images/a.png", false},
+        {"../images/a.png", false},
+        {`C:\site\a.png`, false},
+        {"c:/site/a.png", false},
+    }
+    for _, tt := range tests {
+        if got := isExternalOrSpecial(tt.ref); got != tt.want {
+            t.Errorf("isExternalOrSpecial(%q) = %v，应为 %v", tt.ref, got, tt.want)
+        }
+    }
+}
+
+func TestSVGSpriteUseHashed(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "index.html": `<svg><use xlink:href="images/icons.svg#home"></use></svg>
+<svg><use href="images/icons.svg#user"></use><use href="#local"></use></svg>`,
+        "images/icons.svg": `<svg xmlns="http://www.w3.org/2000/svg"><symbol id="home"/><symbol id="user"/></svg>`,
+    })
+    html := processIndex(t, root, Config{})
+    
+    hashed := "images/icons." + shortHash(`<svg xmlns="http://www.w3.org/2000/svg"><symbol id="home"/><symbol id="user"/></svg>`, 8) + ".svg"
+    for _, want := range []string{
+        `<use xlink:href="` + hashed + `#home"></use>`,
+        `<use href="` + hashed + `#user"></use>`,
+        `<use href="#local"></use>`,
+    } {
+        if !strings.Contains(html, want) {
+            t.Errorf("处理结果应包含 %s:\n%s", want, html)
+        }
+    }
+    assertExists(t, root, hashed)
+}
+
+func TestRunsAreDeterministic(t *testing.T) {
+    files := map[string]string{
+        "a.html":             `<link rel="stylesheet" href="components/a/a.css"><script src="components/a/a.js"></script>`,
+        "b.html":             `<script src="components/b/b.js"></script><link rel="stylesheet" href="components/a/a.css">`,
+        "pages/c.html":       `<link rel="stylesheet" href="../components/b/b.css"><script src="../components/a/a.js"></script>`,
+        "components/a/a.css": "a{background:url(../../images/x.png)}.y{background:url(../../images/y.png)}",
+        "components/a/a.js":  "a()",
+        "components/b/b.css": "b{background:url(../../images/y.png)}",
+        "components/b/b.js":  "b()",
+        "images/x.png":       "X",
+        "images/y.png":       "Y",
+    }
+    elapsed := regexp.MustCompile(`耗时 \S+`)
+    run := func() (map[string]string, string) {
+        root := writeTree(t, files)
+        logs := &syncBuffer{}
+        vm := newTestVM(t, Config{RootDir: root}, logs)
+        if code := RunHTMLFiles(vm, []string{"a.html", "b.html", "pages/c.html"}); code != 0 {
+            t.Fatalf("退出码为 %d:\n%s", code, logs.String())
+        }
+        // 只有耗时每次不同
+        return snapshotTree(t, root), elapsed.ReplaceAllString(strings.ReplaceAll(logs.String(), root, "<root>"), "耗时 <elapsed>")
+    }
+    
+    firstTree, firstLogs := run()
+    secondTree, secondLogs := run()
+    if !reflect.DeepEqual(firstTree, secondTree) {
+        t.Errorf("两次运行的输出不同:\n第一次: %v\n第二次: %v", firstTree, secondTree)
+    }
+    if firstLogs != secondLogs {
+        t.Errorf("两次运行的日志不同:\n第一次:\n%s\n第二次:\n%s", firstLogs, secondLogs)
+    }
+}
+
+func TestHTMLFilesAbsoluteAndRelative(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "index.html":         `<script src="components/a/a.js"></script>`,
+        "pages/about.html":   `<link rel="stylesheet" href="../components/a/a.css">`,
+        "components/a/a.js":  "a()",
+        "components/a/a.css": "a{}",
+    })
+    config, err := json.Marshal(map[string]interface{}{
+        "rootDir":   root,
+        "htmlFiles": []string{"index.html", filepath.Join(root, "pages", "about.html")},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    configPath := filepath.Join(t.TempDir(), "config.json")
+    if err := os.WriteFile(configPath, config, 0644); err != nil {
+        t.Fatal(err)
+    }
+    var logs bytes.Buffer
+    logger, err := NewLogger(&logs, "text", false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if code := Run(Options{ConfigPath: configPath, Logger: logger}); code != 0 {
+        t.Fatalf("退出码为 %d:\n%s", code, logs.String())
+    }
+    
+    if want := `<script src="components/a/a.` + shortHash("a()", 8) + `.js"></script>`; readFile(t, root, "index.html") != want {
+        t.Errorf("index.html 为 %s，应为 %s", readFile(t, root, "index.html"), want)
+    }
+    if want := `<link rel="stylesheet" href="../components/a/a.` + shortHash("a{}", 8) + `.css">`; readFile(t, root, "pages/about.html") != want {
+        t.Errorf("pages/about.html 为 %s，应为 %s", readFile(t, root, "pages/about.html"), want)
+    }
+}
+
+func TestPreHashCommandTransformsCSS(t *testing.T) {
+    if _, err := exec.LookPath("sh"); err != nil {
+        t.Skip("没有 sh")
+    }
+    for name, command := range map[string]string{"stdin": "tr a-z A-Z", "files": "tr a-z A-Z < {in} > {out}"} {
+        t.Run(name, func(t *testing.T) {
+            root := writeTree(t, map[string]string{
+                "index.html":         `<link rel="stylesheet" href="components/a/a.css">`,
+                "components/a/a.css": "a{color:red}",
+            })
+            html := processIndex(t, root, Config{PreHashCommand: command})
+    
+            hashed := "components/a/a." + shortHash("A{COLOR:RED}", 8) + ".css"
+            if want := `<link rel="stylesheet" href="` + hashed + `">`; html != want {
+                t.Errorf("处理结果为 %s，应为 %s", html, want)
+            }
+            if got := readFile(t, root, hashed); got != "A{COLOR:RED}" {
+                t.Errorf("hash文件内容为 %q，应为转换后的内容", got)
+            }
+            if got := readFile(t, root, "components/a/a.css"); got != "a{color:red}" {
+                t.Errorf("源文件被修改为 %q", got)
+            }
+            // 临时文件已删除
+            if len(snapshotTree(t, filepath.Join(root, "components/a"))) != 2 {
+                t.Errorf("目录中有多余的文件: %v", snapshotTree(t, filepath.Join(root, "components/a")))
+            }
+        })
+    }
+    
+    t.Run("failure", func(t *testing.T) {
+        root := writeTree(t, map[string]string{
+            "index.html":         `<link rel="stylesheet" href="components/a/a.css">`,
+            "components/a/a.css": "a{color:red}",
+        })
+        logs := &syncBuffer{}
+        vm := newTestVM(t, Config{RootDir: root, PreHashCommand: "echo boom >&2; exit 3"}, logs)
+        if _, err := vm.ProcessHTML(filepath.Join(root, "index.html")); err == nil || !strings.Contains(err.Error(), "boom") {
+            t.Errorf("命令失败时应返回包含stderr的错误，实际为 %v", err)
+        }
+        if got := readFile(t, root, "index.html"); got != `<link rel="stylesheet" href="components/a/a.css">` {
+            t.Errorf("命令失败时不应改写引用: %s", got)
+        }
+        assertNotExists(t, root, "components/a/a."+shortHash("a{color:red}", 8)+".css")
+    })
+}
+
+func TestCDNRulesPerType(t *testing.T) {
+    root := writeTree(t, map[string]string{
+        "index.html": `<link rel="stylesheet" href="components/a/a.css"><script src="components/a/a.js"></script>
+<script src="components/vendor/lib.js"></script><video poster="images/cover.jpg"></video><link rel="icon" href="favicon.png">`,
+        "components/a/a.css":       "a{background:url(../../images/bg.png)}",
+        "components/a/a.js":        "a()",
+        "components/vendor/lib.js": "lib()",
+        "images/bg.png":            "BG",
+        "images/cover.jpg":         "COVER",
+        "favicon.png":              "ICON",
+    })
+    html := processIndex(t, root, Config{
+        CDNDomain: "https://cdn.x.com",
+        CDNRules: []CDNRule{
+            {PathPrefix: "images", Domain: "https://img.x.com"},
+            {PathPrefix: "components/vendor", Domain: "https://lib.x.com/"},
+            {PathPrefix: "components", Domain: "https://js.x.com"},
+        },
+    })
+    
+    bg := "https://img.x.com/images/bg." + shortHash("BG", 8) + ".png"
+    cssContent := "a{background:url(" + bg + ")}"
+    for _, want := range []string{
+        `href="https://js.x.com/components/a/a.` + shortHash(cssContent, 8) + `.css"`,
+        `src="https://js.x.com/components/a/a.` + shortHash("a()", 8) + `.js"`,
+        `src="https://lib.x.com/components/vendor/lib.` + shortHash("lib()", 8) + `.js"`,
+        `poster="https://img.x.com/images/cover.` + shortHash("COVER", 8) + `.jpg"`,
+        `href="https://cdn.x.com/favicon.` + shortHash("ICON", 8) + `.png"`,
+    } {
+        if !strings.Contains(html, want) {
+            t.Errorf("处理结果应包含 %s:\n%s", want, html)
+        }
+    }
+    if got := readFile(t, root, "components/a/a."+shortHash(cssContent, 8)+".css"); got != cssContent {
+        t.Errorf("CSS中的图片引用为 %s，应为 %s", got, cssContent)
+    }
+}
+
+// journalFS 统计运行日志的整体写入和追加次数，failAppend 时追加失败
+type journalFS struct {
+    FileSystem
+    failAppend      bool
+    writes, appends int
+}
+
+func (j *journalFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+    if filepath.Base(name) == journalFileName {
+        j.writes++
+    }
+    return j.FileSystem.WriteFile(name, data, perm)
+}
+
+func (j *journalFS) AppendFile(name string, data []byte, perm fs.FileMode) error {
+    j.appends++
+    if j.failAppend {
+        return errors.New("disk full")
+    }
+    return j.FileSystem.AppendFile(name, data, perm)
+}
+
+func TestJournalAppendsEntries(t *testing.T) {
+    for _, failAppend := range []bool{false, true} {
+        t.Run(fmt.Sprintf("failAppend=%v", failAppend), func(t *testing.T) {
+            root := writeTree(t, map[string]string{
+                "a.html":          `<script src="components/a.js"></script>`,
+                "b.html":          `<script src="components/b.js"></script>`,
+                "components/a.js": "a()",
+                "components/b.js": "b()",
+            })
+            fsys := &journalFS{FileSystem: osFS{}, failAppend: failAppend}
+            vm := NewVersionManagerFS(Config{RootDir: root}, false, fsys)
+            logs := &syncBuffer{}
+            logger, err := NewLogger(logs, "text", false)
+            if err != nil {
+                t.Fatal(err)
+            }
+            vm.SetLogger(logger)
+            if code := RunHTMLFiles(vm, []string{"a.html", "b.html"}); code != 0 {
+                t.Fatalf("退出码为 %d:\n%s", code, logs.String())
+            }
+    
+            // 开始时写一次，之后每条记录（2 个hash文件、2 个HTML）只追加
+            if fsys.writes != 1 || fsys.appends != 4 {
+                t.Errorf("运行日志整体写入 %d 次、追加 %d 次，应为 1 次和 4 次", fsys.writes, fsys.appends)
+            }
+            warnings := strings.Count(logs.String(), "无法写入运行日志")
+            if failAppend && warnings != 1 {
+                t.Errorf("追加失败时应提示一次，实际 %d 次:\n%s", warnings, logs.String())
+            }
+            if !failAppend && warnings != 0 {
+                t.Errorf("不应有写入失败的提示:\n%s", logs.String())
+            }
+        })
+    }
+}